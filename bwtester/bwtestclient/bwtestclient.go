@@ -8,6 +8,9 @@ import (
 	"bytes"
 	"context"
 	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"net"
@@ -18,6 +21,8 @@ import (
 	"time"
 	"unicode"
 
+	"github.com/lucas-clemente/quic-go"
+
 	. "github.com/netsec-ethz/scion-apps/bwtester/bwtestlib"
 	"github.com/netsec-ethz/scion-apps/pkg/appnet"
 	"github.com/scionproto/scion/go/lib/addr"
@@ -48,7 +53,7 @@ func prepareAESKey() []byte {
 }
 
 func printUsage() {
-	fmt.Println("bwtestclient -c ClientSCIONAddress -s ServerSCIONAddress -cs t,size,num,bw -sc t,size,num,bw -i")
+	fmt.Println("bwtestclient -c ClientSCIONAddress -s ServerSCIONAddress -cs t,size,num,bw -sc t,size,num,bw -i -numPaths n")
 	fmt.Println("A SCION address is specified as ISD-AS,[IP Address]:Port")
 	fmt.Println("Example SCION address 1-1011,[192.33.93.166]:42002")
 	fmt.Println("ClientSCIONAddress can be omitted, the application then binds to localhost")
@@ -67,6 +72,20 @@ func printUsage() {
 	fmt.Println("\tWhen only the cs or sc flag is set, the other flag is set to the same value.")
 	fmt.Println("-i specifies if the client is used in interactive mode, " +
 		"when true the user is prompted for a path choice")
+	fmt.Println("-numPaths specifies the number of paths over which the test is run simultaneously. " +
+		"The paths are chosen to be as disjoint as possible and the test parameters apply to each path " +
+		"individually. Results are reported per path and aggregated over all paths.")
+	fmt.Println("-repeat specifies the number of test runs (0 to repeat until interrupted) and -interval " +
+		"the time between the start of two consecutive runs, e.g. -repeat 0 -interval 10m")
+	fmt.Println("-resultsFile specifies a file to which the results of each run are appended, " +
+		"as one JSON object per path and run")
+	fmt.Println("-proto specifies whether the test measures raw UDP packet delivery (udp), the goodput of a " +
+		"reliable QUIC transfer (quic), or both one after the other (both). For QUIC, only the durations of the " +
+		"-cs and -sc parameters are used. The latency protocol measures the RTT and the one-way delay variation " +
+		"with packets that the server echoes back, sent according to the -cs parameters")
+	fmt.Println("-psk specifies the pre-shared key to authenticate to servers that only serve known clients")
+	fmt.Println("The test duration can be given in seconds or as duration, e.g. 5m,?,?,1Mbps. The maximum "+
+		"duration is configured on the server, by default it is", MaxDuration)
 	fmt.Println("Default test parameters are: ", DefaultBwtestParameters)
 }
 
@@ -98,12 +117,7 @@ func parseBwtestParameters(s string) BwtestParameters {
 			a3 = getPacketCount(a[2])
 			a4 = parseBandwidth(a[3])
 			a1 = (a2 * 8 * a3) / a4
-			if time.Second*time.Duration(a1) > MaxDuration {
-				fmt.Printf("Duration is exceeding MaxDuration: %v > %v, using default value %d\n",
-					a1, MaxDuration/time.Second, DefaultDuration)
-				fmt.Println("Target bandwidth might no be reachable with that parameter.")
-				a1 = DefaultDuration
-			}
+			// The maximum duration is configured on the server, which rejects longer tests
 			if a1 < 1 {
 				fmt.Printf("Duration is too short: %v , using default value %d\n",
 					a1, DefaultDuration)
@@ -201,15 +215,17 @@ func parseBandwidth(bw string) int64 {
 	return a4 * m
 }
 
+// getDuration parses the duration either as a number of seconds or as a duration string
+// such as "2m30s". The maximum duration is enforced by the server.
 func getDuration(duration string) int64 {
 	a1, err := strconv.ParseInt(duration, 10, 64)
-	if err != nil || a1 <= 0 {
-		fmt.Printf("Invalid duration %v provided, using default value %d\n", a1, DefaultDuration)
-		a1 = DefaultDuration
+	if err != nil {
+		var d time.Duration
+		d, err = time.ParseDuration(duration)
+		a1 = int64(d / time.Second)
 	}
-	d := time.Second * time.Duration(a1)
-	if d > MaxDuration {
-		Check(fmt.Errorf("Duration is exceeding MaxDuration: %d > %d", a1, MaxDuration/time.Second))
+	if err != nil || a1 <= 0 {
+		fmt.Printf("Invalid duration %v provided, using default value %d\n", duration, DefaultDuration)
 		a1 = DefaultDuration
 	}
 	return a1
@@ -240,112 +256,116 @@ func getPacketCount(count string) int64 {
 	return a3
 }
 
-func main() {
-	var (
-		serverCCAddrStr string
-		serverCCAddr    *snet.Addr
-		// Control channel connection
-		CCConn snet.Conn
-		// Data channel connection
-		DCConn snet.Conn
-
-		clientBwpStr string
-		clientBwp    BwtestParameters
-		serverBwpStr string
-		serverBwp    BwtestParameters
-		interactive  bool
-		pathAlgo     string
-
-		err   error
-		tzero time.Time // initialized to "zero" time
-
-		receiveDone sync.Mutex // used to signal when the HandleDCConnReceive goroutine has completed
-	)
+// bwtestSession is a single bandwidth test between the client and the server, run over
+// one path. In multipath mode, one session is run concurrently for each selected path.
+type bwtestSession struct {
+	path         snet.Path
+	serverDCAddr *snet.Addr
+	clientDCAddr *net.UDPAddr
+	// Control channel connection
+	CCConn snet.Conn
+	// Data channel connection
+	DCConn snet.Conn
 
-	flag.StringVar(&serverCCAddrStr, "s", "", "Server SCION Address")
-	flag.StringVar(&serverBwpStr, "sc", DefaultBwtestParameters, "Server->Client test parameter")
-	flag.StringVar(&clientBwpStr, "cs", DefaultBwtestParameters, "Client->Server test parameter")
-	flag.BoolVar(&interactive, "i", false, "Interactive mode")
-	flag.StringVar(&pathAlgo, "pathAlgo", "", "Path selection algorithm / metric (\"shortest\", \"mtu\")")
+	clientBwp BwtestParameters
+	serverBwp BwtestParameters
+	// Pre-shared key to authenticate to the server, may be nil
+	psk []byte
 
-	flag.Parse()
-	flagset := make(map[string]bool)
-	// record if flags were set or if default value was used
-	flag.Visit(func(f *flag.Flag) { flagset[f.Name] = true })
+	// If set, a latency test is run instead of a bandwidth test
+	latency bool
 
-	if flag.NFlag() == 0 {
-		// no flag was set, only print usage and exit
-		printUsage()
-		os.Exit(0)
-	}
+	// Results of the server->client test, measured locally
+	scRes *BwtestResult
+	// Results of the client->server test, fetched from the server
+	csRes *BwtestResult
+	// Results of the latency test, measured locally
+	latencyRes *LatencyResult
+}
 
-	if len(serverCCAddrStr) > 0 {
-		serverCCAddr, err = appnet.ResolveUDPAddr(serverCCAddrStr)
-		Check(err)
-	} else {
-		printUsage()
-		Check(fmt.Errorf("Error, server address needs to be specified with -s"))
-	}
+// newBwtestSession opens the control and data channel connections to the server over
+// the given path.
+// The data channel of the server is expected on serverDCPort. If ephemeralDCPort is
+// false, the local data channel port is one larger than the control channel port,
+// otherwise it is assigned by the dispatcher.
+func newBwtestSession(serverCCAddr *snet.Addr, path snet.Path, serverDCPort uint16,
+	ephemeralDCPort bool) (*bwtestSession, error) {
 
-	var path snet.Path
-	if interactive {
-		path, err = appnet.ChoosePathInteractive(serverCCAddr)
-		Check(err)
-	} else {
-		var metric int
-		if pathAlgo == "mtu" {
-			metric = appnet.MTU
-		} else if pathAlgo == "shortest" {
-			metric = appnet.Shortest
-		}
-		path, err = appnet.ChoosePathByMetric(metric, serverCCAddr)
-		Check(err)
-	}
+	ccAddr := serverCCAddr.Copy()
 	if path != nil {
-		appnet.SetPath(serverCCAddr, path)
+		appnet.SetPath(ccAddr, path)
+	}
+	CCConn, err := appnet.DialAddr(ccAddr)
+	if err != nil {
+		return nil, err
 	}
-
-	CCConn, err = appnet.DialAddr(serverCCAddr)
-	Check(err)
 
 	// get the port used by clientCC after it bound to the dispatcher (because it might be 0)
 	clientCCAddr := CCConn.LocalAddr().(*net.UDPAddr)
 	// Address of client data channel (DC)
-	clientDCAddr := &net.UDPAddr{IP: clientCCAddr.IP, Port: clientCCAddr.Port + 1}
+	clientDCAddr := &net.UDPAddr{IP: clientCCAddr.IP}
+	if !ephemeralDCPort {
+		clientDCAddr.Port = clientCCAddr.Port + 1
+	}
 	// Address of server data channel (DC)
-	serverDCAddr := serverCCAddr.Copy()
-	serverDCAddr.Host.L4 = serverCCAddr.Host.L4 + 1
+	serverDCAddr := ccAddr.Copy()
+	serverDCAddr.Host.L4 = serverDCPort
 
 	// Data channel connection
-	DCConn, err = appnet.DefNetwork().Dial(
+	DCConn, err := appnet.DefNetwork().Dial(
 		context.TODO(), "udp", clientDCAddr, appnet.ToSNetUDPAddr(serverDCAddr), addr.SvcNone)
-	Check(err)
+	if err != nil {
+		CCConn.Close()
+		return nil, err
+	}
+	return &bwtestSession{
+		path:         path,
+		serverDCAddr: serverDCAddr,
+		// get the port assigned by the dispatcher, in case it was 0
+		clientDCAddr: DCConn.LocalAddr().(*net.UDPAddr),
+		CCConn:       CCConn,
+		DCConn:       DCConn,
+	}, nil
+}
 
+// setParameters parses the test parameters for both directions and assigns the data
+// channel ports.
+func (s *bwtestSession) setParameters(clientBwpStr, serverBwpStr string) {
 	// update default packet size to max MTU on the selected path
-	if path != nil {
-		InferedPktSize = int64(path.MTU())
+	if s.path != nil {
+		InferedPktSize = int64(s.path.MTU())
 	} else {
 		// use default packet size when within same AS and pathEntry is not set
 		InferedPktSize = DefaultPktSize
 	}
-	if !flagset["cs"] && flagset["sc"] { // Only one direction set, used same for reverse
-		clientBwpStr = serverBwpStr
-		fmt.Println("Only sc parameter set, using same values for cs")
-	}
-	clientBwp = parseBwtestParameters(clientBwpStr)
-	clientBwp.Port = uint16(clientDCAddr.Port)
-	if !flagset["sc"] && flagset["cs"] { // Only one direction set, used same for reverse
-		serverBwpStr = clientBwpStr
-		fmt.Println("Only cs parameter set, using same values for sc")
+	s.clientBwp = parseBwtestParameters(clientBwpStr)
+	s.clientBwp.Port = uint16(s.clientDCAddr.Port)
+	s.serverBwp = parseBwtestParameters(serverBwpStr)
+	s.serverBwp.Port = s.serverDCAddr.Host.L4
+	if s.latency {
+		// The server echoes the client's packets, so both directions use the same parameters
+		if s.clientBwp.PacketSize < LatencyMinPacketSize {
+			s.clientBwp.PacketSize = LatencyMinPacketSize
+		}
+		s.clientBwp.Echo = true
+		s.serverBwp = s.clientBwp
+		s.serverBwp.Port = s.serverDCAddr.Host.L4
 	}
-	serverBwp = parseBwtestParameters(serverBwpStr)
-	serverBwp.Port = serverDCAddr.Host.L4
-	fmt.Println("\nTest parameters:")
-	fmt.Println("clientDCAddr -> serverDCAddr", clientDCAddr, "->", serverDCAddr)
-	fmt.Printf("client->server: %d seconds, %d bytes, %d packets\n",
-		int(clientBwp.BwtestDuration/time.Second), clientBwp.PacketSize, clientBwp.NumPackets)
-	fmt.Printf("server->client: %d seconds, %d bytes, %d packets\n",
-		int(serverBwp.BwtestDuration/time.Second), serverBwp.PacketSize, serverBwp.NumPackets)
+}
+
+// run performs the bandwidth test. It requests a new test from the server, sends and
+// receives the test traffic and finally fetches the results of the client->server test
+// from the server. In a latency test, the packets echoed by the server are collected
+// instead, and the results fetched from the server contain the number of packets echoed.
+func (s *bwtestSession) run() error {
+	var (
+		err   error
+		tzero time.Time // initialized to "zero" time
+
+		receiveDone sync.Mutex // used to signal when the HandleDCConnReceive goroutine has completed
+	)
+	clientBwp := &s.clientBwp
+	serverBwp := &s.serverBwp
 
 	t := time.Now()
 	expFinishTimeSend := t.Add(serverBwp.BwtestDuration + MaxRTT + GracePeriodSend)
@@ -367,24 +387,37 @@ func main() {
 		res.ExpectedFinishTime = expFinishTimeSend
 	}
 
-	receiveDone.Lock()
-	go HandleDCConnReceive(&serverBwp, DCConn, &res, &resLock, &receiveDone)
+	// HandleDCConnReceive and RunLatencyTest close the DC connection when they are done.
+	// If neither was started, it is closed when returning.
+	dcConnOwned := false
+	defer func() {
+		if !dcConnOwned {
+			_ = s.DCConn.Close()
+		}
+	}()
 
-	pktbuf := make([]byte, 2000)
-	pktbuf[0] = 'N' // Request for new bwtest
-	n := EncodeBwtestParameters(&clientBwp, pktbuf[1:])
-	l := n + 1
-	n = EncodeBwtestParameters(&serverBwp, pktbuf[l:])
-	l = l + n
+	if !s.latency {
+		receiveDone.Lock()
+		dcConnOwned = true
+		go HandleDCConnReceive(serverBwp, s.DCConn, &res, &resLock, &receiveDone)
+	}
 
+	pktbuf := make([]byte, 2000)
+	var cookie []byte
+	var n int
 	var numtries int64 = 0
 	for numtries < MaxTries {
-		_, err = CCConn.Write(pktbuf[:l])
-		Check(err)
+		l := s.encodeRequest(pktbuf, cookie)
+		_, err = s.CCConn.Write(pktbuf[:l])
+		if err != nil {
+			return err
+		}
 
-		err = CCConn.SetReadDeadline(time.Now().Add(MaxRTT))
-		Check(err)
-		n, err = CCConn.Read(pktbuf)
+		err = s.CCConn.SetReadDeadline(time.Now().Add(MaxRTT))
+		if err != nil {
+			return err
+		}
+		n, err = s.CCConn.Read(pktbuf)
 		if err != nil {
 			// A timeout likely happened, see if we should adjust the expected finishing time
 			expFinishTimeReceive = time.Now().Add(clientBwp.BwtestDuration + MaxRTT + StragglerWaitPeriod)
@@ -398,10 +431,12 @@ func main() {
 			continue
 		}
 		// Remove read deadline
-		err = CCConn.SetReadDeadline(tzero)
-		Check(err)
+		err = s.CCConn.SetReadDeadline(tzero)
+		if err != nil {
+			return err
+		}
 
-		if n != 2 {
+		if n < 2 {
 			fmt.Println("Incorrect server response, trying again")
 			time.Sleep(Timeout)
 			numtries++
@@ -413,9 +448,41 @@ func main() {
 			numtries++
 			continue
 		}
-		if pktbuf[1] != 0 {
+		if pktbuf[1] == StatusError {
+			if n == 6 {
+				return fmt.Errorf("Error, test rejected by server, the maximum test duration is %d seconds",
+					binary.LittleEndian.Uint32(pktbuf[2:]))
+			}
+			return fmt.Errorf("Error, test rejected by server")
+		}
+		if pktbuf[1] == StatusUnauthorized {
+			return fmt.Errorf("Error, server requires authentication, check the pre-shared key")
+		}
+		if pktbuf[1] == StatusCookie {
+			if n != 2+CookieLen {
+				fmt.Println("Incorrect server response, trying again")
+				time.Sleep(Timeout)
+				numtries++
+				continue
+			}
+			// Repeat the request with the cookie, to prove that we can receive at our address
+			if cookie != nil {
+				// Our previous cookie was not accepted, likely because it expired
+				numtries++
+			}
+			cookie = append([]byte(nil), pktbuf[2:n]...)
+			continue
+		}
+		if pktbuf[1] != StatusOK {
 			// The server asks us to wait for some amount of time
-			time.Sleep(time.Second * time.Duration(int(pktbuf[1])))
+			wait, _, err := DecodeWaitStatus(pktbuf[1:n])
+			if err != nil {
+				fmt.Println("Incorrect server response, trying again")
+				time.Sleep(Timeout)
+				numtries++
+				continue
+			}
+			time.Sleep(wait)
 			// Don't increase numtries in this case
 			continue
 		}
@@ -425,44 +492,43 @@ func main() {
 	}
 
 	if numtries == MaxTries {
-		Check(fmt.Errorf("Error, could not receive a server response, MaxTries attempted without success."))
+		return fmt.Errorf("Error, could not receive a server response, MaxTries attempted without success.")
 	}
 
-	go HandleDCConnSend(&clientBwp, DCConn)
-
-	receiveDone.Lock()
+	if s.latency {
+		dcConnOwned = true
+		s.latencyRes = RunLatencyTest(clientBwp, s.DCConn)
+	} else {
+		go HandleDCConnSend(clientBwp, s.DCConn)
 
-	fmt.Println("\nS->C results")
-	att := 8 * serverBwp.PacketSize * serverBwp.NumPackets / int64(serverBwp.BwtestDuration/time.Second)
-	ach := 8 * serverBwp.PacketSize * res.CorrectlyReceived / int64(serverBwp.BwtestDuration/time.Second)
-	fmt.Printf("Attempted bandwidth: %d bps / %.2f Mbps\n", att, float64(att)/1000000)
-	fmt.Printf("Achieved bandwidth: %d bps / %.2f Mbps\n", ach, float64(ach)/1000000)
-	fmt.Println("Loss rate:", (serverBwp.NumPackets-res.CorrectlyReceived)*100/serverBwp.NumPackets, "%")
-	variance := res.IPAvar
-	average := res.IPAavg
-	fmt.Printf("Interarrival time variance: %dms, average interarrival time: %dms\n",
-		variance/1e6, average/1e6)
-	fmt.Printf("Interarrival time min: %dms, interarrival time max: %dms\n",
-		res.IPAmin/1e6, res.IPAmax/1e6)
+		receiveDone.Lock()
+		s.scRes = &res
+	}
 
 	// Fetch results from server
 	numtries = 0
 	for numtries < MaxTries {
 		pktbuf[0] = 'R'
 		copy(pktbuf[1:], clientBwp.PrgKey)
-		_, err = CCConn.Write(pktbuf[:1+len(clientBwp.PrgKey)])
-		Check(err)
+		_, err = s.CCConn.Write(pktbuf[:1+len(clientBwp.PrgKey)])
+		if err != nil {
+			return err
+		}
 
-		err = CCConn.SetReadDeadline(time.Now().Add(MaxRTT))
-		Check(err)
-		n, err = CCConn.Read(pktbuf)
+		err = s.CCConn.SetReadDeadline(time.Now().Add(MaxRTT))
+		if err != nil {
+			return err
+		}
+		n, err = s.CCConn.Read(pktbuf)
 		if err != nil {
 			numtries++
 			continue
 		}
 		// Remove read deadline
-		err = CCConn.SetReadDeadline(tzero)
-		Check(err)
+		err = s.CCConn.SetReadDeadline(tzero)
+		if err != nil {
+			return err
+		}
 
 		if n < 2 {
 			numtries++
@@ -472,14 +538,19 @@ func main() {
 			numtries++
 			continue
 		}
-		if pktbuf[1] != byte(0) {
+		if pktbuf[1] != StatusOK {
 			// Error case
-			if pktbuf[1] == byte(127) {
-				Check(fmt.Errorf("Results could not be found or PRG key was incorrect, abort"))
+			if pktbuf[1] == StatusError {
+				return fmt.Errorf("Results could not be found or PRG key was incorrect, abort")
 			}
-			// pktbuf[1] contains number of seconds to wait for results
-			fmt.Println("We need to sleep for", pktbuf[1], "seconds before we can get the results")
-			time.Sleep(time.Duration(pktbuf[1]) * time.Second)
+			// pktbuf[1:] contains the time to wait for results
+			wait, _, err := DecodeWaitStatus(pktbuf[1:n])
+			if err != nil {
+				numtries++
+				continue
+			}
+			fmt.Println("We need to sleep for", int(wait/time.Second), "seconds before we can get the results")
+			time.Sleep(wait)
 			// We don't increment numtries as this was not a lost packet or other communication error
 			continue
 		}
@@ -501,20 +572,689 @@ func main() {
 			numtries++
 			continue
 		}
-		fmt.Println("\nC->S results")
-		att = 8 * clientBwp.PacketSize * clientBwp.NumPackets / int64(clientBwp.BwtestDuration/time.Second)
-		ach = 8 * clientBwp.PacketSize * sres.CorrectlyReceived / int64(clientBwp.BwtestDuration/time.Second)
-		fmt.Printf("Attempted bandwidth: %d bps / %.2f Mbps\n", att, float64(att)/1000000)
-		fmt.Printf("Achieved bandwidth: %d bps / %.2f Mbps\n", ach, float64(ach)/1000000)
-		fmt.Println("Loss rate:", (clientBwp.NumPackets-sres.CorrectlyReceived)*100/clientBwp.NumPackets, "%")
-		variance := sres.IPAvar
-		average := sres.IPAavg
-		fmt.Printf("Interarrival time variance: %dms, average interarrival time: %dms\n",
-			variance/1e6, average/1e6)
-		fmt.Printf("Interarrival time min: %dms, interarrival time max: %dms\n",
-			sres.IPAmin/1e6, sres.IPAmax/1e6)
+		s.csRes = sres
+		return nil
+	}
+
+	return fmt.Errorf("Error, could not fetch server results, MaxTries attempted without success.")
+}
+
+// encodeRequest encodes the request for a new bwtest into buf, followed by the cookie, if
+// any, and the MAC over the request if a pre-shared key is set. Returns the length of the
+// request.
+func (s *bwtestSession) encodeRequest(buf []byte, cookie []byte) int {
+	buf[0] = 'N' // Request for new bwtest
+	n := EncodeBwtestParameters(&s.clientBwp, buf[1:])
+	l := n + 1
+	n = EncodeBwtestParameters(&s.serverBwp, buf[l:])
+	l = l + n
+	if cookie == nil {
+		return l
+	}
+	l += copy(buf[l:], cookie)
+	if s.psk != nil {
+		l += copy(buf[l:], RequestMAC(s.psk, buf[:l]))
+	}
+	return l
+}
+
+// Close closes the control channel connection. The data channel connection is closed by
+// HandleDCConnReceive or RunLatencyTest, or by run if neither was started. Sessions
+// that have not run are closed with closeUnused.
+func (s *bwtestSession) Close() error {
+	return s.CCConn.Close()
+}
+
+// closeUnused closes both connections of a session that has not run
+func (s *bwtestSession) closeUnused() {
+	_ = s.DCConn.Close()
+	_ = s.Close()
+}
+
+// printParameters prints the test parameters of the session
+func (s *bwtestSession) printParameters() {
+	fmt.Println("clientDCAddr -> serverDCAddr", s.clientDCAddr, "->", s.serverDCAddr)
+	fmt.Printf("client->server: %d seconds, %d bytes, %d packets\n",
+		int(s.clientBwp.BwtestDuration/time.Second), s.clientBwp.PacketSize, s.clientBwp.NumPackets)
+	fmt.Printf("server->client: %d seconds, %d bytes, %d packets\n",
+		int(s.serverBwp.BwtestDuration/time.Second), s.serverBwp.PacketSize, s.serverBwp.NumPackets)
+}
+
+// attemptedBandwidth returns the bandwidth in bps that the test described by bwp tries to achieve
+func attemptedBandwidth(bwp *BwtestParameters) int64 {
+	return 8 * bwp.PacketSize * bwp.NumPackets / int64(bwp.BwtestDuration/time.Second)
+}
+
+// achievedBandwidth returns the bandwidth in bps achieved in the test described by bwp
+func achievedBandwidth(bwp *BwtestParameters, res *BwtestResult) int64 {
+	return 8 * bwp.PacketSize * res.CorrectlyReceived / int64(bwp.BwtestDuration/time.Second)
+}
+
+func printLatencyResult(res *LatencyResult, serverRes *BwtestResult) {
+	fmt.Printf("Packets sent: %d, echoes received: %d\n", res.NumPacketsSent, res.NumEchoesReceived)
+	if serverRes != nil && res.NumPacketsSent > 0 {
+		// The server's results tell us in which direction the packets were lost
+		fmt.Println("Loss rate C->S:", (res.NumPacketsSent-serverRes.CorrectlyReceived)*100/res.NumPacketsSent, "%")
+		if serverRes.CorrectlyReceived > 0 {
+			fmt.Println("Loss rate S->C:",
+				(serverRes.CorrectlyReceived-res.NumEchoesReceived)*100/serverRes.CorrectlyReceived, "%")
+		}
+	}
+	rtts := res.RTTs
+	fmt.Printf("RTT min: %.2fms, median: %.2fms, 90th percentile: %.2fms, 99th percentile: %.2fms, "+
+		"max: %.2fms\n",
+		float64(Percentile(rtts, 0))/1e6, float64(Percentile(rtts, 50))/1e6, float64(Percentile(rtts, 90))/1e6,
+		float64(Percentile(rtts, 99))/1e6, float64(Percentile(rtts, 100))/1e6)
+	printDelayVariation("C->S", res.ForwardDelays)
+	printDelayVariation("S->C", res.ReverseDelays)
+}
+
+// printDelayVariation prints the variation of the one-way delays in one direction, relative
+// to the minimum delay, and the mean delay difference between consecutive packets (jitter)
+func printDelayVariation(dir string, delays []time.Duration) {
+	variation := DelayVariation(delays)
+	fmt.Printf("%s delay variation median: %.2fms, 90th percentile: %.2fms, max: %.2fms, jitter: %.2fms\n",
+		dir, float64(Percentile(variation, 50))/1e6, float64(Percentile(variation, 90))/1e6,
+		float64(Percentile(variation, 100))/1e6, float64(MeanIPDV(delays))/1e6)
+}
+
+func printBwtestResult(bwp *BwtestParameters, res *BwtestResult) {
+	att := attemptedBandwidth(bwp)
+	ach := achievedBandwidth(bwp, res)
+	fmt.Printf("Attempted bandwidth: %d bps / %.2f Mbps\n", att, float64(att)/1000000)
+	fmt.Printf("Achieved bandwidth: %d bps / %.2f Mbps\n", ach, float64(ach)/1000000)
+	fmt.Println("Loss rate:", (bwp.NumPackets-res.CorrectlyReceived)*100/bwp.NumPackets, "%")
+	variance := res.IPAvar
+	average := res.IPAavg
+	fmt.Printf("Interarrival time variance: %dms, average interarrival time: %dms\n",
+		variance/1e6, average/1e6)
+	fmt.Printf("Interarrival time min: %dms, interarrival time max: %dms\n",
+		res.IPAmin/1e6, res.IPAmax/1e6)
+}
+
+// printAggregateResult prints the sum of the bandwidths achieved over all paths, in one
+// direction. getBwp and getRes select the direction; sessions without results are skipped.
+func printAggregateResult(sessions []*bwtestSession,
+	getBwp func(*bwtestSession) *BwtestParameters, getRes func(*bwtestSession) *BwtestResult) {
+
+	var att, ach, numPackets, correctlyReceived int64
+	for _, s := range sessions {
+		bwp, res := getBwp(s), getRes(s)
+		if res == nil {
+			continue
+		}
+		att += attemptedBandwidth(bwp)
+		ach += achievedBandwidth(bwp, res)
+		numPackets += bwp.NumPackets
+		correctlyReceived += res.CorrectlyReceived
+	}
+	if numPackets == 0 {
+		fmt.Println("No results available")
 		return
 	}
+	fmt.Printf("Attempted bandwidth: %d bps / %.2f Mbps\n", att, float64(att)/1000000)
+	fmt.Printf("Achieved bandwidth: %d bps / %.2f Mbps\n", ach, float64(ach)/1000000)
+	fmt.Println("Loss rate:", (numPackets-correctlyReceived)*100/numPackets, "%")
+}
+
+// pathInterfaceKey identifies an interface on a path
+func pathInterfaceKey(intf snet.PathInterface) string {
+	return fmt.Sprintf("%s#%d", intf.IA(), intf.ID())
+}
+
+// selectDisjointPaths chooses up to n paths to the remote, greedily picking the path
+// that shares the fewest interfaces with the paths already chosen. Among equally
+// disjoint paths, the shortest is chosen.
+func selectDisjointPaths(remote *snet.Addr, n int) ([]snet.Path, error) {
+	paths, err := appnet.QueryPaths(remote.IA)
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("No paths available to %v, multipath test requires a remote AS", remote.IA)
+	}
+
+	usedInterfaces := make(map[string]bool)
+	var selected []snet.Path
+	for len(selected) < n && len(paths) > 0 {
+		best, bestShared := -1, 0
+		for i, path := range paths {
+			shared := 0
+			for _, intf := range path.Interfaces() {
+				if usedInterfaces[pathInterfaceKey(intf)] {
+					shared++
+				}
+			}
+			if best == -1 || shared < bestShared ||
+				(shared == bestShared && len(path.Interfaces()) < len(paths[best].Interfaces())) {
+				best, bestShared = i, shared
+			}
+		}
+		for _, intf := range paths[best].Interfaces() {
+			usedInterfaces[pathInterfaceKey(intf)] = true
+		}
+		selected = append(selected, paths[best])
+		paths = append(paths[:best], paths[best+1:]...)
+	}
+	return selected, nil
+}
+
+func main() {
+	var (
+		serverCCAddrStr string
+		serverCCAddr    *snet.Addr
+
+		clientBwpStr string
+		serverBwpStr string
+		interactive  bool
+		pathAlgo     string
+		numPaths     int
+		repeat       int
+		interval     time.Duration
+		resultsFile  string
+		psk          string
+		proto        string
+
+		err error
+	)
+
+	flag.StringVar(&serverCCAddrStr, "s", "", "Server SCION Address")
+	flag.StringVar(&serverBwpStr, "sc", DefaultBwtestParameters, "Server->Client test parameter")
+	flag.StringVar(&clientBwpStr, "cs", DefaultBwtestParameters, "Client->Server test parameter")
+	flag.BoolVar(&interactive, "i", false, "Interactive mode")
+	flag.StringVar(&pathAlgo, "pathAlgo", "", "Path selection algorithm / metric (\"shortest\", \"mtu\")")
+	flag.IntVar(&numPaths, "numPaths", 1, "Number of disjoint paths to run the test over simultaneously")
+	flag.IntVar(&repeat, "repeat", 1, "Number of test runs, 0 to repeat forever")
+	flag.DurationVar(&interval, "interval", 0, "Time between the start of two consecutive test runs")
+	flag.StringVar(&resultsFile, "resultsFile", "", "File to append the results to, one JSON object per line")
+	flag.StringVar(&psk, "psk", "", "Pre-shared key to authenticate to the server")
+	flag.StringVar(&proto, "proto", "udp", "Test protocol (\"udp\", \"quic\", \"both\" or \"latency\")")
+
+	flag.Parse()
+	flagset := make(map[string]bool)
+	// record if flags were set or if default value was used
+	flag.Visit(func(f *flag.Flag) { flagset[f.Name] = true })
+
+	if flag.NFlag() == 0 {
+		// no flag was set, only print usage and exit
+		printUsage()
+		os.Exit(0)
+	}
+
+	if len(serverCCAddrStr) > 0 {
+		serverCCAddr, err = appnet.ResolveUDPAddr(serverCCAddrStr)
+		Check(err)
+	} else {
+		printUsage()
+		Check(fmt.Errorf("Error, server address needs to be specified with -s"))
+	}
+	if numPaths < 1 || numPaths > MaxMultipathSessions {
+		Check(fmt.Errorf("Error, number of paths needs to be between 1 and %d", MaxMultipathSessions))
+	}
+	if numPaths > 1 && (interactive || pathAlgo != "") {
+		Check(fmt.Errorf("Error, -numPaths cannot be combined with -i or -pathAlgo"))
+	}
+
+	if proto != "udp" && proto != "quic" && proto != "both" && proto != "latency" {
+		Check(fmt.Errorf("Error, unknown protocol %s, needs to be one of udp, quic, both or latency", proto))
+	}
+	if repeat < 0 {
+		Check(fmt.Errorf("Error, number of repetitions needs to be positive, or 0 to repeat forever"))
+	}
+
+	if !flagset["cs"] && flagset["sc"] { // Only one direction set, used same for reverse
+		clientBwpStr = serverBwpStr
+		fmt.Println("Only sc parameter set, using same values for cs")
+	}
+	if !flagset["sc"] && flagset["cs"] { // Only one direction set, used same for reverse
+		serverBwpStr = clientBwpStr
+		fmt.Println("Only cs parameter set, using same values for sc")
+	}
+
+	var paths []snet.Path
+	if interactive {
+		// Only prompt once, also in schedule mode
+		var path snet.Path
+		path, err = appnet.ChoosePathInteractive(serverCCAddr)
+		Check(err)
+		paths = []snet.Path{path}
+	}
+
+	for run := 1; repeat == 0 || run <= repeat; run++ {
+		start := time.Now()
+		if repeat != 1 {
+			fmt.Printf("\nRun %d, %s\n", run, start.Format(time.RFC3339))
+		}
+		if !interactive {
+			// Paths are selected again for each run, as they might have expired in the meantime
+			paths, err = choosePaths(serverCCAddr, numPaths, pathAlgo)
+		}
+		var sessions []*bwtestSession
+		var errs []error
+		var quicTests []*quicTest
+		if err == nil && proto != "quic" {
+			sessions, errs, err = runBwtests(serverCCAddr, paths, clientBwpStr, serverBwpStr, []byte(psk),
+				proto == "latency")
+		}
+		if err == nil && (proto == "quic" || proto == "both") {
+			quicTests = runQUICTests(serverCCAddr, paths, clientBwpStr, serverBwpStr, []byte(psk))
+		}
+		if err != nil {
+			if repeat == 1 {
+				Check(err)
+			}
+			fmt.Println(err)
+		} else {
+			printResults(sessions, errs)
+			printQUICResults(quicTests)
+		}
+		if resultsFile != "" {
+			Check(appendResults(resultsFile, start, sessions, errs, quicTests, err))
+		}
+
+		if repeat == 0 || run < repeat {
+			time.Sleep(time.Until(start.Add(interval)))
+		}
+	}
+}
+
+// choosePaths selects the paths to the server, according to the number of paths and the
+// path selection algorithm.
+func choosePaths(serverCCAddr *snet.Addr, numPaths int, pathAlgo string) ([]snet.Path, error) {
+	if numPaths > 1 {
+		paths, err := selectDisjointPaths(serverCCAddr, numPaths)
+		if err != nil {
+			return nil, err
+		}
+		if len(paths) < numPaths {
+			fmt.Printf("Only %d paths available, running test over %d paths\n", len(paths), len(paths))
+		}
+		return paths, nil
+	}
+	var metric int
+	if pathAlgo == "mtu" {
+		metric = appnet.MTU
+	} else if pathAlgo == "shortest" {
+		metric = appnet.Shortest
+	}
+	path, err := appnet.ChoosePathByMetric(metric, serverCCAddr)
+	if err != nil {
+		return nil, err
+	}
+	return []snet.Path{path}, nil
+}
+
+// runBwtests runs a bandwidth test, or a latency test if latency is set, over each of the
+// paths simultaneously. It returns the sessions and, for each session, the error that
+// occurred during the test.
+func runBwtests(serverCCAddr *snet.Addr, paths []snet.Path,
+	clientBwpStr, serverBwpStr string, psk []byte, latency bool) ([]*bwtestSession, []error, error) {
+
+	multipath := len(paths) > 1
+	var sessions []*bwtestSession
+	for i, path := range paths {
+		// Each session needs a separate data channel port on the server
+		serverDCPort := serverCCAddr.Host.L4 + 1 + uint16(i)
+		s, err := newBwtestSession(serverCCAddr, path, serverDCPort, multipath)
+		if err != nil {
+			for _, s := range sessions {
+				s.closeUnused()
+			}
+			return nil, nil, err
+		}
+		s.latency = latency
+		s.setParameters(clientBwpStr, serverBwpStr)
+		if len(psk) > 0 {
+			s.psk = psk
+		}
+		sessions = append(sessions, s)
+	}
+
+	fmt.Println("\nTest parameters:")
+	for i, s := range sessions {
+		if multipath {
+			fmt.Printf("Path %d: %s\n", i, s.path)
+		}
+		s.printParameters()
+	}
+
+	errs := make([]error, len(sessions))
+	var wg sync.WaitGroup
+	for i, s := range sessions {
+		wg.Add(1)
+		go func(i int, s *bwtestSession) {
+			defer wg.Done()
+			errs[i] = s.run()
+		}(i, s)
+	}
+	wg.Wait()
+	for _, s := range sessions {
+		s.Close()
+	}
+	return sessions, errs, nil
+}
+
+func printResults(sessions []*bwtestSession, errs []error) {
+	multipath := len(sessions) > 1
+	for i, s := range sessions {
+		if multipath {
+			fmt.Printf("\nPath %d fingerprint %s\n%s\n", i, s.path.Fingerprint(), s.path)
+		}
+		if s.latencyRes != nil {
+			fmt.Println("\nLatency results")
+			printLatencyResult(s.latencyRes, s.csRes)
+		} else {
+			if s.scRes != nil {
+				fmt.Println("\nS->C results")
+				printBwtestResult(&s.serverBwp, s.scRes)
+			}
+			if s.csRes != nil {
+				fmt.Println("\nC->S results")
+				printBwtestResult(&s.clientBwp, s.csRes)
+			}
+		}
+		if errs[i] != nil {
+			fmt.Println(errs[i])
+		}
+	}
+
+	if multipath && !sessions[0].latency {
+		fmt.Printf("\nAggregate S->C results over %d paths\n", len(sessions))
+		printAggregateResult(sessions,
+			func(s *bwtestSession) *BwtestParameters { return &s.serverBwp },
+			func(s *bwtestSession) *BwtestResult { return s.scRes })
+		fmt.Printf("\nAggregate C->S results over %d paths\n", len(sessions))
+		printAggregateResult(sessions,
+			func(s *bwtestSession) *BwtestParameters { return &s.clientBwp },
+			func(s *bwtestSession) *BwtestResult { return s.csRes })
+	}
+}
+
+// quicTest is a QUIC throughput test over one path
+type quicTest struct {
+	path     snet.Path
+	idleRTTs []time.Duration
+	cs       *QUICTestResult
+	sc       *QUICTestResult
+	err      error
+}
+
+// runQUICTests runs a QUIC throughput test over each of the paths, one after the other, as
+// the server only serves one QUIC test at a time.
+func runQUICTests(serverCCAddr *snet.Addr, paths []snet.Path, clientBwpStr, serverBwpStr string,
+	psk []byte) []*quicTest {
+	if InferedPktSize == 0 {
+		InferedPktSize = DefaultPktSize
+	}
+	// Only the durations are relevant for QUIC
+	csDuration := parseBwtestParameters(clientBwpStr).BwtestDuration
+	scDuration := parseBwtestParameters(serverBwpStr).BwtestDuration
+
+	var tests []*quicTest
+	for _, path := range paths {
+		q := &quicTest{path: path}
+		q.idleRTTs, q.cs, q.sc, q.err = runQUICTest(serverCCAddr, path, csDuration, scDuration, psk)
+		tests = append(tests, q)
+	}
+	return tests
+}
+
+// runQUICTest runs a QUIC throughput test over the path, authenticating with psk if it is
+// not empty. If the server is busy, the test is retried once the server asks us to.
+func runQUICTest(serverCCAddr *snet.Addr, path snet.Path, csDuration, scDuration time.Duration,
+	psk []byte) ([]time.Duration, *QUICTestResult, *QUICTestResult, error) {
+
+	for {
+		idleRTTs, cs, sc, err := dialQUICTest(serverCCAddr, path, csDuration, scDuration, psk)
+		if waitErr, ok := err.(*QUICWaitError); ok {
+			fmt.Println("We need to sleep for", int(waitErr.Wait/time.Second), "seconds before we can run the QUIC test")
+			time.Sleep(waitErr.Wait)
+			continue
+		}
+		return idleRTTs, cs, sc, err
+	}
+}
+
+// dialQUICTest establishes a session with the server, and runs the test if admitted
+func dialQUICTest(serverCCAddr *snet.Addr, path snet.Path, csDuration, scDuration time.Duration,
+	psk []byte) ([]time.Duration, *QUICTestResult, *QUICTestResult, error) {
 
-	fmt.Println("Error, could not fetch server results, MaxTries attempted without success.")
+	raddr := serverCCAddr.Copy()
+	raddr.Host.L4 += QUICPortOffset
+	if path != nil {
+		appnet.SetPath(raddr, path)
+	} else if err := appnet.SetDefaultPath(raddr); err != nil {
+		return nil, nil, nil, err
+	}
+	sconn, err := appnet.Listen(nil)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer sconn.Close()
+	conn := &CountingConn{PacketConn: sconn}
+	// Don't verify the server's cert, as we are not using the TLS PKI
+	tlsConf := &tls.Config{InsecureSkipVerify: true}
+	sess, err := quic.Dial(conn, raddr, "host:0", tlsConf, &quic.Config{KeepAlive: true})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer sess.Close()
+	if err = AdmitQUICTest(sess, psk); err != nil {
+		return nil, nil, nil, err
+	}
+	return RunQUICTest(sess, conn, csDuration, scDuration)
+}
+
+func printQUICResult(res *QUICTestResult) {
+	gp := res.Goodput()
+	fmt.Printf("Goodput: %d bps / %.2f Mbps (%d bytes in %.2fs)\n",
+		gp, float64(gp)/1000000, res.PayloadBytes, res.Duration.Seconds())
+	fmt.Printf("Sent on the wire: %d bytes in %d packets, overhead incl. headers and acks: %.1f %%\n",
+		res.WireBytes, res.WirePackets, 100*res.Overhead())
+	fmt.Printf("Retransmitted (lost) data packets: %d of %d sent (%.1f %%)\n",
+		res.Retransmissions(), res.DataPacketsSent, 100*res.RetransmissionRate())
+	printRTTs(res.RTTs)
+}
+
+func printRTTs(rtts []time.Duration) {
+	fmt.Printf("RTT (%d samples) min: %.1fms, median: %.1fms, 90th percentile: %.1fms, max: %.1fms\n",
+		len(rtts),
+		float64(Percentile(rtts, 0))/1e6, float64(Percentile(rtts, 50))/1e6,
+		float64(Percentile(rtts, 90))/1e6, float64(Percentile(rtts, 100))/1e6)
+}
+
+func printQUICResults(tests []*quicTest) {
+	for i, q := range tests {
+		if len(tests) > 1 {
+			fmt.Printf("\nQUIC test over path %d fingerprint %s\n%s\n", i, q.path.Fingerprint(), q.path)
+		}
+		if q.idleRTTs != nil {
+			fmt.Println("\nQUIC idle")
+			printRTTs(q.idleRTTs)
+		}
+		if q.cs != nil {
+			fmt.Println("\nQUIC C->S results")
+			printQUICResult(q.cs)
+		}
+		if q.sc != nil {
+			fmt.Println("\nQUIC S->C results")
+			printQUICResult(q.sc)
+		}
+		if q.err != nil {
+			fmt.Println("QUIC test failed:", q.err)
+		}
+	}
+}
+
+// bwtestRecord is appended to the results file for every path of every test run, as one
+// line of JSON.
+type bwtestRecord struct {
+	Time        time.Time            `json:"time"`
+	Protocol    string               `json:"protocol"`
+	Path        string               `json:"path,omitempty"`
+	Fingerprint string               `json:"fingerprint,omitempty"`
+	CS          *directionRecord     `json:"cs,omitempty"`
+	SC          *directionRecord     `json:"sc,omitempty"`
+	QUICCS      *quicDirectionRecord `json:"quic_cs,omitempty"`
+	QUICSC      *quicDirectionRecord `json:"quic_sc,omitempty"`
+	Latency     *latencyRecord       `json:"latency,omitempty"`
+	Error       string               `json:"error,omitempty"`
+}
+
+// directionRecord contains the results of a test in one direction. Interarrival times are
+// in nanoseconds.
+type directionRecord struct {
+	AttemptedBps int64 `json:"attempted_bps"`
+	AchievedBps  int64 `json:"achieved_bps"`
+	LossRate     int64 `json:"loss_rate_percent"`
+	IPAvar       int64 `json:"ipa_var"`
+	IPAmin       int64 `json:"ipa_min"`
+	IPAavg       int64 `json:"ipa_avg"`
+	IPAmax       int64 `json:"ipa_max"`
+}
+
+// quicDirectionRecord contains the results of a QUIC test in one direction. RTTs are in
+// nanoseconds.
+type quicDirectionRecord struct {
+	GoodputBps  int64 `json:"goodput_bps"`
+	WireBytes   int64 `json:"wire_bytes"`
+	WirePackets int64 `json:"wire_packets"`
+	DataPackets int64 `json:"data_packets"`
+	Retransmits int64 `json:"retransmitted_packets"`
+	RTTMin      int64 `json:"rtt_min"`
+	RTTMedian   int64 `json:"rtt_median"`
+	RTTP90      int64 `json:"rtt_p90"`
+	RTTMax      int64 `json:"rtt_max"`
+}
+
+// latencyRecord contains the results of a latency test. Delays are in nanoseconds, the
+// delay variations are relative to the minimum one-way delay in each direction.
+type latencyRecord struct {
+	PacketsSent    int64 `json:"packets_sent"`
+	EchoesReceived int64 `json:"echoes_received"`
+	RTTMin         int64 `json:"rtt_min"`
+	RTTMedian      int64 `json:"rtt_median"`
+	RTTP90         int64 `json:"rtt_p90"`
+	RTTP99         int64 `json:"rtt_p99"`
+	RTTMax         int64 `json:"rtt_max"`
+	CSDelayVarP50  int64 `json:"cs_delay_var_p50"`
+	CSDelayVarP90  int64 `json:"cs_delay_var_p90"`
+	CSJitter       int64 `json:"cs_jitter"`
+	SCDelayVarP50  int64 `json:"sc_delay_var_p50"`
+	SCDelayVarP90  int64 `json:"sc_delay_var_p90"`
+	SCJitter       int64 `json:"sc_jitter"`
+}
+
+func newLatencyRecord(res *LatencyResult) *latencyRecord {
+	if res == nil {
+		return nil
+	}
+	csVar, scVar := DelayVariation(res.ForwardDelays), DelayVariation(res.ReverseDelays)
+	return &latencyRecord{
+		PacketsSent:    res.NumPacketsSent,
+		EchoesReceived: res.NumEchoesReceived,
+		RTTMin:         int64(Percentile(res.RTTs, 0)),
+		RTTMedian:      int64(Percentile(res.RTTs, 50)),
+		RTTP90:         int64(Percentile(res.RTTs, 90)),
+		RTTP99:         int64(Percentile(res.RTTs, 99)),
+		RTTMax:         int64(Percentile(res.RTTs, 100)),
+		CSDelayVarP50:  int64(Percentile(csVar, 50)),
+		CSDelayVarP90:  int64(Percentile(csVar, 90)),
+		CSJitter:       int64(MeanIPDV(res.ForwardDelays)),
+		SCDelayVarP50:  int64(Percentile(scVar, 50)),
+		SCDelayVarP90:  int64(Percentile(scVar, 90)),
+		SCJitter:       int64(MeanIPDV(res.ReverseDelays)),
+	}
+}
+
+func newQUICDirectionRecord(res *QUICTestResult) *quicDirectionRecord {
+	if res == nil {
+		return nil
+	}
+	return &quicDirectionRecord{
+		GoodputBps:  res.Goodput(),
+		WireBytes:   res.WireBytes,
+		WirePackets: res.WirePackets,
+		DataPackets: res.DataPacketsSent,
+		Retransmits: res.Retransmissions(),
+		RTTMin:      int64(Percentile(res.RTTs, 0)),
+		RTTMedian:   int64(Percentile(res.RTTs, 50)),
+		RTTP90:      int64(Percentile(res.RTTs, 90)),
+		RTTMax:      int64(Percentile(res.RTTs, 100)),
+	}
+}
+
+func (r *bwtestRecord) setPath(path snet.Path) {
+	if path != nil {
+		r.Path = fmt.Sprintf("%s", path)
+		r.Fingerprint = path.Fingerprint().String()
+	}
+}
+
+func newDirectionRecord(bwp *BwtestParameters, res *BwtestResult) *directionRecord {
+	if res == nil {
+		return nil
+	}
+	return &directionRecord{
+		AttemptedBps: attemptedBandwidth(bwp),
+		AchievedBps:  achievedBandwidth(bwp, res),
+		LossRate:     (bwp.NumPackets - res.CorrectlyReceived) * 100 / bwp.NumPackets,
+		IPAvar:       res.IPAvar,
+		IPAmin:       res.IPAmin,
+		IPAavg:       res.IPAavg,
+		IPAmax:       res.IPAmax,
+	}
+}
+
+// appendResults appends the results of a test run to the file at path. If the test could
+// not be run at all, runErr is recorded instead.
+func appendResults(path string, start time.Time, sessions []*bwtestSession, errs []error,
+	quicTests []*quicTest, runErr error) error {
+
+	var records []bwtestRecord
+	if runErr != nil {
+		records = append(records, bwtestRecord{Time: start, Error: runErr.Error()})
+	}
+	for i, s := range sessions {
+		r := bwtestRecord{Time: start}
+		if s.latency {
+			r.Protocol = "latency"
+			r.Latency = newLatencyRecord(s.latencyRes)
+		} else {
+			r.Protocol = "udp"
+			r.CS = newDirectionRecord(&s.clientBwp, s.csRes)
+			r.SC = newDirectionRecord(&s.serverBwp, s.scRes)
+		}
+		r.setPath(s.path)
+		if errs[i] != nil {
+			r.Error = errs[i].Error()
+		}
+		records = append(records, r)
+	}
+	for _, q := range quicTests {
+		r := bwtestRecord{
+			Time:     start,
+			Protocol: "quic",
+			QUICCS:   newQUICDirectionRecord(q.cs),
+			QUICSC:   newQUICDirectionRecord(q.sc),
+		}
+		r.setPath(q.path)
+		if q.err != nil {
+			r.Error = q.err.Error()
+		}
+		records = append(records, r)
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	for _, r := range records {
+		if err := enc.Encode(r); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
 }
@@ -0,0 +1,145 @@
+package bwtestlib
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"time"
+)
+
+const (
+	// Length of the cookie the server hands out to prove return routability
+	CookieLen = 8 + 16
+	// Time during which a cookie is accepted by the server
+	CookieLifetime time.Duration = time.Second * 30
+	// Length of the message authentication code of requests authenticated with a
+	// pre-shared key
+	RequestMACLen = 16
+)
+
+// CookieJar creates and verifies return routability cookies.
+// Before the server sends any test traffic to a client, the client needs to prove that
+// it can receive packets at the address it claims by echoing a cookie that the server
+// sent to this address. The cookie consists of a timestamp and a MAC over the
+// timestamp, the client address and the client's data channel port, so the server does
+// not need to keep any state per client.
+type CookieJar struct {
+	secret []byte
+}
+
+// NewCookieJar creates a CookieJar with a fresh random secret
+func NewCookieJar() (*CookieJar, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return &CookieJar{secret: secret}, nil
+}
+
+// Create returns a new cookie for the client with control channel address clientAddr and
+// data channel port dcPort
+func (j *CookieJar) Create(clientAddr string, dcPort uint16, now time.Time) []byte {
+	cookie := make([]byte, CookieLen)
+	binary.LittleEndian.PutUint64(cookie, uint64(now.Unix()))
+	copy(cookie[8:], j.mac(cookie[:8], clientAddr, dcPort))
+	return cookie
+}
+
+// Verify checks that the cookie was created by this jar for the same client address and
+// data channel port, and that it has not expired yet
+func (j *CookieJar) Verify(cookie []byte, clientAddr string, dcPort uint16, now time.Time) bool {
+	if len(cookie) != CookieLen {
+		return false
+	}
+	created := time.Unix(int64(binary.LittleEndian.Uint64(cookie)), 0)
+	if now.Before(created) || now.Sub(created) > CookieLifetime {
+		return false
+	}
+	return hmac.Equal(cookie[8:], j.mac(cookie[:8], clientAddr, dcPort))
+}
+
+func (j *CookieJar) mac(timestamp []byte, clientAddr string, dcPort uint16) []byte {
+	h := hmac.New(sha256.New, j.secret)
+	h.Write(timestamp)
+	h.Write([]byte(clientAddr))
+	port := make([]byte, 2)
+	binary.LittleEndian.PutUint16(port, dcPort)
+	h.Write(port)
+	return h.Sum(nil)[:CookieLen-8]
+}
+
+// RequestMAC computes the MAC authenticating a request with the pre-shared key psk. The
+// MAC covers the whole request, including the cookie.
+func RequestMAC(psk []byte, request []byte) []byte {
+	h := hmac.New(sha256.New, psk)
+	h.Write(request)
+	return h.Sum(nil)[:RequestMACLen]
+}
+
+// VerifyRequestMAC checks whether mac authenticates the request with any of the pre-shared keys
+func VerifyRequestMAC(psks [][]byte, request []byte, mac []byte) bool {
+	for _, psk := range psks {
+		if hmac.Equal(mac, RequestMAC(psk, request)) {
+			return true
+		}
+	}
+	return false
+}
+
+// IARateLimiter limits the number of tests that hosts of each ISD-AS can start within a
+// sliding time window
+type IARateLimiter struct {
+	limit    int
+	interval time.Duration
+	starts   map[string][]time.Time
+	// Time of the last removal of the ISD-ASes without tests in the window
+	lastSweep time.Time
+}
+
+// NewIARateLimiter creates a rate limiter allowing limit tests per interval for each
+// ISD-AS. A limit of 0 disables rate limiting.
+func NewIARateLimiter(limit int, interval time.Duration) *IARateLimiter {
+	return &IARateLimiter{
+		limit:    limit,
+		interval: interval,
+		starts:   make(map[string][]time.Time),
+	}
+}
+
+// Allow checks if another test from the ISD-AS ia may be started now, and records the
+// start of the test if so. Otherwise, the time until the next test is allowed is returned.
+func (l *IARateLimiter) Allow(ia string, now time.Time) (bool, time.Duration) {
+	if l.limit <= 0 {
+		return true, 0
+	}
+	if now.Sub(l.lastSweep) >= l.interval {
+		l.sweep(now)
+	}
+	// Forget about tests that started before the window
+	starts := l.starts[ia]
+	for len(starts) > 0 && now.Sub(starts[0]) >= l.interval {
+		starts = starts[1:]
+	}
+	if len(starts) >= l.limit {
+		l.starts[ia] = starts
+		return false, starts[0].Add(l.interval).Sub(now)
+	}
+	if len(starts) == 0 {
+		// Don't keep the backing array of old entries around
+		starts = nil
+	}
+	l.starts[ia] = append(starts, now)
+	return true, 0
+}
+
+// sweep removes the ISD-ASes whose tests all started before the window, so that the
+// entries of ISD-ASes that stopped starting tests are not kept forever
+func (l *IARateLimiter) sweep(now time.Time) {
+	for ia, starts := range l.starts {
+		if len(starts) == 0 || now.Sub(starts[len(starts)-1]) >= l.interval {
+			delete(l.starts, ia)
+		}
+	}
+	l.lastSweep = now
+}
@@ -0,0 +1,92 @@
+package bwtestlib
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCookieJar(t *testing.T) {
+	jar, err := NewCookieJar()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := "1-ff00:0:110,[127.0.0.1]:40000"
+	now := time.Now()
+	cookie := jar.Create(client, 40001, now)
+	if len(cookie) != CookieLen {
+		t.Fatalf("unexpected cookie length %d", len(cookie))
+	}
+
+	cases := []struct {
+		name   string
+		cookie []byte
+		client string
+		port   uint16
+		now    time.Time
+		valid  bool
+	}{
+		{"valid", cookie, client, 40001, now, true},
+		{"valid before expiry", cookie, client, 40001, now.Add(CookieLifetime - time.Second), true},
+		{"expired", cookie, client, 40001, now.Add(CookieLifetime + time.Second), false},
+		{"other client", cookie, "1-ff00:0:110,[127.0.0.2]:40000", 40001, now, false},
+		{"other port", cookie, client, 40002, now, false},
+		{"truncated", cookie[:CookieLen-1], client, 40001, now, false},
+	}
+	for _, c := range cases {
+		if valid := jar.Verify(c.cookie, c.client, c.port, c.now); valid != c.valid {
+			t.Errorf("%s: expected valid=%v, got %v", c.name, c.valid, valid)
+		}
+	}
+
+	otherJar, err := NewCookieJar()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if otherJar.Verify(cookie, client, 40001, now) {
+		t.Error("cookie accepted by jar with different secret")
+	}
+}
+
+func TestRequestMAC(t *testing.T) {
+	request := []byte("N some request")
+	psks := [][]byte{[]byte("alice"), []byte("bob")}
+	if !VerifyRequestMAC(psks, request, RequestMAC([]byte("bob"), request)) {
+		t.Error("MAC with known key rejected")
+	}
+	if VerifyRequestMAC(psks, request, RequestMAC([]byte("mallory"), request)) {
+		t.Error("MAC with unknown key accepted")
+	}
+	if VerifyRequestMAC(psks, []byte("N other request"), RequestMAC([]byte("bob"), request)) {
+		t.Error("MAC for different request accepted")
+	}
+}
+
+func TestIARateLimiter(t *testing.T) {
+	l := NewIARateLimiter(2, time.Minute)
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.Allow("1-ff00:0:110", now); !ok {
+			t.Fatalf("test %d rejected", i)
+		}
+	}
+	ok, wait := l.Allow("1-ff00:0:110", now.Add(10*time.Second))
+	if ok || wait != 50*time.Second {
+		t.Errorf("expected rejection with wait 50s, got ok=%v wait=%v", ok, wait)
+	}
+	if ok, _ := l.Allow("1-ff00:0:111", now); !ok {
+		t.Error("other IA rejected")
+	}
+	if ok, _ := l.Allow("1-ff00:0:110", now.Add(time.Minute)); !ok {
+		t.Error("rejected after interval")
+	}
+	if ok, _ := l.Allow("1-ff00:0:112", now.Add(3*time.Minute)); !ok || len(l.starts) != 1 {
+		t.Errorf("expected the ISD-ASes without recent tests to be removed, got %v", l.starts)
+	}
+
+	unlimited := NewIARateLimiter(0, time.Minute)
+	for i := 0; i < 100; i++ {
+		if ok, _ := unlimited.Allow("1-ff00:0:110", now); !ok {
+			t.Fatal("rejected without limit")
+		}
+	}
+}
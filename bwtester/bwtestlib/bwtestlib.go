@@ -5,8 +5,8 @@ import (
 	"crypto/aes"
 	"encoding/binary"
 	"encoding/gob"
+	"fmt"
 	"os"
-	"sort"
 	"sync"
 	"time"
 
@@ -16,7 +16,8 @@ import (
 )
 
 const (
-	// Maximum duration of a bandwidth test
+	// Default maximum duration of a bandwidth test. Servers can be configured to allow
+	// longer tests.
 	MaxDuration time.Duration = time.Second * 10
 	// Maximum amount of time to wait for straggler packets
 	StragglerWaitPeriod time.Duration = time.Second
@@ -29,18 +30,41 @@ const (
 	MaxPacketSize int64 = 66000
 	// Make sure the port number is a port the server application can connect to
 	MinPort uint16 = 1024
+	// Maximum number of concurrent tests from the same client host, i.e. the maximum number
+	// of paths used in a multipath bandwidth test
+	MaxMultipathSessions int = 8
 
 	MaxTries int64         = 5 // Number of times to try to reach server
 	Timeout  time.Duration = time.Millisecond * 500
 	MaxRTT   time.Duration = time.Millisecond * 1000
 )
 
+// Status values in the second byte of the server's 'N' and 'R' responses. Values between
+// StatusOK and StatusError are the number of seconds the client needs to wait.
+const (
+	StatusOK byte = 0
+	// The request was rejected; for 'N' requests, the server's maximum test duration in
+	// seconds follows as little endian uint32
+	StatusError byte = 127
+	// The client needs to wait longer than StatusError-1 seconds; the number of seconds
+	// follows as little endian uint32
+	StatusLongWait byte = 128
+	// The request did not contain a valid cookie; a new cookie of length CookieLen follows,
+	// which has to be included in the repeated request
+	StatusCookie byte = 129
+	// The request was not authenticated with a pre-shared key known to the server
+	StatusUnauthorized byte = 130
+)
+
 type BwtestParameters struct {
 	BwtestDuration time.Duration
 	PacketSize     int64
 	NumPackets     int64
 	PrgKey         []byte
 	Port           uint16
+	// Echo requests a latency test, in which the server echoes the client's packets instead
+	// of sending its own test traffic, see RunLatencyTest
+	Echo bool
 }
 
 type BwtestResult struct {
@@ -127,9 +151,7 @@ func DecodeBwtestParameters(buf []byte) (*BwtestParameters, int, error) {
 	var v BwtestParameters
 	err := dec.Decode(&v)
 	// Make sure that arguments are within correct parameter ranges
-	if v.BwtestDuration > MaxDuration {
-		v.BwtestDuration = MaxDuration
-	}
+	// Note: the maximum duration is configurable on the server and checked there
 	if v.BwtestDuration < time.Duration(0) {
 		v.BwtestDuration = time.Duration(0)
 	}
@@ -145,6 +167,38 @@ func DecodeBwtestParameters(buf []byte) (*BwtestParameters, int, error) {
 	return &v, is - bb.Len(), err
 }
 
+// Encode the status of a response that asks the client to wait for the duration d into
+// buf, which must be at least 5 bytes long, return the number of bytes written
+func EncodeWaitStatus(d time.Duration, buf []byte) int {
+	// Round up, the client should rather wait too long than too short
+	secs := int64((d + time.Second - 1) / time.Second)
+	if secs < 1 {
+		secs = 1
+	}
+	if secs < int64(StatusError) {
+		buf[0] = byte(secs)
+		return 1
+	}
+	buf[0] = StatusLongWait
+	binary.LittleEndian.PutUint32(buf[1:], uint32(secs))
+	return 5
+}
+
+// Decode the wait duration from the status of a response, as encoded by EncodeWaitStatus.
+// Returns the duration and the number of bytes consumed.
+func DecodeWaitStatus(buf []byte) (time.Duration, int, error) {
+	if len(buf) < 1 || buf[0] == StatusOK || buf[0] == StatusError {
+		return 0, 0, fmt.Errorf("not a wait status")
+	}
+	if buf[0] != StatusLongWait {
+		return time.Duration(buf[0]) * time.Second, 1, nil
+	}
+	if len(buf) < 5 {
+		return 0, 0, fmt.Errorf("wait status too short")
+	}
+	return time.Duration(binary.LittleEndian.Uint32(buf[1:])) * time.Second, 5, nil
+}
+
 func HandleDCConnSend(bwp *BwtestParameters, udpConnection snet.Conn) {
 	sb := make([]byte, bwp.PacketSize)
 	var i int64 = 0
@@ -169,7 +223,8 @@ func HandleDCConnSend(bwp *BwtestParameters, udpConnection snet.Conn) {
 		}
 		// Send packet now
 		PrgFill(bwp.PrgKey, int(i*bwp.PacketSize), sb)
-		// Place packet number at the beginning of the packet, overwriting some PRG data
+		// Place the offset of the packet at the beginning of the packet, overwriting some PRG
+		// data. It wraps around after 4 GiB, see packetOffset.
 		binary.LittleEndian.PutUint32(sb, uint32(i*bwp.PacketSize))
 		_, err := udpConnection.Write(sb)
 		Check(err)
@@ -182,7 +237,8 @@ func HandleDCConnReceive(bwp *BwtestParameters, udpConnection snet.Conn, res *Bw
 	finish := res.ExpectedFinishTime
 	resLock.Unlock()
 	var numPacketsReceived, correctlyReceived int64 = 0, 0
-	InterPacketArrivalTime := make(map[int]int64)
+	var iat interArrivalStats
+	var lastOffset int64
 	_ = udpConnection.SetReadDeadline(finish)
 	// Make the receive buffer a bit larger to enable detection of packets that are too large
 	recBuf := make([]byte, bwp.PacketSize+1000)
@@ -212,12 +268,13 @@ func HandleDCConnReceive(bwp *BwtestParameters, udpConnection snet.Conn, res *Bw
 		// Todo: create separate verif function which only compares the packet
 		// so that a discrepancy is noticed immediately without generating the
 		// entire packet
-		iv := int64(binary.LittleEndian.Uint32(recBuf))
-		seqNo := int(iv / bwp.PacketSize)
-		InterPacketArrivalTime[seqNo] = time.Now().UnixNano()
+		iv := packetOffset(binary.LittleEndian.Uint32(recBuf), lastOffset)
+		iat.add(iv/bwp.PacketSize, time.Now().UnixNano())
 		PrgFill(bwp.PrgKey, int(iv), cmpBuf)
 		binary.LittleEndian.PutUint32(cmpBuf, uint32(iv))
 		if bytes.Equal(recBuf[:bwp.PacketSize], cmpBuf) {
+			// Only correct packets are used to resolve the wraparound of the offsets
+			lastOffset = iv
 			if correctlyReceived == 0 {
 				// Adjust finish time after first correctly received packet
 				// Note that we should check that we're not too far away from the beginning of the
@@ -245,7 +302,7 @@ func HandleDCConnReceive(bwp *BwtestParameters, udpConnection snet.Conn, res *Bw
 	resLock.Lock()
 	res.NumPacketsReceived = numPacketsReceived
 	res.CorrectlyReceived = correctlyReceived
-	res.IPAvar, res.IPAmin, res.IPAavg, res.IPAmax = aggrInterArrivalTime(InterPacketArrivalTime)
+	res.IPAvar, res.IPAmin, res.IPAavg, res.IPAmax = iat.result()
 
 	// We're done here, let's see if we need to wait for the send function to complete so we can close the connection
 	// Note: the locking here is not strictly necessary, since ExpectedFinishTime is only updated right after
@@ -262,40 +319,52 @@ func HandleDCConnReceive(bwp *BwtestParameters, udpConnection snet.Conn, res *Bw
 	_ = udpConnection.Close()
 }
 
-func aggrInterArrivalTime(bwr map[int]int64) (IPAvar, IPAmin, IPAavg, IPAmax int64) {
-	// reverse map, mapping timestamps to sequence numbers
-	revMap := make(map[int64]int)
-	var keys []int64 // keys are the timestamps of the received packets
-	// fill the reverse map and the keep track of the timestamps
-	for k, v := range bwr {
-		revMap[v] = k
-		keys = append(keys, v)
+// packetOffset returns the offset of a packet in the test's data stream, given the offset
+// in the packet, which wraps around after 4 GiB, and the offset of the last packet
+// received. The packet is assumed to be the one closest to the last packet, i.e. packets
+// may be reordered by up to 2 GiB.
+func packetOffset(wrapped uint32, last int64) int64 {
+	offset := last + int64(int32(wrapped-uint32(last)))
+	if offset < 0 {
+		return int64(wrapped)
 	}
-	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] }) // sorted timestamps of the received packets
+	return offset
+}
 
-	// We keep only the interarrival times of successive packets with no drops
-	var iat []int64
-	i := 1
-	for i < len(keys) {
-		if revMap[keys[i-1]]+1 == revMap[keys[i]] { // valid measurement without reordering, include
-			iat = append(iat, keys[i]-keys[i-1]) // resulting interarrival time
-		}
-		i += 1
-	}
+// interArrivalStats aggregates the interarrival times of the packets as they are received.
+// Only the interarrival times of successive packets with no drops or reordering in between
+// are included.
+type interArrivalStats struct {
+	lastSeqNo   int64
+	lastArrival int64
+	count       int64
+	sum         int64
+	min         int64
+	max         int64
+}
 
-	// Compute variance and average
-	var average float64 = 0
-	IPAmin = -1
-	for _, v := range iat {
-		if v > IPAmax {
-			IPAmax = v
+// add records the arrival of the packet with the sequence number seqNo at the time
+// arrival in nanoseconds
+func (s *interArrivalStats) add(seqNo, arrival int64) {
+	if s.lastArrival != 0 && s.lastSeqNo+1 == seqNo { // valid measurement without reordering, include
+		v := arrival - s.lastArrival // resulting interarrival time
+		if v > s.max {
+			s.max = v
 		}
-		if v < IPAmin || IPAmin == -1 {
-			IPAmin = v
+		if v < s.min || s.count == 0 {
+			s.min = v
 		}
-		average += float64(v) / float64(len(iat))
+		s.sum += v
+		s.count++
+	}
+	s.lastSeqNo, s.lastArrival = seqNo, arrival
+}
+
+// result returns the interarrival time statistics. IPAmin is -1 if there are no samples.
+func (s *interArrivalStats) result() (IPAvar, IPAmin, IPAavg, IPAmax int64) {
+	if s.count == 0 {
+		return 0, -1, 0, 0
 	}
-	IPAvar = IPAmax - int64(average)
-	IPAavg = int64(average)
-	return
+	IPAavg = int64(float64(s.sum) / float64(s.count))
+	return s.max - IPAavg, s.min, IPAavg, s.max
 }
@@ -0,0 +1,39 @@
+package bwtestlib
+
+import (
+	"testing"
+)
+
+func TestPacketOffset(t *testing.T) {
+	const packetSize = 1000
+	var last int64
+	// Packets of a test sending more than 4 GiB, with the packets 4294967 and 4294968
+	// reordered around the wraparound of the offset
+	for _, seqNo := range []int64{0, 1, 2, 4294966, 4294968, 4294967, 4294969, 4296000} {
+		offset := seqNo * packetSize
+		actual := packetOffset(uint32(offset), last)
+		if actual != offset {
+			t.Errorf("Packet %d: expected offset %d, got %d", seqNo, offset, actual)
+		}
+		last = actual
+	}
+}
+
+func TestInterArrivalStats(t *testing.T) {
+	var s interArrivalStats
+	if _, min, _, _ := s.result(); min != -1 {
+		t.Errorf("Expected IPAmin -1 without samples, got %d", min)
+	}
+	// Packet 3 is lost and packets 5 and 6 are reordered, so only the interarrival times
+	// 1->2 and 7->8 are included
+	arrivals := []struct{ seqNo, arrival int64 }{
+		{1, 100}, {2, 110}, {4, 130}, {6, 160}, {5, 170}, {7, 190}, {8, 205},
+	}
+	for _, a := range arrivals {
+		s.add(a.seqNo, a.arrival)
+	}
+	ipaVar, ipaMin, ipaAvg, ipaMax := s.result()
+	if ipaMin != 10 || ipaMax != 15 || ipaAvg != 12 || ipaVar != 3 {
+		t.Errorf("Unexpected statistics: var %d, min %d, avg %d, max %d", ipaVar, ipaMin, ipaAvg, ipaMax)
+	}
+}
@@ -0,0 +1,224 @@
+package bwtestlib
+
+import (
+	"encoding/binary"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/scionproto/scion/go/lib/snet"
+)
+
+// Layout of the packets of a latency test. The client fills in the sequence number and
+// its sending time, the server adds its receiving and sending time and echoes the packet.
+// Timestamps are little endian Unix times in nanoseconds.
+const (
+	latencySeqOffset        = 0
+	latencyClientSendOffset = 4
+	latencyServerRecvOffset = 12
+	latencyServerSendOffset = 20
+	// Minimum packet size of a latency test
+	LatencyMinPacketSize int64 = 28
+)
+
+// LatencyResult contains the measurements of a latency test. The samples are ordered by
+// the sequence numbers of the packets, regardless of the order in which the echoes
+// arrived, so that consecutive samples belong to consecutive packets.
+type LatencyResult struct {
+	NumPacketsSent    int64
+	NumEchoesReceived int64
+	RTTs              []time.Duration
+	// One-way delays of the echoed packets in both directions. As the clocks of client and
+	// server are not synchronized, these include an unknown offset, so only the variation
+	// of the delays is meaningful.
+	ForwardDelays []time.Duration
+	ReverseDelays []time.Duration
+}
+
+// DelayVariation returns the variation of the one-way delays, i.e. the difference of each
+// delay to the minimum delay, which cancels out the clock offset between client and server
+func DelayVariation(delays []time.Duration) []time.Duration {
+	if len(delays) == 0 {
+		return nil
+	}
+	min := delays[0]
+	for _, d := range delays {
+		if d < min {
+			min = d
+		}
+	}
+	variation := make([]time.Duration, len(delays))
+	for i, d := range delays {
+		variation[i] = d - min
+	}
+	return variation
+}
+
+// MeanIPDV returns the mean absolute difference of the delays of consecutive packets
+// (inter-packet delay variation, RFC 3393)
+func MeanIPDV(delays []time.Duration) time.Duration {
+	if len(delays) < 2 {
+		return 0
+	}
+	var sum time.Duration
+	for i := 1; i < len(delays); i++ {
+		d := delays[i] - delays[i-1]
+		if d < 0 {
+			d = -d
+		}
+		sum += d
+	}
+	return sum / time.Duration(len(delays)-1)
+}
+
+// RunLatencyTest sends the packets of a latency test as specified in bwp and collects the
+// packets echoed by the server. The connection is closed when the test is finished.
+func RunLatencyTest(bwp *BwtestParameters, udpConnection snet.Conn) *LatencyResult {
+	res := &LatencyResult{}
+	t0 := time.Now()
+	finish := t0.Add(bwp.BwtestDuration + MaxRTT + StragglerWaitPeriod)
+
+	echoes := make(chan latencyEcho, 64)
+	go func() {
+		defer close(echoes)
+		_ = udpConnection.SetReadDeadline(finish)
+		recBuf := make([]byte, bwp.PacketSize+1000)
+		for time.Now().Before(finish) {
+			n, err := udpConnection.Read(recBuf)
+			if err != nil {
+				continue
+			}
+			recv := time.Now()
+			if int64(n) != bwp.PacketSize {
+				continue
+			}
+			echoes <- latencyEcho{
+				seq:        binary.LittleEndian.Uint32(recBuf[latencySeqOffset:]),
+				clientSend: unixNano(recBuf[latencyClientSendOffset:]),
+				serverRecv: unixNano(recBuf[latencyServerRecvOffset:]),
+				serverSend: unixNano(recBuf[latencyServerSendOffset:]),
+				recv:       recv,
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		// Only count echoes of packets we actually sent, and each only once
+		received := make(map[uint32]bool)
+		var collected []latencyEcho
+		for e := range echoes {
+			if int64(e.seq) >= bwp.NumPackets || received[e.seq] {
+				continue
+			}
+			received[e.seq] = true
+			collected = append(collected, e)
+		}
+		res.addEchoes(collected)
+	}()
+
+	sb := make([]byte, bwp.PacketSize)
+	var interPktInterval time.Duration
+	if bwp.NumPackets > 1 {
+		interPktInterval = bwp.BwtestDuration / time.Duration(bwp.NumPackets-1)
+	} else {
+		interPktInterval = bwp.BwtestDuration
+	}
+	for i := int64(0); i < bwp.NumPackets; i++ {
+		t1 := time.Now()
+		t2 := t0.Add(interPktInterval * time.Duration(i))
+		if t1.Before(t2) {
+			time.Sleep(t2.Sub(t1))
+		}
+		binary.LittleEndian.PutUint32(sb[latencySeqOffset:], uint32(i))
+		binary.LittleEndian.PutUint64(sb[latencyClientSendOffset:], uint64(time.Now().UnixNano()))
+		if _, err := udpConnection.Write(sb); err != nil {
+			continue
+		}
+		res.NumPacketsSent++
+	}
+
+	wg.Wait()
+	_ = udpConnection.Close()
+	return res
+}
+
+// latencyEcho is a packet of a latency test echoed by the server
+type latencyEcho struct {
+	seq                                      uint32
+	clientSend, serverRecv, serverSend, recv time.Time
+}
+
+// addEchoes adds the samples of the echoes, in the order of their sequence numbers
+func (res *LatencyResult) addEchoes(echoes []latencyEcho) {
+	sort.Slice(echoes, func(i, j int) bool { return echoes[i].seq < echoes[j].seq })
+	for _, e := range echoes {
+		res.NumEchoesReceived++
+		res.RTTs = append(res.RTTs, e.recv.Sub(e.clientSend)-e.serverSend.Sub(e.serverRecv))
+		res.ForwardDelays = append(res.ForwardDelays, e.serverRecv.Sub(e.clientSend))
+		res.ReverseDelays = append(res.ReverseDelays, e.recv.Sub(e.serverSend))
+	}
+}
+
+// HandleDCConnEcho echoes the packets of a latency test back to the client, adding the
+// time of reception and sending. The number of echoed packets is recorded in res, and the
+// connection is closed once the test is finished.
+func HandleDCConnEcho(bwp *BwtestParameters, udpConnection snet.Conn, res *BwtestResult, resLock *sync.Mutex) {
+	resLock.Lock()
+	finish := res.ExpectedFinishTime
+	resLock.Unlock()
+	var numPacketsReceived, correctlyReceived int64 = 0, 0
+	_ = udpConnection.SetReadDeadline(finish)
+	recBuf := make([]byte, bwp.PacketSize+1000)
+	for time.Now().Before(finish) && correctlyReceived < bwp.NumPackets {
+		n, err := udpConnection.Read(recBuf)
+		if err != nil {
+			// See HandleDCConnReceive, the finish time might have been extended
+			resLock.Lock()
+			finish = res.ExpectedFinishTime
+			resLock.Unlock()
+			continue
+		}
+		recv := time.Now()
+		numPacketsReceived++
+		if int64(n) != bwp.PacketSize || int64(n) < LatencyMinPacketSize {
+			continue
+		}
+		if correctlyReceived == 0 {
+			// Adjust finish time after first correctly received packet, as in HandleDCConnReceive
+			newFinish := recv.Add(bwp.BwtestDuration + StragglerWaitPeriod)
+			if newFinish.After(finish) {
+				finish = newFinish
+				_ = udpConnection.SetReadDeadline(finish)
+				resLock.Lock()
+				if res.ExpectedFinishTime.Before(finish) {
+					res.ExpectedFinishTime = finish
+				}
+				resLock.Unlock()
+			}
+		}
+		binary.LittleEndian.PutUint64(recBuf[latencyServerRecvOffset:], uint64(recv.UnixNano()))
+		binary.LittleEndian.PutUint64(recBuf[latencyServerSendOffset:], uint64(time.Now().UnixNano()))
+		// Ignore error, the packet then counts as lost on the reverse path
+		_, _ = udpConnection.Write(recBuf[:n])
+		correctlyReceived++
+	}
+
+	resLock.Lock()
+	res.NumPacketsReceived = numPacketsReceived
+	res.CorrectlyReceived = correctlyReceived
+	// Interarrival times are not measured in latency tests
+	res.IPAvar, res.IPAmin, res.IPAavg, res.IPAmax = 0, 0, 0, 0
+	eft := res.ExpectedFinishTime
+	resLock.Unlock()
+	if time.Now().Before(eft) {
+		time.Sleep(time.Until(eft))
+	}
+	_ = udpConnection.Close()
+}
+
+func unixNano(b []byte) time.Time {
+	return time.Unix(0, int64(binary.LittleEndian.Uint64(b)))
+}
@@ -0,0 +1,54 @@
+package bwtestlib
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDelayVariation(t *testing.T) {
+	// One-way delays with a clock offset of 1s between client and server
+	delays := []time.Duration{
+		time.Second + 12*time.Millisecond,
+		time.Second + 10*time.Millisecond,
+		time.Second + 15*time.Millisecond,
+		time.Second + 11*time.Millisecond,
+	}
+	expected := []time.Duration{2 * time.Millisecond, 0, 5 * time.Millisecond, 1 * time.Millisecond}
+	variation := DelayVariation(delays)
+	for i := range expected {
+		if variation[i] != expected[i] {
+			t.Errorf("Delay variation %d is %v, expected %v", i, variation[i], expected[i])
+		}
+	}
+	// |10-12| + |15-10| + |11-15| = 11ms over 3 differences
+	if ipdv := MeanIPDV(delays); ipdv != 11*time.Millisecond/3 {
+		t.Errorf("Mean IPDV is %v, expected %v", ipdv, 11*time.Millisecond/3)
+	}
+	if DelayVariation(nil) != nil || MeanIPDV(delays[:1]) != 0 {
+		t.Errorf("Expected no variation for less than two samples")
+	}
+}
+
+func TestLatencyEchoOrder(t *testing.T) {
+	t0 := time.Unix(1600000000, 0)
+	echo := func(seq uint32, forward time.Duration) latencyEcho {
+		clientSend := t0.Add(time.Duration(seq) * 10 * time.Millisecond)
+		serverRecv := clientSend.Add(forward)
+		return latencyEcho{seq, clientSend, serverRecv, serverRecv, serverRecv.Add(5 * time.Millisecond)}
+	}
+	// The echo of packet 1 arrives after the echo of packet 2
+	var res LatencyResult
+	res.addEchoes([]latencyEcho{echo(0, 10*time.Millisecond), echo(2, 14*time.Millisecond), echo(1, 12*time.Millisecond)})
+	expected := []time.Duration{10 * time.Millisecond, 12 * time.Millisecond, 14 * time.Millisecond}
+	for i := range expected {
+		if res.ForwardDelays[i] != expected[i] {
+			t.Errorf("Forward delay %d is %v, expected %v", i, res.ForwardDelays[i], expected[i])
+		}
+	}
+	if ipdv := MeanIPDV(res.ForwardDelays); ipdv != 2*time.Millisecond {
+		t.Errorf("Mean IPDV is %v, expected 2ms", ipdv)
+	}
+	if res.NumEchoesReceived != 3 || len(res.RTTs) != 3 || res.RTTs[0] != 15*time.Millisecond {
+		t.Errorf("Unexpected result: %+v", res)
+	}
+}
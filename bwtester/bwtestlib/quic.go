@@ -0,0 +1,560 @@
+package bwtestlib
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+	"github.com/lucas-clemente/quic-go"
+)
+
+const (
+	// Offset of the port of the QUIC test server from the server's control channel port.
+	// The ports in between are used for the data channels of multipath tests.
+	QUICPortOffset uint16 = 1 + uint16(MaxMultipathSessions)
+	// Interval between two RTT samples during a QUIC test
+	QUICPingInterval time.Duration = time.Millisecond * 100
+	// Time during which RTT samples are taken on the idle session, before the transfers start
+	QUICIdlePingPeriod time.Duration = QUICPingInterval * 5
+	// Time within which the client needs to be admitted to a test after establishing the session
+	QUICAdmissionTimeout time.Duration = time.Second * 5
+	// Length of the challenge the server sends on the admission stream
+	QUICChallengeLen = 16
+	// Size of the chunks written to the QUIC streams
+	quicChunkSize = 32 * 1024
+	// Minimum size of the packets counted as data packets. The bulk transfers fill the
+	// packets up to the maximum packet size of about 1250 bytes, while acknowledgements and
+	// RTT probes are far smaller.
+	quicDataPacketSize = 1000
+)
+
+// Stream types of the QUIC test, sent by the client as the first byte of each stream
+const (
+	// Admission to the test, which must be the first stream of the session. The server
+	// sends a random challenge of QUICChallengeLen bytes, the client answers with
+	// RequestMAC(psk, challenge), or RequestMACLen zero bytes if it has no key, and the
+	// server responds with a status as in its 'N' response.
+	QUICStreamAuth byte = 'A'
+	// Client->server bulk transfer, the server responds with the encoded QUICTestResult
+	QUICStreamUpload byte = 'U'
+	// Server->client bulk transfer, the duration follows as little endian uint64 nanoseconds
+	QUICStreamDownload byte = 'D'
+	// Request for the bytes and packets the server sent on the wire during the last download
+	QUICStreamStats byte = 'S'
+	// Echo of timestamps for RTT samples
+	QUICStreamPing byte = 'P'
+)
+
+// QUICTestResult contains the results of a QUIC bulk transfer in one direction.
+//
+// The quic-go version in use does not expose its loss recovery statistics, and the
+// packets are encrypted, so retransmissions cannot be told apart from new data on the
+// wire. Instead, both ends count the data packets of the transfer, and each data packet
+// the sender sent but the receiver did not receive is counted as a retransmission, as
+// QUIC retransmits the lost data. Spurious retransmissions of data that was received are
+// not counted.
+type QUICTestResult struct {
+	// Number of payload bytes received
+	PayloadBytes int64
+	// Time between receiving the first and the last payload byte
+	Duration time.Duration
+	// Bytes and packets the sender sent on the wire during the transfer
+	WireBytes   int64
+	WirePackets int64
+	// Data packets the sender sent and the receiver received during the transfer
+	DataPacketsSent     int64
+	DataPacketsReceived int64
+	// RTT samples taken during the transfer
+	RTTs []time.Duration
+}
+
+// Goodput returns the achieved goodput in bps
+func (r *QUICTestResult) Goodput() int64 {
+	if r.Duration <= 0 {
+		return 0
+	}
+	return int64(float64(8*r.PayloadBytes) / r.Duration.Seconds())
+}
+
+// Overhead returns the bytes sent on the wire in excess of the payload, relative to the
+// payload. This includes the QUIC headers, acknowledgements and RTT probes in addition to
+// the retransmissions.
+func (r *QUICTestResult) Overhead() float64 {
+	if r.PayloadBytes == 0 {
+		return 0
+	}
+	return float64(r.WireBytes-r.PayloadBytes) / float64(r.PayloadBytes)
+}
+
+// Retransmissions returns the number of data packets lost during the transfer, each of
+// which QUIC had to retransmit
+func (r *QUICTestResult) Retransmissions() int64 {
+	if r.DataPacketsReceived >= r.DataPacketsSent {
+		return 0
+	}
+	return r.DataPacketsSent - r.DataPacketsReceived
+}
+
+// RetransmissionRate returns the retransmissions relative to the data packets sent
+func (r *QUICTestResult) RetransmissionRate() float64 {
+	if r.DataPacketsSent == 0 {
+		return 0
+	}
+	return float64(r.Retransmissions()) / float64(r.DataPacketsSent)
+}
+
+// Percentile returns the p-th percentile (0 <= p <= 100) of the samples, using the
+// nearest-rank method. Returns 0 if there are no samples.
+func Percentile(samples []time.Duration, p float64) time.Duration {
+	if len(samples) == 0 {
+		return 0
+	}
+	sorted := append([]time.Duration(nil), samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	rank := int(p/100*float64(len(sorted))+0.5) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	if rank >= len(sorted) {
+		rank = len(sorted) - 1
+	}
+	return sorted[rank]
+}
+
+// CountingConn wraps a net.PacketConn and counts the packets and bytes written to it, as
+// well as the data packets written and read.
+type CountingConn struct {
+	net.PacketConn
+	packets      int64
+	bytes        int64
+	dataSent     int64
+	dataReceived int64
+}
+
+// WriteTo implements net.PacketConn
+func (c *CountingConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	n, err := c.PacketConn.WriteTo(b, addr)
+	if err == nil {
+		atomic.AddInt64(&c.packets, 1)
+		atomic.AddInt64(&c.bytes, int64(n))
+		if n >= quicDataPacketSize {
+			atomic.AddInt64(&c.dataSent, 1)
+		}
+	}
+	return n, err
+}
+
+// ReadFrom implements net.PacketConn
+func (c *CountingConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(b)
+	if err == nil && n >= quicDataPacketSize {
+		atomic.AddInt64(&c.dataReceived, 1)
+	}
+	return n, addr, err
+}
+
+// Counters returns the number of packets and bytes written so far
+func (c *CountingConn) Counters() (packets, bytes int64) {
+	return atomic.LoadInt64(&c.packets), atomic.LoadInt64(&c.bytes)
+}
+
+// DataCounters returns the number of data packets written and read so far
+func (c *CountingConn) DataCounters() (sent, received int64) {
+	return atomic.LoadInt64(&c.dataSent), atomic.LoadInt64(&c.dataReceived)
+}
+
+func encodeQUICTestResult(res *QUICTestResult) ([]byte, error) {
+	var bb bytes.Buffer
+	err := gob.NewEncoder(&bb).Encode(*res)
+	return bb.Bytes(), err
+}
+
+func decodeQUICTestResult(r io.Reader) (*QUICTestResult, error) {
+	var v QUICTestResult
+	err := gob.NewDecoder(r).Decode(&v)
+	return &v, err
+}
+
+// receiveQUICData reads from the stream until EOF and measures the payload bytes received
+func receiveQUICData(stream io.Reader) (*QUICTestResult, error) {
+	buf := make([]byte, quicChunkSize)
+	var first, last time.Time
+	var total int64
+	for {
+		n, err := stream.Read(buf)
+		if n > 0 {
+			if total == 0 {
+				first = time.Now()
+			}
+			total += int64(n)
+			last = time.Now()
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &QUICTestResult{PayloadBytes: total, Duration: last.Sub(first)}, nil
+}
+
+// sendQUICData writes to the stream for the given duration and closes it
+func sendQUICData(stream quic.Stream, duration time.Duration) error {
+	buf := make([]byte, quicChunkSize)
+	_ = stream.SetWriteDeadline(time.Now().Add(duration))
+	for {
+		_, err := stream.Write(buf)
+		if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	_ = stream.SetWriteDeadline(time.Time{})
+	return stream.Close()
+}
+
+// QUICAdmitFunc decides whether the QUIC test of the client at remote may start, given
+// the challenge sent to the client and the MAC the client answered with. It returns the
+// status sent to the client, as in the server's 'N' response: StatusOK if the test is
+// admitted, StatusUnauthorized, or a wait status.
+type QUICAdmitFunc func(remote net.Addr, challenge, mac []byte) []byte
+
+// QUICSessionTimeout returns the time after which the server closes the session of a
+// test, which is enough for two transfers of maxDuration
+func QUICSessionTimeout(maxDuration time.Duration) time.Duration {
+	return 2*maxDuration + MaxRTT + StragglerWaitPeriod
+}
+
+// HandleQUICSession serves the QUIC bandwidth test of a client, until the client closes
+// the session or the session exceeds QUICSessionTimeout. The first stream of the session
+// needs to be the admission stream, on which admit decides whether the test may start.
+// conn is the connection the session's listener uses, to count the bytes sent.
+// Returns whether the test was admitted; if so, the test has ended when this returns.
+func HandleQUICSession(sess quic.Session, conn *CountingConn, maxDuration time.Duration,
+	admit QUICAdmitFunc) bool {
+
+	timer := time.AfterFunc(QUICAdmissionTimeout, func() {
+		log.Info("QUIC session timed out, closing", "remote", sess.RemoteAddr())
+		_ = sess.Close()
+	})
+	defer timer.Stop()
+
+	stream, err := sess.AcceptStream()
+	if err != nil {
+		return false
+	}
+	if err = admitQUICSession(sess, stream, admit); err != nil {
+		log.Info("QUIC test not admitted", "remote", sess.RemoteAddr(), "err", err)
+		_ = sess.Close()
+		return false
+	}
+	timer.Stop()
+	timer.Reset(QUICSessionTimeout(maxDuration))
+
+	var lastDownload QUICTestResult
+	var lastDownloadLock sync.Mutex
+	for {
+		// The data packets received are counted from before the stream is accepted, as the
+		// first packet of an upload may already contain data
+		_, received := conn.DataCounters()
+		stream, err := sess.AcceptStream()
+		if err != nil {
+			// The session was closed
+			return true
+		}
+		go func(stream quic.Stream) {
+			err := handleQUICStream(stream, conn, received, maxDuration, &lastDownload, &lastDownloadLock)
+			if err != nil {
+				log.Info("Error handling QUIC test stream", "remote", sess.RemoteAddr(), "err", err)
+				stream.CancelWrite(0)
+			}
+		}(stream)
+	}
+}
+
+// admitQUICSession runs the server side of the admission stream
+func admitQUICSession(sess quic.Session, stream quic.Stream, admit QUICAdmitFunc) error {
+	header := make([]byte, 1)
+	if _, err := io.ReadFull(stream, header); err != nil {
+		return err
+	}
+	if header[0] != QUICStreamAuth {
+		return fmt.Errorf("first stream is not the admission stream: %v", header[0])
+	}
+	challenge := make([]byte, QUICChallengeLen)
+	if _, err := rand.Read(challenge); err != nil {
+		return err
+	}
+	if _, err := stream.Write(challenge); err != nil {
+		return err
+	}
+	mac := make([]byte, RequestMACLen)
+	if _, err := io.ReadFull(stream, mac); err != nil {
+		return err
+	}
+	status := admit(sess.RemoteAddr(), challenge, mac)
+	if _, err := stream.Write(status); err != nil {
+		return err
+	}
+	if status[0] != StatusOK {
+		// Give the client the chance to read the status before the session is closed
+		_ = stream.Close()
+		time.Sleep(MaxRTT)
+		return fmt.Errorf("status %d", status[0])
+	}
+	return stream.Close()
+}
+
+// QUICWaitError is returned if the server asks the client to wait before starting a test
+type QUICWaitError struct {
+	Wait time.Duration
+}
+
+func (e *QUICWaitError) Error() string {
+	return fmt.Sprintf("server busy, retry in %v", e.Wait)
+}
+
+// AdmitQUICTest runs the client side of the admission stream, authenticating with psk if
+// it is not empty. Returns a *QUICWaitError if the server asks the client to wait.
+func AdmitQUICTest(sess quic.Session, psk []byte) error {
+	stream, err := sess.OpenStreamSync()
+	if err != nil {
+		return err
+	}
+	if _, err = stream.Write([]byte{QUICStreamAuth}); err != nil {
+		return err
+	}
+	challenge := make([]byte, QUICChallengeLen)
+	if _, err = io.ReadFull(stream, challenge); err != nil {
+		return err
+	}
+	mac := make([]byte, RequestMACLen)
+	if len(psk) > 0 {
+		mac = RequestMAC(psk, challenge)
+	}
+	if _, err = stream.Write(mac); err != nil {
+		return err
+	}
+	status, err := ioutil.ReadAll(stream)
+	if err != nil {
+		return err
+	}
+	switch {
+	case len(status) == 0:
+		return fmt.Errorf("no admission status received")
+	case status[0] == StatusOK:
+		return nil
+	case status[0] == StatusUnauthorized:
+		return fmt.Errorf("server requires authentication, check the pre-shared key")
+	}
+	wait, _, err := DecodeWaitStatus(status)
+	if err != nil {
+		return fmt.Errorf("test rejected by server")
+	}
+	return &QUICWaitError{Wait: wait}
+}
+
+// handleQUICStream serves a stream of the test, where received is the number of data
+// packets conn had received before the stream was accepted
+func handleQUICStream(stream quic.Stream, conn *CountingConn, received int64,
+	maxDuration time.Duration, lastDownload *QUICTestResult, lastDownloadLock *sync.Mutex) error {
+
+	header := make([]byte, 1)
+	if _, err := io.ReadFull(stream, header); err != nil {
+		return err
+	}
+	switch header[0] {
+	case QUICStreamUpload:
+		res, err := receiveQUICData(stream)
+		if err != nil {
+			return err
+		}
+		_, receivedAfter := conn.DataCounters()
+		res.DataPacketsReceived = receivedAfter - received
+		buf, err := encodeQUICTestResult(res)
+		if err != nil {
+			return err
+		}
+		if _, err = stream.Write(buf); err != nil {
+			return err
+		}
+		return stream.Close()
+	case QUICStreamDownload:
+		durationBuf := make([]byte, 8)
+		if _, err := io.ReadFull(stream, durationBuf); err != nil {
+			return err
+		}
+		duration := time.Duration(binary.LittleEndian.Uint64(durationBuf))
+		if duration > maxDuration {
+			duration = maxDuration
+		}
+		// Record the counters at the start of the transfer. The bytes sent are computed when
+		// the client asks for the statistics after it received all the data, so that
+		// retransmissions at the end of the transfer are included.
+		lastDownloadLock.Lock()
+		lastDownload.WirePackets, lastDownload.WireBytes = conn.Counters()
+		lastDownload.DataPacketsSent, _ = conn.DataCounters()
+		lastDownloadLock.Unlock()
+		return sendQUICData(stream, duration)
+	case QUICStreamStats:
+		packets, bytes := conn.Counters()
+		sent, _ := conn.DataCounters()
+		lastDownloadLock.Lock()
+		res := QUICTestResult{
+			WirePackets:     packets - lastDownload.WirePackets,
+			WireBytes:       bytes - lastDownload.WireBytes,
+			DataPacketsSent: sent - lastDownload.DataPacketsSent,
+		}
+		lastDownloadLock.Unlock()
+		buf, err := encodeQUICTestResult(&res)
+		if err != nil {
+			return err
+		}
+		if _, err = stream.Write(buf); err != nil {
+			return err
+		}
+		return stream.Close()
+	case QUICStreamPing:
+		_, err := io.Copy(stream, stream)
+		return err
+	default:
+		return fmt.Errorf("unknown stream type %v", header[0])
+	}
+}
+
+// quicPinger takes RTT samples by echoing timestamps over a stream
+type quicPinger struct {
+	mutex   sync.Mutex
+	samples []time.Duration
+}
+
+func startQUICPinger(sess quic.Session) (*quicPinger, error) {
+	stream, err := sess.OpenStreamSync()
+	if err != nil {
+		return nil, err
+	}
+	if _, err = stream.Write([]byte{QUICStreamPing}); err != nil {
+		return nil, err
+	}
+	p := &quicPinger{}
+	go func() {
+		ticker := time.NewTicker(QUICPingInterval)
+		defer ticker.Stop()
+		buf := make([]byte, 8)
+		for range ticker.C {
+			binary.LittleEndian.PutUint64(buf, uint64(time.Now().UnixNano()))
+			if _, err := stream.Write(buf); err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		buf := make([]byte, 8)
+		for {
+			if _, err := io.ReadFull(stream, buf); err != nil {
+				return
+			}
+			sent := time.Unix(0, int64(binary.LittleEndian.Uint64(buf)))
+			p.mutex.Lock()
+			p.samples = append(p.samples, time.Since(sent))
+			p.mutex.Unlock()
+		}
+	}()
+	return p, nil
+}
+
+// take returns the samples taken since the last call
+func (p *quicPinger) take() []time.Duration {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	samples := p.samples
+	p.samples = nil
+	return samples
+}
+
+// RunQUICTest runs a QUIC bandwidth test over the session, consisting of a client->server
+// transfer for csDuration followed by a server->client transfer for scDuration. RTT
+// samples are taken on the idle session before the transfers and during the transfers.
+// conn is the connection underlying the session, to count the packets sent and received
+// by the client.
+func RunQUICTest(sess quic.Session, conn *CountingConn, csDuration, scDuration time.Duration) (
+	idleRTTs []time.Duration, cs, sc *QUICTestResult, err error) {
+
+	pinger, err := startQUICPinger(sess)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	time.Sleep(QUICIdlePingPeriod)
+	idleRTTs = pinger.take()
+
+	// Client->server
+	packets, bytes := conn.Counters()
+	sent, _ := conn.DataCounters()
+	stream, err := sess.OpenStreamSync()
+	if err != nil {
+		return idleRTTs, nil, nil, err
+	}
+	if _, err = stream.Write([]byte{QUICStreamUpload}); err != nil {
+		return idleRTTs, nil, nil, err
+	}
+	if err = sendQUICData(stream, csDuration); err != nil {
+		return idleRTTs, nil, nil, err
+	}
+	cs, err = decodeQUICTestResult(stream)
+	if err != nil {
+		return idleRTTs, nil, nil, err
+	}
+	packetsAfter, bytesAfter := conn.Counters()
+	sentAfter, _ := conn.DataCounters()
+	cs.WirePackets, cs.WireBytes = packetsAfter-packets, bytesAfter-bytes
+	cs.DataPacketsSent = sentAfter - sent
+	cs.RTTs = pinger.take()
+
+	// Server->client
+	stream, err = sess.OpenStreamSync()
+	if err != nil {
+		return idleRTTs, cs, nil, err
+	}
+	header := make([]byte, 9)
+	header[0] = QUICStreamDownload
+	binary.LittleEndian.PutUint64(header[1:], uint64(scDuration))
+	_, received := conn.DataCounters()
+	if _, err = stream.Write(header); err != nil {
+		return idleRTTs, cs, nil, err
+	}
+	sc, err = receiveQUICData(stream)
+	if err != nil {
+		return idleRTTs, cs, nil, err
+	}
+	_, receivedAfter := conn.DataCounters()
+	sc.DataPacketsReceived = receivedAfter - received
+	sc.RTTs = pinger.take()
+
+	stream, err = sess.OpenStreamSync()
+	if err != nil {
+		return idleRTTs, cs, sc, err
+	}
+	if _, err = stream.Write([]byte{QUICStreamStats}); err != nil {
+		return idleRTTs, cs, sc, err
+	}
+	stats, err := decodeQUICTestResult(stream)
+	if err != nil {
+		return idleRTTs, cs, sc, err
+	}
+	sc.WirePackets, sc.WireBytes = stats.WirePackets, stats.WireBytes
+	sc.DataPacketsSent = stats.DataPacketsSent
+	return idleRTTs, cs, sc, nil
+}
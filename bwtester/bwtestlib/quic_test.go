@@ -0,0 +1,106 @@
+package bwtestlib
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+
+	"github.com/netsec-ethz/scion-apps/pkg/appnet/appquic"
+)
+
+// TestQUICTest runs a short QUIC test over a local (non-SCION) UDP socket
+func TestQUICTest(t *testing.T) {
+	serverUDPConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConn := &CountingConn{PacketConn: serverUDPConn}
+	tlsConf, err := appquic.GetDummyTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := quic.Listen(serverConn, tlsConf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	psks := [][]byte{[]byte("secret")}
+	admit := func(remote net.Addr, challenge, mac []byte) []byte {
+		if !VerifyRequestMAC(psks, challenge, mac) {
+			return []byte{StatusUnauthorized}
+		}
+		return []byte{StatusOK}
+	}
+	go func() {
+		for {
+			sess, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go HandleQUICSession(sess, serverConn, time.Second, admit)
+		}
+	}()
+
+	clientUDPConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientUDPConn.Close()
+	clientConn := &CountingConn{PacketConn: clientUDPConn}
+	dial := func() quic.Session {
+		sess, err := quic.Dial(clientConn, serverUDPConn.LocalAddr(), "host:0",
+			&tls.Config{InsecureSkipVerify: true}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sess
+	}
+
+	sess := dial()
+	if err := AdmitQUICTest(sess, []byte("wrong")); err == nil {
+		t.Error("expected test with wrong key to be rejected")
+	}
+	sess.Close()
+
+	sess = dial()
+	defer sess.Close()
+	if err := AdmitQUICTest(sess, psks[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	idleRTTs, cs, sc, err := RunQUICTest(sess, clientConn, 200*time.Millisecond, 200*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(idleRTTs) == 0 {
+		t.Error("no idle RTT samples")
+	}
+	for name, res := range map[string]*QUICTestResult{"cs": cs, "sc": sc} {
+		if res.PayloadBytes == 0 || res.Goodput() == 0 {
+			t.Errorf("%s: no payload received: %+v", name, res)
+		}
+		if res.WireBytes < res.PayloadBytes || res.WirePackets == 0 {
+			t.Errorf("%s: fewer bytes on the wire than payload: %+v", name, res)
+		}
+		if res.DataPacketsSent == 0 || res.DataPacketsReceived == 0 ||
+			res.DataPacketsReceived > res.DataPacketsSent {
+			t.Errorf("%s: unexpected data packet counts: %+v", name, res)
+		}
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	samples := []time.Duration{5, 1, 4, 2, 3, 6, 7, 8, 9, 10}
+	cases := map[float64]time.Duration{0: 1, 10: 1, 50: 5, 90: 9, 100: 10}
+	for p, expected := range cases {
+		if actual := Percentile(samples, p); actual != expected {
+			t.Errorf("percentile %v: expected %v, got %v", p, expected, actual)
+		}
+	}
+	if Percentile(nil, 50) != 0 {
+		t.Error("expected 0 for no samples")
+	}
+}
@@ -7,18 +7,23 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/binary"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
 	log "github.com/inconshreveable/log15"
 	"github.com/kormat/fmt15"
+	"github.com/lucas-clemente/quic-go"
 
 	. "github.com/netsec-ethz/scion-apps/bwtester/bwtestlib"
 	"github.com/netsec-ethz/scion-apps/pkg/appnet"
+	"github.com/netsec-ethz/scion-apps/pkg/appnet/appquic"
 	"github.com/scionproto/scion/go/lib/addr"
 	"github.com/scionproto/scion/go/lib/snet"
 )
@@ -26,9 +31,25 @@ import (
 var (
 	resultsMap     map[string]*BwtestResult
 	resultsMapLock sync.Mutex
-	currentBwtest  string // Contains connection parameters, in case server's ack packet was lost
+	// Contains connection parameters of the ongoing tests, in case server's ack packet was lost.
+	// Several tests can run concurrently only if they are part of a multipath test, i.e. if
+	// they originate from the same client host.
+	currentBwtests    map[string]bool
+	currentClientHost string
+	// Whether a QUIC test is running, and when it will be finished at the latest. QUIC
+	// tests run exclusively, not concurrently with any other test.
+	quicTestRunning    bool
+	quicTestFinishTime time.Time
+	// Protects currentBwtests, currentClientHost and the state of the QUIC test
+	currentBwtestsLock sync.Mutex
 )
 
+// clientHost identifies the client host (ISD-AS and IP) of a control channel address,
+// ignoring the port.
+func clientHost(a *snet.UDPAddr) string {
+	return fmt.Sprintf("%s,[%s]", a.IA, a.Host.IP)
+}
+
 // Deletes the old entries in resultsMap
 func purgeOldResults() {
 	for {
@@ -47,10 +68,17 @@ func purgeOldResults() {
 
 func main() {
 	resultsMap = make(map[string]*BwtestResult)
+	currentBwtests = make(map[string]bool)
 	go purgeOldResults()
 
 	// Fetch arguments from command line
 	serverPort := flag.Uint("p", 40002, "Port")
+	maxDuration := flag.Duration("maxDuration", MaxDuration, "Maximum duration of a bandwidth test")
+	pskFile := flag.String("pskFile", "",
+		"File with pre-shared keys, one per line. If set, only clients knowing one of the keys are served")
+	iaLimit := flag.Int("iaLimit", 0, "Maximum number of tests per ISD-AS within iaLimitInterval, 0 for no limit")
+	iaLimitInterval := flag.Duration("iaLimitInterval", time.Hour, "Interval for the per ISD-AS rate limit")
+	quicTests := flag.Bool("quic", true, "Serve QUIC throughput tests on the port p+"+fmt.Sprint(QUICPortOffset))
 	id := flag.String("id", "bwtester", "Element ID")
 	logDir := flag.String("log_dir", "./logs", "Log directory")
 
@@ -70,26 +98,152 @@ func main() {
 			log.Must.FileHandler(fmt.Sprintf("%s/%s.log", *logDir, *id),
 				fmt15.Fmt15Format(nil)))))
 
-	err := runServer(uint16(*serverPort))
+	cookies, err := NewCookieJar()
+	if err != nil {
+		LogFatal("Unable to create cookie secret", "err", err)
+	}
+	conf := &serverConfig{
+		maxDuration: *maxDuration,
+		quic:        *quicTests,
+		rateLimiter: NewIARateLimiter(*iaLimit, *iaLimitInterval),
+		cookies:     cookies,
+	}
+	if *pskFile != "" {
+		conf.psks, err = loadPSKs(*pskFile)
+		if err != nil {
+			LogFatal("Unable to load pre-shared keys", "err", err)
+		}
+	}
+
+	err = runServer(uint16(*serverPort), conf)
 	if err != nil {
 		LogFatal("Unable to start server", "err", err)
 	}
 }
 
-func runServer(port uint16) error {
+// serverConfig contains the limits and the authentication settings of the server
+type serverConfig struct {
+	maxDuration time.Duration
+	// Serve QUIC throughput tests
+	quic bool
+	// Pre-shared keys, if empty, clients are not authenticated
+	psks        [][]byte
+	rateLimiter *IARateLimiter
+	cookies     *CookieJar
+}
+
+// loadPSKs reads the pre-shared keys from a file, one key per line. Empty lines and lines
+// starting with # are ignored.
+func loadPSKs(path string) ([][]byte, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var psks [][]byte
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		psks = append(psks, []byte(line))
+	}
+	if len(psks) == 0 {
+		return nil, fmt.Errorf("no keys found in %s", path)
+	}
+	return psks, nil
+}
+
+func runServer(port uint16, conf *serverConfig) error {
 
 	conn, err := appnet.ListenPort(port)
 	if err != nil {
 		return err
 	}
 
+	if conf.quic {
+		go func() {
+			err := runQUICServer(port+QUICPortOffset, conf)
+			if err != nil {
+				LogFatal("Unable to run QUIC server", "err", err)
+			}
+		}()
+	}
+
 	receivePacketBuffer := make([]byte, 2500)
 	sendPacketBuffer := make([]byte, 2500)
-	handleClients(conn, receivePacketBuffer, sendPacketBuffer)
+	handleClients(conn, receivePacketBuffer, sendPacketBuffer, conf)
 	return nil
 }
 
-func handleClients(CCConn snet.Conn, receivePacketBuffer []byte, sendPacketBuffer []byte) {
+// runQUICServer accepts QUIC throughput tests. The tests are admitted like the tests on
+// the control channel, and are run one at a time, exclusively of the other tests, so that
+// they do not bias each other.
+func runQUICServer(port uint16, conf *serverConfig) error {
+	sconn, err := appnet.ListenPort(port)
+	if err != nil {
+		return err
+	}
+	conn := &CountingConn{PacketConn: sconn}
+	tlsConf, err := appquic.GetDummyTLSConfig()
+	if err != nil {
+		return err
+	}
+	listener, err := quic.Listen(conn, tlsConf, &quic.Config{KeepAlive: true})
+	if err != nil {
+		return err
+	}
+	for {
+		sess, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		fmt.Println("Received QUIC test request:", sess.RemoteAddr())
+		go func() {
+			if HandleQUICSession(sess, conn, conf.maxDuration, conf.admitQUICTest) {
+				currentBwtestsLock.Lock()
+				quicTestRunning = false
+				currentBwtestsLock.Unlock()
+			}
+		}()
+	}
+}
+
+// admitQUICTest checks the authentication, the ongoing tests and the rate limit of the
+// client, like the 'N' request on the control channel. The handshake of the QUIC session
+// has already shown that the client can receive at its address.
+func (conf *serverConfig) admitQUICTest(remote net.Addr, challenge, mac []byte) []byte {
+	currentBwtestsLock.Lock()
+	defer currentBwtestsLock.Unlock()
+
+	if len(conf.psks) > 0 && !VerifyRequestMAC(conf.psks, challenge, mac) {
+		fmt.Println("Error, QUIC test not authenticated")
+		return []byte{StatusUnauthorized}
+	}
+	t := time.Now()
+	updateCurrentBwtests(t)
+	if quicTestRunning || len(currentBwtests) != 0 {
+		fmt.Println("A bwtest is already ongoing")
+		status := make([]byte, 5)
+		l := EncodeWaitStatus(remainingTestTime(t)+time.Second, status)
+		return status[:l]
+	}
+	ia := remote.String()
+	if a, ok := remote.(*snet.UDPAddr); ok {
+		ia = a.IA.String()
+	}
+	if ok, wait := conf.rateLimiter.Allow(ia, t); !ok {
+		fmt.Println("Rate limit exceeded for", ia)
+		status := make([]byte, 5)
+		l := EncodeWaitStatus(wait, status)
+		return status[:l]
+	}
+	quicTestRunning = true
+	quicTestFinishTime = t.Add(QUICSessionTimeout(conf.maxDuration))
+	return []byte{StatusOK}
+}
+
+func handleClients(CCConn snet.Conn, receivePacketBuffer []byte, sendPacketBuffer []byte,
+	conf *serverConfig) {
 
 	for {
 		// Handle client requests
@@ -103,174 +257,265 @@ func handleClients(CCConn snet.Conn, receivePacketBuffer []byte, sendPacketBuffe
 			continue
 		}
 
-		t := time.Now()
-		// Check if a current test is ongoing, and if it completed
-		if len(currentBwtest) > 0 {
-			v, ok := resultsMap[currentBwtest]
-			if !ok {
-				// This can only happen if client aborted and never picked up results
-				// then information got removed by purgeOldResults goroutine
-				currentBwtest = ""
-			} else if t.After(v.ExpectedFinishTime) {
-				// The bwtest should be finished by now, check if results are written
-				if v.NumPacketsReceived >= 0 {
-					// Indeed, the bwtest has completed
-					currentBwtest = ""
-				}
-			}
-		}
-		clientCCAddrStr := clientCCAddr.String()
-		fmt.Println("Received request:", clientCCAddrStr)
-
-		if receivePacketBuffer[0] == 'N' {
-			// New bwtest request
-			if len(currentBwtest) != 0 {
-				fmt.Println("A bwtest is already ongoing")
-				if clientCCAddrStr == currentBwtest {
-					// The request is from the same client for which the current test is already ongoing
-					// If the response packet was dropped, then the client would send another request
-					// We simply send another response packet, indicating success
-					fmt.Println("error, clientCCAddrStr == currentBwtest")
-					sendPacketBuffer[0] = 'N'
-					sendPacketBuffer[1] = byte(0)
-					_, _ = CCConn.WriteTo(sendPacketBuffer[:2], clientCCAddr)
-					// Ignore error
-					continue
-				}
-
-				// The request is from a different client
-				// A bwtest is currently ongoing, so send back remaining duration
-				resultsMapLock.Lock()
-				v, ok := resultsMap[currentBwtest]
-				if !ok {
-					// This should never happen
-					resultsMapLock.Unlock()
-					continue
-				}
-				resultsMapLock.Unlock()
-
-				// Compute for how much longer the current test is running
-				remTime := t.Sub(v.ExpectedFinishTime)
-				sendPacketBuffer[0] = 'N'
-				sendPacketBuffer[1] = byte(remTime/time.Second) + 1
-				_, _ = CCConn.WriteTo(sendPacketBuffer[:2], clientCCAddr)
-				// Ignore error
-				continue
-			}
+		// Handle the request with the state of the current tests locked, as it is shared
+		// with the QUIC tests
+		currentBwtestsLock.Lock()
+		handleRequest(CCConn, receivePacketBuffer[:n], clientCCAddr, sendPacketBuffer, conf)
+		currentBwtestsLock.Unlock()
+	}
+}
 
-			// This is a new request
-			clientBwp, n1, err := DecodeBwtestParameters(receivePacketBuffer[1:])
-			if err != nil {
-				fmt.Println("Decoding error")
-				// Decoding error, continue
-				continue
-			}
-			serverBwp, n2, err := DecodeBwtestParameters(receivePacketBuffer[n1+1:])
-			if err != nil {
-				fmt.Println("Decoding error")
-				// Decoding error, continue
-				continue
-			}
-			if n != 1+n1+n2 {
-				fmt.Println("Error, packet size incorrect")
-				// Do not send a response packet for malformed request
-				continue
-			}
+// handleRequest handles a request received on the control channel, must be called with
+// currentBwtestsLock held
+func handleRequest(CCConn snet.Conn, receivePacketBuffer []byte, clientCCAddr *snet.UDPAddr,
+	sendPacketBuffer []byte, conf *serverConfig) {
 
-			// Address of client Data Connection (DC)
-			clientDCAddr := copySnetUDPAddr(clientCCAddr)
-			clientDCAddr.Host.Port = int(clientBwp.Port)
+	n := len(receivePacketBuffer)
+	t := time.Now()
+	updateCurrentBwtests(t)
+	clientCCAddrStr := clientCCAddr.String()
+	fmt.Println("Received request:", clientCCAddrStr)
 
-			// Address of server Data Connection (DC)
-			serverCCAddr := CCConn.LocalAddr().(*net.UDPAddr)
-			serverDCAddr := &net.UDPAddr{IP: serverCCAddr.IP, Port: int(serverBwp.Port)}
+	if receivePacketBuffer[0] == 'N' {
+		// New bwtest request
+		if currentBwtests[clientCCAddrStr] {
+			// The request is from the same client for which the current test is already ongoing
+			// If the response packet was dropped, then the client would send another request
+			// We simply send another response packet, indicating success
+			fmt.Println("A bwtest is already ongoing for this client")
+			sendPacketBuffer[0] = 'N'
+			sendPacketBuffer[1] = StatusOK
+			_, _ = CCConn.WriteTo(sendPacketBuffer[:2], clientCCAddr)
+			// Ignore error
+			return
+		}
+		if quicTestRunning || (len(currentBwtests) != 0 &&
+			(clientHost(clientCCAddr) != currentClientHost || len(currentBwtests) >= MaxMultipathSessions)) {
+			// The request is from a different client, or the client has already reached the maximum
+			// number of concurrent tests, or a QUIC test is running.
+			// A bwtest is currently ongoing, so send back remaining duration
+			fmt.Println("A bwtest is already ongoing")
+			remTime := remainingTestTime(t)
 
-			// Open Data Connection
-			DCConn, err := appnet.DefNetwork().Dial(
-				context.TODO(), "udp", serverDCAddr, clientDCAddr, addr.SvcNone)
-			if err != nil {
-				// An error happened, ask the client to try again in 1 second
+			// Compute for how much longer the current tests are running
+			sendPacketBuffer[0] = 'N'
+			l := EncodeWaitStatus(remTime+time.Second, sendPacketBuffer[1:])
+			_, _ = CCConn.WriteTo(sendPacketBuffer[:1+l], clientCCAddr)
+			// Ignore error
+			return
+		}
+
+		// This is a new request
+		clientBwp, n1, err := DecodeBwtestParameters(receivePacketBuffer[1:])
+		if err != nil {
+			fmt.Println("Decoding error")
+			// Decoding error, ignore the request
+			return
+		}
+		serverBwp, n2, err := DecodeBwtestParameters(receivePacketBuffer[n1+1:])
+		if err != nil {
+			fmt.Println("Decoding error")
+			// Decoding error, ignore the request
+			return
+		}
+		l := 1 + n1 + n2
+		if n == l {
+			// No cookie, the client first needs to prove that it can receive at its address.
+			// The response is smaller than the request, so it can not be abused for amplification.
+			sendPacketBuffer[0] = 'N'
+			sendPacketBuffer[1] = StatusCookie
+			copy(sendPacketBuffer[2:], conf.cookies.Create(clientCCAddrStr, clientBwp.Port, t))
+			_, _ = CCConn.WriteTo(sendPacketBuffer[:2+CookieLen], clientCCAddr)
+			// Ignore error
+			return
+		}
+		macLen := 0
+		if len(conf.psks) > 0 {
+			macLen = RequestMACLen
+		}
+		if n != l+CookieLen+macLen {
+			fmt.Println("Error, packet size incorrect")
+			// Do not send a response packet for malformed request
+			return
+		}
+		if !conf.cookies.Verify(receivePacketBuffer[l:l+CookieLen], clientCCAddrStr, clientBwp.Port, t) {
+			fmt.Println("Invalid or expired cookie")
+			// Hand out a fresh cookie, the old one might just have expired
+			sendPacketBuffer[0] = 'N'
+			sendPacketBuffer[1] = StatusCookie
+			copy(sendPacketBuffer[2:], conf.cookies.Create(clientCCAddrStr, clientBwp.Port, t))
+			_, _ = CCConn.WriteTo(sendPacketBuffer[:2+CookieLen], clientCCAddr)
+			// Ignore error
+			return
+		}
+		l += CookieLen
+		if macLen > 0 && !VerifyRequestMAC(conf.psks, receivePacketBuffer[:l], receivePacketBuffer[l:n]) {
+			fmt.Println("Error, request not authenticated")
+			sendPacketBuffer[0] = 'N'
+			sendPacketBuffer[1] = StatusUnauthorized
+			_, _ = CCConn.WriteTo(sendPacketBuffer[:2], clientCCAddr)
+			// Ignore error
+			return
+		}
+		if clientBwp.BwtestDuration > conf.maxDuration || serverBwp.BwtestDuration > conf.maxDuration {
+			fmt.Println("Error, requested duration exceeds maximum duration", conf.maxDuration)
+			// Reject the request and tell the client about the maximum duration
+			sendPacketBuffer[0] = 'N'
+			sendPacketBuffer[1] = StatusError
+			binary.LittleEndian.PutUint32(sendPacketBuffer[2:], uint32(conf.maxDuration/time.Second))
+			_, _ = CCConn.WriteTo(sendPacketBuffer[:6], clientCCAddr)
+			// Ignore error
+			return
+		}
+		// A multipath test is charged once, for its first session. The other sessions join
+		// the ongoing test of the same client host, so that they are not asked to wait
+		// while their siblings run.
+		if len(currentBwtests) == 0 {
+			if ok, wait := conf.rateLimiter.Allow(clientCCAddr.IA.String(), t); !ok {
+				fmt.Println("Rate limit exceeded for", clientCCAddr.IA)
 				sendPacketBuffer[0] = 'N'
-				sendPacketBuffer[1] = byte(1)
-				_, _ = CCConn.WriteTo(sendPacketBuffer[:2], clientCCAddr)
+				l := EncodeWaitStatus(wait, sendPacketBuffer[1:])
+				_, _ = CCConn.WriteTo(sendPacketBuffer[:1+l], clientCCAddr)
 				// Ignore error
-				continue
+				return
 			}
+		}
 
-			// Nothing needs to be added to account for network delay, since sending starts right away
-			expFinishTimeSend := t.Add(serverBwp.BwtestDuration + GracePeriodSend)
-			expFinishTimeReceive := t.Add(clientBwp.BwtestDuration + StragglerWaitPeriod)
-			// We use resultsMapLock also for the bres variable
-			bres := BwtestResult{
-				NumPacketsReceived: -1,
-				CorrectlyReceived:  -1,
-				IPAvar:             -1,
-				IPAmin:             -1,
-				IPAavg:             -1,
-				IPAmax:             -1,
-				PrgKey:             clientBwp.PrgKey,
-				ExpectedFinishTime: expFinishTimeReceive,
-			}
-			if expFinishTimeReceive.Before(expFinishTimeSend) {
-				// The receiver will close the DC connection, so it will wait long enough until the
-				// sender is also done
-				bres.ExpectedFinishTime = expFinishTimeSend
-			}
-			resultsMapLock.Lock()
-			resultsMap[clientCCAddrStr] = &bres
-			resultsMapLock.Unlock()
+		// Address of client Data Connection (DC)
+		clientDCAddr := copySnetUDPAddr(clientCCAddr)
+		clientDCAddr.Host.Port = int(clientBwp.Port)
 
-			// go HandleDCConnReceive(clientBwp, DCConn, resChan)
-			go HandleDCConnReceive(clientBwp, DCConn, &bres, &resultsMapLock, nil)
-			go HandleDCConnSend(serverBwp, DCConn)
+		// Address of server Data Connection (DC)
+		serverCCAddr := CCConn.LocalAddr().(*net.UDPAddr)
+		serverDCAddr := &net.UDPAddr{IP: serverCCAddr.IP, Port: int(serverBwp.Port)}
 
-			// Send back success
+		// Open Data Connection
+		DCConn, err := appnet.DefNetwork().Dial(
+			context.TODO(), "udp", serverDCAddr, clientDCAddr, addr.SvcNone)
+		if err != nil {
+			// An error happened, ask the client to try again in 1 second
 			sendPacketBuffer[0] = 'N'
-			sendPacketBuffer[1] = byte(0)
+			sendPacketBuffer[1] = byte(1)
 			_, _ = CCConn.WriteTo(sendPacketBuffer[:2], clientCCAddr)
 			// Ignore error
-			// Everything succeeded, now set variable that bwtest is ongoing
-			currentBwtest = clientCCAddrStr
-		} else if receivePacketBuffer[0] == 'R' {
-			// This is a request for the results
-			sendPacketBuffer[0] = 'R'
-			// Make sure that the client is known and that the results are ready
-			v, ok := resultsMap[clientCCAddrStr]
-			if !ok {
-				// There are no results for this client, return an error
-				sendPacketBuffer[1] = byte(127)
-				_, _ = CCConn.WriteTo(sendPacketBuffer[:2], clientCCAddr)
-				continue
-			}
-			// Make sure the PRG key is correct
-			if n != 1+len(v.PrgKey) || !bytes.Equal(v.PrgKey, receivePacketBuffer[1:1+len(v.PrgKey)]) {
-				// Error, the sent PRG is incorrect
-				sendPacketBuffer[1] = byte(127)
-				_, _ = CCConn.WriteTo(sendPacketBuffer[:2], clientCCAddr)
-				continue
-			}
-			// Note: it would be better to have the resultsMap key consist only of the PRG key,
-			// so that a repeated bwtest from the same client with the same port gets a
-			// different resultsMap entry. However, in practice, a client would not run concurrent
-			// bwtests, as long as the results are fetched before a new bwtest is initiated, this
-			// code will work fine.
-			if v.NumPacketsReceived == -1 {
-				// The results are not yet ready
-				if t.After(v.ExpectedFinishTime) {
-					// The results should be ready, but are not yet written into the data
-					// structure, so let's let client wait for 1 second
-					sendPacketBuffer[1] = byte(1)
-				} else {
-					sendPacketBuffer[1] = byte(v.ExpectedFinishTime.Sub(t)/time.Second) + 1
-				}
-				_, _ = CCConn.WriteTo(sendPacketBuffer[:n], clientCCAddr)
-				continue
+			return
+		}
+
+		// Nothing needs to be added to account for network delay, since sending starts right away
+		expFinishTimeSend := t.Add(serverBwp.BwtestDuration + GracePeriodSend)
+		expFinishTimeReceive := t.Add(clientBwp.BwtestDuration + StragglerWaitPeriod)
+		// We use resultsMapLock also for the bres variable
+		bres := BwtestResult{
+			NumPacketsReceived: -1,
+			CorrectlyReceived:  -1,
+			IPAvar:             -1,
+			IPAmin:             -1,
+			IPAavg:             -1,
+			IPAmax:             -1,
+			PrgKey:             clientBwp.PrgKey,
+			ExpectedFinishTime: expFinishTimeReceive,
+		}
+		if expFinishTimeReceive.Before(expFinishTimeSend) {
+			// The receiver will close the DC connection, so it will wait long enough until the
+			// sender is also done
+			bres.ExpectedFinishTime = expFinishTimeSend
+		}
+		resultsMapLock.Lock()
+		resultsMap[clientCCAddrStr] = &bres
+		resultsMapLock.Unlock()
+
+		if clientBwp.Echo {
+			go HandleDCConnEcho(clientBwp, DCConn, &bres, &resultsMapLock)
+		} else {
+			go HandleDCConnReceive(clientBwp, DCConn, &bres, &resultsMapLock, nil)
+			go HandleDCConnSend(serverBwp, DCConn)
+		}
+
+		// Send back success
+		sendPacketBuffer[0] = 'N'
+		sendPacketBuffer[1] = StatusOK
+		_, _ = CCConn.WriteTo(sendPacketBuffer[:2], clientCCAddr)
+		// Ignore error
+		// Everything succeeded, now record that bwtest is ongoing
+		currentBwtests[clientCCAddrStr] = true
+		currentClientHost = clientHost(clientCCAddr)
+	} else if receivePacketBuffer[0] == 'R' {
+		// This is a request for the results
+		sendPacketBuffer[0] = 'R'
+		// Make sure that the client is known and that the results are ready
+		v, ok := resultsMap[clientCCAddrStr]
+		if !ok {
+			// There are no results for this client, return an error
+			sendPacketBuffer[1] = StatusError
+			_, _ = CCConn.WriteTo(sendPacketBuffer[:2], clientCCAddr)
+			return
+		}
+		// Make sure the PRG key is correct
+		if n != 1+len(v.PrgKey) || !bytes.Equal(v.PrgKey, receivePacketBuffer[1:1+len(v.PrgKey)]) {
+			// Error, the sent PRG is incorrect
+			sendPacketBuffer[1] = StatusError
+			_, _ = CCConn.WriteTo(sendPacketBuffer[:2], clientCCAddr)
+			return
+		}
+		// Note: it would be better to have the resultsMap key consist only of the PRG key,
+		// so that a repeated bwtest from the same client with the same port gets a
+		// different resultsMap entry. However, in practice, a client would not run concurrent
+		// bwtests, as long as the results are fetched before a new bwtest is initiated, this
+		// code will work fine.
+		if v.NumPacketsReceived == -1 {
+			// The results are not yet ready
+			// If the results should be ready, but are not yet written into the data
+			// structure, the client waits for 1 second
+			l := EncodeWaitStatus(v.ExpectedFinishTime.Sub(t), sendPacketBuffer[1:])
+			_, _ = CCConn.WriteTo(sendPacketBuffer[:1+l], clientCCAddr)
+			return
+		}
+		sendPacketBuffer[1] = StatusOK
+		n = EncodeBwtestResult(v, sendPacketBuffer[2:])
+		_, _ = CCConn.WriteTo(sendPacketBuffer[:n+2], clientCCAddr)
+	}
+}
+
+// updateCurrentBwtests removes the completed tests from currentBwtests, must be called
+// with currentBwtestsLock held
+func updateCurrentBwtests(t time.Time) {
+	// Check if the current tests are ongoing, and if they completed
+	resultsMapLock.Lock()
+	for k := range currentBwtests {
+		v, ok := resultsMap[k]
+		if !ok {
+			// This can only happen if client aborted and never picked up results
+			// then information got removed by purgeOldResults goroutine
+			delete(currentBwtests, k)
+		} else if t.After(v.ExpectedFinishTime) {
+			// The bwtest should be finished by now, check if results are written
+			if v.NumPacketsReceived >= 0 {
+				// Indeed, the bwtest has completed
+				delete(currentBwtests, k)
 			}
-			sendPacketBuffer[1] = byte(0)
-			n = EncodeBwtestResult(v, sendPacketBuffer[2:])
-			_, _ = CCConn.WriteTo(sendPacketBuffer[:n+2], clientCCAddr)
 		}
 	}
+	resultsMapLock.Unlock()
+	if len(currentBwtests) == 0 {
+		currentClientHost = ""
+	}
+}
+
+// remainingTestTime returns for how much longer the current tests are running, must be
+// called with currentBwtestsLock held
+func remainingTestTime(t time.Time) time.Duration {
+	var remTime time.Duration
+	if quicTestRunning {
+		remTime = quicTestFinishTime.Sub(t)
+	}
+	resultsMapLock.Lock()
+	for k := range currentBwtests {
+		if v, ok := resultsMap[k]; ok && v.ExpectedFinishTime.Sub(t) > remTime {
+			remTime = v.ExpectedFinishTime.Sub(t)
+		}
+	}
+	resultsMapLock.Unlock()
+	return remTime
 }
 
 // XXX(matzf) I assume a Copy() function will be added to snet.UDPAddr
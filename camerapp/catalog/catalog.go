@@ -0,0 +1,241 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package catalog implements the listing messages of the camerapp, describing the images
+// available on the imageserver.
+//
+// The most recent image is listed with the latest message. The catalog of all images is
+// requested in pages, each fitting into a single packet. Integers are in little endian,
+// like the other camerapp messages.
+//
+//	Latest request:   'L'
+//	Latest response:  'L', entry
+//	Catalog request:  'C', uint32 index of the first entry, zero padding to
+//	                  CatalogRequestSize bytes
+//	Catalog response: 'C', uint32 total number of entries, uint32 index of the first
+//	                  entry, uint8 number of entries, entries
+//	Entry:            uint8 name length, name, uint32 size, int64 capture time in
+//	                  nanoseconds since the Unix epoch, 32 bytes hash of the image,
+//	                  uint8 signature length, signature
+//
+// The hash of an image is the root of its SHA-256 hash tree, see Hash. It allows the
+// client to check each block of the image as it arrives.
+//
+// The catalog entries are ordered by capture time, oldest first.
+//
+// Catalog requests are padded to a quarter of MaxPageSize, so that the server can not be
+// abused to reflect a large amount of traffic to a spoofed address.
+//
+// If the server has a signing key, the signature is the Ed25519 signature of the entry,
+// see Entry.Sign; otherwise it is empty.
+package catalog
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/netsec-ethz/scion-apps/pkg/blocktransfer"
+)
+
+// Commands, the first byte of requests and responses
+const (
+	CommandLatest  byte = 'L'
+	CommandCatalog byte = 'C'
+)
+
+const (
+	// MaxNameLength is the maximum length of image names
+	MaxNameLength = 255
+	// MaxPageSize is the maximum size of a response, chosen to fit into a single packet
+	// on any path
+	MaxPageSize = 1200
+	// CatalogRequestSize is the minimum size of a catalog request, which is padded so that
+	// a page is at most 4 times the size of the request
+	CatalogRequestSize = MaxPageSize / 4
+
+	requestSize        = 1 + 4
+	responseHeaderSize = 1 + 4 + 4 + 1
+	entryFixedSize     = 1 + 4 + 8 + sha256.Size + 1
+)
+
+var errInvalidMessage = errors.New("invalid catalog message")
+
+// Hash returns the hash of an image, the root of its hash tree as defined by
+// blocktransfer.HashTree
+func Hash(content []byte) [sha256.Size]byte {
+	return blocktransfer.RootHash(content)
+}
+
+// Entry describes an image
+type Entry struct {
+	Name        string
+	Size        uint32
+	CaptureTime time.Time
+	Hash        [sha256.Size]byte
+	Signature   []byte
+}
+
+// Page is a part of the catalog, starting at entry Start
+type Page struct {
+	Total   int
+	Start   int
+	Entries []Entry
+}
+
+// Sort orders the entries by capture time, oldest first, and by name for equal times
+func Sort(entries []Entry) {
+	sort.Slice(entries, func(i, j int) bool {
+		if !entries[i].CaptureTime.Equal(entries[j].CaptureTime) {
+			return entries[i].CaptureTime.Before(entries[j].CaptureTime)
+		}
+		return entries[i].Name < entries[j].Name
+	})
+}
+
+// MarshalCatalogRequest returns a request for the page of the catalog starting at entry start
+func MarshalCatalogRequest(start int) []byte {
+	b := make([]byte, CatalogRequestSize)
+	b[0] = CommandCatalog
+	binary.LittleEndian.PutUint32(b[1:], uint32(start))
+	return b
+}
+
+// ParseCatalogRequest returns the index of the first entry requested. Requests that are
+// not padded to CatalogRequestSize are rejected.
+func ParseCatalogRequest(b []byte) (int, error) {
+	if len(b) < CatalogRequestSize || b[0] != CommandCatalog {
+		return 0, errInvalidMessage
+	}
+	return int(binary.LittleEndian.Uint32(b[1:])), nil
+}
+
+// MarshalPage returns the response with as many of the sorted entries as fit into
+// MaxPageSize, starting at entry start. A start beyond the end results in an empty page.
+func MarshalPage(entries []Entry, start int) []byte {
+	b := make([]byte, responseHeaderSize, MaxPageSize)
+	b[0] = CommandCatalog
+	binary.LittleEndian.PutUint32(b[1:], uint32(len(entries)))
+	binary.LittleEndian.PutUint32(b[5:], uint32(start))
+	n := 0
+	for i := start; i < len(entries) && n < 255; i++ {
+		e := &entries[i]
+		if !e.valid() || len(b)+e.size() > MaxPageSize {
+			break
+		}
+		b = e.append(b)
+		n++
+	}
+	b[9] = byte(n)
+	return b
+}
+
+// ParsePage parses a catalog response
+func ParsePage(b []byte) (*Page, error) {
+	if len(b) < responseHeaderSize || b[0] != CommandCatalog {
+		return nil, errInvalidMessage
+	}
+	page := &Page{
+		Total:   int(binary.LittleEndian.Uint32(b[1:])),
+		Start:   int(binary.LittleEndian.Uint32(b[5:])),
+		Entries: make([]Entry, b[9]),
+	}
+	rest := b[responseHeaderSize:]
+	for i := range page.Entries {
+		var err error
+		if rest, err = page.Entries[i].parse(rest); err != nil {
+			return nil, err
+		}
+	}
+	if len(rest) != 0 {
+		return nil, errInvalidMessage
+	}
+	return page, nil
+}
+
+// MarshalLatestRequest returns a request for the most recent image
+func MarshalLatestRequest() []byte {
+	return []byte{CommandLatest}
+}
+
+// MarshalLatest returns the response listing the most recent image
+func MarshalLatest(e *Entry) ([]byte, error) {
+	if !e.valid() {
+		return nil, errInvalidMessage
+	}
+	return e.append([]byte{CommandLatest}), nil
+}
+
+// ParseLatest parses the response listing the most recent image
+func ParseLatest(b []byte) (*Entry, error) {
+	if len(b) < 1 || b[0] != CommandLatest {
+		return nil, errInvalidMessage
+	}
+	var e Entry
+	rest, err := e.parse(b[1:])
+	if err != nil || len(rest) != 0 {
+		return nil, errInvalidMessage
+	}
+	return &e, nil
+}
+
+func (e *Entry) valid() bool {
+	return len(e.Name) <= MaxNameLength && len(e.Signature) <= 255
+}
+
+// size returns the size of the encoded entry
+func (e *Entry) size() int {
+	return entryFixedSize + len(e.Name) + len(e.Signature)
+}
+
+// appendFields appends the encoding of the entry without the signature
+func (e *Entry) appendFields(b []byte) []byte {
+	b = append(b, byte(len(e.Name)))
+	b = append(b, e.Name...)
+	b = append(b, make([]byte, 12)...)
+	binary.LittleEndian.PutUint32(b[len(b)-12:], e.Size)
+	binary.LittleEndian.PutUint64(b[len(b)-8:], uint64(e.CaptureTime.UnixNano()))
+	return append(b, e.Hash[:]...)
+}
+
+func (e *Entry) append(b []byte) []byte {
+	b = e.appendFields(b)
+	b = append(b, byte(len(e.Signature)))
+	return append(b, e.Signature...)
+}
+
+// parse decodes an entry from b and returns the rest of b
+func (e *Entry) parse(b []byte) ([]byte, error) {
+	if len(b) < entryFixedSize || len(b) < entryFixedSize+int(b[0]) {
+		return nil, errInvalidMessage
+	}
+	nameLen := int(b[0])
+	e.Name = string(b[1 : 1+nameLen])
+	b = b[1+nameLen:]
+	e.Size = binary.LittleEndian.Uint32(b)
+	e.CaptureTime = time.Unix(0, int64(binary.LittleEndian.Uint64(b[4:])))
+	copy(e.Hash[:], b[12:])
+	b = b[12+sha256.Size:]
+	sigLen := int(b[0])
+	if len(b) < 1+sigLen {
+		return nil, errInvalidMessage
+	}
+	e.Signature = nil
+	if sigLen > 0 {
+		e.Signature = append([]byte(nil), b[1:1+sigLen]...)
+	}
+	return b[1+sigLen:], nil
+}
@@ -0,0 +1,179 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package catalog
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPages(t *testing.T) {
+	base := time.Unix(1600000000, 123)
+	var entries []Entry
+	for i := 0; i < 100; i++ {
+		name := fmt.Sprintf("image-%03d.jpg", i)
+		entries = append(entries, Entry{
+			Name:        name,
+			Size:        uint32(1000 * i),
+			CaptureTime: base.Add(time.Duration(100-i) * time.Second),
+			Hash:        sha256.Sum256([]byte(name)),
+		})
+	}
+	Sort(entries)
+	if entries[0].Name != "image-099.jpg" {
+		t.Fatalf("Expected oldest entry first, got %s", entries[0].Name)
+	}
+
+	// Fetching all pages returns all entries in order
+	var listed []Entry
+	for start := 0; start < len(entries); {
+		request := MarshalCatalogRequest(start)
+		req, err := ParseCatalogRequest(request)
+		if err != nil || req != start {
+			t.Fatalf("Request for %d: got %d, %v", start, req, err)
+		}
+		if _, err := ParseCatalogRequest(request[:requestSize]); err == nil {
+			t.Fatalf("Expected unpadded request to be rejected")
+		}
+		b := MarshalPage(entries, req)
+		if len(b) > MaxPageSize || len(b) > 4*len(request) {
+			t.Fatalf("Page of %d bytes exceeds MaxPageSize or 4 times the request", len(b))
+		}
+		page, err := ParsePage(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if page.Total != len(entries) || page.Start != start || len(page.Entries) == 0 {
+			t.Fatalf("Unexpected page at %d: total %d, start %d, %d entries",
+				start, page.Total, page.Start, len(page.Entries))
+		}
+		listed = append(listed, page.Entries...)
+		start += len(page.Entries)
+	}
+	for i := range entries {
+		if !reflect.DeepEqual(entries[i].Hash, listed[i].Hash) || entries[i].Name != listed[i].Name ||
+			entries[i].Size != listed[i].Size || !entries[i].CaptureTime.Equal(listed[i].CaptureTime) {
+			t.Errorf("Entry %d: expected %v, got %v", i, entries[i], listed[i])
+		}
+	}
+
+	page, err := ParsePage(MarshalPage(entries, len(entries)))
+	if err != nil || len(page.Entries) != 0 {
+		t.Errorf("Expected empty page beyond the end, got %v, %v", page, err)
+	}
+
+	b := MarshalPage(entries, 0)
+	if _, err := ParsePage(b[:len(b)-1]); err == nil {
+		t.Errorf("Expected error for truncated page")
+	}
+}
+
+func TestSignature(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := []byte("image content")
+	e := Entry{
+		Name:        "image.jpg",
+		Size:        uint32(len(content)),
+		CaptureTime: time.Unix(1600000000, 0),
+		Hash:        Hash(content),
+	}
+	if err := e.Verify(pub); err != ErrNoSignature {
+		t.Errorf("Expected ErrNoSignature, got %v", err)
+	}
+	e.Sign(key)
+
+	// The signature is transmitted in the latest response
+	b, err := MarshalLatest(&e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	latest, err := ParseLatest(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := latest.Verify(pub); err != nil {
+		t.Errorf("Expected valid signature, got %v", err)
+	}
+	if err := latest.Check(content); err != nil {
+		t.Errorf("Expected content to match, got %v", err)
+	}
+	if err := latest.Check([]byte("image Content")); err != ErrContentMismatch {
+		t.Errorf("Expected ErrContentMismatch, got %v", err)
+	}
+
+	latest.Name = "other.jpg"
+	if err := latest.Verify(pub); err != ErrInvalidSignature {
+		t.Errorf("Expected ErrInvalidSignature for modified entry, got %v", err)
+	}
+	otherPub, _, _ := ed25519.GenerateKey(rand.Reader)
+	if err := e.Verify(otherPub); err != ErrInvalidSignature {
+		t.Errorf("Expected ErrInvalidSignature for other key, got %v", err)
+	}
+}
+
+func TestLoadKeys(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "catalog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, "key.pem")
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err = x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubFile := filepath.Join(dir, "pub.pem")
+	err = ioutil.WriteFile(pubFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if loaded, err := LoadPrivateKey(keyFile); err != nil || !bytes.Equal(key, loaded) {
+		t.Errorf("Loading private key: %v", err)
+	}
+	if loaded, err := LoadPublicKey(pubFile); err != nil || !bytes.Equal(pub, loaded) {
+		t.Errorf("Loading public key: %v", err)
+	}
+	if _, err := LoadPublicKey(keyFile); err == nil {
+		t.Errorf("Expected error loading private key as public key")
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package catalog
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// signatureContext prefixes the signed data, so that signatures of entries can't be
+// confused with other uses of the key
+const signatureContext = "camerapp image entry\x00"
+
+var (
+	// ErrNoSignature is returned by Verify if the entry is not signed
+	ErrNoSignature = errors.New("image is not signed")
+	// ErrInvalidSignature is returned by Verify if the signature does not match the key
+	ErrInvalidSignature = errors.New("invalid image signature")
+	// ErrContentMismatch is returned by Check if the image does not match its entry
+	ErrContentMismatch = errors.New("image does not match its size and hash")
+)
+
+// signedData returns the data signed for the entry: all fields except the signature,
+// encoded as on the wire
+func (e *Entry) signedData() []byte {
+	return e.appendFields([]byte(signatureContext))
+}
+
+// Sign sets the signature of the entry. The name, size, capture time and hash must be
+// set before signing.
+func (e *Entry) Sign(key ed25519.PrivateKey) {
+	e.Signature = ed25519.Sign(key, e.signedData())
+}
+
+// Verify checks the signature of the entry
+func (e *Entry) Verify(key ed25519.PublicKey) error {
+	if len(e.Signature) == 0 {
+		return ErrNoSignature
+	}
+	if !ed25519.Verify(key, e.signedData(), e.Signature) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// Check checks that the content of an image matches the size and hash of the entry
+func (e *Entry) Check(content []byte) error {
+	hash := Hash(content)
+	if len(content) != int(e.Size) || !bytes.Equal(hash[:], e.Hash[:]) {
+		return ErrContentMismatch
+	}
+	return nil
+}
+
+// LoadPrivateKey reads an Ed25519 private key from a PEM encoded PKCS #8 file, e.g.
+// created with "openssl genpkey -algorithm ed25519"
+func LoadPrivateKey(file string) (ed25519.PrivateKey, error) {
+	der, err := readPEM(file, "PRIVATE KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", file, err)
+	}
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an Ed25519 key", file)
+	}
+	return edKey, nil
+}
+
+// LoadPublicKey reads an Ed25519 public key from a PEM encoded PKIX file, e.g. created
+// with "openssl pkey -pubout"
+func LoadPublicKey(file string) (ed25519.PublicKey, error) {
+	der, err := readPEM(file, "PUBLIC KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", file, err)
+	}
+	edKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an Ed25519 key", file)
+	}
+	return edKey, nil
+}
+
+func readPEM(file, blockType string) ([]byte, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != blockType {
+		return nil, fmt.Errorf("%s does not contain a PEM block of type %s", file, blockType)
+	}
+	return block.Bytes, nil
+}
@@ -5,26 +5,26 @@
 package main
 
 import (
-	"encoding/binary"
+	"crypto/ed25519"
+	"encoding/hex"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"os"
+	"path/filepath"
 	"time"
 
+	"github.com/netsec-ethz/scion-apps/camerapp/catalog"
+	"github.com/netsec-ethz/scion-apps/camerapp/subscription"
 	"github.com/netsec-ethz/scion-apps/pkg/appnet"
+	"github.com/netsec-ethz/scion-apps/pkg/blocktransfer"
 	"github.com/scionproto/scion/go/lib/snet"
 )
 
 const (
 	maxRetries   int           = 4
 	maxWaitDelay time.Duration = 3 * time.Second
-
-	// Number of blocks that are simultaneously requested
-	maxNumBlocksRequested               = 5
-	blockSize             uint32        = 1000
-	rttTimeoutMult        time.Duration = 3
-	consecReqWaitTime     time.Duration = 500 * time.Microsecond
 )
 
 func check(e error) {
@@ -33,7 +33,7 @@ func check(e error) {
 	}
 }
 
-func fetchFileInfo(udpConnection snet.Conn) (string, uint32, time.Duration, error) {
+func fetchFileInfo(udpConnection snet.Conn) (*catalog.Entry, time.Duration, error) {
 	numRetries := 0
 	packetBuffer := make([]byte, 2500)
 
@@ -41,7 +41,7 @@ func fetchFileInfo(udpConnection snet.Conn) (string, uint32, time.Duration, erro
 		numRetries++
 		// Send LIST command ("L") to server
 		t0 := time.Now()
-		_, err := udpConnection.Write([]byte("L"))
+		_, err := udpConnection.Write(catalog.MarshalLatestRequest())
 		check(err)
 
 		// Read response
@@ -67,172 +67,285 @@ func fetchFileInfo(udpConnection snet.Conn) (string, uint32, time.Duration, erro
 		t1 := time.Now()
 		rttApprox := t1.Sub(t0)
 
-		if n < 2 {
-			continue
-		}
-		if packetBuffer[0] != 'L' {
-			continue
-		}
-		fileNameLen := int(packetBuffer[1])
-		if 2+fileNameLen+4 != n {
+		entry, err := catalog.ParseLatest(packetBuffer[:n])
+		if err != nil {
 			continue
 		}
-		fileName := string(packetBuffer[2 : fileNameLen+2])
-		fileSize := binary.LittleEndian.Uint32(packetBuffer[fileNameLen+2:])
 
 		// Remove deadline
 		var tzero time.Time // initialized to "zero" time
 		err = udpConnection.SetReadDeadline(tzero)
 		check(err)
-		return fileName, fileSize, rttApprox, nil
+		return entry, rttApprox, nil
 	}
-	return "", 0, 0, fmt.Errorf("could not obtain file information")
+	return nil, 0, fmt.Errorf("could not obtain file information")
 }
 
-func blockFetcher(fetchBlockChan chan uint32, udpConnection snet.Conn, fileName string, fileSize uint32) {
-	packetBuffer := make([]byte, 512)
-	packetBuffer[0] = 'G'
-	packetBuffer[1] = byte(len(fileName))
-	copy(packetBuffer[2:], []byte(fileName))
-	sendLen := 2 + len(fileName) + 8
-	for i := range fetchBlockChan {
-		binary.LittleEndian.PutUint32(packetBuffer[sendLen-8:], i)
-		readLength := blockSize
-		if i+readLength > fileSize {
-			// Final block, read remaining amount
-			readLength = fileSize - i
-		}
-		binary.LittleEndian.PutUint32(packetBuffer[sendLen-4:], i+readLength)
-		_, err := udpConnection.Write(packetBuffer[:sendLen])
+// fetchCatalogPage requests the page of the catalog starting at entry start
+func fetchCatalogPage(udpConnection snet.Conn, start int) (*catalog.Page, time.Duration, error) {
+	packetBuffer := make([]byte, 2500)
+	request := catalog.MarshalCatalogRequest(start)
+
+	for numRetries := 0; numRetries < maxRetries; numRetries++ {
+		t0 := time.Now()
+		_, err := udpConnection.Write(request)
+		check(err)
+
+		err = udpConnection.SetReadDeadline(t0.Add(maxWaitDelay))
 		check(err)
+		// Skip responses to earlier requests until the deadline
+		for {
+			n, _, err := udpConnection.ReadFrom(packetBuffer)
+			if err != nil {
+				break
+			}
+			page, err := catalog.ParsePage(packetBuffer[:n])
+			if err != nil || page.Start != start {
+				continue
+			}
+			var tzero time.Time
+			err = udpConnection.SetReadDeadline(tzero)
+			check(err)
+			return page, time.Since(t0), nil
+		}
 	}
+	return nil, 0, fmt.Errorf("could not obtain catalog")
 }
 
-func blockReceiver(receivedBlockChan chan uint32, udpConnection snet.Conn, fileBuffer []byte, fileSize uint32) {
-	packetBuffer := make([]byte, 2500)
-	for {
-		n, _, err := udpConnection.ReadFrom(packetBuffer)
-		if err != nil {
-			continue
-			// Uncomment and remove "continue" on previous line once the new version of snet is part of the SCIONLab branch
-			// if operr, ok := err.(*snet.OpError); ok {
-			// 	// This is an OpError, could be SCMP, in which case continue
-			// 	if operr.SCMP() != nil {
-			// 		continue
-			// 	}
-			// }
-			// If it's not an snet SCMP error, then it's something more serious and fail
-			// check(err)
-		}
-		if n < 10 {
-			continue
-		}
-		if packetBuffer[0] != 'G' {
-			continue
+// fetchCatalog requests all pages of the catalog. The listing is restarted if the catalog
+// changes while it is fetched.
+func fetchCatalog(udpConnection snet.Conn) ([]catalog.Entry, time.Duration, error) {
+	for attempt := 0; attempt < maxRetries; attempt++ {
+		var entries []catalog.Entry
+		var rttApprox time.Duration
+		total := -1
+		for total < 0 || len(entries) < total {
+			page, rtt, err := fetchCatalogPage(udpConnection, len(entries))
+			if err != nil {
+				return nil, 0, err
+			}
+			rttApprox = rtt
+			if total >= 0 && page.Total != total {
+				break
+			}
+			total = page.Total
+			if len(page.Entries) == 0 && len(entries) < total {
+				break
+			}
+			entries = append(entries, page.Entries...)
 		}
-		startByte := binary.LittleEndian.Uint32(packetBuffer[1:])
-		endByte := binary.LittleEndian.Uint32(packetBuffer[5:])
-		readLength := blockSize
-		if startByte+readLength > fileSize {
-			// Final block, read remaining amount
-			readLength = fileSize - startByte
+		if len(entries) == total {
+			return entries, rttApprox, nil
 		}
-		if uint32(n) != 9+readLength {
-			continue
+	}
+	return nil, 0, fmt.Errorf("catalog changed while listing it")
+}
+
+// parseSince parses either a duration before now, e.g. "30m", or an RFC 3339 time
+func parseSince(s string) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid -since %q, expected a duration or RFC 3339 time", s)
+	}
+	return t, nil
+}
+
+// printCatalog prints the entries. With a public key, entries with an invalid signature
+// are marked.
+func printCatalog(entries []catalog.Entry, pubKey ed25519.PublicKey) {
+	for _, e := range entries {
+		var note string
+		if pubKey != nil {
+			if err := e.Verify(pubKey); err != nil {
+				note = " (" + err.Error() + ")"
+			}
 		}
-		if endByte != startByte+readLength {
-			continue
+		fmt.Printf("%s %10d %s %s%s\n", e.CaptureTime.Format(time.RFC3339), e.Size,
+			hex.EncodeToString(e.Hash[:]), e.Name, note)
+	}
+}
+
+// fileBuffer collects the blocks of the image as they arrive
+type fileBuffer []byte
+
+func (b fileBuffer) WriteAt(p []byte, off int64) (int, error) {
+	if off+int64(len(p)) > int64(len(b)) {
+		return 0, fmt.Errorf("block exceeds file size")
+	}
+	return copy(b[off:], p), nil
+}
+
+// dial connects to the server over the first path, and returns the block size for the
+// path MTU
+func dial(serverAddrStr string) (snet.Conn, int, error) {
+	serverAddr, err := appnet.ResolveUDPAddr(serverAddrStr)
+	if err != nil {
+		return nil, 0, err
+	}
+	paths, err := appnet.QueryPaths(serverAddr.IA)
+	if err != nil {
+		return nil, 0, err
+	}
+	var path snet.Path
+	if len(paths) > 0 {
+		path = paths[0]
+	}
+	appnet.SetPath(serverAddr, path)
+	conn, err := appnet.DialAddr(serverAddr)
+	if err != nil {
+		return nil, 0, err
+	}
+	return conn, blocktransfer.BlockSizeForPath(path), nil
+}
+
+// fetchEntry fetches the image of a catalog entry. With a public key, the signature of
+// the entry is verified first. Each block is checked against the hash of the entry as
+// it arrives; blocks that don't match, e.g. because they were spoofed, are requested
+// again.
+func fetchEntry(udpConnection snet.Conn, entry *catalog.Entry, pubKey ed25519.PublicKey,
+	blockSize int, rttApprox time.Duration) ([]byte, error) {
+
+	if pubKey != nil {
+		if err := entry.Verify(pubKey); err != nil {
+			return nil, fmt.Errorf("%s: %v", entry.Name, err)
 		}
-		copy(fileBuffer[startByte:], packetBuffer[9:n])
-		receivedBlockChan <- startByte
 	}
+	blockSize = blocktransfer.TreeBlockSize(blockSize)
+	fileBuffer := make(fileBuffer, entry.Size)
+	stats, err := blocktransfer.FetchVerified(udpConnection, entry.Name, int64(entry.Size), entry.Hash,
+		fileBuffer, &blocktransfer.Options{
+			BlockSize:  blockSize,
+			InitialRTT: rttApprox,
+		})
+	if err != nil {
+		return nil, fmt.Errorf("fetching %s: %v", entry.Name, err)
+	}
+	fmt.Printf("Fetched %s: %d blocks of %d bytes, %d retransmitted, %d forged, RTT %v\n",
+		entry.Name, stats.Blocks, blockSize, stats.Retransmissions, stats.Forged, stats.RTT)
+	return fileBuffer, nil
 }
 
 func main() {
 	startTime := time.Now()
 
 	serverAddrStr := flag.String("s", "", "Server address (<ISD-AS,[IP]:port> or <hostname:port>)")
-	outputFilePath := flag.String("output", "", "Path to the output file")
+	outputFilePath := flag.String("output", "",
+		"Path to the output file, or the output directory with -since and -subscribe")
+	list := flag.Bool("list", false, "List the images available on the server")
+	name := flag.String("name", "", "Fetch the image with this name instead of the most recent one")
+	since := flag.String("since", "",
+		"Fetch all images captured since this time (RFC 3339) or duration before now (e.g. 30m)")
+	subscribeMode := flag.Bool("subscribe", false,
+		"Receive new images as they are captured, -s is the subscription address of the server")
+	window := flag.Int("window", subscription.DefaultWindow,
+		"With -subscribe, the number of images in flight before the server skips images")
+	mjpeg := flag.Bool("mjpeg", false, "With -subscribe, write the images to stdout as MJPEG stream")
+	pubKeyFile := flag.String("pubkey", "", "Ed25519 public key (PEM) of the server to verify the images with")
 	flag.Parse()
 
-	udpConnection, err := appnet.Dial(*serverAddrStr)
-	check(err)
+	var pubKey ed25519.PublicKey
+	if *pubKeyFile != "" {
+		var err error
+		pubKey, err = catalog.LoadPublicKey(*pubKeyFile)
+		check(err)
+	}
+
+	modes := 0
+	for _, set := range []bool{*list, *name != "", *since != "", *subscribeMode} {
+		if set {
+			modes++
+		}
+	}
+	if modes > 1 {
+		log.Fatal("-list, -name, -since and -subscribe are mutually exclusive")
+	}
+	if *mjpeg && (!*subscribeMode || *outputFilePath != "") {
+		log.Fatal("-mjpeg requires -subscribe and can't be used with -output")
+	}
+	if *subscribeMode {
+		if *outputFilePath == "" {
+			*outputFilePath = "."
+		}
+		if !*mjpeg {
+			err := os.MkdirAll(*outputFilePath, 0700)
+			check(err)
+		}
+		check(subscribe(*serverAddrStr, *window, *outputFilePath, *mjpeg, pubKey))
+		return
+	}
+	var sinceTime time.Time
+	if *since != "" {
+		var err error
+		sinceTime, err = parseSince(*since)
+		check(err)
+	}
 
-	fileName, fileSize, rttApprox, err := fetchFileInfo(udpConnection)
+	udpConnection, blockSize, err := dial(*serverAddrStr)
 	check(err)
 
-	fetchBlockChan := make(chan uint32, 2)
-	receivedBlockChan := make(chan uint32, 2)
-
-	fileBuffer := make([]byte, fileSize)
-
-	// Sends block fetch requests to image server
-	go blockFetcher(fetchBlockChan, udpConnection, fileName, fileSize)
-
-	// Receives arriving image blocks
-	// Instead of implementation as a goroutine, it can also be implemented as socket read with a timeout.
-	// In this approach, the control loop structure is quite clean.
-	go blockReceiver(receivedBlockChan, udpConnection, fileBuffer, fileSize)
-
-	// The list of already requested blocks for which no response has yet been received.
-	// This is a map because the most common operation is insert and remove.
-	// Iteration through all the elements is occurring on in the rare case of packet loss.
-	requestedBlockMap := make(map[uint32]time.Time)
-
-	i := uint32(0)
-	numTimeouts := 0
-	done := false
-	for !done {
-		waitDuration := rttTimeoutMult * rttApprox
-		if len(requestedBlockMap) < maxNumBlocksRequested && i < fileSize {
-			// We can fetch an additional block
-			requestedBlockMap[i] = time.Now()
-			fetchBlockChan <- i
-			fmt.Print("r")
-			i = i + blockSize
-			if len(requestedBlockMap) < maxNumBlocksRequested {
-				// If we can fetch yet one more additional block,
-				// wait for a short amount of time before requesting the next block
-				waitDuration = consecReqWaitTime
+	switch {
+	case *list:
+		entries, _, err := fetchCatalog(udpConnection)
+		check(err)
+		printCatalog(entries, pubKey)
+		return
+	case *name != "":
+		entries, rttApprox, err := fetchCatalog(udpConnection)
+		check(err)
+		var found *catalog.Entry
+		for i := range entries {
+			if entries[i].Name == *name {
+				found = &entries[i]
+				break
 			}
 		}
-		// If a missing block has reached a timeout, then request it again.
-		now := time.Now()
-		for l, m := range requestedBlockMap {
-			if now.Sub(m) > rttTimeoutMult*rttApprox {
-				// Timeout expired, let's request it again
-				fetchBlockChan <- l
-				fmt.Print("T")
-				requestedBlockMap[l] = now
-			}
+		if found == nil {
+			log.Fatalf("no image %s on the server", *name)
 		}
-		select {
-		case k := <-receivedBlockChan:
-			fmt.Print(".")
-			numTimeouts = 0
-			delete(requestedBlockMap, k)
-			// Was this the last block?
-			if i >= fileSize && len(requestedBlockMap) == 0 {
-				done = true
-			}
-		case <-time.After(waitDuration):
-			if waitDuration == consecReqWaitTime {
-				// Do not include numTimeouts if it was a short waiting period between consecutive requests
+		content, err := fetchEntry(udpConnection, found, pubKey, blockSize, rttApprox)
+		check(err)
+		if *outputFilePath == "" {
+			*outputFilePath = filepath.Base(found.Name)
+		}
+		err = ioutil.WriteFile(*outputFilePath, content, 0600)
+		check(err)
+	case *since != "":
+		entries, rttApprox, err := fetchCatalog(udpConnection)
+		check(err)
+		if *outputFilePath == "" {
+			*outputFilePath = "."
+		}
+		err = os.MkdirAll(*outputFilePath, 0700)
+		check(err)
+		fetched := 0
+		for i := range entries {
+			entry := &entries[i]
+			if entry.CaptureTime.Before(sinceTime) {
 				continue
 			}
-			numTimeouts++
-			if numTimeouts > maxRetries {
-				fmt.Println(requestedBlockMap)
-				check(fmt.Errorf("too many missing packets, aborting"))
-			}
+			content, err := fetchEntry(udpConnection, entry, pubKey, blockSize, rttApprox)
+			check(err)
+			// Don't let the server name files outside of the output directory
+			err = ioutil.WriteFile(filepath.Join(*outputFilePath, filepath.Base(entry.Name)), content, 0600)
+			check(err)
+			fetched++
 		}
-	}
+		fmt.Printf("Fetched %d of %d images\n", fetched, len(entries))
+	default:
+		entry, rttApprox, err := fetchFileInfo(udpConnection)
+		check(err)
+		content, err := fetchEntry(udpConnection, entry, pubKey, blockSize, rttApprox)
+		check(err)
 
-	// Write file to disk
-	if *outputFilePath == "" {
-		*outputFilePath = fileName
+		// Write file to disk
+		if *outputFilePath == "" {
+			*outputFilePath = filepath.Base(entry.Name)
+		}
+		err = ioutil.WriteFile(*outputFilePath, content, 0600)
+		check(err)
 	}
-	err = ioutil.WriteFile(*outputFilePath, fileBuffer, 0600)
-	check(err)
-	fmt.Println("\nDone, exiting. Total duration", time.Since(startTime))
+	fmt.Println("Done, exiting. Total duration", time.Since(startTime))
 }
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/netsec-ethz/scion-apps/camerapp/catalog"
+	"github.com/netsec-ethz/scion-apps/camerapp/subscription"
+	"github.com/netsec-ethz/scion-apps/pkg/appnet/appquic"
+)
+
+// jpegMagic starts every JPEG image
+var jpegMagic = []byte{0xff, 0xd8}
+
+// subscribe receives the images pushed by the server until the subscription ends. Each
+// image is written to outputDir or, with mjpeg, to stdout as MJPEG stream of the JPEG
+// images. An image is only acknowledged once it was written, so a slow output causes the
+// server to skip images. With a public key, images with an invalid signature are skipped.
+func subscribe(serverAddrStr string, window int, outputDir string, mjpeg bool,
+	pubKey ed25519.PublicKey) error {
+
+	sess, err := appquic.Dial(serverAddrStr, nil, subscription.QUICConfig())
+	if err != nil {
+		return err
+	}
+	defer sess.Close()
+	stream, err := sess.OpenStreamSync()
+	if err != nil {
+		return err
+	}
+	if err = subscription.WriteSubscribe(stream, window); err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(stream)
+	for {
+		img, err := subscription.ReadImage(r)
+		if err == io.EOF {
+			// The server ended the subscription
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err = writeImage(img, outputDir, mjpeg, pubKey); err != nil {
+			return err
+		}
+		if err = subscription.WriteAck(stream); err != nil {
+			return err
+		}
+	}
+}
+
+// writeImage writes a pushed image to outputDir or, with mjpeg, to stdout. Images that
+// can't be verified with the public key, and non-JPEG images with mjpeg, are skipped.
+func writeImage(img *subscription.Image, outputDir string, mjpeg bool, pubKey ed25519.PublicKey) error {
+	if pubKey != nil {
+		if err := verifyImage(img, pubKey); err != nil {
+			log.Printf("Skipping %s: %v", img.Name, err)
+			return nil
+		}
+	}
+	if mjpeg {
+		if !bytes.HasPrefix(img.Content, jpegMagic) {
+			log.Printf("Skipping %s, not a JPEG image", img.Name)
+			return nil
+		}
+		_, err := os.Stdout.Write(img.Content)
+		return err
+	}
+	// Don't let the server name files outside of the output directory
+	path := filepath.Join(outputDir, filepath.Base(img.Name))
+	if err := ioutil.WriteFile(path, img.Content, 0600); err != nil {
+		return err
+	}
+	log.Printf("Received %s, captured %v, %d bytes", img.Name, img.CaptureTime, len(img.Content))
+	return nil
+}
+
+// verifyImage verifies the signature of a pushed image
+func verifyImage(img *subscription.Image, pubKey ed25519.PublicKey) error {
+	entry := catalog.Entry{
+		Name:        img.Name,
+		Size:        uint32(len(img.Content)),
+		CaptureTime: img.CaptureTime,
+		Hash:        catalog.Hash(img.Content),
+		Signature:   img.Signature,
+	}
+	return entry.Verify(pubKey)
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/netsec-ethz/scion-apps/camerapp/catalog"
+	"github.com/netsec-ethz/scion-apps/pkg/blocktransfer"
+)
+
+type imageFileType struct {
+	name        string
+	size        uint32
+	content     []byte
+	captureTime time.Time
+	// tree is the hash tree of the content, its root is the hash of the catalog entry
+	tree *blocktransfer.HashTree
+	// signature of the catalog entry, if the store has a key
+	signature []byte
+	// seq orders the images by the time they were read, to push new images to subscribers
+	seq uint64
+	// expiredAt is set once the image violates the retention policy; it is then no longer
+	// listed, and removed after MaxFileAgeGracePeriod
+	expiredAt time.Time
+}
+
+func (v *imageFileType) entry() catalog.Entry {
+	return catalog.Entry{
+		Name:        v.name,
+		Size:        v.size,
+		CaptureTime: v.captureTime,
+		Hash:        v.tree.Root(),
+		Signature:   v.signature,
+	}
+}
+
+// retentionPolicy limits the images kept by the server. Zero values mean no limit.
+type retentionPolicy struct {
+	maxAge   time.Duration
+	maxCount int
+	maxBytes int64
+}
+
+// imageStore holds the images found in a directory
+type imageStore struct {
+	dir        string
+	extensions []string
+	retention  retentionPolicy
+	// keep disables deleting expired images from disk, they are only forgotten
+	keep bool
+	// key signs the images if set
+	key ed25519.PrivateKey
+
+	lock       sync.Mutex
+	files      map[string]*imageFileType
+	mostRecent string
+	// forgotten records the modification time of expired images that are still on disk,
+	// so that they are not read again
+	forgotten map[string]time.Time
+	lastSeq   uint64
+	// subscribers are notified after each update of the store
+	subscribers map[chan struct{}]struct{}
+}
+
+func newImageStore(dir string, extensions []string, retention retentionPolicy, keep bool,
+	key ed25519.PrivateKey) *imageStore {
+
+	return &imageStore{
+		dir:         dir,
+		extensions:  extensions,
+		retention:   retention,
+		keep:        keep,
+		key:         key,
+		files:       make(map[string]*imageFileType),
+		forgotten:   make(map[string]time.Time),
+		subscribers: make(map[chan struct{}]struct{}),
+	}
+}
+
+// parseExtensions parses a comma separated list of file extensions, with or without dot
+func parseExtensions(s string) []string {
+	var extensions []string
+	for _, ext := range strings.Split(s, ",") {
+		ext = strings.ToLower(strings.TrimSpace(ext))
+		if ext == "" {
+			continue
+		}
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		extensions = append(extensions, ext)
+	}
+	return extensions
+}
+
+func (s *imageStore) isImage(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	for _, e := range s.extensions {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
+// run keeps the store up to date, scanning the directory whenever a change is notified
+// on events, and at least every imageReadInterval. Errors are logged, and the scan is
+// retried later.
+func (s *imageStore) run(events <-chan struct{}) {
+	ticker := time.NewTicker(imageReadInterval)
+	defer ticker.Stop()
+	for {
+		if err := s.scan(); err != nil {
+			log.Printf("Scanning %s: %v", s.dir, err)
+		}
+		s.expire(time.Now())
+		s.notify()
+		select {
+		case <-events:
+		case <-ticker.C:
+		}
+	}
+}
+
+// scan reads new and modified images from the directory, and forgets the images that
+// were removed from it
+func (s *imageStore) scan() error {
+	direntries, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	onDisk := make(map[string]bool)
+	for _, entry := range direntries {
+		name := entry.Name()
+		if entry.IsDir() || !s.isImage(name) || len(name) > MaxFileNameLength ||
+			entry.Size() > math.MaxUint32 {
+			continue
+		}
+		onDisk[name] = true
+
+		// Check if we've already read in this version of the image
+		s.lock.Lock()
+		current, ok := s.files[name]
+		unchanged := ok && current.captureTime.Equal(entry.ModTime()) && int64(current.size) == entry.Size()
+		if forgottenTime, ok := s.forgotten[name]; ok && forgottenTime.Equal(entry.ModTime()) {
+			unchanged = true
+		}
+		s.lock.Unlock()
+		if unchanged {
+			continue
+		}
+		// Images that already exceed the maximum age are not read. They are deleted at the
+		// time an image read before would have been, unless images are kept.
+		if age := now.Sub(entry.ModTime()); s.retention.maxAge > 0 && age > s.retention.maxAge {
+			if !s.keep && age >= s.retention.maxAge+MaxFileAgeGracePeriod {
+				err := os.Remove(filepath.Join(s.dir, name))
+				if err != nil && !os.IsNotExist(err) {
+					log.Printf("Deleting image %s: %v", name, err)
+				}
+			}
+			continue
+		}
+
+		fileContents, err := ioutil.ReadFile(filepath.Join(s.dir, name))
+		if err != nil {
+			// The file may have been removed in the meantime, try again in the next scan
+			log.Printf("Reading image %s: %v", name, err)
+			continue
+		}
+		newFile := &imageFileType{
+			name:        name,
+			size:        uint32(len(fileContents)),
+			content:     fileContents,
+			captureTime: entry.ModTime(),
+			tree:        blocktransfer.NewHashTree(fileContents),
+		}
+		if s.key != nil {
+			entry := newFile.entry()
+			entry.Sign(s.key)
+			newFile.signature = entry.Signature
+		}
+		s.lock.Lock()
+		s.lastSeq++
+		newFile.seq = s.lastSeq
+		s.files[name] = newFile
+		delete(s.forgotten, name)
+		s.lock.Unlock()
+	}
+
+	s.lock.Lock()
+	for name := range s.files {
+		if !onDisk[name] {
+			delete(s.files, name)
+		}
+	}
+	for name := range s.forgotten {
+		if !onDisk[name] {
+			delete(s.forgotten, name)
+		}
+	}
+	s.lock.Unlock()
+	return nil
+}
+
+// expire applies the retention policy. The most recent images within the limits are
+// kept, the others are no longer listed and removed after MaxFileAgeGracePeriod.
+func (s *imageStore) expire(now time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	images := make([]*imageFileType, 0, len(s.files))
+	for _, v := range s.files {
+		images = append(images, v)
+	}
+	sort.Slice(images, func(i, j int) bool {
+		if !images[i].captureTime.Equal(images[j].captureTime) {
+			return images[i].captureTime.After(images[j].captureTime)
+		}
+		return images[i].name > images[j].name
+	})
+
+	s.mostRecent = ""
+	count, totalBytes := 0, int64(0)
+	for _, v := range images {
+		if v.expiredAt.IsZero() {
+			if s.retention.exceeded(now.Sub(v.captureTime), count+1, totalBytes+int64(v.size)) {
+				v.expiredAt = now
+			} else {
+				count++
+				totalBytes += int64(v.size)
+				if s.mostRecent == "" {
+					s.mostRecent = v.name
+				}
+			}
+		}
+		if !v.expiredAt.IsZero() && now.Sub(v.expiredAt) >= MaxFileAgeGracePeriod {
+			s.remove(v)
+		}
+	}
+}
+
+func (p retentionPolicy) exceeded(age time.Duration, count int, totalBytes int64) bool {
+	return p.maxAge > 0 && age > p.maxAge ||
+		p.maxCount > 0 && count > p.maxCount ||
+		p.maxBytes > 0 && totalBytes > p.maxBytes
+}
+
+// remove forgets an image, and deletes it from disk unless keep is set. Must be called
+// with the lock held.
+func (s *imageStore) remove(v *imageFileType) {
+	delete(s.files, v.name)
+	if s.keep {
+		s.forgotten[v.name] = v.captureTime
+		return
+	}
+	err := os.Remove(filepath.Join(s.dir, v.name))
+	if err != nil && !os.IsNotExist(err) {
+		// Don't read the image again while it's still on disk
+		s.forgotten[v.name] = v.captureTime
+		log.Printf("Deleting image %s: %v", v.name, err)
+	}
+}
+
+// lookup returns the contents of the image with the given name, to serve its blocks
+func (s *imageStore) lookup(name string) (io.ReaderAt, int64, bool) {
+	s.lock.Lock()
+	v, ok := s.files[name]
+	// We don't need to lock any more, since the content of the image structure does
+	// not get changed once set up.
+	s.lock.Unlock()
+	if !ok {
+		return nil, 0, false
+	}
+	return bytes.NewReader(v.content), int64(v.size), true
+}
+
+// lookupTree returns the hash tree of the image with the given name
+func (s *imageStore) lookupTree(name string) (*blocktransfer.HashTree, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	v, ok := s.files[name]
+	if !ok {
+		return nil, false
+	}
+	return v.tree, true
+}
+
+// latest returns the catalog entry of the most recent image
+func (s *imageStore) latest() (catalog.Entry, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	v, ok := s.files[s.mostRecent]
+	if !ok {
+		return catalog.Entry{}, false
+	}
+	return v.entry(), true
+}
+
+// list returns the catalog of the images that have not expired
+func (s *imageStore) list() []catalog.Entry {
+	s.lock.Lock()
+	entries := make([]catalog.Entry, 0, len(s.files))
+	for _, v := range s.files {
+		if !v.expiredAt.IsZero() {
+			continue
+		}
+		entries = append(entries, v.entry())
+	}
+	s.lock.Unlock()
+	catalog.Sort(entries)
+	return entries
+}
+
+// subscribe returns a channel on which an update of the store is notified. Updates are
+// coalesced if the subscriber does not keep up. cancel must be called once done.
+func (s *imageStore) subscribe() (updates <-chan struct{}, cancel func()) {
+	ch := make(chan struct{}, 1)
+	s.lock.Lock()
+	s.subscribers[ch] = struct{}{}
+	s.lock.Unlock()
+	return ch, func() {
+		s.lock.Lock()
+		delete(s.subscribers, ch)
+		s.lock.Unlock()
+	}
+}
+
+func (s *imageStore) notify() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for ch := range s.subscribers {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// since returns the images that have not expired and were read after the image with
+// sequence number seq, ordered by capture time
+func (s *imageStore) since(seq uint64) []*imageFileType {
+	s.lock.Lock()
+	var images []*imageFileType
+	for _, v := range s.files {
+		if v.seq > seq && v.expiredAt.IsZero() {
+			images = append(images, v)
+		}
+	}
+	s.lock.Unlock()
+	sort.Slice(images, func(i, j int) bool {
+		if !images[i].captureTime.Equal(images[j].captureTime) {
+			return images[i].captureTime.Before(images[j].captureTime)
+		}
+		return images[i].name < images[j].name
+	})
+	return images
+}
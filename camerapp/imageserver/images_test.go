@@ -0,0 +1,145 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeImage(t *testing.T, dir, name string, size int, modTime time.Time) {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, make([]byte, size), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func listedNames(s *imageStore) []string {
+	var names []string
+	for _, e := range s.list() {
+		names = append(names, e.Name)
+	}
+	return names
+}
+
+func TestImageStoreRetention(t *testing.T) {
+	base := time.Now().Add(-time.Hour)
+	for _, keep := range []bool{false, true} {
+		dir, err := ioutil.TempDir("", "imageserver")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		writeImage(t, dir, "a.jpg", 100, base)
+		writeImage(t, dir, "b.PNG", 100, base.Add(time.Second))
+		writeImage(t, dir, "c.webp", 100, base.Add(2*time.Second))
+		writeImage(t, dir, "notes.txt", 100, base.Add(3*time.Second))
+
+		s := newImageStore(dir, parseExtensions("jpg, png,.webp"), retentionPolicy{maxCount: 2}, keep, nil)
+		if err := s.scan(); err != nil {
+			t.Fatal(err)
+		}
+		now := time.Now()
+		s.expire(now)
+		if names := listedNames(s); len(names) != 2 || names[0] != "b.PNG" || names[1] != "c.webp" {
+			t.Fatalf("Expected the 2 most recent images listed, got %v", names)
+		}
+		if latest, _ := s.latest(); latest.Name != "c.webp" {
+			t.Errorf("Expected c.webp as most recent image, got %s", latest.Name)
+		}
+		if _, _, ok := s.lookup("a.jpg"); !ok {
+			t.Errorf("Expected expired image to be available during the grace period")
+		}
+
+		s.expire(now.Add(MaxFileAgeGracePeriod))
+		if _, _, ok := s.lookup("a.jpg"); ok {
+			t.Errorf("Expected expired image to be removed after the grace period")
+		}
+		_, err = os.Stat(filepath.Join(dir, "a.jpg"))
+		if keep && err != nil || !keep && !os.IsNotExist(err) {
+			t.Errorf("Unexpected state of expired image on disk with keep %v: %v", keep, err)
+		}
+
+		// Forgotten images are not read again, but new images are
+		writeImage(t, dir, "d.jpg", 100, base.Add(4*time.Second))
+		if err := s.scan(); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, ok := s.lookup("a.jpg"); ok {
+			t.Errorf("Expected forgotten image not to be read again")
+		}
+		s.expire(now.Add(MaxFileAgeGracePeriod))
+		if names := listedNames(s); len(names) != 2 || names[1] != "d.jpg" {
+			t.Errorf("Expected new image listed, got %v", names)
+		}
+
+		// Images removed from disk are forgotten
+		if err := os.Remove(filepath.Join(dir, "d.jpg")); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.scan(); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, ok := s.lookup("d.jpg"); ok {
+			t.Errorf("Expected removed image to be forgotten")
+		}
+	}
+}
+
+func TestImageStoreMaxAge(t *testing.T) {
+	now := time.Now()
+	for _, keep := range []bool{false, true} {
+		dir, err := ioutil.TempDir("", "imageserver")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		writeImage(t, dir, "old.jpg", 100, now.Add(-2*time.Hour))
+		writeImage(t, dir, "expired.jpg", 100, now.Add(-time.Hour-time.Second))
+		writeImage(t, dir, "new.jpg", 100, now.Add(-50*time.Minute))
+
+		s := newImageStore(dir, parseExtensions("jpg"), retentionPolicy{maxAge: time.Hour}, keep, nil)
+		if err := s.scan(); err != nil {
+			t.Fatal(err)
+		}
+		s.expire(now)
+		if names := listedNames(s); len(names) != 1 || names[0] != "new.jpg" {
+			t.Errorf("Expected only the image within the maximum age listed, got %v", names)
+		}
+		for _, name := range []string{"old.jpg", "expired.jpg"} {
+			if _, _, ok := s.lookup(name); ok {
+				t.Errorf("Expected %s exceeding the maximum age not to be read", name)
+			}
+		}
+		// Images exceeding the maximum age by the grace period are deleted unless kept
+		if _, err := os.Stat(filepath.Join(dir, "old.jpg")); keep && err != nil || !keep && !os.IsNotExist(err) {
+			t.Errorf("Unexpected state of old image on disk with keep %v: %v", keep, err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "expired.jpg")); err != nil {
+			t.Errorf("Expected expired image to be kept during the grace period: %v", err)
+		}
+
+		// The age is counted from the capture time
+		s.expire(now.Add(11 * time.Minute))
+		if names := listedNames(s); len(names) != 0 {
+			t.Errorf("Expected image to expire by its capture time, got %v", names)
+		}
+	}
+}
+
+func TestRetentionPolicy(t *testing.T) {
+	p := retentionPolicy{maxAge: time.Minute, maxBytes: 1000}
+	if p.exceeded(time.Second, 100, 1000) {
+		t.Errorf("Expected images within the limits to be retained")
+	}
+	if !p.exceeded(2*time.Minute, 1, 10) || !p.exceeded(time.Second, 1, 1001) {
+		t.Errorf("Expected images exceeding the limits to expire")
+	}
+	if (retentionPolicy{}).exceeded(1000*time.Hour, 1000, 1<<40) {
+		t.Errorf("Expected no limits with the zero policy")
+	}
+}
@@ -5,40 +5,36 @@
 package main
 
 import (
-	"encoding/binary"
+	"crypto/ed25519"
 	"flag"
-	"io/ioutil"
 	"log"
-	"os"
-	"strings"
-	"sync"
+	"net"
 	"time"
 
+	"github.com/netsec-ethz/scion-apps/camerapp/catalog"
 	"github.com/netsec-ethz/scion-apps/pkg/appnet"
+	"github.com/netsec-ethz/scion-apps/pkg/blocktransfer"
 )
 
 const (
-	// MaxFileNameLength is the max acceptable length for file names of served images
-	MaxFileNameLength int = 255
+	// MaxFileNameLength is the max acceptable length for file names of served images,
+	// leaving room for the prefix of the names of their hash lists
+	MaxFileNameLength int = blocktransfer.MaxHashedNameLength
 
-	// MaxFileAge defines that after an image was stored for this amount of time,
-	// it will be deleted
+	// MaxFileAge is the default age after which an image is no longer listed and
+	// will be deleted
 	MaxFileAge time.Duration = time.Minute * 10
 
 	// MaxFileAgeGracePeriod defines the duration after which an image is still
 	// available for download, but it will not be listed any more in new requests
 	MaxFileAgeGracePeriod time.Duration = time.Minute * 1
 
-	// Interval after which the file system is read to check for new images
+	// Interval after which the file system is read to check for new images, if no
+	// change is notified
 	imageReadInterval time.Duration = time.Second * 59
-)
 
-type imageFileType struct {
-	name     string
-	size     uint32
-	content  []byte
-	readTime time.Time
-}
+	defaultExtensions = "jpg,jpeg,png,webp,mjpeg"
+)
 
 func check(e error) {
 	if e != nil {
@@ -46,72 +42,51 @@ func check(e error) {
 	}
 }
 
-var (
-	currentFiles     map[string]*imageFileType
-	mostRecentFile   string
-	currentFilesLock sync.Mutex
-)
-
-func handleImageFiles() {
-	for {
-		// Read the directory and look for new .jpg images
-		direntries, err := ioutil.ReadDir(".")
-		check(err)
-
-		for _, entry := range direntries {
-			if entry.IsDir() {
-				continue
-			}
-			if !strings.HasSuffix(entry.Name(), ".jpg") {
-				continue
-			}
-			if len(entry.Name()) > MaxFileNameLength {
-				continue
-			}
-			// Check if we've already read in the image
-			currentFilesLock.Lock()
-			if _, ok := currentFiles[entry.Name()]; !ok {
-				fileContents, err := ioutil.ReadFile(entry.Name())
-				check(err)
-				newFile := imageFileType{entry.Name(), uint32(entry.Size()), fileContents, time.Now()}
-				currentFiles[newFile.name] = &newFile
-				mostRecentFile = newFile.name
-			}
-			currentFilesLock.Unlock()
-		}
-		// Check if an image should be deleted
-		now := time.Now()
-		currentFilesLock.Lock()
-		for k, v := range currentFiles {
-			if now.Sub(v.readTime) > MaxFileAge+MaxFileAgeGracePeriod {
-				err = os.Remove(k)
-				check(err)
-				delete(currentFiles, k)
-				if k == mostRecentFile {
-					mostRecentFile = ""
-				}
-			}
-		}
-		currentFilesLock.Unlock()
-
-		time.Sleep(imageReadInterval)
-	}
-}
-
 func main() {
-	currentFiles = make(map[string]*imageFileType)
-
 	// Fetch arguments from command line
 	port := flag.Uint("p", 40002, "Server Port")
+	subscribePort := flag.Uint("subscribePort", 0, "Port for QUIC subscriptions, 0 to disable")
+	dir := flag.String("dir", ".", "Directory containing the images")
+	extensions := flag.String("ext", defaultExtensions, "Comma separated list of image file extensions")
+	maxAge := flag.Duration("maxAge", MaxFileAge, "Age after which images expire, 0 for no limit")
+	maxCount := flag.Int("maxCount", 0, "Number of most recent images to retain, 0 for no limit")
+	maxBytes := flag.Int64("maxBytes", 0, "Total size of the most recent images to retain, 0 for no limit")
+	keep := flag.Bool("keep", false, "Only forget expired images instead of deleting them from disk")
+	keyFile := flag.String("key", "", "Ed25519 private key (PEM) to sign the images with")
 	flag.Parse()
 
+	var key ed25519.PrivateKey
+	if *keyFile != "" {
+		var err error
+		key, err = catalog.LoadPrivateKey(*keyFile)
+		check(err)
+	}
+
+	images := newImageStore(*dir, parseExtensions(*extensions), retentionPolicy{
+		maxAge:   *maxAge,
+		maxCount: *maxCount,
+		maxBytes: *maxBytes,
+	}, *keep, key)
+
 	udpConnection, err := appnet.ListenPort(uint16(*port))
 	check(err)
 
-	go handleImageFiles()
+	events, err := watchDir(*dir)
+	if err != nil {
+		log.Printf("Watching %s failed, scanning every %v: %v", *dir, imageReadInterval, err)
+	}
+	go images.run(events)
 
-	receivePacketBuffer := make([]byte, 2500)
-	sendPacketBuffer := make([]byte, 2500)
+	if *subscribePort != 0 {
+		go func() {
+			check(serveSubscriptions(uint16(*subscribePort), images))
+		}()
+	}
+
+	blockServer := blocktransfer.NewServer(udpConnection, images.lookup)
+	blockServer.Trees = images.lookupTree
+
+	receivePacketBuffer := make([]byte, blocktransfer.MaxRequestSize)
 	for {
 		// Handle client requests
 		n, remoteUDPaddress, err := udpConnection.ReadFrom(receivePacketBuffer)
@@ -128,49 +103,37 @@ func main() {
 			// check(err)
 		}
 		if n > 0 {
-			if receivePacketBuffer[0] == 'L' {
-				// We also need to lock access to mostRecentFile, otherwise a race condition is possible
-				// where the file is deleted after the initial check
-				currentFilesLock.Lock()
-				sendLen := len(mostRecentFile)
-				if sendLen == 0 {
-					currentFilesLock.Unlock()
+			if receivePacketBuffer[0] == catalog.CommandLatest {
+				entry, ok := images.latest()
+				if !ok {
+					continue
+				}
+				response, err := catalog.MarshalLatest(&entry)
+				if err != nil {
 					continue
 				}
-				sendPacketBuffer[0] = 'L'
-				sendPacketBuffer[1] = byte(sendLen)
-				copy(sendPacketBuffer[2:], []byte(mostRecentFile))
-				sendLen = sendLen + 2
-				binary.LittleEndian.PutUint32(sendPacketBuffer[sendLen:], currentFiles[mostRecentFile].size)
-				currentFilesLock.Unlock()
-				sendLen = sendLen + 4
-				_, err = udpConnection.WriteTo(sendPacketBuffer[:sendLen], remoteUDPaddress)
-				check(err)
-			} else if receivePacketBuffer[0] == 'G' && n > 1 {
-				filenameLen := int(receivePacketBuffer[1])
-				if n >= (2 + filenameLen + 8) {
-					currentFilesLock.Lock()
-					v, ok := currentFiles[string(receivePacketBuffer[2:filenameLen+2])]
-					// We don't need to lock any more, since we now have a pointer to the image structure
-					// which does not get changed once set up.
-					currentFilesLock.Unlock()
-					if !ok {
-						continue
-					}
-					startByte := binary.LittleEndian.Uint32(receivePacketBuffer[filenameLen+2:])
-					endByte := binary.LittleEndian.Uint32(receivePacketBuffer[filenameLen+6:])
-					if endByte > startByte && endByte <= v.size+1 {
-						sendPacketBuffer[0] = 'G'
-						// Copy startByte and endByte from request packet
-						copy(sendPacketBuffer[1:], receivePacketBuffer[filenameLen+2:filenameLen+10])
-						// Copy image contents
-						copy(sendPacketBuffer[9:], v.content[startByte:endByte])
-						sendLen := 9 + endByte - startByte
-						_, err = udpConnection.WriteTo(sendPacketBuffer[:sendLen], remoteUDPaddress)
-						check(err)
-					}
+				_, err = udpConnection.WriteTo(response, remoteUDPaddress)
+				logWriteError(err, remoteUDPaddress)
+			} else if receivePacketBuffer[0] == catalog.CommandCatalog {
+				start, err := catalog.ParseCatalogRequest(receivePacketBuffer[:n])
+				if err != nil {
+					continue
 				}
+				_, err = udpConnection.WriteTo(catalog.MarshalPage(images.list(), start), remoteUDPaddress)
+				logWriteError(err, remoteUDPaddress)
+			} else {
+				// Block requests, see package blocktransfer
+				_, err = blockServer.Handle(receivePacketBuffer[:n], remoteUDPaddress)
+				logWriteError(err, remoteUDPaddress)
 			}
 		}
 	}
 }
+
+// logWriteError logs an error sending a response. The server keeps serving other
+// clients, e.g. if the path to a single client is broken.
+func logWriteError(err error, addr net.Addr) {
+	if err != nil {
+		log.Printf("Sending response to %v: %v", addr, err)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"io"
+	"log"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+	"github.com/netsec-ethz/scion-apps/camerapp/subscription"
+	"github.com/netsec-ethz/scion-apps/pkg/appnet/appquic"
+)
+
+// subscriberWriteTimeout is the time after which a subscriber that does not read the
+// images is dropped
+const subscriberWriteTimeout = 30 * time.Second
+
+// serveSubscriptions accepts QUIC sessions on port and pushes new images to each
+// subscriber
+func serveSubscriptions(port uint16, images *imageStore) error {
+	listener, err := appquic.ListenPort(port, nil, subscription.QUICConfig())
+	if err != nil {
+		return err
+	}
+	for {
+		sess, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			if err := serveSubscriber(sess, images); err != nil {
+				log.Printf("Subscription from %v ended: %v", sess.RemoteAddr(), err)
+			}
+			sess.Close()
+		}()
+	}
+}
+
+// serveSubscriber handles the subscription of a session. It sends the most recent
+// images when subscribing and then each new image, keeping at most window images
+// unacknowledged. Images that can't be sent within the window are skipped.
+func serveSubscriber(sess quic.Session, images *imageStore) error {
+	stream, err := sess.AcceptStream()
+	if err != nil {
+		return err
+	}
+	window, err := subscription.ReadSubscribe(stream)
+	if err != nil {
+		return err
+	}
+
+	updates, cancel := images.subscribe()
+	defer cancel()
+
+	acks := make(chan error)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			err := subscription.ReadAck(stream)
+			select {
+			case acks <- err:
+			case <-done:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	var lastSeq uint64
+	inFlight := 0
+	for {
+		if pending := images.since(lastSeq); inFlight < window && len(pending) > 0 {
+			lastSeq = maxSeq(pending)
+			if len(pending) > window-inFlight {
+				pending = pending[len(pending)-(window-inFlight):]
+			}
+			for _, v := range pending {
+				err = stream.SetWriteDeadline(time.Now().Add(subscriberWriteTimeout))
+				if err != nil {
+					return err
+				}
+				err = subscription.WriteImage(stream, &subscription.Image{
+					Name:        v.name,
+					CaptureTime: v.captureTime,
+					Content:     v.content,
+					Signature:   v.signature,
+				})
+				if err != nil {
+					return err
+				}
+				inFlight++
+			}
+			continue
+		}
+		select {
+		case <-updates:
+		case err := <-acks:
+			if err == io.EOF {
+				// The client unsubscribed
+				return nil
+			} else if err != nil {
+				return err
+			}
+			if inFlight > 0 {
+				inFlight--
+			}
+		}
+	}
+}
+
+func maxSeq(images []*imageFileType) uint64 {
+	var seq uint64
+	for _, v := range images {
+		if v.seq > seq {
+			seq = v.seq
+		}
+	}
+	return seq
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"log"
+	"syscall"
+)
+
+// watchDir notifies changes of the files in dir with inotify. Bursts of changes may be
+// coalesced into a single notification.
+func watchDir(dir string) (<-chan struct{}, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	mask := uint32(syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO | syscall.IN_MOVED_FROM | syscall.IN_DELETE)
+	if _, err = syscall.InotifyAddWatch(fd, dir, mask); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	events := make(chan struct{}, 1)
+	go func() {
+		defer syscall.Close(fd)
+		buf := make([]byte, 4096)
+		for {
+			n, err := syscall.Read(fd, buf)
+			if err == syscall.EINTR {
+				continue
+			}
+			if err != nil || n <= 0 {
+				// The directory is still scanned periodically
+				log.Printf("Watching %s stopped: %v", dir, err)
+				return
+			}
+			select {
+			case events <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return events, nil
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "errors"
+
+// watchDir is not supported on this platform, the directory is only scanned periodically
+func watchDir(dir string) (<-chan struct{}, error) {
+	return nil, errors.New("change notification not supported on this platform")
+}
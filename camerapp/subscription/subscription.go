@@ -0,0 +1,181 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package subscription implements the messages of camerapp subscriptions, with which the
+// imageserver pushes new images to the client.
+//
+// A subscription is a QUIC stream opened by the client. The client sends a subscribe
+// request, the server then sends the images, and the client acknowledges each image.
+// The server sends at most window images that were not yet acknowledged; if the client
+// is slower than the camera, the server skips to the most recent images. Integers are
+// in little endian, like the other camerapp messages.
+//
+//	Subscribe:   'U', uint8 window
+//	Image:       'I', uint8 name length, name, int64 capture time in nanoseconds since
+//	             the Unix epoch, uint32 image length, image, uint8 signature length,
+//	             signature
+//	Acknowledge: 'A'
+//
+// If the server has a signing key, the signature is the signature of the catalog entry
+// of the image, see catalog.Entry.Sign; otherwise it is empty.
+package subscription
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+)
+
+// Message types
+const (
+	TypeSubscribe byte = 'U'
+	TypeImage     byte = 'I'
+	TypeAck       byte = 'A'
+)
+
+const (
+	// DefaultWindow is the default number of unacknowledged images
+	DefaultWindow = 2
+	// MaxImageSize is the maximum size of images accepted by the client
+	MaxImageSize = 1 << 26
+	// IdleTimeout is the time after which a subscription without any activity is
+	// closed. QUIC keepalives are sent before it expires.
+	IdleTimeout = 30 * time.Second
+)
+
+// QUICConfig returns the QUIC configuration for subscriptions, with keepalive enabled
+func QUICConfig() *quic.Config {
+	return &quic.Config{
+		KeepAlive:   true,
+		IdleTimeout: IdleTimeout,
+	}
+}
+
+// Image is an image pushed to the client
+type Image struct {
+	Name        string
+	CaptureTime time.Time
+	Content     []byte
+	Signature   []byte
+}
+
+// WriteSubscribe writes a subscribe request
+func WriteSubscribe(w io.Writer, window int) error {
+	if window < 1 || window > 255 {
+		return fmt.Errorf("invalid window %d, must be within 1 and 255", window)
+	}
+	_, err := w.Write([]byte{TypeSubscribe, byte(window)})
+	return err
+}
+
+// ReadSubscribe reads a subscribe request and returns the window
+func ReadSubscribe(r io.Reader) (int, error) {
+	var b [2]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return 0, err
+	}
+	if b[0] != TypeSubscribe || b[1] == 0 {
+		return 0, fmt.Errorf("invalid subscribe request")
+	}
+	return int(b[1]), nil
+}
+
+// WriteImage writes an image
+func WriteImage(w io.Writer, img *Image) error {
+	if len(img.Name) > 255 || len(img.Signature) > 255 {
+		return fmt.Errorf("image name or signature too long")
+	}
+	b := make([]byte, 0, 2+len(img.Name)+12)
+	b = append(b, TypeImage, byte(len(img.Name)))
+	b = append(b, img.Name...)
+	b = append(b, make([]byte, 12)...)
+	binary.LittleEndian.PutUint64(b[len(b)-12:], uint64(img.CaptureTime.UnixNano()))
+	binary.LittleEndian.PutUint32(b[len(b)-4:], uint32(len(img.Content)))
+	if _, err := w.Write(b); err != nil {
+		return err
+	}
+	if _, err := w.Write(img.Content); err != nil {
+		return err
+	}
+	_, err := w.Write(append([]byte{byte(len(img.Signature))}, img.Signature...))
+	return err
+}
+
+// ReadImage reads an image
+func ReadImage(r io.Reader) (*Image, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	if header[0] != TypeImage {
+		return nil, fmt.Errorf("unexpected message type %q", header[0])
+	}
+	b := make([]byte, int(header[1])+12)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	nameLen := int(header[1])
+	size := binary.LittleEndian.Uint32(b[nameLen+8:])
+	if size > MaxImageSize {
+		return nil, fmt.Errorf("image of %d bytes exceeds maximum size", size)
+	}
+	img := &Image{
+		Name:        string(b[:nameLen]),
+		CaptureTime: time.Unix(0, int64(binary.LittleEndian.Uint64(b[nameLen:]))),
+		Content:     make([]byte, size),
+	}
+	if _, err := io.ReadFull(r, img.Content); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	var sigLen [1]byte
+	if _, err := io.ReadFull(r, sigLen[:]); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if sigLen[0] > 0 {
+		img.Signature = make([]byte, sigLen[0])
+		if _, err := io.ReadFull(r, img.Signature); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+	}
+	return img, nil
+}
+
+// WriteAck acknowledges an image
+func WriteAck(w io.Writer) error {
+	_, err := w.Write([]byte{TypeAck})
+	return err
+}
+
+// ReadAck reads an acknowledgement
+func ReadAck(r io.Reader) error {
+	var b [1]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return err
+	}
+	if b[0] != TypeAck {
+		return fmt.Errorf("unexpected message type %q", b[0])
+	}
+	return nil
+}
+
+// unexpectedEOF reports the end of the stream within a message as error
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
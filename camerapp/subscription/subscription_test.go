@@ -0,0 +1,75 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subscription
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestMessages(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteSubscribe(&buf, 3); err != nil {
+		t.Fatal(err)
+	}
+	if window, err := ReadSubscribe(&buf); err != nil || window != 3 {
+		t.Errorf("Expected window 3, got %d, %v", window, err)
+	}
+	if err := WriteSubscribe(&buf, 0); err == nil {
+		t.Errorf("Expected error for window 0")
+	}
+
+	images := []*Image{
+		{Name: "a.jpg", CaptureTime: time.Unix(1600000000, 42), Content: []byte("first image"),
+			Signature: []byte("signature")},
+		{Name: "b.png", CaptureTime: time.Unix(1600000001, 0), Content: []byte{}},
+	}
+	for _, img := range images {
+		if err := WriteImage(&buf, img); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, img := range images {
+		read, err := ReadImage(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if read.Name != img.Name || !read.CaptureTime.Equal(img.CaptureTime) ||
+			!bytes.Equal(read.Content, img.Content) || !bytes.Equal(read.Signature, img.Signature) {
+			t.Errorf("Expected %v, got %v", img, read)
+		}
+	}
+	if _, err := ReadImage(&buf); err != io.EOF {
+		t.Errorf("Expected EOF after the last image, got %v", err)
+	}
+
+	if err := WriteImage(&buf, images[0]); err != nil {
+		t.Fatal(err)
+	}
+	truncated := bytes.NewReader(buf.Bytes()[:buf.Len()-1])
+	if _, err := ReadImage(truncated); err != io.ErrUnexpectedEOF {
+		t.Errorf("Expected ErrUnexpectedEOF for truncated image, got %v", err)
+	}
+
+	buf.Reset()
+	if err := WriteAck(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := ReadAck(&buf); err != nil {
+		t.Errorf("Unexpected error reading acknowledgement: %v", err)
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// In datagram mode (-datagram), each datagram on stdin/stdout is prefixed with its length
+// as a big endian uint16, so that the datagram boundaries are preserved.
+const (
+	datagramLenSize = 2
+	maxDatagramSize = 65535
+)
+
+// copyStream copies the data from src to dst without regard to datagram boundaries
+func copyStream(dst io.Writer, src io.Reader) error {
+	_, err := io.Copy(dst, src)
+	return err
+}
+
+// copyDatagrams copies datagrams from src to dst until EOF on src. Each read from src is
+// written as a single datagram.
+func copyDatagrams(dst io.Writer, src io.Reader) error {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, err := src.Read(buf)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if _, err = dst.Write(buf[:n]); err != nil {
+			return err
+		}
+	}
+}
+
+// copyFramedToDatagrams reads length-prefixed datagrams from src until EOF, and writes
+// each as a single datagram to dst
+func copyFramedToDatagrams(dst io.Writer, src io.Reader) error {
+	r := bufio.NewReader(src)
+	header := make([]byte, datagramLenSize)
+	buf := make([]byte, maxDatagramSize)
+	for {
+		if _, err := io.ReadFull(r, header); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("truncated datagram length on input: %v", err)
+		}
+		n := binary.BigEndian.Uint16(header)
+		if _, err := io.ReadFull(r, buf[:n]); err != nil {
+			return fmt.Errorf("truncated datagram on input, expected %d bytes: %v", n, err)
+		}
+		if _, err := dst.Write(buf[:n]); err != nil {
+			return err
+		}
+	}
+}
+
+// copyDatagramsToFramed reads datagrams from src until EOF, and writes each prefixed with
+// its length to dst
+func copyDatagramsToFramed(dst io.Writer, src io.Reader) error {
+	buf := make([]byte, datagramLenSize+maxDatagramSize)
+	for {
+		n, err := src.Read(buf[datagramLenSize:])
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		binary.BigEndian.PutUint16(buf, uint16(n))
+		if _, err = dst.Write(buf[:datagramLenSize+n]); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// datagramConn records each write as a datagram, and returns one datagram per read
+type datagramConn struct {
+	written [][]byte
+	toRead  [][]byte
+}
+
+func (c *datagramConn) Write(b []byte) (int, error) {
+	c.written = append(c.written, append([]byte(nil), b...))
+	return len(b), nil
+}
+
+func (c *datagramConn) Read(b []byte) (int, error) {
+	if len(c.toRead) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(b, c.toRead[0])
+	c.toRead = c.toRead[1:]
+	return n, nil
+}
+
+func TestDatagramFraming(t *testing.T) {
+	datagrams := [][]byte{[]byte("first"), {}, bytes.Repeat([]byte{42}, 1500), []byte("last")}
+
+	// Datagrams received from the connection are framed on the output
+	conn := &datagramConn{toRead: datagrams}
+	var framed bytes.Buffer
+	if err := copyDatagramsToFramed(&framed, conn); err != nil {
+		t.Fatal(err)
+	}
+
+	// The framed input is split into the same datagrams when written to the connection,
+	// no matter how the input is split into reads
+	conn = &datagramConn{}
+	if err := copyFramedToDatagrams(conn, &oneByteReader{r: &framed}); err != nil {
+		t.Fatal(err)
+	}
+	if len(conn.written) != len(datagrams) {
+		t.Fatalf("Expected %d datagrams, got %d", len(datagrams), len(conn.written))
+	}
+	for i := range datagrams {
+		if !bytes.Equal(conn.written[i], datagrams[i]) {
+			t.Errorf("Datagram %d: expected %q, got %q", i, datagrams[i], conn.written[i])
+		}
+	}
+}
+
+func TestDatagramFramingTruncated(t *testing.T) {
+	conn := &datagramConn{}
+	err := copyFramedToDatagrams(conn, bytes.NewReader([]byte{0, 5, 'a', 'b'}))
+	if err == nil {
+		t.Errorf("Expected error for truncated datagram")
+	}
+	if len(conn.written) != 0 {
+		t.Errorf("Expected no datagram written, got %q", conn.written)
+	}
+}
+
+type oneByteReader struct {
+	r io.Reader
+}
+
+func (r *oneByteReader) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	return r.r.Read(b[:1])
+}
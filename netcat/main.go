@@ -15,35 +15,85 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"io"
-	golog "log"
 	"os"
 	"os/exec"
 	"strconv"
-	"sync"
+	"time"
 
 	"github.com/netsec-ethz/scion-apps/netcat/modes"
+	"github.com/netsec-ethz/scion-apps/pkg/appnet"
+	"github.com/netsec-ethz/scion-apps/ssh/scionutils"
 	scionlog "github.com/scionproto/scion/go/lib/log"
+	"github.com/scionproto/scion/go/lib/pathpol"
+	"github.com/scionproto/scion/go/lib/snet"
 
 	log "github.com/inconshreveable/log15"
 )
 
+// Exit statuses, so that scripts can distinguish the reasons of a failure
+const (
+	exitError            = 1
+	exitUsage            = 2
+	exitResolve          = 3
+	exitNoPath           = 4
+	exitHandshakeTimeout = 5
+	exitRemoteClosed     = 6
+	exitIdleTimeout      = 7
+	exitVerification     = 8
+)
+
 var (
 	quicTLSKeyPath         string
 	quicTLSCertificatePath string
+	tlsCAPath              string
+	tlsPins                string
+	quicTLSConfig          *tls.Config
 
 	extraByte bool
 	listen    bool
 
-	udpMode bool
+	udpMode        bool
+	udpIdleTimeout time.Duration
+	udpMaxSessions int
+	udpBuffer      int
+	datagramMode   bool
 
 	repeatAfter  bool
 	repeatDuring bool
 
 	commandString string
 
+	shutdownOnEOF bool
+	quitAfterEOF  int
+
+	scanMode     bool
+	scanParallel int
+
+	timeout         int
+	keepAlive       bool
+	quicIdleTimeout time.Duration
+
+	relayListenAddr string
+	relayDialAddr   string
+
+	multiStream bool
+
+	interactive bool
+	pathAlgoStr string
+	pathAlgo    int
+	pathAlgoSet bool
+	policyFile  string
+	policyName  string
+	pathConf    *scionutils.PathAppConf
+
+	sendPath   string
+	recvPath   string
+	recvResume bool
+
 	verboseMode     bool
 	veryVerboseMode bool
 )
@@ -51,6 +101,9 @@ var (
 func printUsage() {
 	fmt.Println("netcat [flags] host-address:port")
 	fmt.Println("netcat [flags] -l port")
+	fmt.Println("netcat [flags] -L network:address host-address:port")
+	fmt.Println("netcat [flags] -z host-address ports")
+	fmt.Println("netcat [flags] -l -R network:address port")
 	fmt.Println("The host address is specified as ISD-AS,[IP Address]")
 	fmt.Println("Example SCION address: 17-ffaa:1:bfd,[127.0.0.1]")
 	fmt.Println("Note that due to the nature of the UDP/QUIC protocols, the server will only notice incoming clients once data has been sent. You can use the -b argument (on both sides) to force clients to send an extra byte which will then be ignored by the server")
@@ -60,13 +113,70 @@ func printUsage() {
 	fmt.Println("  -k: After the connection ended, accept new connections. Requires -l flag. If -u flag is present, requires -c flag. Incompatible with -K flag")
 	fmt.Println("  -K: After the connection has been established, accept new connections. Requires -l and -c flags. Incompatible with -k flag")
 	fmt.Println("  -c: Instead of piping the connection to stdin/stdout, run the given command using /bin/sh")
+	fmt.Println("  -z: Scan mode, probe the given comma separated ports and port ranges (e.g. 80,1000-1010) of the host without sending data, and print the state of each port and the path used. Exits with status 1 if no port is open. QUIC ports are open if the handshake succeeds, filtered if there is no response. UDP ports are open if they reply to a probe packet")
+	fmt.Println("  -parallel: Number of ports probed concurrently in scan mode (default: 8)")
+	fmt.Println("  -w: Timeout in seconds. Connections which cannot be established or are idle (no data in either direction) time out after the given number of seconds. In scan mode, the timeout of a probe (default: 5)")
+	fmt.Println("  -keepAlive: Send QUIC keepalive packets, at half the idle timeout of the peer (default: true)")
+	fmt.Println("  -idleTimeout: The QUIC connection is closed if no packets arrive for the given duration, e.g. 1m (default: 30s)")
+	fmt.Println("  -L: Relay mode, accept connections on the given local address and relay each over a new connection to the SCION host. The address is given as tcp:host:port, udp:host:port or unix:path. UDP datagrams are relayed with their boundaries intact, one connection per local source address, and require -u flag. Incompatible with -l, -k, -K and -c flags")
+	fmt.Println("  -R: Relay mode, relay each incoming SCION connection over a new connection to the given local address. The address is given as tcp:host:port, udp:host:port or unix:path. UDP addresses require -u flag. Requires -l flag. Incompatible with -k, -K and -c flags")
+	fmt.Println("  -streams: Carry many connections as streams of a single QUIC session, so that they share one handshake and one path. With -l flag, each stream opened by a client is accepted as a connection (e.g. with -K, each stream runs its own command). With -L flag, each local connection is relayed over a new stream. Requires -l or -L flag. Incompatible with -u flag")
+	fmt.Println("  -send: File transfer mode, send the given file. The receiver verifies the SHA-256 hash of the file. Incompatible with -u, -k, -K, -c, -L and -R flags")
+	fmt.Println("  -recv: File transfer mode, receive a file sent with -send and write it to the given path. Exits with status 8 if the file does not match the hash sent. Incompatible with -u, -k, -K, -c, -L and -R flags")
+	fmt.Println("  -resume: Resume a partial transfer, only receive the data after the end of the existing file given with -recv")
+	fmt.Println("  -N: Shutdown the write direction of the connection after EOF on the input, so the peer reads EOF. Requires QUIC mode")
+	fmt.Println("  -q: After EOF on the input, wait the given number of seconds and then quit. Negative values wait forever (default: -1)")
 	fmt.Println("  -u: UDP mode")
+	fmt.Println("  -datagram: In UDP mode, preserve the datagram boundaries on stdin/stdout, or the command's stdin/stdout. Each datagram is prefixed with its length as a 2 byte big endian integer. Requires -u flag")
+	fmt.Println("  -udpIdleTimeout: In UDP listen mode and when relaying from a local UDP address, close connections after the given time without packets, e.g. 30s. 0 disables the timeout (default: 0)")
+	fmt.Println("  -udpMaxSessions: In UDP listen mode, the maximum number of concurrent connections. Packets from new remotes are dropped when reached. 0 means unlimited (default: 64)")
+	fmt.Println("  -udpBuffer: In UDP listen mode, the number of packets buffered per connection. Further packets are dropped until they are read (default: 64)")
+	fmt.Println("  -i: Interactive path selection, prompt to choose the path to the remote. The prompt is written to stderr and read from the terminal")
+	fmt.Println("  -pathAlgo: Path selection algorithm, choose the path with the lowest number of hops (shortest) or the largest MTU (mtu). Incompatible with -i flag (default: first path)")
+	fmt.Println("  -policy: Only use paths allowed by a path policy from the given JSON file of named policies, as used by the ssh client, e.g. {\"no133\": {\"acl\": [\"- 1-ff00:0:133\", \"+\"]}}. Applied before -i and -pathAlgo flags")
+	fmt.Println("  -policy-name: Name of the policy to apply from the -policy file, may be omitted if the file contains a single policy")
 	fmt.Println("  -local: Local SCION address (default localhost)")
 	fmt.Println("  -b: Send or expect an extra (throw-away) byte before the actual data")
-	fmt.Println("  -tlsKey: TLS key path. Requires -l flag (default: ./key.pem)")
-	fmt.Println("  -tlsCert: TLS certificate path. Requires -l flag (default: ./certificate.pem)")
+	fmt.Println("  -tlsKey: TLS key path. In listen mode, the dummy certificate is used if neither key nor certificate exist. Without -l flag, the client certificate to present to the server (default: ./key.pem)")
+	fmt.Println("  -tlsCert: TLS certificate path, see -tlsKey (default: ./certificate.pem)")
+	fmt.Println("  -tlsCA: Verify that the peer's certificate is issued by a CA in the given PEM file. With -l flag, clients are required to present a certificate (mutual TLS)")
+	fmt.Println("  -tlsPin: Verify that the peer's certificate matches one of the given comma separated SHA-256 fingerprints. With -l flag, clients are required to present a certificate (mutual TLS)")
 	fmt.Println("  -v: Enable verbose mode")
 	fmt.Println("  -vv: Enable very verbose mode")
+	fmt.Println("Exit status:")
+	fmt.Println("  0: Success")
+	fmt.Println("  1: Error, or no open port in scan mode")
+	fmt.Println("  2: Invalid usage")
+	fmt.Println("  3: The remote address could not be resolved")
+	fmt.Println("  4: No path to the remote")
+	fmt.Println("  5: The QUIC handshake timed out")
+	fmt.Println("  6: The connection was closed by the remote or lost")
+	fmt.Println("  7: The connection was idle longer than the -w timeout")
+	fmt.Println("  8: The received file does not match the hash sent, in file transfer mode")
+}
+
+// exitCodeError is an error that causes a specific exit status
+type exitCodeError struct {
+	code int
+	err  error
+}
+
+func (e *exitCodeError) Error() string {
+	return e.err.Error()
+}
+
+// exitCode returns the exit status for the error
+func exitCode(err error) int {
+	if e, ok := err.(*exitCodeError); ok {
+		return e.code
+	}
+	return exitError
+}
+
+// fatal prints the error message and exits with the given status
+func fatal(code int, format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "netcat: "+format+"\n", args...)
+	os.Exit(code)
 }
 
 func main() {
@@ -74,15 +184,40 @@ func main() {
 	flag.Usage = printUsage
 	flag.StringVar(&quicTLSKeyPath, "tlsKey", "./key.pem", "TLS key path")
 	flag.StringVar(&quicTLSCertificatePath, "tlsCert", "./certificate.pem", "TLS certificate path")
+	flag.StringVar(&tlsCAPath, "tlsCA", "", "CA certificates to verify the peer with")
+	flag.StringVar(&tlsPins, "tlsPin", "", "SHA-256 fingerprints of accepted peer certificates")
 	flag.BoolVar(&extraByte, "b", false, "Expect extra byte")
 	flag.BoolVar(&listen, "l", false, "Listen mode")
 	flag.BoolVar(&udpMode, "u", false, "UDP mode")
+	flag.DurationVar(&udpIdleTimeout, "udpIdleTimeout", 0, "Idle timeout of UDP listen connections")
+	flag.IntVar(&udpMaxSessions, "udpMaxSessions", 64, "Maximum number of concurrent UDP listen connections")
+	flag.IntVar(&udpBuffer, "udpBuffer", 64, "Number of packets buffered per UDP listen connection")
+	flag.BoolVar(&datagramMode, "datagram", false, "Length-prefixed datagrams on stdin/stdout")
 	flag.BoolVar(&repeatAfter, "k", false, "Accept new connections after connection end")
 	flag.BoolVar(&repeatDuring, "K", false, "Accept multiple connections concurrently")
 	flag.StringVar(&commandString, "c", "", "Command")
+	flag.StringVar(&sendPath, "send", "", "Send the given file")
+	flag.StringVar(&recvPath, "recv", "", "Receive a file to the given path")
+	flag.BoolVar(&recvResume, "resume", false, "Resume receiving a partial file")
+	flag.BoolVar(&shutdownOnEOF, "N", false, "Shutdown the write direction after EOF on the input")
+	flag.IntVar(&quitAfterEOF, "q", -1, "Quit the given number of seconds after EOF on the input")
+	flag.BoolVar(&scanMode, "z", false, "Scan mode")
+	flag.IntVar(&scanParallel, "parallel", 8, "Number of concurrent probes in scan mode")
+	flag.IntVar(&timeout, "w", 0, "Connect and idle timeout in seconds")
+	flag.BoolVar(&keepAlive, "keepAlive", true, "Send QUIC keepalive packets")
+	flag.DurationVar(&quicIdleTimeout, "idleTimeout", 0, "QUIC idle timeout")
+	flag.StringVar(&relayListenAddr, "L", "", "Relay connections accepted on this local address to the SCION host")
+	flag.StringVar(&relayDialAddr, "R", "", "Relay incoming SCION connections to this local address")
+	flag.BoolVar(&multiStream, "streams", false, "Carry connections as streams of a single QUIC session")
+	flag.BoolVar(&interactive, "i", false, "Interactive path selection")
+	flag.StringVar(&pathAlgoStr, "pathAlgo", "", "Path selection algorithm (\"shortest\", \"mtu\")")
+	flag.StringVar(&policyFile, "policy", "", "JSON path policy file")
+	flag.StringVar(&policyName, "policy-name", "", "Name of the policy to apply")
 	flag.BoolVar(&verboseMode, "v", false, "Verbose mode")
 	flag.BoolVar(&veryVerboseMode, "vv", false, "Very verbose mode")
 	flag.Parse()
+	flagset := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { flagset[f.Name] = true })
 
 	if veryVerboseMode {
 		_ = scionlog.SetupLogConsole("debug")
@@ -93,45 +228,196 @@ func main() {
 	}
 
 	tail := flag.Args()
-	if len(tail) != 1 {
+	if scanMode {
+		if len(tail) != 2 {
+			fatal(exitUsage, "Incorrect number of arguments! Expected host-address ports, got: %v", tail)
+		}
+	} else if len(tail) != 1 {
 		expected := "host-address:port"
 		if listen {
 			expected = "port"
 		}
-		golog.Panicf("Incorrect number of arguments! Expected %s, got: %v", expected, tail)
+		fatal(exitUsage, "Incorrect number of arguments! Expected %s, got: %v", expected, tail)
 	}
 
 	if repeatAfter && repeatDuring {
-		golog.Panicf("-k and -K flags are exclusive!")
+		fatal(exitUsage, "-k and -K flags are exclusive!")
 	}
 	if repeatAfter && !listen {
-		golog.Panicf("-k flag requires -l flag!")
+		fatal(exitUsage, "-k flag requires -l flag!")
 	}
 	if repeatDuring && !listen {
-		golog.Panicf("-K flag requires -l flag!")
+		fatal(exitUsage, "-K flag requires -l flag!")
 	}
 	if repeatAfter && udpMode && commandString == "" {
-		golog.Panicf("-k flag in UDP mode requires -c flag!")
+		fatal(exitUsage, "-k flag in UDP mode requires -c flag!")
 	}
 	if repeatDuring && commandString == "" {
-		golog.Panicf("-K flag requires -c flag!")
+		fatal(exitUsage, "-K flag requires -c flag!")
+	}
+	if shutdownOnEOF && udpMode {
+		fatal(exitUsage, "-N flag is incompatible with -u flag!")
+	}
+	if relayListenAddr != "" && relayDialAddr != "" {
+		fatal(exitUsage, "-L and -R flags are exclusive!")
+	}
+	if relayListenAddr != "" && listen {
+		fatal(exitUsage, "-L flag is incompatible with -l flag!")
+	}
+	if relayDialAddr != "" && !listen {
+		fatal(exitUsage, "-R flag requires -l flag!")
+	}
+	if (isDatagramRelayAddr(relayListenAddr) || isDatagramRelayAddr(relayDialAddr)) && !udpMode {
+		fatal(exitUsage, "UDP relay addresses require -u flag!")
+	}
+	if datagramMode && !udpMode {
+		fatal(exitUsage, "-datagram flag requires -u flag!")
+	}
+	if (relayListenAddr != "" || relayDialAddr != "") && (repeatAfter || repeatDuring || commandString != "") {
+		fatal(exitUsage, "-L and -R flags are incompatible with -k, -K and -c flags!")
+	}
+	if multiStream && !listen && relayListenAddr == "" {
+		fatal(exitUsage, "-streams flag requires -l or -L flag!")
+	}
+	if multiStream && udpMode {
+		fatal(exitUsage, "-streams flag is incompatible with -u flag!")
+	}
+
+	if (tlsCAPath != "" || tlsPins != "" || (!listen && (flagset["tlsCert"] || flagset["tlsKey"]))) && udpMode {
+		fatal(exitUsage, "TLS flags are incompatible with -u flag!")
+	}
+
+	if scanMode && (listen || commandString != "" || relayListenAddr != "" || relayDialAddr != "") {
+		fatal(exitUsage, "-z flag is incompatible with -l, -c, -L and -R flags!")
+	}
+	if scanParallel < 1 {
+		fatal(exitUsage, "-parallel flag requires a positive number!")
+	}
+
+	fileMode := sendPath != "" || recvPath != ""
+	if sendPath != "" && recvPath != "" {
+		fatal(exitUsage, "-send and -recv flags are exclusive!")
+	}
+	if fileMode && (udpMode || repeatAfter || repeatDuring || commandString != "" ||
+		relayListenAddr != "" || relayDialAddr != "" || scanMode) {
+		fatal(exitUsage, "-send and -recv flags are incompatible with -u, -k, -K, -c, -L, -R and -z flags!")
+	}
+	if recvResume && recvPath == "" {
+		fatal(exitUsage, "-resume flag requires -recv flag!")
+	}
+
+	if listen && (interactive || pathAlgoStr != "" || policyFile != "") {
+		fatal(exitUsage, "-i, -pathAlgo and -policy flags are incompatible with -l flag!")
+	}
+	if interactive && pathAlgoStr != "" {
+		fatal(exitUsage, "-i and -pathAlgo flags are exclusive!")
+	}
+	var err error
+	pathAlgo, pathAlgoSet, err = parsePathAlgo(pathAlgoStr)
+	if err != nil {
+		fatal(exitUsage, "Invalid -pathAlgo flag: %v", err)
+	}
+	var policy *pathpol.Policy
+	if policyFile != "" {
+		policy, err = scionutils.LoadPolicy(policyFile, policyName)
+		if err != nil {
+			fatal(exitUsage, "Invalid path policy: %v", err)
+		}
+	} else if policyName != "" {
+		fatal(exitUsage, "-policy-name flag requires -policy flag!")
+	}
+	// Each connection uses a single path
+	pathConf, err = scionutils.NewPathAppConf(policy, "static")
+	if err != nil {
+		fatal(exitUsage, "Invalid path configuration: %v", err)
 	}
 
 	log.Info("Launching netcat")
 
+	if !udpMode {
+		var err error
+		if listen {
+			quicTLSConfig, err = serverTLSConfig(flagset["tlsCert"], flagset["tlsKey"])
+		} else {
+			quicTLSConfig, err = clientTLSConfig(flagset["tlsCert"], flagset["tlsKey"])
+		}
+		if err != nil {
+			fatal(exitUsage, "Invalid TLS configuration: %v", err)
+		}
+	}
+
+	if scanMode {
+		ports, err := parsePorts(tail[1])
+		if err != nil {
+			fatal(exitUsage, "Invalid ports %s: %v", tail[1], err)
+		}
+		scanTimeout := defaultScanTimeout
+		if timeout > 0 {
+			scanTimeout = time.Duration(timeout) * time.Second
+		}
+		open, err := scanPorts(tail[0], ports, quicTLSConfig, scanTimeout, scanParallel)
+		if err != nil {
+			fatal(exitCode(err), "Error scanning %s: %v", tail[0], err)
+		}
+		if open == 0 {
+			os.Exit(exitError)
+		}
+		return
+	}
+
+	if relayListenAddr != "" {
+		dial := func() (io.ReadWriteCloser, error) {
+			return doDial(tail[0])
+		}
+		if multiStream {
+			dialer, err := doDialStreams(tail[0])
+			if err != nil {
+				fatal(exitCode(err), "%v", err)
+			}
+			defer dialer.Close()
+			dial = func() (io.ReadWriteCloser, error) {
+				conn, err := dialer.OpenStream()
+				if err != nil {
+					return nil, dialError(tail[0], err)
+				}
+				return sendExtraByte(conn)
+			}
+		}
+		err := relayLocalToSCION(relayListenAddr, dial)
+		if err != nil {
+			fatal(exitError, "Error relaying from %s: %v", relayListenAddr, err)
+		}
+		return
+	}
+
 	var conns chan io.ReadWriteCloser
 
 	if listen {
-		port, err := strconv.Atoi(tail[0])
+		var port int
+		port, err = strconv.Atoi(tail[0])
 		if err != nil {
-			printUsage()
-			golog.Panicf("Invalid port %s: %v", tail[0], err)
+			fatal(exitUsage, "Invalid port %s: %v", tail[0], err)
+		}
+		conns, err = doListen(uint16(port))
+		if err != nil {
+			fatal(exitError, "%v", err)
 		}
-		conns = doListen(uint16(port))
 	} else {
 		remoteAddr := tail[0]
+		conn, err := doDial(remoteAddr)
+		if err != nil {
+			fatal(exitCode(err), "%v", err)
+		}
 		conns = make(chan io.ReadWriteCloser, 1)
-		conns <- doDial(remoteAddr)
+		conns <- conn
+	}
+
+	if relayDialAddr != "" {
+		err := relaySCIONToLocal(conns, relayDialAddr)
+		if err != nil {
+			fatal(exitError, "Error relaying to %s: %v", relayDialAddr, err)
+		}
+		return
 	}
 
 	if repeatAfter {
@@ -140,7 +426,9 @@ func main() {
 			go func(conn io.ReadWriteCloser) {
 				select {
 				case isAvailable <- true:
-					pipeConn(conn)
+					if err := pipeConn(conn); err != nil {
+						log.Error("Error piping connection", "conn", conn, "err", err)
+					}
 					<-isAvailable
 				default:
 					log.Info("Closing new connection as there's already a connection", "conn", conn)
@@ -150,17 +438,31 @@ func main() {
 		}
 	} else if repeatDuring {
 		for conn := range conns {
-			go pipeConn(conn)
+			go func(conn io.ReadWriteCloser) {
+				if err := pipeConn(conn); err != nil {
+					log.Error("Error piping connection", "conn", conn, "err", err)
+				}
+			}(conn)
 		}
 	} else {
-		conn := <-conns // Pipe the first incoming connection
+		conn, ok := <-conns // Pipe the first incoming connection
+		if !ok {
+			fatal(exitError, "Listener failed before accepting a connection")
+		}
 		go func() {
 			for conn := range conns {
 				// Reject all other incoming connections
 				conn.Close()
 			}
 		}()
-		pipeConn(conn)
+		if fileMode {
+			err = transferFile(conn)
+		} else {
+			err = pipeConn(conn)
+		}
+		if err != nil {
+			fatal(exitCode(err), "%v", err)
+		}
 	}
 
 	// Note that we don't close the connection currently
@@ -168,7 +470,10 @@ func main() {
 	log.Debug("Done, closing now")
 }
 
-func pipeConn(conn io.ReadWriteCloser) {
+// pipeConn pipes the connection to stdin/stdout or the command, until both directions are
+// done. The returned error causes the exit status if this is the only connection.
+func pipeConn(conn io.ReadWriteCloser) error {
+	conn = withIdleTimeout(conn)
 	closeThis := func() {
 		log.Debug("Closing connection...", "conn", conn)
 		err := conn.Close()
@@ -190,26 +495,26 @@ func pipeConn(conn io.ReadWriteCloser) {
 		var err error
 		writer, err = cmd.StdinPipe()
 		if err != nil {
-			log.Crit("Error getting command's stdin pipe", "cmd", cmd, "err", err)
-			return
+			closeThis()
+			return fmt.Errorf("error getting command's stdin pipe: %v", err)
 		}
 		reader, err = cmd.StdoutPipe()
 		if err != nil {
-			log.Crit("Error getting command's stdout pipe", "cmd", cmd, "err", err)
-			return
+			closeThis()
+			return fmt.Errorf("error getting command's stdout pipe: %v", err)
 		}
 		errreader, err := cmd.StderrPipe()
 		if err != nil {
-			log.Crit("Error getting command's stderr pipe", "cmd", cmd, "err", err)
-			return
+			closeThis()
+			return fmt.Errorf("error getting command's stderr pipe: %v", err)
 		}
 		go func() {
 			io.Copy(os.Stderr, errreader) //nolint:errcheck // XXX(matzf): should an error here be handled?
 		}()
 		err = cmd.Start()
 		if err != nil {
-			log.Crit("Error starting command", "cmd", cmd, "err", err)
-			return
+			closeThis()
+			return fmt.Errorf("error starting command: %v", err)
 		}
 		prevCloseThis := closeThis
 		closeThis = func() {
@@ -222,50 +527,192 @@ func pipeConn(conn io.ReadWriteCloser) {
 		}
 	}
 
-	var pipesWait sync.WaitGroup
-	pipesWait.Add(2)
-
+	inputDone := make(chan error, 1)
+	outputDone := make(chan error, 1)
+	copyInput, copyOutput := copyStream, copyStream
+	if datagramMode {
+		copyInput, copyOutput = copyFramedToDatagrams, copyDatagramsToFramed
+	}
+	go func() {
+		inputDone <- copyInput(conn, reader)
+	}()
 	go func() {
-		_, err := io.Copy(conn, reader)
-		log.Debug("Done copying from (std/process) input", "conn", conn, "error", err)
-		pipesWait.Done()
+		outputDone <- copyOutput(writer, conn)
 	}()
-	_, err := io.Copy(writer, conn)
-	log.Debug("Done copying to (std/process) output", "conn", conn, "error", err)
-	pipesWait.Done()
 
-	pipesWait.Wait()
+	// Wait until both directions are done, or until the -q timeout after EOF on the input.
+	// The channels are set to nil once done, so that they are no longer selected.
+	var quit <-chan time.Time
+	var connErr error
+	for inputDone != nil || outputDone != nil {
+		select {
+		case err := <-inputDone:
+			log.Debug("Done copying from (std/process) input", "conn", conn, "error", err)
+			inputDone = nil
+			if err != nil {
+				if connErr == nil {
+					connErr = err
+				}
+				break
+			}
+			if shutdownOnEOF {
+				closeWrite(conn)
+			}
+			if quitAfterEOF >= 0 {
+				quit = time.After(time.Duration(quitAfterEOF) * time.Second)
+			}
+		case err := <-outputDone:
+			log.Debug("Done copying to (std/process) output", "conn", conn, "error", err)
+			outputDone = nil
+			if err != nil && connErr == nil {
+				connErr = err
+			}
+			// Pass on the EOF to the command
+			if writer != os.Stdout {
+				if c, ok := writer.(io.Closer); ok {
+					c.Close()
+				}
+			}
+		case <-quit:
+			log.Debug("Quitting after EOF on (std/process) input", "conn", conn)
+			inputDone, outputDone = nil, nil
+		}
+	}
 	closeThis()
 
-	log.Info("Connection closed", "conn", conn)
+	log.Info("Connection closed", "conn", conn, "err", connErr)
+	if connErr != nil {
+		return connClosedError(connErr)
+	}
+	return nil
+}
+
+// transferFile sends or receives the file given with -send or -recv over the connection
+func transferFile(conn io.ReadWriteCloser) error {
+	conn = withIdleTimeout(conn)
+	defer conn.Close()
+
+	if sendPath != "" {
+		log.Info("Sending file", "conn", conn, "file", sendPath)
+		return sendFile(conn, sendPath)
+	}
+	log.Info("Receiving file", "conn", conn, "file", recvPath)
+	return receiveFile(conn, recvPath, recvResume)
+}
+
+// connClosedError wraps an error reading from or writing to the connection with its exit
+// status
+func connClosedError(err error) error {
+	if err == errIdleTimeout {
+		return &exitCodeError{code: exitIdleTimeout, err: err}
+	}
+	return &exitCodeError{code: exitRemoteClosed, err: fmt.Errorf("connection closed: %v", err)}
+}
+
+// closeWrite closes the write direction of the connection, if it supports half-close
+func closeWrite(conn io.ReadWriteCloser) {
+	cw, ok := conn.(closeWriter)
+	if !ok {
+		log.Debug("Connection does not support half-close", "conn", conn)
+		return
+	}
+	log.Debug("Closing write direction of connection", "conn", conn)
+	err := cw.CloseWrite()
+	if err != nil {
+		log.Error("Error closing write direction of connection", "conn", conn, "err", err)
+	}
 }
 
-func doDial(remoteAddr string) io.ReadWriteCloser {
+// doDial resolves the remote address, chooses the path and dials. The returned errors
+// carry the exit status for the failure.
+func doDial(remoteAddr string) (io.ReadWriteCloser, error) {
+	raddr, err := resolveRemote(remoteAddr)
+	if err != nil {
+		return nil, err
+	}
+
 	var conn io.ReadWriteCloser
 	if udpMode {
-		conn = modes.DoDialUDP(remoteAddr)
+		conn, err = modes.DoDialUDP(raddr)
 	} else {
-		conn = modes.DoDialQUIC(remoteAddr)
+		conn, err = modes.DoDialQUIC(raddr, quicTLSConfig, quicConfig())
+	}
+	if err != nil {
+		return nil, dialError(remoteAddr, err)
 	}
+	return sendExtraByte(conn)
+}
+
+// doDialStreams resolves the remote address, chooses the path and dials a QUIC session on
+// which connections are opened as streams, see doDial.
+func doDialStreams(remoteAddr string) (*modes.QUICStreamDialer, error) {
+	raddr, err := resolveRemote(remoteAddr)
+	if err != nil {
+		return nil, err
+	}
+	dialer := modes.NewQUICStreamDialer(raddr, quicTLSConfig, quicConfig())
+	if err = dialer.Connect(); err != nil {
+		return nil, dialError(remoteAddr, err)
+	}
+	return dialer, nil
+}
+
+// resolveRemote resolves the remote address and sets the path to it
+func resolveRemote(remoteAddr string) (*snet.Addr, error) {
+	raddr, err := appnet.ResolveUDPAddr(remoteAddr)
+	if err != nil {
+		return nil, &exitCodeError{code: exitResolve, err: fmt.Errorf("can't resolve %s: %v", remoteAddr, err)}
+	}
+	if _, err = choosePath(raddr); err != nil {
+		return nil, err
+	}
+	return raddr, nil
+}
+
+// dialError wraps an error of dialing the remote address with its exit status
+func dialError(remoteAddr string, err error) error {
+	if isTimeout(err) {
+		return &exitCodeError{code: exitHandshakeTimeout,
+			err: fmt.Errorf("handshake with %s timed out: %v", remoteAddr, err)}
+	}
+	return fmt.Errorf("can't dial %s: %v", remoteAddr, err)
+}
 
+// sendExtraByte writes the extra byte to the new connection, if enabled with -b
+func sendExtraByte(conn io.ReadWriteCloser) (io.ReadWriteCloser, error) {
 	if extraByte {
 		_, err := conn.Write([]byte{88}) // ascii('X')
 		if err != nil {
-			golog.Panicf("Error writing extra byte: %v", err)
+			conn.Close()
+			return nil, fmt.Errorf("error writing extra byte: %v", err)
 		}
 
 		log.Debug("Sent extra byte!")
 	}
 
-	return conn
+	return conn, nil
 }
 
-func doListen(port uint16) chan io.ReadWriteCloser {
+// udpListenConfig returns the configuration of UDP listen connections according to the
+// -udpIdleTimeout, -udpMaxSessions and -udpBuffer flags
+func udpListenConfig() modes.UDPListenConfig {
+	return modes.UDPListenConfig{
+		IdleTimeout:   udpIdleTimeout,
+		MaxSessions:   udpMaxSessions,
+		BufferPackets: udpBuffer,
+	}
+}
+
+func doListen(port uint16) (chan io.ReadWriteCloser, error) {
 	var conns chan io.ReadWriteCloser
+	var err error
 	if udpMode {
-		conns = modes.DoListenUDP(port)
+		conns, err = modes.DoListenUDP(port, udpListenConfig())
 	} else {
-		conns = modes.DoListenQUIC(port)
+		conns, err = modes.DoListenQUIC(port, quicTLSConfig, quicConfig(), multiStream)
+	}
+	if err != nil {
+		return nil, err
 	}
 
 	var nconns chan io.ReadWriteCloser
@@ -284,10 +731,11 @@ func doListen(port uint16) chan io.ReadWriteCloser {
 
 				nconns <- conn
 			}
+			close(nconns)
 		}()
 	} else {
 		nconns = conns
 	}
 
-	return nconns
+	return nconns, nil
 }
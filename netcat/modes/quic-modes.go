@@ -15,33 +15,56 @@
 package modes
 
 import (
+	"crypto/tls"
+	"fmt"
 	"io"
-	golog "log"
+	"strings"
+	"sync"
 
 	"github.com/lucas-clemente/quic-go"
 	"github.com/netsec-ethz/scion-apps/pkg/appnet/appquic"
+	"github.com/scionproto/scion/go/lib/snet"
 
 	log "github.com/inconshreveable/log15"
 )
 
+// sessConn is a connection over a QUIC stream
 type sessConn struct {
+	// The session is closed together with the stream. It is nil if the session is shared
+	// with other streams.
 	sess   quic.Session
 	stream quic.Stream
 }
 
 func (conn *sessConn) Read(b []byte) (n int, err error) {
-	return conn.stream.Read(b)
+	n, err = conn.stream.Read(b)
+	if err != nil && isPeerGoingAway(err) {
+		// The peer closed the session normally, which ends the stream as well
+		err = io.EOF
+	}
+	return n, err
 }
 
 func (conn *sessConn) Write(b []byte) (n int, err error) {
 	return conn.stream.Write(b)
 }
 
+// CloseWrite closes the write direction of the stream, the peer reads EOF after all data
+// written so far. The stream can still be read from.
+func (conn *sessConn) CloseWrite() error {
+	return conn.stream.Close()
+}
+
 func (conn *sessConn) Close() error {
 	err := conn.stream.Close()
 	if err != nil {
 		return err
 	}
+	if conn.sess == nil {
+		// Shared session, only stop receiving on this stream
+		conn.stream.CancelRead(0)
+		return nil
+	}
 
 	err = conn.sess.Close()
 	if err != nil {
@@ -51,11 +74,21 @@ func (conn *sessConn) Close() error {
 	return nil
 }
 
-// DoListenQUIC listens on a QUIC socket
-func DoListenQUIC(port uint16) chan io.ReadWriteCloser {
-	listener, err := appquic.ListenPort(port, nil, &quic.Config{KeepAlive: true})
+// isPeerGoingAway returns whether err signals that the peer closed the session without
+// error. The error type is internal to quic-go, so the error code is matched by its name.
+func isPeerGoingAway(err error) bool {
+	return strings.HasPrefix(err.Error(), "PeerGoingAway")
+}
+
+// DoListenQUIC listens on a QUIC socket. If tlsConf is nil, a dummy certificate is used.
+// If multiStream is set, every stream opened by the client is a separate connection,
+// otherwise only the first stream of each session is accepted.
+func DoListenQUIC(port uint16, tlsConf *tls.Config, quicConf *quic.Config,
+	multiStream bool) (chan io.ReadWriteCloser, error) {
+
+	listener, err := appquic.ListenPort(port, tlsConf, quicConf)
 	if err != nil {
-		golog.Panicf("Can't listen on port %d: %v", port, err)
+		return nil, fmt.Errorf("can't listen on port %d: %v", port, err)
 	}
 
 	conns := make(chan io.ReadWriteCloser)
@@ -67,6 +100,11 @@ func DoListenQUIC(port uint16) chan io.ReadWriteCloser {
 				continue
 			}
 
+			if multiStream {
+				go acceptStreams(sess, conns)
+				continue
+			}
+
 			stream, err := sess.AcceptStream()
 			if err != nil {
 				log.Crit("Can't accept stream: %v", err)
@@ -82,19 +120,116 @@ func DoListenQUIC(port uint16) chan io.ReadWriteCloser {
 		}
 	}()
 
-	return conns
+	return conns, nil
+}
+
+// acceptStreams passes on all the streams of the session as connections, until the session
+// is closed
+func acceptStreams(sess quic.Session, conns chan<- io.ReadWriteCloser) {
+	log.Info("New QUIC session", "remote", sess.RemoteAddr())
+	for {
+		stream, err := sess.AcceptStream()
+		if err != nil {
+			log.Info("QUIC session closed", "remote", sess.RemoteAddr(), "err", err)
+			return
+		}
+
+		log.Info("New QUIC stream", "remote", sess.RemoteAddr(), "stream", stream.StreamID())
+
+		conns <- &sessConn{stream: stream}
+	}
+}
+
+// QUICStreamDialer opens streams on a single QUIC session, so that many connections share
+// one handshake and one path. If the session fails, a new session is dialed.
+type QUICStreamDialer struct {
+	remoteAddr *snet.Addr
+	tlsConf    *tls.Config
+	quicConf   *quic.Config
+
+	mutex sync.Mutex
+	sess  quic.Session
+}
+
+// NewQUICStreamDialer creates a dialer for the remote address, see DoDialQUIC
+func NewQUICStreamDialer(remoteAddr *snet.Addr, tlsConf *tls.Config, quicConf *quic.Config) *QUICStreamDialer {
+	return &QUICStreamDialer{
+		remoteAddr: remoteAddr,
+		tlsConf:    tlsConf,
+		quicConf:   quicConf,
+	}
 }
 
-// DoDialQUIC dials with a QUIC socket
-func DoDialQUIC(remoteAddr string) io.ReadWriteCloser {
-	sess, err := appquic.Dial(remoteAddr, nil, &quic.Config{KeepAlive: true})
+// Connect dials the session, if not connected yet. The error is returned unwrapped, see
+// DoDialQUIC.
+func (d *QUICStreamDialer) Connect() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.connect()
+}
+
+func (d *QUICStreamDialer) connect() error {
+	if d.sess != nil {
+		return nil
+	}
+	sess, err := appquic.DialAddr(d.remoteAddr, d.tlsConf, d.quicConf)
 	if err != nil {
-		golog.Panicf("Can't dial remote address %v: %v", remoteAddr, err)
+		return err
+	}
+	log.Debug("Connected!")
+	d.sess = sess
+	return nil
+}
+
+// OpenStream opens a new stream on the session. Closing the returned connection only
+// closes the stream.
+func (d *QUICStreamDialer) OpenStream() (io.ReadWriteCloser, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.sess != nil {
+		stream, err := d.sess.OpenStreamSync()
+		if err == nil {
+			return &sessConn{stream: stream}, nil
+		}
+		log.Info("QUIC session failed, dialing new session", "err", err)
+		_ = d.sess.Close()
+		d.sess = nil
+	}
+	if err := d.connect(); err != nil {
+		return nil, err
+	}
+	stream, err := d.sess.OpenStreamSync()
+	if err != nil {
+		return nil, err
+	}
+	return &sessConn{stream: stream}, nil
+}
+
+// Close closes the session and with it all its streams
+func (d *QUICStreamDialer) Close() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.sess == nil {
+		return nil
+	}
+	err := d.sess.Close()
+	d.sess = nil
+	return err
+}
+
+// DoDialQUIC dials with a QUIC socket, over the path set on the remote address. If tlsConf
+// is nil, the server's certificate is not verified. The error is returned unwrapped, so
+// that handshake timeouts can be detected.
+func DoDialQUIC(remoteAddr *snet.Addr, tlsConf *tls.Config, quicConf *quic.Config) (io.ReadWriteCloser, error) {
+	sess, err := appquic.DialAddr(remoteAddr, tlsConf, quicConf)
+	if err != nil {
+		return nil, err
 	}
 
 	stream, err := sess.OpenStreamSync()
 	if err != nil {
-		golog.Panicf("Can't open stream: %v", err)
+		_ = sess.Close()
+		return nil, err
 	}
 
 	log.Debug("Connected!")
@@ -102,5 +237,5 @@ func DoDialQUIC(remoteAddr string) io.ReadWriteCloser {
 	return &sessConn{
 		sess:   sess,
 		stream: stream,
-	}
+	}, nil
 }
@@ -15,109 +15,275 @@
 package modes
 
 import (
+	"fmt"
 	"io"
-	golog "log"
+	"net"
+	"sync"
+	"time"
 
 	"github.com/netsec-ethz/scion-apps/pkg/appnet"
+	"github.com/scionproto/scion/go/lib/snet"
 
 	log "github.com/inconshreveable/log15"
 )
 
-// May not be accessed from multiple threads concurrently, especially Read(...) and Close(...)
-type udpListenConn struct {
-	requests  chan<- []byte
-	responses <-chan int
-	isClosed  bool
-	write     func(b []byte) (int, error)
-	close     func() error
+// DoDialUDP dials with a UDP socket, over the path set on the remote address
+func DoDialUDP(remoteAddr *snet.Addr) (io.ReadWriteCloser, error) {
+	conn, err := appnet.DialAddr(remoteAddr)
+	if err != nil {
+		return nil, fmt.Errorf("can't dial remote address %v: %v", remoteAddr, err)
+	}
+
+	log.Debug("Connected!")
+
+	return conn, nil
 }
 
-func (conn *udpListenConn) Read(b []byte) (int, error) {
-	conn.requests <- b
-	return <-conn.responses, nil
+// UDPListenConfig configures the sessions created by DoListenUDP
+type UDPListenConfig struct {
+	// Sessions are closed when no packet was received or sent for this duration.
+	// 0 disables the timeout.
+	IdleTimeout time.Duration
+	// Maximum number of concurrent sessions. Packets from new remotes are dropped while
+	// the maximum is reached. 0 means unlimited.
+	MaxSessions int
+	// Number of datagrams buffered per session. Further datagrams are dropped until the
+	// consumer of the session reads, so that a slow consumer does not stall other sessions.
+	BufferPackets int
 }
 
-func (conn *udpListenConn) Write(b []byte) (int, error) {
-	return conn.write(b)
+// Number of new sessions that are queued until accepted by the consumer, further new
+// sessions are dropped
+const udpAcceptBacklog = 16
+
+// udpListener demultiplexes the packets received on a single socket into sessions, one
+// per remote address
+type udpListener struct {
+	conn   net.PacketConn
+	config UDPListenConfig
+	conns  chan io.ReadWriteCloser
+
+	mutex    sync.Mutex
+	sessions map[string]*udpSession
 }
 
-func (conn *udpListenConn) Close() error {
-	return conn.close()
+// udpSession is the pseudo-connection to a single remote of a udpListener. Read and Write
+// may be called concurrently with each other and with Close.
+type udpSession struct {
+	listener *udpListener
+	addr     net.Addr
+	key      string
+	packets  chan []byte
+
+	// Remainder of a datagram that did not fit into the buffer of the previous Read
+	readMutex sync.Mutex
+	pending   []byte
+
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	activeMutex sync.Mutex
+	lastActive  time.Time
 }
 
-// DoDialUDP dials with a UDP socket
-func DoDialUDP(remoteAddr string) io.ReadWriteCloser {
-	conn, err := appnet.Dial(remoteAddr)
-	if err != nil {
-		golog.Panicf("Can't dial remote address %v: %v", remoteAddr, err)
+func newUDPListener(conn net.PacketConn, config UDPListenConfig) *udpListener {
+	if config.BufferPackets <= 0 {
+		config.BufferPackets = 1
+	}
+	return &udpListener{
+		conn:     conn,
+		config:   config,
+		conns:    make(chan io.ReadWriteCloser, udpAcceptBacklog),
+		sessions: make(map[string]*udpSession),
 	}
+}
 
-	log.Debug("Connected!")
+// serve reads from the socket and dispatches the packets to the sessions until reading
+// fails, e.g. because the socket was closed. All sessions are closed when it returns.
+func (l *udpListener) serve() error {
+	if l.config.IdleTimeout > 0 {
+		done := make(chan struct{})
+		defer close(done)
+		go l.expireIdle(done)
+	}
+	defer l.closeAll()
 
-	return conn
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := l.conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		sess := l.session(addr)
+		if sess == nil {
+			continue
+		}
+		sess.touch()
+		packet := make([]byte, n)
+		copy(packet, buf[:n])
+		select {
+		case sess.packets <- packet:
+		default:
+			log.Debug("UDP session buffer full, dropping packet", "addr", sess.key)
+		}
+	}
 }
 
-// DoListenUDP listens on a UDP socket
-func DoListenUDP(port uint16) chan io.ReadWriteCloser {
-	conn, err := appnet.ListenPort(port)
-	if err != nil {
-		golog.Panicf("Can't listen on port %d: %v", port, err)
+// session returns the session for the remote address, creating it if needed. Returns nil
+// if no new session can be accepted.
+func (l *udpListener) session(addr net.Addr) *udpSession {
+	key := addr.String()
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if sess, ok := l.sessions[key]; ok {
+		return sess
+	}
+	if l.config.MaxSessions > 0 && len(l.sessions) >= l.config.MaxSessions {
+		log.Debug("Maximum number of UDP sessions reached, dropping packet", "addr", key)
+		return nil
+	}
+	sess := &udpSession{
+		listener:   l,
+		addr:       addr,
+		key:        key,
+		packets:    make(chan []byte, l.config.BufferPackets),
+		closed:     make(chan struct{}),
+		lastActive: time.Now(),
 	}
+	select {
+	case l.conns <- sess:
+	default:
+		log.Debug("Too many UDP sessions waiting to be accepted, dropping packet", "addr", key)
+		return nil
+	}
+	log.Info("New UDP connection", "addr", key)
+	l.sessions[key] = sess
+	return sess
+}
 
-	readRequests := make(map[string](chan []byte))
-	readResponses := make(map[string](chan int))
+func (l *udpListener) remove(sess *udpSession) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.sessions[sess.key] == sess {
+		delete(l.sessions, sess.key)
+	}
+}
 
-	conns := make(chan io.ReadWriteCloser)
+func (l *udpListener) closeAll() {
+	l.mutex.Lock()
+	sessions := make([]*udpSession, 0, len(l.sessions))
+	for _, sess := range l.sessions {
+		sessions = append(sessions, sess)
+	}
+	l.mutex.Unlock()
+	for _, sess := range sessions {
+		sess.Close()
+	}
+}
 
-	go func() {
-		buf := make([]byte, 65536)
-		for {
-			n, addr, err := conn.ReadFrom(buf)
-			if err != nil {
-				golog.Panicf("Error reading from UDP socket: %v", err)
-			}
-			addrStr := addr.String()
-
-			nbufChan, contained := readRequests[addrStr]
-			nrespChan := readResponses[addrStr]
-			if !contained {
-				// create new UDP connection
-				log.Info("New UDP connection", "addr", addrStr)
-				nbufChan = make(chan []byte)
-				nrespChan = make(chan int, 1)
-
-				readRequests[addrStr] = nbufChan
-				readResponses[addrStr] = nrespChan
-
-				conns <- &udpListenConn{
-					requests:  nbufChan,
-					responses: nrespChan,
-					isClosed:  false,
-					write: func(b []byte) (n int, err error) {
-						return conn.WriteTo(b, addr)
-					},
-					close: func() (err error) {
-						close(nbufChan)
-						delete(readRequests, addrStr)
-						return nil
-					},
-				}
+// expireIdle periodically closes the sessions that exceeded the idle timeout, until done
+// is closed
+func (l *udpListener) expireIdle(done <-chan struct{}) {
+	ticker := time.NewTicker(l.config.IdleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		var idle []*udpSession
+		l.mutex.Lock()
+		for _, sess := range l.sessions {
+			if sess.idleSince() >= l.config.IdleTimeout {
+				idle = append(idle, sess)
 			}
+		}
+		l.mutex.Unlock()
+		for _, sess := range idle {
+			log.Info("Closing idle UDP connection", "addr", sess.key)
+			sess.Close()
+		}
+	}
+}
 
-			// copy to the correct buffer
-			from := 0
-			for from < n {
-				nbuf, open := <-nbufChan
-				if !open {
-					log.Debug("UDP connection closed with unread data remaining in buffer, discarding it")
-					break
-				}
-				written := copy(nbuf, buf[from:n])
-				from += written
-				nrespChan <- written
-			}
+func (sess *udpSession) touch() {
+	sess.activeMutex.Lock()
+	sess.lastActive = time.Now()
+	sess.activeMutex.Unlock()
+}
+
+func (sess *udpSession) idleSince() time.Duration {
+	sess.activeMutex.Lock()
+	defer sess.activeMutex.Unlock()
+	return time.Since(sess.lastActive)
+}
+
+// Read reads the next datagram of the session. A read never returns data of more than one
+// datagram; if the buffer is too small, the remainder of the datagram is returned by the
+// following reads. Returns io.EOF once the session is closed.
+func (sess *udpSession) Read(b []byte) (int, error) {
+	sess.readMutex.Lock()
+	defer sess.readMutex.Unlock()
+	if len(sess.pending) == 0 {
+		select {
+		case packet := <-sess.packets:
+			sess.pending = packet
+		case <-sess.closed:
+			return 0, io.EOF
 		}
+	}
+	n := copy(b, sess.pending)
+	sess.pending = sess.pending[n:]
+	return n, nil
+}
+
+func (sess *udpSession) Write(b []byte) (int, error) {
+	select {
+	case <-sess.closed:
+		return 0, fmt.Errorf("UDP connection to %s closed", sess.key)
+	default:
+	}
+	sess.touch()
+	return sess.listener.conn.WriteTo(b, sess.addr)
+}
+
+// Close closes the session. Packets received afterwards from the same remote start a new
+// session.
+func (sess *udpSession) Close() error {
+	sess.closeOnce.Do(func() {
+		close(sess.closed)
+		sess.listener.remove(sess)
+	})
+	return nil
+}
+
+func (sess *udpSession) String() string {
+	return "udp:" + sess.key
+}
+
+// DoListenUDP listens on a UDP socket. The returned channel is closed if reading from the
+// socket fails.
+func DoListenUDP(port uint16, config UDPListenConfig) (chan io.ReadWriteCloser, error) {
+	conn, err := appnet.ListenPort(port)
+	if err != nil {
+		return nil, fmt.Errorf("can't listen on port %d: %v", port, err)
+	}
+
+	return ListenPacketConn(conn, config), nil
+}
+
+// ListenPacketConn splits the packets received on the socket into connections, one per
+// remote address, as for DoListenUDP. This allows to use a local UDP socket in the same
+// way as a SCION UDP socket. The returned channel is closed if reading from the socket
+// fails.
+func ListenPacketConn(conn net.PacketConn, config UDPListenConfig) chan io.ReadWriteCloser {
+	listener := newUDPListener(conn, config)
+	go func() {
+		err := listener.serve()
+		log.Crit("Error reading from UDP socket", "err", err)
+		close(listener.conns)
 	}()
 
-	return conns
+	return listener.conns
 }
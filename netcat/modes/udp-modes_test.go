@@ -0,0 +1,206 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modes
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startUDPListener runs a udpListener on a local plain UDP socket. The returned function
+// closes the socket and waits until the listener stopped.
+func startUDPListener(t *testing.T, config UDPListenConfig) (*udpListener, func()) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := newUDPListener(conn, config)
+	done := make(chan struct{})
+	go func() {
+		_ = l.serve()
+		close(done)
+	}()
+	return l, func() {
+		conn.Close()
+		<-done
+	}
+}
+
+func dialUDP(t *testing.T, l *udpListener) net.Conn {
+	conn, err := net.Dial("udp", l.conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func accept(t *testing.T, l *udpListener) io.ReadWriteCloser {
+	select {
+	case conn := <-l.conns:
+		return conn
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for new UDP session")
+		return nil
+	}
+}
+
+func TestUDPListenerConcurrentSessions(t *testing.T) {
+	l, stop := startUDPListener(t, UDPListenConfig{BufferPackets: 64})
+	defer stop()
+
+	const numClients = 8
+	const numPackets = 20
+	clients := make([]net.Conn, numClients)
+	for i := range clients {
+		clients[i] = dialUDP(t, l)
+		defer clients[i].Close()
+	}
+
+	// Echo on every session concurrently
+	var wg sync.WaitGroup
+	go func() {
+		for conn := range l.conns {
+			wg.Add(1)
+			go func(conn io.ReadWriteCloser) {
+				defer wg.Done()
+				buf := make([]byte, 100)
+				for {
+					n, err := conn.Read(buf)
+					if err != nil {
+						return
+					}
+					if _, err := conn.Write(buf[:n]); err != nil {
+						return
+					}
+				}
+			}(conn)
+		}
+	}()
+
+	var clientsWg sync.WaitGroup
+	for i, c := range clients {
+		clientsWg.Add(1)
+		go func(i int, c net.Conn) {
+			defer clientsWg.Done()
+			buf := make([]byte, 100)
+			for j := 0; j < numPackets; j++ {
+				msg := fmt.Sprintf("client %d packet %d", i, j)
+				if _, err := c.Write([]byte(msg)); err != nil {
+					t.Error(err)
+					return
+				}
+				_ = c.SetReadDeadline(time.Now().Add(time.Second))
+				n, err := c.Read(buf)
+				if err != nil {
+					t.Errorf("Client %d: %v", i, err)
+					return
+				}
+				if string(buf[:n]) != msg {
+					t.Errorf("Client %d: expected %q, got %q", i, msg, buf[:n])
+				}
+			}
+		}(i, c)
+	}
+	clientsWg.Wait()
+	stop()
+	wg.Wait()
+}
+
+func TestUDPListenerSlowConsumer(t *testing.T) {
+	l, stop := startUDPListener(t, UDPListenConfig{BufferPackets: 2})
+	defer stop()
+
+	slow := dialUDP(t, l)
+	defer slow.Close()
+	fast := dialUDP(t, l)
+	defer fast.Close()
+
+	// The session of the slow client is never read, its packets exceeding the buffer are
+	// dropped without blocking the fast client
+	for i := 0; i < 10; i++ {
+		_, _ = slow.Write([]byte("slow"))
+	}
+	slowConn := accept(t, l)
+	defer slowConn.Close()
+
+	_, _ = fast.Write([]byte("fast"))
+	fastConn := accept(t, l)
+	defer fastConn.Close()
+	buf := make([]byte, 10)
+	n, err := fastConn.Read(buf)
+	if err != nil || string(buf[:n]) != "fast" {
+		t.Fatalf("Expected packet of fast client, got %q, %v", buf[:n], err)
+	}
+}
+
+func TestUDPListenerMaxSessions(t *testing.T) {
+	l, stop := startUDPListener(t, UDPListenConfig{MaxSessions: 1, BufferPackets: 1})
+	defer stop()
+
+	first := dialUDP(t, l)
+	defer first.Close()
+	_, _ = first.Write([]byte("first"))
+	firstConn := accept(t, l)
+
+	second := dialUDP(t, l)
+	defer second.Close()
+	_, _ = second.Write([]byte("second"))
+	select {
+	case <-l.conns:
+		t.Fatal("Session accepted beyond the maximum")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Once the first session is closed, the second remote is accepted
+	firstConn.Close()
+	_, _ = second.Write([]byte("second"))
+	secondConn := accept(t, l)
+	secondConn.Close()
+}
+
+func TestUDPListenerIdleTimeout(t *testing.T) {
+	l, stop := startUDPListener(t, UDPListenConfig{IdleTimeout: 100 * time.Millisecond, BufferPackets: 1})
+	defer stop()
+
+	c := dialUDP(t, l)
+	defer c.Close()
+	_, _ = c.Write([]byte("x"))
+	conn := accept(t, l)
+	buf := make([]byte, 10)
+	if _, err := conn.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(buf)
+		readErr <- err
+	}()
+	select {
+	case err := <-readErr:
+		if err != io.EOF {
+			t.Errorf("Expected EOF after idle timeout, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Idle session was not closed")
+	}
+	if _, err := conn.Write([]byte("x")); err == nil {
+		t.Errorf("Expected error writing to closed session")
+	}
+}
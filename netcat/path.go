@@ -0,0 +1,160 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/netsec-ethz/scion-apps/pkg/appnet"
+	"github.com/scionproto/scion/go/lib/addr"
+	"github.com/scionproto/scion/go/lib/pathpol"
+	"github.com/scionproto/scion/go/lib/snet"
+
+	log "github.com/inconshreveable/log15"
+)
+
+// The path chosen interactively, so that the user is only prompted once when dialing
+// several connections, e.g. in relay mode
+var (
+	chosenPathMutex sync.Mutex
+	chosenPath      snet.PathFingerprint
+)
+
+// parsePathAlgo parses the -pathAlgo flag. The empty string selects the first path.
+func parsePathAlgo(s string) (algo int, set bool, err error) {
+	switch s {
+	case "":
+		return appnet.PathAlgoDefault, false, nil
+	case "shortest":
+		return appnet.Shortest, true, nil
+	case "mtu":
+		return appnet.MTU, true, nil
+	default:
+		return 0, false, fmt.Errorf("unknown path algorithm %q, expected shortest or mtu", s)
+	}
+}
+
+// filterPaths returns the paths allowed by the policy, in the original order
+func filterPaths(paths []snet.Path, policy *pathpol.Policy) []snet.Path {
+	if policy == nil {
+		return paths
+	}
+	pathSet := make(pathpol.PathSet)
+	for _, path := range paths {
+		pathSet[path.Fingerprint()] = path
+	}
+	pathSet = policy.Filter(pathSet)
+	var filtered []snet.Path
+	for _, path := range paths {
+		if _, ok := pathSet[path.Fingerprint()]; ok {
+			filtered = append(filtered, path)
+		}
+	}
+	return filtered
+}
+
+// choosePath selects the path to the remote address according to the -policy, -i and
+// -pathAlgo flags, and sets it. Without -i or -pathAlgo, the first path is used. Returns
+// nil if the remote is in the local AS.
+func choosePath(raddr *snet.Addr) (snet.Path, error) {
+	if raddr.IA == appnet.DefNetwork().IA {
+		log.Info("Remote is in the local AS, no path needed", "remote", raddr.IA)
+		appnet.SetPath(raddr, nil)
+		return nil, nil
+	}
+	paths, err := appnet.QueryPaths(raddr.IA)
+	if err != nil {
+		return nil, &exitCodeError{code: exitNoPath, err: fmt.Errorf("can't query paths to %s: %v", raddr.IA, err)}
+	}
+	if len(paths) == 0 {
+		return nil, &exitCodeError{code: exitNoPath, err: fmt.Errorf("no path to %s", raddr.IA)}
+	}
+	if policy := pathConf.Policy(); policy != nil {
+		paths = filterPaths(paths, policy)
+		if len(paths) == 0 {
+			return nil, &exitCodeError{code: exitNoPath,
+				err: fmt.Errorf("no path to %s allowed by policy %s", raddr.IA, policy.Name)}
+		}
+	}
+
+	var path snet.Path
+	if interactive {
+		path, err = choosePathInteractive(raddr.IA, paths)
+		if err != nil {
+			return nil, &exitCodeError{code: exitNoPath, err: err}
+		}
+	} else if pathAlgoSet {
+		path = appnet.SelectPathByMetric(pathAlgo, paths)
+	} else {
+		path = paths[0]
+	}
+	log.Info("Using path", "remote", raddr.IA, "path", fmt.Sprintf("%s", path), "mtu", path.MTU())
+	appnet.SetPath(raddr, path)
+	return path, nil
+}
+
+// choosePathInteractive prompts the user to choose one of the paths, unless a path that
+// was chosen before is still available. As stdin and stdout carry the data, the prompt is
+// written to stderr and the answer read from the terminal.
+func choosePathInteractive(ia addr.IA, paths []snet.Path) (snet.Path, error) {
+	chosenPathMutex.Lock()
+	defer chosenPathMutex.Unlock()
+	if chosenPath != "" {
+		for _, path := range paths {
+			if path.Fingerprint() == chosenPath {
+				return path, nil
+			}
+		}
+	}
+
+	tty, err := os.Open("/dev/tty")
+	if err != nil {
+		return nil, fmt.Errorf("can't open terminal to choose path: %v", err)
+	}
+	defer tty.Close()
+	path, err := promptPath(tty, os.Stderr, ia, paths)
+	if err != nil {
+		return nil, err
+	}
+	chosenPath = path.Fingerprint()
+	return path, nil
+}
+
+// promptPath lists the paths on out and reads the index of the chosen path from in
+func promptPath(in io.Reader, out io.Writer, ia addr.IA, paths []snet.Path) (snet.Path, error) {
+	fmt.Fprintf(out, "Available paths to %v\n", ia)
+	for i, path := range paths {
+		fmt.Fprintf(out, "[%2d] %s\n", i, fmt.Sprintf("%s", path))
+	}
+	scanner := bufio.NewScanner(in)
+	for {
+		fmt.Fprintf(out, "Choose path: ")
+		if !scanner.Scan() {
+			return nil, errors.New("no path chosen")
+		}
+		pathIndex, err := strconv.Atoi(strings.TrimSpace(scanner.Text()))
+		if err == nil && 0 <= pathIndex && pathIndex < len(paths) {
+			return paths[pathIndex], nil
+		}
+		fmt.Fprintf(out, "ERROR: Invalid path index %q, valid indices range: [0, %v]\n", scanner.Text(), len(paths)-1)
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/netsec-ethz/scion-apps/ssh/scionutils"
+	"github.com/scionproto/scion/go/lib/addr"
+	"github.com/scionproto/scion/go/lib/common"
+	"github.com/scionproto/scion/go/lib/snet"
+	"github.com/scionproto/scion/go/lib/spath"
+)
+
+// mockPath satisfies the snet.Path interface, with only the fingerprint and interfaces
+// set, as used for filtering
+type mockPath struct {
+	name string
+	ifs  []snet.PathInterface
+}
+
+func (p *mockPath) Fingerprint() snet.PathFingerprint { return snet.PathFingerprint(p.name) }
+func (p *mockPath) OverlayNextHop() *net.UDPAddr      { return nil }
+func (p *mockPath) Path() *spath.Path                 { return nil }
+func (p *mockPath) Interfaces() []snet.PathInterface  { return p.ifs }
+func (p *mockPath) Destination() addr.IA              { return addr.IA{} }
+func (p *mockPath) MTU() uint16                       { return 0 }
+func (p *mockPath) Expiry() time.Time                 { return time.Time{} }
+func (p *mockPath) Copy() snet.Path                   { return p }
+func (p *mockPath) String() string                    { return p.name }
+
+type mockInterface struct {
+	id common.IFIDType
+	ia addr.IA
+}
+
+func (i mockInterface) ID() common.IFIDType { return i.id }
+func (i mockInterface) IA() addr.IA         { return i.ia }
+
+// makePath creates a path through the given ASes, with interface IDs 1 and 2 for each
+func makePath(t *testing.T, name string, ias ...string) snet.Path {
+	var ifs []snet.PathInterface
+	for _, s := range ias {
+		ia, err := addr.IAFromString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ifs = append(ifs, mockInterface{id: 1, ia: ia}, mockInterface{id: 2, ia: ia})
+	}
+	return &mockPath{name: name, ifs: ifs}
+}
+
+func TestParsePathAlgo(t *testing.T) {
+	if _, set, err := parsePathAlgo(""); err != nil || set {
+		t.Errorf("Expected no path algorithm for empty flag, got %v, %v", set, err)
+	}
+	for _, s := range []string{"shortest", "mtu"} {
+		if _, set, err := parsePathAlgo(s); err != nil || !set {
+			t.Errorf("Expected path algorithm %s to be valid, got %v, %v", s, set, err)
+		}
+	}
+	if _, _, err := parsePathAlgo("fastest"); err == nil {
+		t.Errorf("Expected error for unknown path algorithm")
+	}
+}
+
+func TestLoadPolicyAndFilter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "netcat-policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "policy.json")
+	err = ioutil.WriteFile(file, []byte(`{
+		"base": {"acl": ["- 1-ff00:0:133", "+"]},
+		"no133": {"extends": ["base"]},
+		"other": {"acl": ["+"]}
+	}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	policy, err := scionutils.LoadPolicy(file, "no133")
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths := []snet.Path{
+		makePath(t, "a", "1-ff00:0:110", "1-ff00:0:133", "1-ff00:0:111"),
+		makePath(t, "b", "1-ff00:0:110", "1-ff00:0:112", "1-ff00:0:111"),
+		makePath(t, "c", "1-ff00:0:110", "1-ff00:0:111"),
+	}
+	filtered := filterPaths(paths, policy)
+	if len(filtered) != 2 || filtered[0] != paths[1] || filtered[1] != paths[2] {
+		t.Errorf("Expected paths b and c, got %v", filtered)
+	}
+
+	for _, name := range []string{"", "missing"} {
+		if _, err = scionutils.LoadPolicy(file, name); err == nil {
+			t.Errorf("Expected error for policy name %q", name)
+		}
+	}
+	err = ioutil.WriteFile(file, []byte(`{"broken": {"extends": ["missing"]}}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = scionutils.LoadPolicy(file, ""); err == nil {
+		t.Errorf("Expected error for extending a missing policy")
+	}
+}
+
+func TestPromptPath(t *testing.T) {
+	paths := []snet.Path{makePath(t, "a"), makePath(t, "b")}
+	var out bytes.Buffer
+	path, err := promptPath(strings.NewReader("5\nx\n1\n"), &out, addr.IA{}, paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != paths[1] {
+		t.Errorf("Expected path b, got %v", path)
+	}
+	if strings.Count(out.String(), "ERROR") != 2 {
+		t.Errorf("Expected two invalid choices, got output %q", out.String())
+	}
+
+	if _, err = promptPath(strings.NewReader(""), &out, addr.IA{}, paths); err == nil {
+		t.Errorf("Expected error without answer")
+	}
+}
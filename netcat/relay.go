@@ -0,0 +1,203 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/netsec-ethz/scion-apps/netcat/modes"
+
+	log "github.com/inconshreveable/log15"
+)
+
+// closeWriter is implemented by connections that support closing only their write
+// direction, e.g. *net.TCPConn and *net.UnixConn
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// parseRelayAddr parses a local address for the relay modes, given as network:address,
+// e.g. tcp:127.0.0.1:8080, udp:127.0.0.1:53 or unix:/run/x.sock
+func parseRelayAddr(s string) (network, address string, err error) {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return "", "", fmt.Errorf("invalid relay address %q, expected tcp:host:port, udp:host:port or unix:path", s)
+	}
+	network, address = parts[0], parts[1]
+	if network != "tcp" && network != "udp" && network != "unix" {
+		return "", "", fmt.Errorf("unsupported relay network %q, expected tcp, udp or unix", network)
+	}
+	return network, address, nil
+}
+
+// isDatagramRelayAddr returns whether the relay address is a UDP socket
+func isDatagramRelayAddr(s string) bool {
+	return strings.HasPrefix(s, "udp:")
+}
+
+// relayLocalToSCION accepts connections on the local address and, for each, dials a SCION
+// connection with dial and relays the data between the two connections.
+func relayLocalToSCION(localAddr string, dial func() (io.ReadWriteCloser, error)) error {
+	network, address, err := parseRelayAddr(localAddr)
+	if err != nil {
+		return err
+	}
+	if network == "udp" {
+		return relayLocalDatagramsToSCION(localAddr, address, dial)
+	}
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	log.Info("Relaying local connections to SCION", "local", localAddr)
+
+	for {
+		local, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go func(local net.Conn) {
+			remote, err := dial()
+			if err != nil {
+				log.Error("Can't dial SCION remote for relayed connection", "err", err)
+				local.Close()
+				return
+			}
+			relay(local, withIdleTimeout(remote))
+		}(local)
+	}
+}
+
+// relayLocalDatagramsToSCION splits the datagrams received on the local UDP address into
+// connections by source address, and relays each over a SCION connection dialed with dial
+func relayLocalDatagramsToSCION(localAddr, address string, dial func() (io.ReadWriteCloser, error)) error {
+	pconn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return err
+	}
+	defer pconn.Close()
+	log.Info("Relaying local datagrams to SCION", "local", localAddr)
+
+	for local := range modes.ListenPacketConn(pconn, udpListenConfig()) {
+		go func(local io.ReadWriteCloser) {
+			remote, err := dial()
+			if err != nil {
+				log.Error("Can't dial SCION remote for relayed connection", "err", err)
+				local.Close()
+				return
+			}
+			relayDatagrams(local, withIdleTimeout(remote))
+		}(local)
+	}
+	return fmt.Errorf("can't read from %s", localAddr)
+}
+
+// relaySCIONToLocal dials the local address for each incoming SCION connection and relays
+// the data between the two connections.
+func relaySCIONToLocal(conns chan io.ReadWriteCloser, localAddr string) error {
+	network, address, err := parseRelayAddr(localAddr)
+	if err != nil {
+		return err
+	}
+	log.Info("Relaying SCION connections to local address", "local", localAddr)
+
+	for conn := range conns {
+		go func(conn io.ReadWriteCloser) {
+			local, err := net.Dial(network, address)
+			if err != nil {
+				log.Error("Can't dial local address for relayed connection", "local", localAddr, "err", err)
+				conn.Close()
+				return
+			}
+			if network == "udp" {
+				relayDatagrams(withIdleTimeout(conn), local)
+			} else {
+				relay(withIdleTimeout(conn), local)
+			}
+		}(conn)
+	}
+	return nil
+}
+
+// relay copies data in both directions until both directions are done, and closes both
+// connections. When one direction reaches EOF, the write direction of the destination is
+// closed if supported, so that the peer can still send its reply.
+func relay(a, b io.ReadWriteCloser) {
+	log.Info("Relaying new connection", "a", a, "b", b)
+
+	var once sync.Once
+	closeBoth := func() {
+		once.Do(func() {
+			a.Close()
+			b.Close()
+		})
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	copyHalf := func(dst, src io.ReadWriteCloser) {
+		defer wg.Done()
+		_, err := io.Copy(dst, src)
+		if err != nil {
+			log.Debug("Error relaying connection, closing", "err", err)
+			closeBoth()
+			return
+		}
+		if cw, ok := dst.(closeWriter); ok {
+			_ = cw.CloseWrite()
+		}
+	}
+	go copyHalf(a, b)
+	go copyHalf(b, a)
+	wg.Wait()
+	closeBoth()
+
+	log.Info("Relayed connection closed", "a", a, "b", b)
+}
+
+// relayDatagrams copies datagrams in both directions, preserving their boundaries, until
+// either direction ends or fails, and closes both connections
+func relayDatagrams(a, b io.ReadWriteCloser) {
+	log.Info("Relaying new datagram connection", "a", a, "b", b)
+
+	var once sync.Once
+	closeBoth := func() {
+		once.Do(func() {
+			a.Close()
+			b.Close()
+		})
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	copyHalf := func(dst, src io.ReadWriteCloser) {
+		defer wg.Done()
+		err := copyDatagrams(dst, src)
+		if err != nil {
+			log.Debug("Error relaying datagrams, closing", "err", err)
+		}
+		closeBoth()
+	}
+	go copyHalf(a, b)
+	go copyHalf(b, a)
+	wg.Wait()
+
+	log.Info("Relayed datagram connection closed", "a", a, "b", b)
+}
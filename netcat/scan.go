@@ -0,0 +1,181 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+	"github.com/netsec-ethz/scion-apps/pkg/appnet"
+	"github.com/netsec-ethz/scion-apps/pkg/appnet/appquic"
+	"github.com/scionproto/scion/go/lib/snet"
+
+	log "github.com/inconshreveable/log15"
+)
+
+// Timeout of a probe if none was given with -w
+const defaultScanTimeout = 5 * time.Second
+
+// Port states reported by the scan
+const (
+	portOpen     = "open"
+	portClosed   = "closed"
+	portFiltered = "filtered"
+	// A UDP probe without reply can't be distinguished from a filtered port
+	portOpenFiltered = "open|filtered"
+)
+
+// parsePorts parses a comma separated list of ports and port ranges, e.g. 80,443,1000-1010
+func parsePorts(spec string) ([]uint16, error) {
+	var ports []uint16
+	for _, part := range strings.Split(spec, ",") {
+		bounds := strings.SplitN(part, "-", 2)
+		first, err := strconv.ParseUint(bounds[0], 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q", bounds[0])
+		}
+		last := first
+		if len(bounds) == 2 {
+			last, err = strconv.ParseUint(bounds[1], 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("invalid port %q", bounds[1])
+			}
+			if last < first {
+				return nil, fmt.Errorf("invalid port range %q", part)
+			}
+		}
+		for p := first; p <= last; p++ {
+			ports = append(ports, uint16(p))
+		}
+	}
+	return ports, nil
+}
+
+// scanPorts probes the ports of the host, at most parallel at a time, and prints the
+// state of each port together with the path used. QUIC probes use the TLS configuration
+// tlsConf. Returns the number of open ports.
+func scanPorts(host string, ports []uint16, tlsConf *tls.Config, timeout time.Duration,
+	parallel int) (int, error) {
+
+	raddr, err := appnet.ResolveUDPAddr(host + ":0")
+	if err != nil {
+		return 0, &exitCodeError{code: exitResolve, err: err}
+	}
+	// All probes use the same path, so that the results are comparable
+	path, err := choosePath(raddr)
+	if err != nil {
+		return 0, err
+	}
+	pathStr := "local"
+	if path != nil {
+		pathStr = fmt.Sprintf("%s", path)
+	}
+	proto := "quic"
+	if udpMode {
+		proto = "udp"
+	}
+
+	states := make([]string, len(ports))
+	sem := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+	for i, port := range ports {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, port uint16) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			addr := raddr.Copy()
+			addr.Host.L4 = port
+			if udpMode {
+				states[i] = probeUDP(addr, timeout)
+			} else {
+				states[i] = probeQUIC(addr, tlsConf, timeout)
+			}
+		}(i, port)
+	}
+	wg.Wait()
+
+	open := 0
+	for i, port := range ports {
+		if states[i] == portOpen {
+			open++
+		}
+		fmt.Printf("%s:%d\t%s\t%s\t%s\n", host, port, proto, states[i], pathStr)
+	}
+	return open, nil
+}
+
+// probeQUIC attempts a QUIC handshake. The port is reported as open if the server
+// presented its certificate, even if the handshake failed afterwards, e.g. because the
+// certificate did not match the -tlsCA and -tlsPin flags or the server requires a client
+// certificate. Otherwise, the port is reported as filtered if there was no response
+// within the timeout, and as closed if the handshake failed.
+func probeQUIC(raddr *snet.Addr, tlsConf *tls.Config, timeout time.Duration) string {
+	var presented int32
+	conf := tlsConf.Clone()
+	verify := conf.VerifyPeerCertificate
+	conf.VerifyPeerCertificate = func(rawCerts [][]byte, chains [][]*x509.Certificate) error {
+		atomic.StoreInt32(&presented, 1)
+		if verify != nil {
+			return verify(rawCerts, chains)
+		}
+		return nil
+	}
+	sess, err := appquic.DialAddr(raddr, conf, &quic.Config{HandshakeTimeout: timeout})
+	if err != nil {
+		log.Debug("QUIC probe failed", "addr", raddr, "err", err)
+		if atomic.LoadInt32(&presented) != 0 {
+			return portOpen
+		}
+		if isTimeout(err) {
+			return portFiltered
+		}
+		return portClosed
+	}
+	_ = sess.Close()
+	return portOpen
+}
+
+// probeUDP sends a single byte and waits for a reply. As services are not required to
+// reply, a missing reply is reported as open|filtered.
+func probeUDP(raddr *snet.Addr, timeout time.Duration) string {
+	conn, err := appnet.DialAddr(raddr)
+	if err != nil {
+		log.Debug("UDP probe failed", "addr", raddr, "err", err)
+		return portClosed
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte{88}); err != nil { // ascii('X')
+		log.Debug("UDP probe failed", "addr", raddr, "err", err)
+		return portClosed
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, 1)
+	if _, err = conn.Read(buf); err != nil {
+		log.Debug("UDP probe failed", "addr", raddr, "err", err)
+		if isTimeout(err) {
+			return portOpenFiltered
+		}
+		return portClosed
+	}
+	return portOpen
+}
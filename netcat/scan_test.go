@@ -0,0 +1,36 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParsePorts(t *testing.T) {
+	ports, err := parsePorts("80,1000-1003,443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []uint16{80, 1000, 1001, 1002, 1003, 443}
+	if !reflect.DeepEqual(ports, expected) {
+		t.Errorf("Expected ports %v, got %v", expected, ports)
+	}
+	for _, invalid := range []string{"", "a", "10-5", "1-", "70000", "1,,2"} {
+		if _, err := parsePorts(invalid); err == nil {
+			t.Errorf("Expected error for %q", invalid)
+		}
+	}
+}
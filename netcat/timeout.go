@@ -0,0 +1,124 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+)
+
+// errIdleTimeout is returned by an idleConn once it was closed because it was idle
+var errIdleTimeout = errors.New("connection idle timeout")
+
+// quicConfig returns the QUIC configuration according to the -w, -keepAlive and
+// -idleTimeout flags
+func quicConfig() *quic.Config {
+	conf := &quic.Config{
+		KeepAlive:   keepAlive,
+		IdleTimeout: quicIdleTimeout,
+	}
+	if timeout > 0 {
+		conf.HandshakeTimeout = time.Duration(timeout) * time.Second
+	}
+	return conf
+}
+
+// isTimeout returns whether the error is a timeout, including QUIC handshake and idle
+// timeouts
+func isTimeout(err error) bool {
+	if nerr, ok := err.(net.Error); ok {
+		return nerr.Timeout()
+	}
+	if terr, ok := err.(interface{ Timeout() bool }); ok {
+		return terr.Timeout()
+	}
+	return false
+}
+
+// idleConn closes the connection if no data was read or written for the timeout. Reads
+// and writes then fail with errIdleTimeout.
+type idleConn struct {
+	io.ReadWriteCloser
+	timeout  time.Duration
+	timer    *time.Timer
+	timedOut int32
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// withIdleTimeout wraps the connection in an idleConn if a timeout was set with -w
+func withIdleTimeout(conn io.ReadWriteCloser) io.ReadWriteCloser {
+	if timeout > 0 {
+		return newIdleConn(conn, time.Duration(timeout)*time.Second)
+	}
+	return conn
+}
+
+func newIdleConn(conn io.ReadWriteCloser, timeout time.Duration) *idleConn {
+	c := &idleConn{ReadWriteCloser: conn, timeout: timeout}
+	c.timer = time.AfterFunc(timeout, func() {
+		atomic.StoreInt32(&c.timedOut, 1)
+		c.Close()
+	})
+	return c
+}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(b)
+	return n, c.update(n, err)
+}
+
+func (c *idleConn) Write(b []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Write(b)
+	return n, c.update(n, err)
+}
+
+// update restarts the timer if data was transferred, and replaces the error if the
+// connection was closed due to the timeout
+func (c *idleConn) update(n int, err error) error {
+	if atomic.LoadInt32(&c.timedOut) == 1 {
+		if err != nil {
+			return errIdleTimeout
+		}
+		return nil
+	}
+	if n > 0 {
+		c.timer.Reset(c.timeout)
+	}
+	return err
+}
+
+// CloseWrite closes the write direction of the underlying connection, if supported
+func (c *idleConn) CloseWrite() error {
+	if cw, ok := c.ReadWriteCloser.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errors.New("connection does not support half-close")
+}
+
+func (c *idleConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.timer.Stop()
+		c.closeErr = c.ReadWriteCloser.Close()
+	})
+	return c.closeErr
+}
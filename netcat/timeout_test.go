@@ -0,0 +1,54 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestIdleConn(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	conn := newIdleConn(a, 100*time.Millisecond)
+
+	// Regular traffic keeps the connection open beyond the timeout
+	go func() {
+		for i := 0; i < 5; i++ {
+			time.Sleep(50 * time.Millisecond)
+			if _, err := b.Write([]byte("x")); err != nil {
+				return
+			}
+		}
+	}()
+	buf := make([]byte, 1)
+	for i := 0; i < 5; i++ {
+		if _, err := conn.Read(buf); err != nil {
+			t.Fatalf("Unexpected error on active connection: %v", err)
+		}
+	}
+
+	start := time.Now()
+	if _, err := conn.Read(buf); err != errIdleTimeout {
+		t.Errorf("Expected idle timeout error, got %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Idle timeout took %v", d)
+	}
+	if err := conn.Close(); err != nil {
+		t.Errorf("Closing timed out connection failed: %v", err)
+	}
+}
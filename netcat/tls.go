@@ -0,0 +1,201 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/netsec-ethz/scion-apps/pkg/appnet/appquic"
+
+	log "github.com/inconshreveable/log15"
+)
+
+// certFingerprint returns the SHA-256 fingerprint of a DER encoded certificate, as used
+// for certificate pinning
+func certFingerprint(der []byte) []byte {
+	sum := sha256.Sum256(der)
+	return sum[:]
+}
+
+// parsePins parses a comma separated list of hex encoded SHA-256 certificate fingerprints.
+// The bytes may be separated by colons, as in the output of
+// openssl x509 -noout -fingerprint -sha256
+func parsePins(s string) ([][]byte, error) {
+	var pins [][]byte
+	for _, p := range strings.Split(s, ",") {
+		p = strings.Replace(strings.TrimSpace(p), ":", "", -1)
+		if p == "" {
+			continue
+		}
+		pin, err := hex.DecodeString(p)
+		if err != nil || len(pin) != sha256.Size {
+			return nil, fmt.Errorf("invalid certificate fingerprint %q, expected hex encoded SHA-256", p)
+		}
+		pins = append(pins, pin)
+	}
+	return pins, nil
+}
+
+// loadCertPool reads the PEM encoded CA certificates in the file at path
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pemCerts, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pemCerts) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// newPeerVerifier returns a function for tls.Config.VerifyPeerCertificate, that checks
+// that the peer's certificate matches one of the pins, if any, and that it was issued by
+// one of the roots, if set. The host name is not verified, as SCION addresses are not
+// covered by certificates.
+func newPeerVerifier(pins [][]byte, roots *x509.CertPool) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("peer did not present a certificate")
+		}
+		if len(pins) > 0 {
+			fingerprint := certFingerprint(rawCerts[0])
+			pinned := false
+			for _, pin := range pins {
+				if bytes.Equal(pin, fingerprint) {
+					pinned = true
+					break
+				}
+			}
+			if !pinned {
+				return fmt.Errorf("peer certificate %x does not match any pinned fingerprint", fingerprint)
+			}
+		}
+		if roots != nil {
+			certs := make([]*x509.Certificate, len(rawCerts))
+			for i, raw := range rawCerts {
+				cert, err := x509.ParseCertificate(raw)
+				if err != nil {
+					return fmt.Errorf("invalid peer certificate: %v", err)
+				}
+				certs[i] = cert
+			}
+			intermediates := x509.NewCertPool()
+			for _, cert := range certs[1:] {
+				intermediates.AddCert(cert)
+			}
+			_, err := certs[0].Verify(x509.VerifyOptions{
+				Roots:         roots,
+				Intermediates: intermediates,
+				KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+			})
+			if err != nil {
+				return fmt.Errorf("peer certificate not trusted: %v", err)
+			}
+		}
+		return nil
+	}
+}
+
+// peerVerification returns the pins and the CA pool to verify the peer with, as
+// configured by the -tlsPin and -tlsCA flags
+func peerVerification() ([][]byte, *x509.CertPool, error) {
+	pins, err := parsePins(tlsPins)
+	if err != nil {
+		return nil, nil, err
+	}
+	var roots *x509.CertPool
+	if tlsCAPath != "" {
+		roots, err = loadCertPool(tlsCAPath)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return pins, roots, nil
+}
+
+// serverTLSConfig returns the TLS configuration to listen with. The configured
+// certificate is used if it was set explicitly or exists at the default location,
+// otherwise a dummy certificate is generated. If the peer is to be verified, clients
+// are required to present a certificate (mutual TLS).
+func serverTLSConfig(certSet, keySet bool) (*tls.Config, error) {
+	var conf *tls.Config
+	if certSet || keySet || fileExists(quicTLSCertificatePath) || fileExists(quicTLSKeyPath) {
+		cert, err := tls.LoadX509KeyPair(quicTLSCertificatePath, quicTLSKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("can't load TLS certificate: %v", err)
+		}
+		conf = &tls.Config{Certificates: []tls.Certificate{cert}}
+	} else {
+		log.Info("No TLS certificate found, using a dummy certificate", "cert", quicTLSCertificatePath)
+		dummy, err := appquic.GetDummyTLSConfig()
+		if err != nil {
+			return nil, err
+		}
+		conf = dummy.Clone()
+	}
+	if len(conf.Certificates) > 0 && len(conf.Certificates[0].Certificate) > 0 {
+		log.Info("Using TLS certificate",
+			"fingerprint", hex.EncodeToString(certFingerprint(conf.Certificates[0].Certificate[0])))
+	}
+
+	pins, roots, err := peerVerification()
+	if err != nil {
+		return nil, err
+	}
+	if len(pins) > 0 || roots != nil {
+		conf.ClientAuth = tls.RequireAnyClientCert
+		conf.VerifyPeerCertificate = newPeerVerifier(pins, roots)
+	}
+	return conf, nil
+}
+
+// clientTLSConfig returns the TLS configuration to dial with. A client certificate is
+// presented if one was set explicitly. The server's certificate is verified against the
+// configured pins and CA, if any.
+func clientTLSConfig(certSet, keySet bool) (*tls.Config, error) {
+	// The host name is never verified, see newPeerVerifier
+	conf := &tls.Config{InsecureSkipVerify: true}
+	if certSet || keySet {
+		cert, err := tls.LoadX509KeyPair(quicTLSCertificatePath, quicTLSKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("can't load TLS client certificate: %v", err)
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+
+	pins, roots, err := peerVerification()
+	if err != nil {
+		return nil, err
+	}
+	if len(pins) > 0 || roots != nil {
+		conf.VerifyPeerCertificate = newPeerVerifier(pins, roots)
+	}
+	return conf, nil
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
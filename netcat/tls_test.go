@@ -0,0 +1,107 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+// createCert creates a certificate signed by parent (self-signed if parent is nil)
+func createCert(t *testing.T, name string, isCA bool, parent *x509.Certificate,
+	parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestPeerVerifier(t *testing.T) {
+	ca, caKey := createCert(t, "ca", true, nil, nil)
+	leaf, _ := createCert(t, "leaf", false, ca, caKey)
+	other, _ := createCert(t, "other", false, nil, nil)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	pinStr := hex.EncodeToString(certFingerprint(leaf.Raw))
+	pins, err := parsePins("  " + pinStr + ",")
+	if err != nil || len(pins) != 1 {
+		t.Fatalf("Parsing pin failed: %v", err)
+	}
+	// Colon separated, upper case as printed by openssl
+	var colonPin []string
+	for i := 0; i < len(pinStr); i += 2 {
+		colonPin = append(colonPin, strings.ToUpper(pinStr[i:i+2]))
+	}
+	if _, err := parsePins(strings.Join(colonPin, ":")); err != nil {
+		t.Errorf("Parsing colon separated pin failed: %v", err)
+	}
+	if _, err := parsePins("abcd"); err == nil {
+		t.Errorf("Expected error for short pin")
+	}
+
+	cases := []struct {
+		name  string
+		pins  [][]byte
+		roots *x509.CertPool
+		certs [][]byte
+		ok    bool
+	}{
+		{"pinned", pins, nil, [][]byte{leaf.Raw}, true},
+		{"not pinned", pins, nil, [][]byte{other.Raw}, false},
+		{"issued by CA", nil, roots, [][]byte{leaf.Raw}, true},
+		{"not issued by CA", nil, roots, [][]byte{other.Raw}, false},
+		{"pinned and issued by CA", pins, roots, [][]byte{leaf.Raw}, true},
+		{"no certificate", nil, roots, nil, false},
+	}
+	for _, c := range cases {
+		err := newPeerVerifier(c.pins, c.roots)(c.certs, nil)
+		if c.ok && err != nil {
+			t.Errorf("%s: unexpected error: %v", c.name, err)
+		} else if !c.ok && err == nil {
+			t.Errorf("%s: expected verification to fail", c.name)
+		}
+	}
+}
@@ -0,0 +1,281 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+)
+
+// File transfer protocol. Both sides first write their message and then read the other
+// side's message, so that it does not matter which side dialed:
+//   - the sender writes the header, with the file size and SHA-256 hash
+//   - the receiver writes the offset to resume from, i.e. the size of the partial file
+//
+// The sender then sends the file from the offset and closes the write direction. The
+// receiver verifies the hash of the complete file and replies with the status.
+const (
+	transferMagic      = "SNCF"
+	transferHeaderSize = 4 + 8 + sha256.Size
+	transferStatusOK   = 0
+	transferStatusBad  = 1
+)
+
+// Interval of the progress output
+const progressInterval = time.Second
+
+// errVerification is returned if the hash of the received file does not match
+var errVerification = errors.New("hash of received file does not match")
+
+type transferHeader struct {
+	size uint64
+	hash [sha256.Size]byte
+}
+
+func (h *transferHeader) marshal() []byte {
+	b := make([]byte, transferHeaderSize)
+	copy(b, transferMagic)
+	binary.BigEndian.PutUint64(b[4:], h.size)
+	copy(b[12:], h.hash[:])
+	return b
+}
+
+func (h *transferHeader) unmarshal(b []byte) error {
+	if len(b) != transferHeaderSize || !bytes.Equal(b[:4], []byte(transferMagic)) {
+		return errors.New("invalid file transfer header, is the peer sending a file?")
+	}
+	h.size = binary.BigEndian.Uint64(b[4:])
+	copy(h.hash[:], b[12:])
+	return nil
+}
+
+// sendFile sends the file over the connection and waits until the receiver verified it
+func sendFile(conn io.ReadWriteCloser, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return fmt.Errorf("can't read %s: %v", path, err)
+	}
+	header := transferHeader{size: uint64(size)}
+	copy(header.hash[:], h.Sum(nil))
+	if _, err = conn.Write(header.marshal()); err != nil {
+		return connClosedError(err)
+	}
+
+	b := make([]byte, 8)
+	if _, err = io.ReadFull(conn, b); err != nil {
+		return connClosedError(err)
+	}
+	offset := int64(binary.BigEndian.Uint64(b))
+	if offset > size {
+		return fmt.Errorf("receiver's partial file is larger than %s (%d > %d bytes)", path, offset, size)
+	}
+	if offset > 0 {
+		log.Info("Resuming transfer", "offset", offset)
+	}
+	if _, err = f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	p := newProgress("Sent", size, offset)
+	_, err = io.CopyN(conn, io.TeeReader(f, p), size-offset)
+	p.stop()
+	if err != nil {
+		return connClosedError(err)
+	}
+	closeWrite(conn)
+
+	status := make([]byte, 1)
+	if _, err = io.ReadFull(conn, status); err != nil {
+		return connClosedError(err)
+	}
+	if status[0] != transferStatusOK {
+		return &exitCodeError{code: exitVerification, err: errors.New("receiver failed to verify the file")}
+	}
+	return nil
+}
+
+// receiveFile receives a file over the connection and verifies its hash. If resume is set,
+// the transfer continues after the data already in the file.
+func receiveFile(conn io.ReadWriteCloser, path string, resume bool) error {
+	flags := os.O_RDWR | os.O_CREATE
+	if !resume {
+		flags |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(path, flags, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Hash the partial file, this leaves the file offset at its end
+	h := sha256.New()
+	offset, err := io.Copy(h, f)
+	if err != nil {
+		return fmt.Errorf("can't read %s: %v", path, err)
+	}
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(offset))
+	if _, err = conn.Write(b); err != nil {
+		return connClosedError(err)
+	}
+
+	b = make([]byte, transferHeaderSize)
+	if _, err = io.ReadFull(conn, b); err != nil {
+		return connClosedError(err)
+	}
+	var header transferHeader
+	if err = header.unmarshal(b); err != nil {
+		return err
+	}
+	size := int64(header.size)
+	if offset > size {
+		return fmt.Errorf("partial file %s is larger than the sent file (%d > %d bytes)", path, offset, size)
+	}
+	if offset > 0 {
+		log.Info("Resuming transfer", "offset", offset)
+	}
+
+	p := newProgress("Received", size, offset)
+	_, err = io.CopyN(io.MultiWriter(f, h, p), conn, size-offset)
+	p.stop()
+	if err == io.EOF {
+		return &exitCodeError{code: exitRemoteClosed,
+			err: fmt.Errorf("transfer truncated, received %d of %d bytes", offset+p.transferred(), size)}
+	} else if err != nil {
+		return connClosedError(err)
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+
+	status := []byte{transferStatusOK}
+	if !bytes.Equal(h.Sum(nil), header.hash[:]) {
+		status[0] = transferStatusBad
+	}
+	if _, err = conn.Write(status); err != nil {
+		return connClosedError(err)
+	}
+	closeWrite(conn)
+	// Wait until the sender closed the connection, so that the status is not lost by
+	// closing the session early
+	_, _ = io.Copy(ioutil.Discard, conn)
+	if status[0] != transferStatusOK {
+		return &exitCodeError{code: exitVerification, err: errVerification}
+	}
+	return nil
+}
+
+// progress prints the progress and throughput of a transfer to stderr, once per
+// progressInterval and when stopped. Data written to it is counted as transferred.
+type progress struct {
+	action string
+	size   int64
+	offset int64
+	done   int64 // updated atomically
+	start  time.Time
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// newProgress starts printing the progress of the transfer of size bytes, of which offset
+// bytes were transferred before
+func newProgress(action string, size, offset int64) *progress {
+	p := &progress{
+		action: action,
+		size:   size,
+		offset: offset,
+		start:  time.Now(),
+		quit:   make(chan struct{}),
+	}
+	p.wg.Add(1)
+	go p.run()
+	return p
+}
+
+func (p *progress) Write(b []byte) (int, error) {
+	atomic.AddInt64(&p.done, int64(len(b)))
+	return len(b), nil
+}
+
+// transferred returns the number of bytes transferred, excluding the offset
+func (p *progress) transferred() int64 {
+	return atomic.LoadInt64(&p.done)
+}
+
+func (p *progress) run() {
+	defer p.wg.Done()
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.print()
+		case <-p.quit:
+			p.print()
+			fmt.Fprintln(os.Stderr)
+			return
+		}
+	}
+}
+
+func (p *progress) print() {
+	done := p.offset + p.transferred()
+	percent := 100.0
+	if p.size > 0 {
+		percent = float64(done) * 100 / float64(p.size)
+	}
+	rate := float64(p.transferred()) / time.Since(p.start).Seconds()
+	fmt.Fprintf(os.Stderr, "\r%s %s of %s (%.0f%%), %s/s ", p.action,
+		formatBytes(float64(done)), formatBytes(float64(p.size)), percent, formatBytes(rate))
+}
+
+// stop prints the final progress
+func (p *progress) stop() {
+	close(p.quit)
+	p.wg.Wait()
+}
+
+// formatBytes formats a number of bytes with a binary prefix, e.g. 1.5 MiB
+func formatBytes(n float64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%.0f B", n)
+	}
+	prefixes := "KMGTPE"
+	i := 0
+	for n /= unit; n >= unit && i < len(prefixes)-1; n /= unit {
+		i++
+	}
+	return fmt.Sprintf("%.1f %ciB", n, prefixes[i])
+}
@@ -0,0 +1,119 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// transfer sends the file src to dst over a local TCP connection, which supports
+// half-close like the QUIC streams. Returns the errors of the sender and the receiver.
+func transfer(t *testing.T, src, dst string, resume bool) (error, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	recvErr := make(chan error, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			recvErr <- err
+			return
+		}
+		defer conn.Close()
+		recvErr <- receiveFile(conn, dst, resume)
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendErr := sendFile(conn, src)
+	conn.Close()
+	return sendErr, <-recvErr
+}
+
+func TestTransferFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "netcat-transfer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	dst := filepath.Join(dir, "dst")
+	data := make([]byte, 100000)
+	rand.Read(data)
+	if err = ioutil.WriteFile(src, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(name string, sendErr, recvErr error) {
+		if sendErr != nil || recvErr != nil {
+			t.Fatalf("%s: transfer failed, sender: %v, receiver: %v", name, sendErr, recvErr)
+		}
+		received, err := ioutil.ReadFile(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(received, data) {
+			t.Errorf("%s: received file differs, %d of %d bytes", name, len(received), len(data))
+		}
+	}
+
+	sendErr, recvErr := transfer(t, src, dst, false)
+	check("Complete", sendErr, recvErr)
+
+	// Without -resume, the existing file is overwritten
+	sendErr, recvErr = transfer(t, src, dst, false)
+	check("Overwrite", sendErr, recvErr)
+
+	if err = ioutil.WriteFile(dst, data[:40000], 0644); err != nil {
+		t.Fatal(err)
+	}
+	sendErr, recvErr = transfer(t, src, dst, true)
+	check("Resume", sendErr, recvErr)
+
+	// A partial file with different data fails the verification on both sides
+	if err = ioutil.WriteFile(dst, make([]byte, 40000), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sendErr, recvErr = transfer(t, src, dst, true)
+	if exitCode(sendErr) != exitVerification || exitCode(recvErr) != exitVerification {
+		t.Errorf("Expected verification failure, sender: %v, receiver: %v", sendErr, recvErr)
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	cases := map[float64]string{
+		0:           "0 B",
+		1023:        "1023 B",
+		1536:        "1.5 KiB",
+		1024 * 1024: "1.0 MiB",
+		3 << 30:     "3.0 GiB",
+	}
+	for n, expected := range cases {
+		if s := formatBytes(n); s != expected {
+			t.Errorf("formatBytes(%v): expected %q, got %q", n, expected, s)
+		}
+	}
+}
@@ -80,6 +80,12 @@ func ChoosePathByMetric(pathAlgo int, remote *snet.Addr) (snet.Path, error) {
 	return pathSelection(paths, pathAlgo), nil
 }
 
+// SelectPathByMetric chooses the best of the given paths based on the metric pathAlgo.
+// The paths must not be empty.
+func SelectPathByMetric(pathAlgo int, paths []snet.Path) snet.Path {
+	return pathSelection(paths, pathAlgo)
+}
+
 // SetPath is a helper function to set the path on an snet.Addr
 func SetPath(addr *snet.Addr, path snet.Path) {
 	if path == nil {
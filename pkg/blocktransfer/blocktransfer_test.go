@@ -0,0 +1,257 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blocktransfer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lossyConn drops every dropEvery-th packet written, and corrupts the last byte of every
+// corruptEvery-th packet. Every forgeEvery-th block response is replaced by a forged
+// block with a valid checksum.
+type lossyConn struct {
+	net.PacketConn
+	dropEvery    int
+	corruptEvery int
+	forgeEvery   int
+
+	mutex   sync.Mutex
+	written int
+}
+
+func (c *lossyConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.mutex.Lock()
+	c.written++
+	drop := c.dropEvery > 0 && c.written%c.dropEvery == 0
+	corrupt := c.corruptEvery > 0 && c.written%c.corruptEvery == 0
+	forge := c.forgeEvery > 0 && c.written%c.forgeEvery == 0
+	c.mutex.Unlock()
+	if drop {
+		return len(b), nil
+	}
+	if corrupt {
+		b = append([]byte(nil), b...)
+		b[len(b)-1] ^= 0xff
+	}
+	if forge && b[0] == TypeBlock && len(b) > blockResponseHeaderSize {
+		b = append([]byte(nil), b...)
+		b[len(b)-1] ^= 0xff
+		binary.BigEndian.PutUint32(b[9:], blockChecksum(b[blockResponseHeaderSize:]))
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+// writerAt collects the data written at any offset
+type writerAt struct {
+	buf []byte
+}
+
+func (w *writerAt) WriteAt(b []byte, off int64) (int, error) {
+	if end := int(off) + len(b); end > len(w.buf) {
+		w.buf = append(w.buf, make([]byte, end-len(w.buf))...)
+	}
+	return copy(w.buf[off:], b), nil
+}
+
+// startServer serves the objects on a local UDP socket over conn, and returns a client
+// socket connected to it
+func startServer(t *testing.T, objects map[string][]byte, conn *lossyConn) (net.Conn, func()) {
+	pconn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.PacketConn = pconn
+	source := func(name string) (io.ReaderAt, int64, bool) {
+		data, ok := objects[name]
+		return bytes.NewReader(data), int64(len(data)), ok
+	}
+	server := NewServer(conn, source)
+	server.Trees = func(name string) (*HashTree, bool) {
+		data, ok := objects[name]
+		return NewHashTree(data), ok
+	}
+	go func() {
+		_ = server.Serve()
+	}()
+	client, err := net.Dial("udp", pconn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, func() {
+		client.Close()
+		pconn.Close()
+	}
+}
+
+func TestMessages(t *testing.T) {
+	stat := statRequest{id: 7, name: "image.jpg"}
+	var parsedStat statRequest
+	if err := parsedStat.unmarshal(stat.marshal()); err != nil || parsedStat != stat {
+		t.Errorf("Stat request: expected %v, got %v, %v", stat, parsedStat, err)
+	}
+
+	block := blockRequest{id: 7, blockSize: 1200, name: "image.jpg", blocks: []uint32{0, 5, 1 << 20}}
+	var parsedBlock blockRequest
+	if err := parsedBlock.unmarshal(block.marshal()); err != nil || !reflect.DeepEqual(parsedBlock, block) {
+		t.Errorf("Block request: expected %v, got %v, %v", block, parsedBlock, err)
+	}
+
+	b := block.marshal()
+	if len(b)*maxAmplification < len(block.blocks)*(blockResponseHeaderSize+block.blockSize) {
+		t.Errorf("Block request of %d bytes not padded", len(b))
+	}
+	if err := parsedBlock.unmarshal(b[:len(b)-1]); err == nil {
+		t.Errorf("Expected error for truncated block request")
+	}
+}
+
+func TestBlockSizeForPath(t *testing.T) {
+	if s := BlockSizeForPath(nil); s != DefaultBlockSize {
+		t.Errorf("Expected default block size without path, got %d", s)
+	}
+}
+
+func TestFetch(t *testing.T) {
+	data := make([]byte, 123456)
+	_, _ = rand.Read(data)
+	objects := map[string][]byte{"obj": data, "empty": {}}
+
+	for _, dropEvery := range []int{0, 7, 3} {
+		conn, stop := startServer(t, objects, &lossyConn{dropEvery: dropEvery})
+
+		size, _, err := Stat(conn, "obj")
+		if err != nil || size != int64(len(data)) {
+			stop()
+			t.Fatalf("Stat with drop every %d: expected size %d, got %d, %v", dropEvery, len(data), size, err)
+		}
+
+		var w writerAt
+		opts := &Options{BlockSize: 1000, InitialRTT: 5 * time.Millisecond}
+		stats, err := Fetch(conn, "obj", size, &w, opts)
+		stop()
+		if err != nil {
+			t.Fatalf("Fetch with drop every %d: %v", dropEvery, err)
+		}
+		if !bytes.Equal(w.buf, data) {
+			t.Errorf("Fetch with drop every %d: received data differs", dropEvery)
+		}
+		if stats.Blocks != 124 {
+			t.Errorf("Fetch with drop every %d: expected 124 blocks, got %d", dropEvery, stats.Blocks)
+		}
+		if dropEvery > 0 && stats.Retransmissions == 0 {
+			t.Errorf("Fetch with drop every %d: expected retransmissions", dropEvery)
+		}
+	}
+
+	conn, stop := startServer(t, objects, &lossyConn{})
+	defer stop()
+	var w writerAt
+	if _, err := Fetch(conn, "empty", 0, &w, nil); err != nil || len(w.buf) != 0 {
+		t.Errorf("Fetch of empty object: %v", err)
+	}
+	if _, _, err := Stat(conn, "missing"); err != ErrNotFound {
+		t.Errorf("Stat of missing object: expected ErrNotFound, got %v", err)
+	}
+	if _, err := Fetch(conn, "missing", 10, &w, nil); err != ErrNotFound {
+		t.Errorf("Fetch of missing object: expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestFetchCorrupted(t *testing.T) {
+	data := make([]byte, 50000)
+	_, _ = rand.Read(data)
+	conn, stop := startServer(t, map[string][]byte{"obj": data}, &lossyConn{corruptEvery: 5})
+	defer stop()
+
+	var w writerAt
+	opts := &Options{BlockSize: 1000, InitialRTT: 5 * time.Millisecond}
+	stats, err := Fetch(conn, "obj", int64(len(data)), &w, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(w.buf, data) {
+		t.Errorf("Received data differs")
+	}
+	if stats.Corrupted == 0 {
+		t.Errorf("Expected corrupted blocks to be detected")
+	}
+}
+
+func TestHashTree(t *testing.T) {
+	for _, size := range []int{0, 1, 256, 257, 1024, 5000, 123456} {
+		data := make([]byte, size)
+		_, _ = rand.Read(data)
+		tree := NewHashTree(data)
+		root := RootHash(data)
+		if tree.Root() != root {
+			t.Errorf("Size %d: root of tree differs from RootHash", size)
+		}
+		for k := 0; k < len(tree.levels); k++ {
+			r, listSize, ok := tree.hashList(k)
+			if !ok || listSize != int64(numNodes(int64(size), k))*32 {
+				t.Fatalf("Size %d: unexpected hash list of level %d: %d, %v", size, k, listSize, ok)
+			}
+			list := make([]byte, listSize)
+			if n, err := r.ReadAt(list, 0); n != len(list) || (err != nil && err != io.EOF) {
+				t.Fatalf("Size %d: reading hash list of level %d: %d, %v", size, k, n, err)
+			}
+			if treeHash(parseHashes(list)) != root {
+				t.Errorf("Size %d: hash list of level %d does not match the root", size, k)
+			}
+		}
+		if _, _, ok := tree.hashList(len(tree.levels)); ok {
+			t.Errorf("Size %d: expected no hash list above the root", size)
+		}
+	}
+	if s := TreeBlockSize(1300); s != 1024 {
+		t.Errorf("Expected tree block size 1024, got %d", s)
+	}
+}
+
+func TestFetchVerified(t *testing.T) {
+	data := make([]byte, 300000)
+	_, _ = rand.Read(data)
+	root := RootHash(data)
+	conn, stop := startServer(t, map[string][]byte{"obj": data, "empty": {}}, &lossyConn{forgeEvery: 7})
+	defer stop()
+
+	var w writerAt
+	opts := &Options{BlockSize: 256, InitialRTT: 5 * time.Millisecond}
+	stats, err := FetchVerified(conn, "obj", int64(len(data)), root, &w, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(w.buf, data) {
+		t.Errorf("Received data differs")
+	}
+	if stats.Forged == 0 || stats.HashBlocks == 0 {
+		t.Errorf("Expected forged blocks to be detected and hash lists to be fetched: %+v", stats)
+	}
+
+	if _, err := FetchVerified(conn, "empty", 0, RootHash(nil), &w, nil); err != nil {
+		t.Errorf("Fetch of empty object: %v", err)
+	}
+	if _, err := FetchVerified(conn, "obj", int64(len(data)), root, &w, &Options{BlockSize: 1000}); err == nil {
+		t.Errorf("Expected error for block size that is not a power of two")
+	}
+}
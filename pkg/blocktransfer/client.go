@@ -0,0 +1,604 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blocktransfer
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"time"
+)
+
+const (
+	// Number of attempts and timeout of each attempt of Stat
+	statRetries = 4
+	statTimeout = 3 * time.Second
+
+	defaultInitialWindow = 4
+	defaultMaxWindow     = 256
+	defaultTimeout       = 10 * time.Second
+	// The window is not reduced below this size on loss, only on timeouts
+	minWindow = 2
+	// A block is considered lost once this many blocks requested after it were received
+	dupThreshold = 3
+
+	initialRTO = time.Second
+	minRTO     = 20 * time.Millisecond
+	maxRTO     = 10 * time.Second
+)
+
+var (
+	// ErrTimeout is returned if the server did not reply within the timeout
+	ErrTimeout = errors.New("timeout waiting for server")
+	// ErrHashMismatch is returned by FetchVerified if an empty object does not match
+	// the root hash
+	ErrHashMismatch = errors.New("object does not match its hash")
+)
+
+// Options configure a transfer. Zero values select the defaults.
+type Options struct {
+	// BlockSize is the size of the requested blocks, see BlockSizeForPath (default
+	// DefaultBlockSize)
+	BlockSize int
+	// InitialWindow and MaxWindow limit the number of blocks requested but not yet
+	// received (default 4 and 256)
+	InitialWindow int
+	MaxWindow     int
+	// InitialRTT is the estimate of the round trip time before the first block is
+	// received, e.g. measured by Stat. Without it, blocks are requested again after 1s.
+	InitialRTT time.Duration
+	// Timeout is the time after which the transfer fails if no block was received
+	// (default 10s)
+	Timeout time.Duration
+}
+
+// Stats describe a completed transfer
+type Stats struct {
+	Blocks          int64
+	Requests        int
+	Retransmissions int64
+	Timeouts        int
+	// Blocks dropped because of an invalid checksum
+	Corrupted int64
+	// Blocks dropped by FetchVerified because they did not match the hash tree
+	Forged int64
+	// Blocks of the hash lists fetched by FetchVerified
+	HashBlocks int64
+	// Smoothed round trip time and window size at the end of the transfer
+	RTT      time.Duration
+	Window   int
+	Duration time.Duration
+}
+
+// Stat requests the size of the object from the server connected to conn. It returns the
+// size and the round trip time of the request.
+func Stat(conn net.Conn, name string) (int64, time.Duration, error) {
+	if len(name) > MaxNameLength {
+		return 0, 0, fmt.Errorf("name too long: %d bytes", len(name))
+	}
+	defer clearReadDeadline(conn)
+
+	id := newTransferID()
+	req := (&statRequest{id: id, name: name}).marshal()
+	buf := make([]byte, 64)
+	for i := 0; i < statRetries; i++ {
+		start := time.Now()
+		if _, err := conn.Write(req); err != nil {
+			return 0, 0, err
+		}
+		deadline := start.Add(statTimeout)
+		if err := conn.SetReadDeadline(deadline); err != nil {
+			return 0, 0, err
+		}
+		for time.Now().Before(deadline) {
+			n, err := conn.Read(buf)
+			if err != nil {
+				// Timeout, or e.g. an SCMP error; retry in both cases
+				break
+			}
+			typ, respID, ok := responseID(buf[:n])
+			if !ok || respID != id {
+				continue
+			}
+			if typ == TypeError && n == 6 {
+				return 0, 0, responseError(buf[5])
+			}
+			if typ == TypeStat && n == 13 {
+				return int64(binary.BigEndian.Uint64(buf[5:])), time.Since(start), nil
+			}
+		}
+	}
+	return 0, 0, ErrTimeout
+}
+
+// Fetch requests the object of the given size from the server connected to conn, and
+// writes it to w. The blocks are written as they arrive, i.e. not in order.
+func Fetch(conn net.Conn, name string, size int64, w io.WriterAt, opts *Options) (*Stats, error) {
+	f, err := newFetcher(conn, name, size, w, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer clearReadDeadline(conn)
+	return f.run()
+}
+
+// FetchVerified is like Fetch, but checks each block against the hash tree of the
+// object with the given root hash, see HashTree. Blocks that don't match, e.g. because
+// they were spoofed, are dropped and requested again like lost blocks. The hash lists
+// needed to check the blocks are fetched first, and their blocks are checked in the same
+// way against the root. The block size must be HashLeafSize times a power of two, see
+// TreeBlockSize, and the server must serve the hash trees, see Server.Trees.
+func FetchVerified(conn net.Conn, name string, size int64, root [sha256.Size]byte, w io.WriterAt,
+	opts *Options) (*Stats, error) {
+
+	if len(name) > MaxHashedNameLength {
+		return nil, fmt.Errorf("name too long: %d bytes", len(name))
+	}
+	var o Options
+	if opts != nil {
+		o = *opts
+	}
+	if o.BlockSize == 0 {
+		o.BlockSize = TreeBlockSize(DefaultBlockSize)
+	}
+	if !isTreeBlockSize(o.BlockSize) || o.BlockSize > MaxBlockSize {
+		return nil, fmt.Errorf("block size %d is not %d times a power of two", o.BlockSize, HashLeafSize)
+	}
+	if size == 0 {
+		// Nothing to fetch, but the root must still match
+		if RootHash(nil) != root {
+			return nil, ErrHashMismatch
+		}
+		return &Stats{}, nil
+	}
+	var hashStats Stats
+	hashes, err := levelHashes(conn, name, size, root, treeLevel(o.BlockSize), &o, &hashStats)
+	if err != nil {
+		return nil, err
+	}
+	f, err := newFetcher(conn, name, size, w, &o)
+	if err != nil {
+		return nil, err
+	}
+	f.verify = func(index uint32, data []byte) bool {
+		return treeHash(leafHashes(data)) == hashes[index]
+	}
+	defer clearReadDeadline(conn)
+	stats, err := f.run()
+	if err != nil {
+		return nil, err
+	}
+	stats.Forged += hashStats.Forged
+	stats.HashBlocks = hashStats.HashBlocks
+	return stats, nil
+}
+
+// levelHashes returns the nodes of level k of the hash tree of an object. If the level
+// has more than one node, its hash list is fetched, checking each block of the list
+// against the level covering a block of the list.
+func levelHashes(conn net.Conn, name string, size int64, root [sha256.Size]byte, k int,
+	opts *Options, stats *Stats) ([][sha256.Size]byte, error) {
+
+	n := numNodes(size, k)
+	if n == 1 {
+		return [][sha256.Size]byte{root}, nil
+	}
+	perBlock := opts.BlockSize / sha256.Size
+	parents, err := levelHashes(conn, name, size, root, k+treeLevel(perBlock*HashLeafSize), opts, stats)
+	if err != nil {
+		return nil, err
+	}
+	list := make(buffer, n*sha256.Size)
+	f, err := newFetcher(conn, hashListName(name, k), int64(len(list)), list, opts)
+	if err != nil {
+		return nil, err
+	}
+	f.verify = func(index uint32, data []byte) bool {
+		return treeHash(parseHashes(data)) == parents[index]
+	}
+	defer clearReadDeadline(conn)
+	listStats, err := f.run()
+	if err != nil {
+		return nil, fmt.Errorf("fetching hash list: %v", err)
+	}
+	stats.Forged += listStats.Forged
+	stats.HashBlocks += listStats.Blocks
+	// The next transfer starts with the round trip time measured so far
+	opts.InitialRTT = listStats.RTT
+	return parseHashes(list), nil
+}
+
+// buffer collects the blocks of an object in memory
+type buffer []byte
+
+func (b buffer) WriteAt(p []byte, off int64) (int, error) {
+	if off+int64(len(p)) > int64(len(b)) {
+		return 0, fmt.Errorf("block exceeds object size")
+	}
+	return copy(b[off:], p), nil
+}
+
+// flight is a request of a block that was not yet answered
+type flight struct {
+	seq           uint64
+	sentAt        time.Time
+	retransmitted bool
+}
+
+type fetcher struct {
+	conn      net.Conn
+	name      string
+	size      int64
+	w         io.WriterAt
+	opts      Options
+	id        uint32
+	numBlocks int64
+
+	// Blocks that were requested at least once, and that were received
+	requested []bool
+	received  []bool
+	done      int64
+	// Next block that was never requested, and blocks to request again
+	next     uint32
+	lost     []uint32
+	inflight map[uint32]flight
+	seq      uint64
+
+	cwnd       float64
+	ssthresh   float64
+	recoverSeq uint64
+
+	srtt   time.Duration
+	rttvar time.Duration
+	rto    time.Duration
+
+	// verify, if set, checks the data of each block
+	verify func(index uint32, data []byte) bool
+
+	stats Stats
+}
+
+func newFetcher(conn net.Conn, name string, size int64, w io.WriterAt, opts *Options) (*fetcher, error) {
+	if len(name) > MaxNameLength {
+		return nil, fmt.Errorf("name too long: %d bytes", len(name))
+	}
+	var o Options
+	if opts != nil {
+		o = *opts
+	}
+	if o.BlockSize == 0 {
+		o.BlockSize = DefaultBlockSize
+	}
+	if o.BlockSize < MinBlockSize || o.BlockSize > MaxBlockSize {
+		return nil, fmt.Errorf("block size %d not in [%d, %d]", o.BlockSize, MinBlockSize, MaxBlockSize)
+	}
+	if o.MaxWindow <= 0 {
+		o.MaxWindow = defaultMaxWindow
+	}
+	if o.InitialWindow <= 0 {
+		o.InitialWindow = defaultInitialWindow
+	}
+	if o.InitialWindow > o.MaxWindow {
+		o.InitialWindow = o.MaxWindow
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = defaultTimeout
+	}
+	n := numBlocks(size, o.BlockSize)
+	if n > int64(^uint32(0)) {
+		return nil, fmt.Errorf("object too large for block size %d", o.BlockSize)
+	}
+
+	f := &fetcher{
+		conn:      conn,
+		name:      name,
+		size:      size,
+		w:         w,
+		opts:      o,
+		id:        newTransferID(),
+		numBlocks: n,
+		requested: make([]bool, n),
+		received:  make([]bool, n),
+		inflight:  make(map[uint32]flight),
+		cwnd:      float64(o.InitialWindow),
+		ssthresh:  float64(o.MaxWindow),
+		rto:       initialRTO,
+	}
+	if o.InitialRTT > 0 {
+		f.updateRTT(o.InitialRTT)
+	}
+	return f, nil
+}
+
+func (f *fetcher) run() (*Stats, error) {
+	start := time.Now()
+	lastProgress := start
+	buf := make([]byte, blockResponseHeaderSize+MaxBlockSize+1)
+	for f.done < f.numBlocks {
+		if err := f.sendRequests(); err != nil {
+			return nil, err
+		}
+		if err := f.conn.SetReadDeadline(f.nextTimeout()); err != nil {
+			return nil, err
+		}
+		n, err := f.conn.Read(buf)
+		now := time.Now()
+		if err != nil {
+			if isTimeout(err) {
+				f.onTimeout(now)
+			}
+			// Other errors, e.g. SCMP errors, are ignored; the transfer fails by timeout
+			// if they persist
+		} else {
+			progress, err := f.handleResponse(buf[:n], now)
+			if err != nil {
+				return nil, err
+			}
+			if progress {
+				lastProgress = now
+			}
+		}
+		if now.Sub(lastProgress) > f.opts.Timeout {
+			return nil, ErrTimeout
+		}
+	}
+	f.stats.Blocks = f.numBlocks
+	f.stats.RTT = f.srtt
+	f.stats.Window = int(f.cwnd)
+	f.stats.Duration = time.Since(start)
+	return &f.stats, nil
+}
+
+// sendRequests requests blocks until the window is full, first the lost blocks, then new
+// blocks
+func (f *fetcher) sendRequests() error {
+	var batch []uint32
+	for len(f.inflight)+len(batch) < int(f.cwnd) {
+		index, ok := f.nextBlock()
+		if !ok {
+			break
+		}
+		batch = append(batch, index)
+		if len(batch) == MaxBlocksPerRequest {
+			if err := f.request(batch); err != nil {
+				return err
+			}
+			batch = nil
+		}
+	}
+	if len(batch) > 0 {
+		return f.request(batch)
+	}
+	return nil
+}
+
+func (f *fetcher) nextBlock() (uint32, bool) {
+	for len(f.lost) > 0 {
+		index := f.lost[0]
+		f.lost = f.lost[1:]
+		// A block marked as lost might still have arrived late
+		if !f.received[index] {
+			return index, true
+		}
+	}
+	if int64(f.next) < f.numBlocks {
+		f.next++
+		return f.next - 1, true
+	}
+	return 0, false
+}
+
+func (f *fetcher) request(blocks []uint32) error {
+	req := blockRequest{id: f.id, blockSize: f.opts.BlockSize, name: f.name, blocks: blocks}
+	if _, err := f.conn.Write(req.marshal()); err != nil {
+		return err
+	}
+	f.stats.Requests++
+	now := time.Now()
+	for _, index := range blocks {
+		f.seq++
+		if f.requested[index] {
+			f.stats.Retransmissions++
+		}
+		f.inflight[index] = flight{seq: f.seq, sentAt: now, retransmitted: f.requested[index]}
+		f.requested[index] = true
+	}
+	return nil
+}
+
+// nextTimeout returns the time at which the oldest outstanding request times out
+func (f *fetcher) nextTimeout() time.Time {
+	var oldest time.Time
+	for _, fl := range f.inflight {
+		if oldest.IsZero() || fl.sentAt.Before(oldest) {
+			oldest = fl.sentAt
+		}
+	}
+	if oldest.IsZero() {
+		oldest = time.Now()
+	}
+	return oldest.Add(f.rto)
+}
+
+// handleResponse processes a packet from the server. It returns whether a new block was
+// received, and an error if the transfer failed.
+func (f *fetcher) handleResponse(b []byte, now time.Time) (bool, error) {
+	typ, id, ok := responseID(b)
+	if !ok || id != f.id {
+		return false, nil
+	}
+	switch typ {
+	case TypeError:
+		if len(b) != 6 {
+			return false, nil
+		}
+		return false, responseError(b[5])
+	case TypeBlock:
+		if len(b) < blockResponseHeaderSize {
+			return false, nil
+		}
+		index := binary.BigEndian.Uint32(b[5:])
+		data := b[blockResponseHeaderSize:]
+		if int64(index) >= f.numBlocks || len(data) != blockLength(f.size, f.opts.BlockSize, index) {
+			return false, nil
+		}
+		if f.received[index] {
+			return false, nil
+		}
+		if binary.BigEndian.Uint32(b[9:]) != blockChecksum(data) {
+			// Requested again like a lost block
+			f.stats.Corrupted++
+			return false, nil
+		}
+		if f.verify != nil && !f.verify(index, data) {
+			// Requested again like a lost block
+			f.stats.Forged++
+			return false, nil
+		}
+		if _, err := f.w.WriteAt(data, int64(index)*int64(f.opts.BlockSize)); err != nil {
+			return false, err
+		}
+		f.received[index] = true
+		f.done++
+		if fl, ok := f.inflight[index]; ok {
+			delete(f.inflight, index)
+			if !fl.retransmitted {
+				// Only unambiguous samples, see Karn's algorithm
+				f.updateRTT(now.Sub(fl.sentAt))
+			}
+			f.detectLosses(fl.seq)
+			f.increaseWindow()
+		}
+		return true, nil
+	default:
+		return false, nil
+	}
+}
+
+// detectLosses marks the blocks as lost that were requested dupThreshold requests before
+// the block with the sequence number seq, which was just received
+func (f *fetcher) detectLosses(seq uint64) {
+	var lost []uint32
+	loss := false
+	for index, fl := range f.inflight {
+		if fl.seq+dupThreshold <= seq {
+			lost = append(lost, index)
+			delete(f.inflight, index)
+			// Losses of blocks requested before the last reduction belong to the same
+			// loss event
+			if fl.seq > f.recoverSeq {
+				loss = true
+			}
+		}
+	}
+	if loss {
+		f.ssthresh = f.cwnd / 2
+		if f.ssthresh < minWindow {
+			f.ssthresh = minWindow
+		}
+		f.cwnd = f.ssthresh
+		f.recoverSeq = f.seq
+	}
+	f.markLost(lost)
+}
+
+// onTimeout marks all blocks as lost whose requests timed out, and restarts with a
+// window of a single block
+func (f *fetcher) onTimeout(now time.Time) {
+	var lost []uint32
+	for index, fl := range f.inflight {
+		if now.Sub(fl.sentAt) >= f.rto {
+			lost = append(lost, index)
+			delete(f.inflight, index)
+		}
+	}
+	if len(lost) == 0 {
+		return
+	}
+	f.stats.Timeouts++
+	f.ssthresh = f.cwnd / 2
+	if f.ssthresh < minWindow {
+		f.ssthresh = minWindow
+	}
+	f.cwnd = 1
+	f.recoverSeq = f.seq
+	f.rto *= 2
+	if f.rto > maxRTO {
+		f.rto = maxRTO
+	}
+	f.markLost(lost)
+}
+
+func (f *fetcher) markLost(lost []uint32) {
+	sort.Slice(lost, func(i, j int) bool { return lost[i] < lost[j] })
+	f.lost = append(f.lost, lost...)
+}
+
+// increaseWindow grows the window exponentially up to the slow start threshold, and
+// linearly after it
+func (f *fetcher) increaseWindow() {
+	if f.cwnd < f.ssthresh {
+		f.cwnd++
+	} else {
+		f.cwnd += 1 / f.cwnd
+	}
+	if f.cwnd > float64(f.opts.MaxWindow) {
+		f.cwnd = float64(f.opts.MaxWindow)
+	}
+}
+
+// updateRTT updates the round trip time estimate and the retransmission timeout with a
+// new sample, as in RFC 6298
+func (f *fetcher) updateRTT(sample time.Duration) {
+	if f.srtt == 0 {
+		f.srtt = sample
+		f.rttvar = sample / 2
+	} else {
+		diff := f.srtt - sample
+		if diff < 0 {
+			diff = -diff
+		}
+		f.rttvar = (3*f.rttvar + diff) / 4
+		f.srtt = (7*f.srtt + sample) / 8
+	}
+	f.rto = f.srtt + 4*f.rttvar
+	if f.rto < minRTO {
+		f.rto = minRTO
+	}
+	if f.rto > maxRTO {
+		f.rto = maxRTO
+	}
+}
+
+func newTransferID() uint32 {
+	b := make([]byte, 4)
+	_, _ = rand.Read(b)
+	return binary.BigEndian.Uint32(b)
+}
+
+// clearReadDeadline removes the read deadline set for the requests
+func clearReadDeadline(conn net.Conn) {
+	_ = conn.SetReadDeadline(time.Time{})
+}
+
+func isTimeout(err error) bool {
+	nerr, ok := err.(net.Error)
+	return ok && nerr.Timeout()
+}
@@ -0,0 +1,240 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blocktransfer
+
+import (
+	"crypto/sha256"
+	"io"
+)
+
+const (
+	// HashLeafSize is the size of the leaves of the hash tree of an object
+	HashLeafSize = MinBlockSize
+	// MaxHashedNameLength is the maximum length of the names of objects whose hash tree
+	// is served, as the hash lists are requested with a longer name
+	MaxHashedNameLength = MaxNameLength - 2
+
+	// Levels of the hash tree below this level are not stored, but computed from the
+	// object when requested, as they take up a sizable fraction of the object size
+	minStoredLevel = 2
+)
+
+// Prefix of the name of a hash list, followed by the level and the name of the object
+const hashListPrefix byte = 0
+
+// RootHash returns the root of the hash tree of data, see HashTree
+func RootHash(data []byte) [sha256.Size]byte {
+	return treeHash(leafHashes(data))
+}
+
+// HashTree is a Merkle tree over the leaves of HashLeafSize bytes of an object, as in
+// RFC 6962: a leaf hashes to SHA-256(0x00 || leaf), an inner node with the children l and
+// r to SHA-256(0x01 || l || r). A tree with n > 1 leaves is split into a left subtree
+// with the largest power of two below n leaves and a right subtree with the rest. An
+// empty object has a single empty leaf.
+//
+// Level k of the tree consists of the nodes covering 2^k leaves each, the last node may
+// cover fewer. The nodes of a level are served as a hash list, i.e. an object containing
+// the concatenated node hashes. FetchVerified checks each block of a level against the
+// level above it, and each block of the object against the level covering a block.
+type HashTree struct {
+	data []byte
+	// levels[k] contains the nodes of level k, for k >= minStoredLevel
+	levels [][][sha256.Size]byte
+}
+
+// NewHashTree computes the hash tree of data. data must not be modified afterwards.
+func NewHashTree(data []byte) *HashTree {
+	t := &HashTree{data: data}
+	level := leafHashes(data)
+	for k := 0; ; k++ {
+		if k >= minStoredLevel || len(level) == 1 {
+			t.levels = append(t.levels, level)
+		} else {
+			t.levels = append(t.levels, nil)
+		}
+		if len(level) == 1 {
+			return t
+		}
+		parents := make([][sha256.Size]byte, (len(level)+1)/2)
+		for i := range parents {
+			parents[i] = treeHash(level[2*i : min(2*i+2, len(level))])
+		}
+		level = parents
+	}
+}
+
+// Root returns the root hash of the tree
+func (t *HashTree) Root() [sha256.Size]byte {
+	return t.levels[len(t.levels)-1][0]
+}
+
+// numNodes returns the number of nodes of level k
+func (t *HashTree) numNodes(k int) int {
+	return numNodes(int64(len(t.data)), k)
+}
+
+// hashList returns the hash list of level k of the tree
+func (t *HashTree) hashList(k int) (io.ReaderAt, int64, bool) {
+	if k < 0 || k >= len(t.levels) {
+		return nil, 0, false
+	}
+	return &hashListReader{tree: t, level: k}, int64(t.numNodes(k)) * sha256.Size, true
+}
+
+// hashListReader reads the hash list of a level, computing the nodes of the levels that
+// are not stored
+type hashListReader struct {
+	tree  *HashTree
+	level int
+}
+
+func (r *hashListReader) ReadAt(p []byte, off int64) (int, error) {
+	n := r.tree.numNodes(r.level)
+	first := int(off / sha256.Size)
+	last := int((off + int64(len(p)) + sha256.Size - 1) / sha256.Size)
+	if last > n {
+		last = n
+	}
+	if first >= last {
+		return 0, io.EOF
+	}
+	var b []byte
+	if stored := r.tree.levels[r.level]; stored != nil {
+		for _, h := range stored[first:last] {
+			b = append(b, h[:]...)
+		}
+	} else {
+		span := int64(HashLeafSize) << uint(r.level)
+		for i := first; i < last; i++ {
+			start := int64(i) * span
+			end := start + span
+			if end > int64(len(r.tree.data)) {
+				end = int64(len(r.tree.data))
+			}
+			h := treeHash(leafHashes(r.tree.data[start:end]))
+			b = append(b, h[:]...)
+		}
+	}
+	copied := copy(p, b[off-int64(first)*sha256.Size:])
+	if copied < len(p) {
+		return copied, io.EOF
+	}
+	return copied, nil
+}
+
+// hashListName returns the name under which the hash list of level k of the object is
+// requested
+func hashListName(name string, k int) string {
+	return string([]byte{hashListPrefix, byte(k)}) + name
+}
+
+// parseHashListName returns the object name and the level of a hash list name
+func parseHashListName(name string) (string, int, bool) {
+	if len(name) < 2 || name[0] != hashListPrefix {
+		return "", 0, false
+	}
+	return name[2:], int(name[1]), true
+}
+
+// isTreeBlockSize returns whether blocks of the given size are nodes of the hash tree,
+// i.e. whether the size is HashLeafSize times a power of two
+func isTreeBlockSize(blockSize int) bool {
+	return blockSize >= HashLeafSize && blockSize%HashLeafSize == 0 &&
+		(blockSize/HashLeafSize)&(blockSize/HashLeafSize-1) == 0
+}
+
+// TreeBlockSize rounds the block size down to a size suitable for FetchVerified
+func TreeBlockSize(blockSize int) int {
+	size := HashLeafSize
+	for 2*size <= blockSize && 2*size <= MaxBlockSize {
+		size *= 2
+	}
+	return size
+}
+
+// treeLevel returns the level of the tree with nodes of the given size in bytes, which
+// is HashLeafSize times a power of two
+func treeLevel(size int) int {
+	k := 0
+	for HashLeafSize<<uint(k) < size {
+		k++
+	}
+	return k
+}
+
+// numNodes returns the number of nodes of level k of the tree of an object
+func numNodes(size int64, k int) int {
+	leaves := (size + HashLeafSize - 1) / HashLeafSize
+	if leaves == 0 {
+		leaves = 1
+	}
+	span := int64(1) << uint(k)
+	return int((leaves + span - 1) / span)
+}
+
+// leafHashes returns the hashes of the leaves of data
+func leafHashes(data []byte) [][sha256.Size]byte {
+	n := numNodes(int64(len(data)), 0)
+	hashes := make([][sha256.Size]byte, n)
+	for i := range hashes {
+		leaf := data[i*HashLeafSize:]
+		if len(leaf) > HashLeafSize {
+			leaf = leaf[:HashLeafSize]
+		}
+		h := sha256.New()
+		_, _ = h.Write([]byte{0})
+		_, _ = h.Write(leaf)
+		copy(hashes[i][:], h.Sum(nil))
+	}
+	return hashes
+}
+
+// treeHash returns the root of the tree with the given leaf hashes, or equivalently, of
+// the subtree with the given consecutive nodes of a level, where all but the last cover
+// the same number of leaves and the first is aligned to a power of two number of nodes
+func treeHash(hashes [][sha256.Size]byte) [sha256.Size]byte {
+	if len(hashes) == 1 {
+		return hashes[0]
+	}
+	split := 1
+	for 2*split < len(hashes) {
+		split *= 2
+	}
+	left, right := treeHash(hashes[:split]), treeHash(hashes[split:])
+	h := sha256.New()
+	_, _ = h.Write([]byte{1})
+	_, _ = h.Write(left[:])
+	_, _ = h.Write(right[:])
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+// parseHashes splits a hash list into its hashes
+func parseHashes(b []byte) [][sha256.Size]byte {
+	hashes := make([][sha256.Size]byte, len(b)/sha256.Size)
+	for i := range hashes {
+		copy(hashes[i][:], b[i*sha256.Size:])
+	}
+	return hashes
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,269 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package blocktransfer implements reliable transfer of named objects over an unreliable
+// datagram socket, e.g. a SCION/UDP snet.Conn.
+//
+// The client requests the blocks of an object from the server, which replies with each
+// block in a separate packet. The server is stateless; all reliability is implemented by
+// the client, which keeps a window of outstanding blocks, adapts the window size to
+// the losses, detects lost blocks from the blocks received after them (like TCP SACK)
+// and requests lost blocks again.
+//
+// Wire format, all integers in big endian. The first byte of each packet is the message
+// type; applications can use other message types for their own messages on the same socket.
+//
+//	Stat request:   'S', uint32 transfer ID, uint8 name length, name
+//	Stat response:  'S', uint32 transfer ID, uint64 object size
+//	Block request:  'B', uint32 transfer ID, uint16 block size, uint8 name length, name,
+//	                uint8 number of blocks, uint32 block index for each block, zero padding
+//	Block response: 'B', uint32 transfer ID, uint32 block index, uint32 CRC-32C of the
+//	                block data, block data
+//	Error response: 'E', uint32 transfer ID, uint8 error code
+//
+// Block requests are padded, so that the block responses are at most 4 times as large as
+// the request. This keeps the server from being abused to reflect a large amount of
+// traffic to a spoofed address.
+//
+// Block i of an object covers the bytes [i*blockSize, (i+1)*blockSize), the last block
+// may be shorter. The client drops blocks with an invalid checksum, and requests them
+// again like lost blocks. The checksum only detects corruption; to detect blocks spoofed
+// by an attacker, FetchVerified checks each block against the hash tree of the object,
+// whose root hash the application obtains from a trusted source, e.g. signed. The hash
+// lists of the tree are requested like objects, with the name of the object prefixed by
+// a zero byte and the level of the tree, see HashTree.
+package blocktransfer
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+
+	"github.com/scionproto/scion/go/lib/snet"
+)
+
+// Message types
+const (
+	TypeStat  byte = 'S'
+	TypeBlock byte = 'B'
+	TypeError byte = 'E'
+)
+
+// Error codes of error responses
+const (
+	codeNotFound   byte = 1
+	codeBadRequest byte = 2
+)
+
+const (
+	// MaxNameLength is the maximum length of object names
+	MaxNameLength = 255
+	// MaxBlocksPerRequest is the maximum number of blocks requested in a single packet
+	MaxBlocksPerRequest = 4
+	// MaxRequestSize is the maximum size of all requests, including the padding
+	MaxRequestSize = blockResponseHeaderSize + MaxBlockSize
+
+	// DefaultBlockSize is used if the path MTU is not known
+	DefaultBlockSize = 1000
+	// MinBlockSize and MaxBlockSize are the limits of the block size accepted by the server
+	MinBlockSize = 256
+	MaxBlockSize = 8192
+
+	// Size of the header of block responses
+	blockResponseHeaderSize = 1 + 4 + 4 + 4
+	// Maximum ratio of the size of the block responses to the size of the block request
+	maxAmplification = 4
+
+	// Size of the SCION common header, the address header with IPv6 hosts, and the UDP
+	// header, in addition to the forwarding path
+	scionHeaderOverhead = 8 + 16 + 32 + 8
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+var (
+	// ErrNotFound is returned if the server does not have the requested object
+	ErrNotFound = errors.New("object not found")
+	// ErrBadRequest is returned if the server rejected the request as invalid
+	ErrBadRequest = errors.New("bad request")
+
+	errInvalidMessage = errors.New("invalid message")
+)
+
+// BlockSizeForPath returns the largest block size for which a block response fits into a
+// single packet on the path, within MinBlockSize and MaxBlockSize. DefaultBlockSize is
+// returned if the path or its MTU is not known, e.g. in the local AS.
+func BlockSizeForPath(path snet.Path) int {
+	if path == nil || path.MTU() == 0 {
+		return DefaultBlockSize
+	}
+	overhead := scionHeaderOverhead + blockResponseHeaderSize
+	if p := path.Path(); p != nil {
+		overhead += len(p.Raw)
+	}
+	size := int(path.MTU()) - overhead
+	if size < MinBlockSize {
+		return MinBlockSize
+	}
+	if size > MaxBlockSize {
+		return MaxBlockSize
+	}
+	return size
+}
+
+// blockChecksum returns the checksum of the data of a block response
+func blockChecksum(data []byte) uint32 {
+	return crc32.Checksum(data, crcTable)
+}
+
+// blockRequestSize returns the size to which a request for n blocks is padded
+func blockRequestSize(n int, blockSize int) int {
+	return (n*(blockResponseHeaderSize+blockSize) + maxAmplification - 1) / maxAmplification
+}
+
+// numBlocks returns the number of blocks of an object
+func numBlocks(size int64, blockSize int) int64 {
+	return (size + int64(blockSize) - 1) / int64(blockSize)
+}
+
+// blockLength returns the length of block index of an object
+func blockLength(size int64, blockSize int, index uint32) int {
+	start := int64(index) * int64(blockSize)
+	if size-start < int64(blockSize) {
+		return int(size - start)
+	}
+	return blockSize
+}
+
+type statRequest struct {
+	id   uint32
+	name string
+}
+
+type blockRequest struct {
+	id        uint32
+	blockSize int
+	name      string
+	blocks    []uint32
+}
+
+func appendName(b []byte, name string) []byte {
+	b = append(b, byte(len(name)))
+	return append(b, name...)
+}
+
+func parseName(b []byte) (string, []byte, error) {
+	if len(b) < 1 || len(b) < 1+int(b[0]) {
+		return "", nil, errInvalidMessage
+	}
+	n := int(b[0])
+	return string(b[1 : 1+n]), b[1+n:], nil
+}
+
+func (r *statRequest) marshal() []byte {
+	b := make([]byte, 5, 6+len(r.name))
+	b[0] = TypeStat
+	binary.BigEndian.PutUint32(b[1:], r.id)
+	return appendName(b, r.name)
+}
+
+func (r *statRequest) unmarshal(b []byte) error {
+	if len(b) < 5 || b[0] != TypeStat {
+		return errInvalidMessage
+	}
+	r.id = binary.BigEndian.Uint32(b[1:])
+	name, rest, err := parseName(b[5:])
+	if err != nil || len(rest) != 0 {
+		return errInvalidMessage
+	}
+	r.name = name
+	return nil
+}
+
+func (r *blockRequest) marshal() []byte {
+	b := make([]byte, 7, MaxRequestSize)
+	b[0] = TypeBlock
+	binary.BigEndian.PutUint32(b[1:], r.id)
+	binary.BigEndian.PutUint16(b[5:], uint16(r.blockSize))
+	b = appendName(b, r.name)
+	b = append(b, byte(len(r.blocks)))
+	for _, index := range r.blocks {
+		b = append(b, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(b[len(b)-4:], index)
+	}
+	if padded := blockRequestSize(len(r.blocks), r.blockSize); len(b) < padded {
+		b = append(b, make([]byte, padded-len(b))...)
+	}
+	return b
+}
+
+func (r *blockRequest) unmarshal(b []byte) error {
+	if len(b) < 7 || b[0] != TypeBlock {
+		return errInvalidMessage
+	}
+	r.id = binary.BigEndian.Uint32(b[1:])
+	r.blockSize = int(binary.BigEndian.Uint16(b[5:]))
+	name, rest, err := parseName(b[7:])
+	if err != nil || len(rest) < 1 {
+		return errInvalidMessage
+	}
+	r.name = name
+	n := int(rest[0])
+	rest = rest[1:]
+	if n > MaxBlocksPerRequest || len(rest) < 4*n || len(b) < blockRequestSize(n, r.blockSize) {
+		return errInvalidMessage
+	}
+	r.blocks = make([]uint32, n)
+	for i := range r.blocks {
+		r.blocks[i] = binary.BigEndian.Uint32(rest[4*i:])
+	}
+	return nil
+}
+
+func marshalStatResponse(id uint32, size int64) []byte {
+	b := make([]byte, 13)
+	b[0] = TypeStat
+	binary.BigEndian.PutUint32(b[1:], id)
+	binary.BigEndian.PutUint64(b[5:], uint64(size))
+	return b
+}
+
+func marshalErrorResponse(id uint32, code byte) []byte {
+	b := make([]byte, 6)
+	b[0] = TypeError
+	binary.BigEndian.PutUint32(b[1:], id)
+	b[5] = code
+	return b
+}
+
+// responseError returns the error of an error response
+func responseError(code byte) error {
+	switch code {
+	case codeNotFound:
+		return ErrNotFound
+	case codeBadRequest:
+		return ErrBadRequest
+	default:
+		return fmt.Errorf("unknown error code %d", code)
+	}
+}
+
+// responseID returns the type and transfer ID of a response
+func responseID(b []byte) (byte, uint32, bool) {
+	if len(b) < 5 {
+		return 0, 0, false
+	}
+	return b[0], binary.BigEndian.Uint32(b[1:]), true
+}
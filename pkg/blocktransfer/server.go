@@ -0,0 +1,148 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blocktransfer
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+)
+
+// Source looks up the object with the given name. ok is false if there is no such object.
+type Source func(name string) (r io.ReaderAt, size int64, ok bool)
+
+// TreeSource looks up the hash tree of the object with the given name. ok is false if
+// there is no such object.
+type TreeSource func(name string) (tree *HashTree, ok bool)
+
+// Server serves the objects of a Source. It does not keep any state per client.
+type Server struct {
+	// Trees, if set, looks up the hash trees of the objects, whose hash lists are then
+	// served to clients using FetchVerified
+	Trees TreeSource
+
+	conn    net.PacketConn
+	source  Source
+	sendBuf []byte
+}
+
+// NewServer creates a server replying on conn
+func NewServer(conn net.PacketConn, source Source) *Server {
+	return &Server{
+		conn:    conn,
+		source:  source,
+		sendBuf: make([]byte, blockResponseHeaderSize+MaxBlockSize),
+	}
+}
+
+// Serve reads and handles requests until reading from the socket fails. Errors writing
+// a response are ignored, as the client requests the data again.
+func (s *Server) Serve() error {
+	buf := make([]byte, MaxRequestSize)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		_, _ = s.Handle(buf[:n], addr)
+	}
+}
+
+// Handle handles a packet received from addr. It returns false if the packet is not a
+// request of this package, so that applications can handle their own messages on the
+// same socket. An error is only returned if writing to the socket failed. Handle must
+// not be called concurrently.
+func (s *Server) Handle(b []byte, addr net.Addr) (bool, error) {
+	if len(b) == 0 {
+		return false, nil
+	}
+	switch b[0] {
+	case TypeStat:
+		return true, s.handleStat(b, addr)
+	case TypeBlock:
+		return true, s.handleBlocks(b, addr)
+	default:
+		return false, nil
+	}
+}
+
+func (s *Server) handleStat(b []byte, addr net.Addr) error {
+	var req statRequest
+	if err := req.unmarshal(b); err != nil {
+		// Without a valid transfer ID, the client can't match a reply
+		return nil
+	}
+	_, size, ok := s.lookup(req.name)
+	if !ok {
+		return s.write(marshalErrorResponse(req.id, codeNotFound), addr)
+	}
+	return s.write(marshalStatResponse(req.id, size), addr)
+}
+
+func (s *Server) handleBlocks(b []byte, addr net.Addr) error {
+	var req blockRequest
+	if err := req.unmarshal(b); err != nil {
+		return nil
+	}
+	if req.blockSize < MinBlockSize || req.blockSize > MaxBlockSize {
+		return s.write(marshalErrorResponse(req.id, codeBadRequest), addr)
+	}
+	r, size, ok := s.lookup(req.name)
+	if !ok {
+		return s.write(marshalErrorResponse(req.id, codeNotFound), addr)
+	}
+	n := numBlocks(size, req.blockSize)
+	for _, index := range req.blocks {
+		if int64(index) >= n {
+			return s.write(marshalErrorResponse(req.id, codeBadRequest), addr)
+		}
+		length := blockLength(size, req.blockSize, index)
+		resp := s.sendBuf[:blockResponseHeaderSize+length]
+		resp[0] = TypeBlock
+		binary.BigEndian.PutUint32(resp[1:], req.id)
+		binary.BigEndian.PutUint32(resp[5:], index)
+		read, err := r.ReadAt(resp[blockResponseHeaderSize:], int64(index)*int64(req.blockSize))
+		if read < length {
+			// The object was truncated or removed while serving it
+			return s.write(marshalErrorResponse(req.id, codeNotFound), addr)
+		}
+		binary.BigEndian.PutUint32(resp[9:], blockChecksum(resp[blockResponseHeaderSize:]))
+		if err = s.write(resp, addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lookup returns the object or hash list with the given name
+func (s *Server) lookup(name string) (io.ReaderAt, int64, bool) {
+	object, level, ok := parseHashListName(name)
+	if !ok {
+		return s.source(name)
+	}
+	if s.Trees == nil {
+		return nil, 0, false
+	}
+	tree, ok := s.Trees(object)
+	if !ok {
+		return nil, 0, false
+	}
+	return tree.hashList(level)
+}
+
+func (s *Server) write(b []byte, addr net.Addr) error {
+	_, err := s.conn.WriteTo(b, addr)
+	return err
+}
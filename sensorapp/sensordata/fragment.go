@@ -0,0 +1,219 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sensordata
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	// MaxFragments is the maximum number of fragments of a response. Longer histories are
+	// fetched with several queries.
+	MaxFragments = 4
+	// MaxMessageSize is the maximum size of a response to an identified request
+	MaxMessageSize = MaxFragments * fragmentPayloadSize
+	// MaxAmplification is the maximum size of the fragments of a response relative to the
+	// size of the identified request, so that the server can not be used to reflect a
+	// large amount of traffic to a spoofed address. Requests are padded to
+	// MaxResponseSize, allowing responses of MaxFragments fragments, see MaxResponseLen.
+	MaxAmplification = 4
+
+	requestHeaderSize   = 1 + 4 + 2
+	fragmentHeaderSize  = 1 + 4 + 2 + 2
+	fragmentPayloadSize = MaxResponseSize - fragmentHeaderSize
+)
+
+var errTooLarge = errors.New("sensor message too large")
+
+// MarshalRequest wraps a request into an identified request, padded to at least
+// MaxResponseSize. The response to an identified request is sent in fragments with the
+// request ID, see Fragment.
+func MarshalRequest(id uint32, request []byte) []byte {
+	size := requestHeaderSize + len(request)
+	if size < MaxResponseSize {
+		size = MaxResponseSize
+	}
+	b := make([]byte, size)
+	b[0] = TypeRequest
+	binary.BigEndian.PutUint32(b[1:], id)
+	binary.BigEndian.PutUint16(b[5:], uint16(len(request)))
+	copy(b[requestHeaderSize:], request)
+	return b
+}
+
+// ParseRequest returns the ID and the wrapped request of an identified request
+func ParseRequest(b []byte) (uint32, []byte, error) {
+	if len(b) < requestHeaderSize || b[0] != TypeRequest {
+		return 0, nil, errInvalidMessage
+	}
+	end := requestHeaderSize + int(binary.BigEndian.Uint16(b[5:]))
+	if end > len(b) {
+		return 0, nil, errInvalidMessage
+	}
+	return binary.BigEndian.Uint32(b[1:]), b[requestHeaderSize:end], nil
+}
+
+// MaxResponseLen returns the maximum size of the response to an identified request of
+// requestLen bytes, such that the fragments of the response are at most MaxAmplification
+// times the size of the request. Returns 0 if the request is too short for a single
+// fragment.
+func MaxResponseLen(requestLen int) int {
+	fragments := MaxAmplification * requestLen / MaxResponseSize
+	if fragments > MaxFragments {
+		fragments = MaxFragments
+	}
+	return fragments * fragmentPayloadSize
+}
+
+// FragmentsSize returns the total size of the fragments
+func FragmentsSize(fragments [][]byte) int {
+	size := 0
+	for _, f := range fragments {
+		size += len(f)
+	}
+	return size
+}
+
+// Fragment splits the response to the request with the given ID into fragments of at
+// most MaxResponseSize
+func Fragment(id uint32, response []byte) ([][]byte, error) {
+	if len(response) > MaxMessageSize {
+		return nil, errTooLarge
+	}
+	count := (len(response) + fragmentPayloadSize - 1) / fragmentPayloadSize
+	if count == 0 {
+		count = 1
+	}
+	fragments := make([][]byte, count)
+	for i := range fragments {
+		payload := response[i*fragmentPayloadSize:]
+		if len(payload) > fragmentPayloadSize {
+			payload = payload[:fragmentPayloadSize]
+		}
+		b := make([]byte, fragmentHeaderSize, fragmentHeaderSize+len(payload))
+		b[0] = TypeFragment
+		binary.BigEndian.PutUint32(b[1:], id)
+		binary.BigEndian.PutUint16(b[5:], uint16(i))
+		binary.BigEndian.PutUint16(b[7:], uint16(count))
+		fragments[i] = append(b, payload...)
+	}
+	return fragments, nil
+}
+
+// Reassembler reassembles the response to an identified request from its fragments,
+// received in any order and possibly duplicated
+type Reassembler struct {
+	id        uint32
+	fragments [][]byte
+	received  int
+}
+
+// NewReassembler creates a reassembler for the response to the request with the given ID
+func NewReassembler(id uint32) *Reassembler {
+	return &Reassembler{id: id}
+}
+
+// Add adds a received packet. It returns the response once all fragments have been
+// received. Fragments of other requests are ignored.
+func (r *Reassembler) Add(b []byte) ([]byte, error) {
+	if len(b) < fragmentHeaderSize || b[0] != TypeFragment {
+		return nil, errInvalidMessage
+	}
+	if binary.BigEndian.Uint32(b[1:]) != r.id {
+		return nil, nil
+	}
+	index := int(binary.BigEndian.Uint16(b[5:]))
+	count := int(binary.BigEndian.Uint16(b[7:]))
+	if count == 0 || count > MaxFragments || index >= count ||
+		(r.fragments != nil && count != len(r.fragments)) {
+		return nil, errInvalidMessage
+	}
+	if r.fragments == nil {
+		r.fragments = make([][]byte, count)
+	}
+	if r.fragments[index] == nil {
+		r.fragments[index] = append([]byte{}, b[fragmentHeaderSize:]...)
+		r.received++
+	}
+	if r.received < count {
+		return nil, nil
+	}
+	var response []byte
+	for _, f := range r.fragments {
+		response = append(response, f...)
+	}
+	return response, nil
+}
+
+// ResponseCache keeps the fragments of recent responses, so that a retried request is
+// answered with the same response and the client can combine the fragments it received
+// in each attempt. It is safe for concurrent use.
+type ResponseCache struct {
+	max int
+	ttl time.Duration
+
+	mutex   sync.Mutex
+	entries map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	fragments [][]byte
+	expires   time.Time
+}
+
+// NewResponseCache creates a cache keeping up to max responses for the duration ttl
+func NewResponseCache(max int, ttl time.Duration) *ResponseCache {
+	return &ResponseCache{
+		max:     max,
+		ttl:     ttl,
+		entries: make(map[string]cacheEntry),
+	}
+}
+
+// Get returns the cached fragments of the response, nil if none are cached
+func (c *ResponseCache) Get(key string, now time.Time) [][]byte {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	e, ok := c.entries[key]
+	if !ok || now.After(e.expires) {
+		return nil
+	}
+	return e.fragments
+}
+
+// Put caches the fragments of a response. If the cache is full, the response expiring
+// first is dropped.
+func (c *ResponseCache) Put(key string, fragments [][]byte, now time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for k, e := range c.entries {
+		if now.After(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.max {
+		var first string
+		for k, e := range c.entries {
+			if first == "" || e.expires.Before(c.entries[first].expires) {
+				first = k
+			}
+		}
+		delete(c.entries, first)
+	}
+	c.entries[key] = cacheEntry{fragments: fragments, expires: now.Add(c.ttl)}
+}
@@ -0,0 +1,209 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sensordata
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// History keeps the most recent readings of each sensor in a ring buffer. It is safe
+// for concurrent use.
+type History struct {
+	capacity int
+
+	mutex   sync.Mutex
+	sensors map[string]*ring
+}
+
+// ring holds the readings of a sensor, oldest first, starting at index start
+type ring struct {
+	readings []Reading
+	start    int
+}
+
+// NewHistory creates a history keeping up to capacity readings per sensor
+func NewHistory(capacity int) *History {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &History{
+		capacity: capacity,
+		sensors:  make(map[string]*ring),
+	}
+}
+
+// Add adds a reading. If it has the same time as the previous reading of the sensor,
+// it replaces it.
+func (h *History) Add(r Reading) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	rg, ok := h.sensors[r.Sensor]
+	if !ok {
+		rg = &ring{readings: make([]Reading, 0, 16)}
+		h.sensors[r.Sensor] = rg
+	}
+	if n := len(rg.readings); n > 0 {
+		last := (rg.start + n - 1) % n
+		if rg.readings[last].Time.Equal(r.Time) {
+			rg.readings[last] = r
+			return
+		}
+	}
+	if len(rg.readings) < h.capacity {
+		rg.readings = append(rg.readings, r)
+		return
+	}
+	rg.readings[rg.start] = r
+	rg.start = (rg.start + 1) % len(rg.readings)
+}
+
+// Latest returns the most recent reading of the given sensors, or of all sensors if
+// none are given, ordered by sensor ID. Unknown sensors are omitted.
+func (h *History) Latest(sensors []string) []Reading {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	var readings []Reading
+	for _, rg := range h.lookup(sensors) {
+		n := len(rg.readings)
+		readings = append(readings, rg.readings[(rg.start+n-1)%n])
+	}
+	sortReadings(readings)
+	return readings
+}
+
+// Range returns the readings of the given sensors, or of all sensors if none are given,
+// with a time within [from, to). The readings are ordered by sensor ID and time.
+func (h *History) Range(sensors []string, from, to time.Time) []Reading {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	var readings []Reading
+	for _, rg := range h.lookup(sensors) {
+		for _, r := range rg.readings {
+			if !r.Time.Before(from) && r.Time.Before(to) {
+				readings = append(readings, r)
+			}
+		}
+	}
+	sortReadings(readings)
+	return readings
+}
+
+// Query returns the samples requested by a history query, see HistoryQuery
+func (h *History) Query(q *HistoryQuery) []Sample {
+	readings := h.Range(q.Sensors, q.From, q.To)
+	var samples []Sample
+	if q.Interval > 0 {
+		samples = Downsample(readings, q.From, q.Interval)
+	} else {
+		samples = Samples(readings)
+	}
+	i := sort.Search(len(samples), func(i int) bool {
+		return q.After(&samples[i])
+	})
+	return samples[i:]
+}
+
+// lookup returns the rings of the sensors, must be called with the mutex held
+func (h *History) lookup(sensors []string) []*ring {
+	var rings []*ring
+	if len(sensors) == 0 {
+		for _, rg := range h.sensors {
+			rings = append(rings, rg)
+		}
+		return rings
+	}
+	seen := make(map[string]bool)
+	for _, s := range sensors {
+		if rg, ok := h.sensors[s]; ok && !seen[s] {
+			seen[s] = true
+			rings = append(rings, rg)
+		}
+	}
+	return rings
+}
+
+func sortReadings(readings []Reading) {
+	sort.SliceStable(readings, func(i, j int) bool {
+		if readings[i].Sensor != readings[j].Sensor {
+			return readings[i].Sensor < readings[j].Sensor
+		}
+		return readings[i].Time.Before(readings[j].Time)
+	})
+}
+
+// Sample summarizes the readings of a sensor in an interval starting at Time. A sample
+// of a single reading has the time of the reading.
+type Sample struct {
+	Sensor string    `json:"sensor"`
+	Unit   string    `json:"unit,omitempty"`
+	Time   time.Time `json:"time"`
+	Count  int       `json:"count"`
+	Min    float64   `json:"min"`
+	Avg    float64   `json:"avg"`
+	Max    float64   `json:"max"`
+}
+
+// Samples returns a sample for each reading
+func Samples(readings []Reading) []Sample {
+	samples := make([]Sample, len(readings))
+	for i, r := range readings {
+		samples[i] = Sample{
+			Sensor: r.Sensor,
+			Unit:   r.Unit,
+			Time:   r.Time,
+			Count:  1,
+			Min:    r.Value,
+			Avg:    r.Value,
+			Max:    r.Value,
+		}
+	}
+	return samples
+}
+
+// Downsample summarizes readings ordered by sensor ID and time, as returned by
+// History.Range, in intervals of the given length starting at from. Intervals
+// without readings are omitted.
+func Downsample(readings []Reading, from time.Time, interval time.Duration) []Sample {
+	var samples []Sample
+	var sum float64
+	for _, r := range readings {
+		if r.Time.Before(from) {
+			continue
+		}
+		start := from.Add(r.Time.Sub(from) / interval * interval)
+		last := len(samples) - 1
+		if last < 0 || samples[last].Sensor != r.Sensor || !samples[last].Time.Equal(start) {
+			samples = append(samples, Sample{
+				Sensor: r.Sensor,
+				Time:   start,
+				Min:    math.Inf(1),
+				Max:    math.Inf(-1),
+			})
+			last++
+			sum = 0
+		}
+		s := &samples[last]
+		s.Unit = r.Unit
+		s.Count++
+		sum += r.Value
+		s.Avg = sum / float64(s.Count)
+		s.Min = math.Min(s.Min, r.Value)
+		s.Max = math.Max(s.Max, r.Value)
+	}
+	return samples
+}
@@ -0,0 +1,350 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sensordata
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Message types
+const (
+	TypeQuery           byte = 'Q'
+	TypeResponse        byte = 'R'
+	TypeHistoryQuery    byte = 'H'
+	TypeHistoryResponse byte = 'S'
+	TypeSubscribe       byte = 'U'
+	TypeSubscriptionAck byte = 'K'
+	TypeUpdate          byte = 'P'
+	TypeAlert           byte = 'T'
+	TypeRequest         byte = 'I'
+	TypeFragment        byte = 'F'
+)
+
+// Flags of messages
+const (
+	// FlagTruncated is set if a query response does not contain all readings
+	FlagTruncated byte = 1 << iota
+	// FlagMore is set if more samples follow the samples of a history response
+	FlagMore
+	// FlagUpdates is set if a subscription requests updates of changed readings
+	FlagUpdates
+	// FlagCleared is set if an alert reports that the readings are within the threshold
+	// again
+	FlagCleared
+)
+
+const (
+	// MaxIDLength is the maximum length of sensor IDs and units
+	MaxIDLength = 255
+	// MaxResponseSize is the maximum size of a packet, chosen to fit into a single
+	// packet on any path. Responses to requests that are not identified are limited to
+	// this size.
+	MaxResponseSize = 1200
+
+	responseHeaderSize = 1 + 1 + 2
+	readingFixedSize   = 1 + 1 + 8 + 8
+	sampleValuesSize   = 8 + 4 + 3*8
+	sampleFixedSize    = 1 + 1 + sampleValuesSize
+	historyHeaderSize  = 1 + 3*8
+)
+
+var errInvalidMessage = errors.New("invalid sensor message")
+
+// MarshalQuery returns a query for the given sensors, or all sensors if there are none
+func MarshalQuery(sensors []string) ([]byte, error) {
+	if len(sensors) > math.MaxUint8 {
+		return nil, fmt.Errorf("too many sensors in query: %d", len(sensors))
+	}
+	b := []byte{TypeQuery, byte(len(sensors))}
+	for _, s := range sensors {
+		if len(s) > MaxIDLength {
+			return nil, fmt.Errorf("sensor ID too long: %q", s)
+		}
+		b = append(b, byte(len(s)))
+		b = append(b, s...)
+	}
+	return b, nil
+}
+
+// ParseQuery returns the sensors requested by a query
+func ParseQuery(b []byte) ([]string, error) {
+	if len(b) < 2 || b[0] != TypeQuery {
+		return nil, errInvalidMessage
+	}
+	sensors := make([]string, b[1])
+	rest := b[2:]
+	for i := range sensors {
+		var err error
+		if sensors[i], rest, err = parseString(rest); err != nil {
+			return nil, err
+		}
+	}
+	if len(rest) != 0 {
+		return nil, errInvalidMessage
+	}
+	return sensors, nil
+}
+
+// MarshalResponse returns the response with as many readings as fit into maxSize
+func MarshalResponse(readings []Reading, maxSize int) []byte {
+	b := make([]byte, responseHeaderSize, MaxResponseSize)
+	b[0] = TypeResponse
+	n := 0
+	for i := range readings {
+		r := &readings[i]
+		if len(r.Sensor) > MaxIDLength || len(r.Unit) > MaxIDLength {
+			continue
+		}
+		if len(b)+readingFixedSize+len(r.Sensor)+len(r.Unit) > maxSize ||
+			n == math.MaxUint16 {
+			b[1] |= FlagTruncated
+			break
+		}
+		b = appendReading(b, r)
+		n++
+	}
+	binary.BigEndian.PutUint16(b[2:], uint16(n))
+	return b
+}
+
+// ParseResponse parses a response. truncated is set if the server could not include all
+// readings.
+func ParseResponse(b []byte) (readings []Reading, truncated bool, err error) {
+	if len(b) < responseHeaderSize || b[0] != TypeResponse {
+		return nil, false, errInvalidMessage
+	}
+	truncated = b[1]&FlagTruncated != 0
+	readings = make([]Reading, binary.BigEndian.Uint16(b[2:]))
+	rest := b[responseHeaderSize:]
+	for i := range readings {
+		if rest, err = parseReading(rest, &readings[i]); err != nil {
+			return nil, false, err
+		}
+	}
+	if len(rest) != 0 {
+		return nil, false, errInvalidMessage
+	}
+	return readings, truncated, nil
+}
+
+func appendReading(b []byte, r *Reading) []byte {
+	b = append(b, byte(len(r.Sensor)))
+	b = append(b, r.Sensor...)
+	b = append(b, byte(len(r.Unit)))
+	b = append(b, r.Unit...)
+	b = append(b, make([]byte, 16)...)
+	binary.BigEndian.PutUint64(b[len(b)-16:], math.Float64bits(r.Value))
+	binary.BigEndian.PutUint64(b[len(b)-8:], uint64(r.Time.UnixNano()))
+	return b
+}
+
+func parseReading(b []byte, r *Reading) ([]byte, error) {
+	var err error
+	if r.Sensor, b, err = parseString(b); err != nil {
+		return nil, err
+	}
+	if r.Unit, b, err = parseString(b); err != nil {
+		return nil, err
+	}
+	if len(b) < 16 {
+		return nil, errInvalidMessage
+	}
+	r.Value = math.Float64frombits(binary.BigEndian.Uint64(b))
+	r.Time = time.Unix(0, int64(binary.BigEndian.Uint64(b[8:])))
+	return b[16:], nil
+}
+
+func parseString(b []byte) (string, []byte, error) {
+	if len(b) < 1 || len(b) < 1+int(b[0]) {
+		return "", nil, errInvalidMessage
+	}
+	n := int(b[0])
+	return string(b[1 : 1+n]), b[1+n:], nil
+}
+
+// HistoryQuery requests the samples of the given sensors, or all sensors if there are
+// none, in the time window [From, To). With an Interval, the readings are downsampled
+// to one sample per interval, starting at From.
+//
+// The samples are ordered by sensor ID and time. The response only contains the samples
+// after the cursor (AfterSensor, AfterTime) in this order, all samples if AfterSensor is
+// empty; to fetch all samples, the client repeats the query with the cursor set to the
+// last sample received.
+type HistoryQuery struct {
+	From        time.Time
+	To          time.Time
+	Interval    time.Duration
+	AfterSensor string
+	AfterTime   time.Time
+	Sensors     []string
+}
+
+// After returns whether the sample is after the cursor of the query
+func (q *HistoryQuery) After(s *Sample) bool {
+	if q.AfterSensor == "" {
+		return true
+	}
+	if s.Sensor != q.AfterSensor {
+		return s.Sensor > q.AfterSensor
+	}
+	return s.Time.After(q.AfterTime)
+}
+
+// MarshalHistoryQuery returns the history query
+func MarshalHistoryQuery(q *HistoryQuery) ([]byte, error) {
+	if len(q.Sensors) > math.MaxUint8 {
+		return nil, fmt.Errorf("too many sensors in query: %d", len(q.Sensors))
+	}
+	if len(q.AfterSensor) > MaxIDLength {
+		return nil, fmt.Errorf("sensor ID too long: %q", q.AfterSensor)
+	}
+	if q.Interval < 0 {
+		return nil, fmt.Errorf("negative interval: %v", q.Interval)
+	}
+	b := make([]byte, historyHeaderSize, MaxResponseSize)
+	b[0] = TypeHistoryQuery
+	binary.BigEndian.PutUint64(b[1:], uint64(q.From.UnixNano()))
+	binary.BigEndian.PutUint64(b[9:], uint64(q.To.UnixNano()))
+	binary.BigEndian.PutUint64(b[17:], uint64(q.Interval))
+	b = append(b, byte(len(q.AfterSensor)))
+	b = append(b, q.AfterSensor...)
+	b = append(b, make([]byte, 8)...)
+	if q.AfterSensor != "" {
+		binary.BigEndian.PutUint64(b[len(b)-8:], uint64(q.AfterTime.UnixNano()))
+	}
+	b = append(b, byte(len(q.Sensors)))
+	for _, s := range q.Sensors {
+		if len(s) > MaxIDLength {
+			return nil, fmt.Errorf("sensor ID too long: %q", s)
+		}
+		b = append(b, byte(len(s)))
+		b = append(b, s...)
+	}
+	return b, nil
+}
+
+// ParseHistoryQuery parses a history query
+func ParseHistoryQuery(b []byte) (*HistoryQuery, error) {
+	if len(b) < historyHeaderSize || b[0] != TypeHistoryQuery {
+		return nil, errInvalidMessage
+	}
+	q := &HistoryQuery{}
+	q.From = time.Unix(0, int64(binary.BigEndian.Uint64(b[1:])))
+	q.To = time.Unix(0, int64(binary.BigEndian.Uint64(b[9:])))
+	q.Interval = time.Duration(binary.BigEndian.Uint64(b[17:]))
+	if q.Interval < 0 {
+		return nil, errInvalidMessage
+	}
+	var err error
+	rest := b[historyHeaderSize:]
+	if q.AfterSensor, rest, err = parseString(rest); err != nil {
+		return nil, err
+	}
+	if len(rest) < 9 {
+		return nil, errInvalidMessage
+	}
+	q.AfterTime = time.Unix(0, int64(binary.BigEndian.Uint64(rest)))
+	q.Sensors = make([]string, rest[8])
+	rest = rest[9:]
+	for i := range q.Sensors {
+		if q.Sensors[i], rest, err = parseString(rest); err != nil {
+			return nil, err
+		}
+	}
+	if len(rest) != 0 {
+		return nil, errInvalidMessage
+	}
+	return q, nil
+}
+
+// MarshalHistoryResponse returns the response with as many samples as fit into maxSize,
+// setting FlagMore if not all samples fit
+func MarshalHistoryResponse(samples []Sample, maxSize int) []byte {
+	b := make([]byte, responseHeaderSize, MaxResponseSize)
+	b[0] = TypeHistoryResponse
+	n := 0
+	for i := range samples {
+		s := &samples[i]
+		if len(s.Sensor) > MaxIDLength || len(s.Unit) > MaxIDLength {
+			continue
+		}
+		if len(b)+sampleFixedSize+len(s.Sensor)+len(s.Unit) > maxSize ||
+			n == math.MaxUint16 {
+			b[1] |= FlagMore
+			break
+		}
+		b = appendSample(b, s)
+		n++
+	}
+	binary.BigEndian.PutUint16(b[2:], uint16(n))
+	return b
+}
+
+// ParseHistoryResponse parses a response. more is set if more samples follow.
+func ParseHistoryResponse(b []byte) (samples []Sample, more bool, err error) {
+	if len(b) < responseHeaderSize || b[0] != TypeHistoryResponse {
+		return nil, false, errInvalidMessage
+	}
+	more = b[1]&FlagMore != 0
+	samples = make([]Sample, binary.BigEndian.Uint16(b[2:]))
+	rest := b[responseHeaderSize:]
+	for i := range samples {
+		if rest, err = parseSample(rest, &samples[i]); err != nil {
+			return nil, false, err
+		}
+	}
+	if len(rest) != 0 {
+		return nil, false, errInvalidMessage
+	}
+	return samples, more, nil
+}
+
+func appendSample(b []byte, s *Sample) []byte {
+	b = append(b, byte(len(s.Sensor)))
+	b = append(b, s.Sensor...)
+	b = append(b, byte(len(s.Unit)))
+	b = append(b, s.Unit...)
+	b = append(b, make([]byte, sampleValuesSize)...)
+	p := b[len(b)-sampleValuesSize:]
+	binary.BigEndian.PutUint64(p, uint64(s.Time.UnixNano()))
+	binary.BigEndian.PutUint32(p[8:], uint32(s.Count))
+	binary.BigEndian.PutUint64(p[12:], math.Float64bits(s.Min))
+	binary.BigEndian.PutUint64(p[20:], math.Float64bits(s.Avg))
+	binary.BigEndian.PutUint64(p[28:], math.Float64bits(s.Max))
+	return b
+}
+
+func parseSample(b []byte, s *Sample) ([]byte, error) {
+	var err error
+	if s.Sensor, b, err = parseString(b); err != nil {
+		return nil, err
+	}
+	if s.Unit, b, err = parseString(b); err != nil {
+		return nil, err
+	}
+	if len(b) < sampleValuesSize {
+		return nil, errInvalidMessage
+	}
+	s.Time = time.Unix(0, int64(binary.BigEndian.Uint64(b)))
+	s.Count = int(binary.BigEndian.Uint32(b[8:]))
+	s.Min = math.Float64frombits(binary.BigEndian.Uint64(b[12:]))
+	s.Avg = math.Float64frombits(binary.BigEndian.Uint64(b[20:]))
+	s.Max = math.Float64frombits(binary.BigEndian.Uint64(b[28:]))
+	return b[sampleValuesSize:], nil
+}
@@ -0,0 +1,171 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sensordata implements the sensor readings of the sensorapp, and the protocol
+// with which the sensorfetcher queries them from the sensorserver.
+//
+// Wire format of queries, all integers in big endian, times in nanoseconds since the
+// Unix epoch:
+//
+//	Query request:    'Q', uint8 number of sensor IDs, for each sensor: uint8 ID length, ID
+//	Query response:   'R', uint8 flags, uint16 number of readings, readings
+//	Reading:          uint8 sensor ID length, sensor ID, uint8 unit length, unit,
+//	                  float64 value, int64 time
+//	History request:  'H', int64 from, int64 to, int64 interval in nanoseconds,
+//	                  uint8 cursor sensor ID length, cursor sensor ID, int64 cursor time,
+//	                  uint8 number of sensor IDs, for each sensor: uint8 ID length, ID
+//	History response: 'S', uint8 flags, uint16 number of samples, samples
+//	Sample:           uint8 sensor ID length, sensor ID, uint8 unit length, unit,
+//	                  int64 time, uint32 number of readings, float64 min, avg, max
+//	Subscribe:        'U', uint8 flags, uint32 lease in seconds, cookie,
+//	                  uint8 number of sensor IDs, for each sensor: uint8 ID length, ID,
+//	                  uint8 number of thresholds, thresholds
+//	Subscribe ack:    'K', uint32 lease in seconds, cookie
+//	Cookie:           CookieLen bytes
+//	Update:           'P', reading
+//	Alert:            'T', uint8 flags, threshold, reading
+//	Threshold:        uint8 sensor ID length, sensor ID, '>' or '<', float64 value
+//	Request with ID:  'I', uint32 request ID, uint16 request length, request, padding
+//	Fragment:         'F', uint32 request ID, uint16 index, uint16 number of fragments,
+//	                  part of the response
+//
+// Requests can be wrapped into identified requests, whose responses are split into
+// fragments of at most MaxResponseSize, with a total size of up to MaxMessageSize.
+// Identified requests are padded, and the fragments of the response are at most
+// MaxAmplification times the size of the request. The
+// client retries a request that is not answered in time with the same request ID; the
+// server answers retries with the same fragments, so that the client can combine the
+// fragments received in each attempt. Requests that are not identified are answered in
+// a single packet of at most MaxResponseSize.
+//
+// A query without sensor IDs requests the readings of all sensors. Sensors without a
+// reading are omitted from the response. If not all readings fit into the response, it
+// is truncated and the flag FlagTruncated is set.
+//
+// A history query requests the readings in a time window, optionally downsampled, see
+// HistoryQuery. If not all samples fit into the response, the flag FlagMore is set.
+//
+// Instead of polling, clients can subscribe to pushed updates and alerts, see
+// Subscription. The server acknowledges each subscription request with the lease it
+// granted and the cookie of the client's address. A subscription only takes effect if it
+// contains the cookie, so that the server does not push to spoofed addresses; until the
+// client echoes the cookie, the server sends nothing but the acknowledgement. Pushed
+// messages are not acknowledged and may be lost.
+//
+// An empty request is answered with the readings as text, like the input lines, for
+// sensorfetchers that don't know the query protocol.
+package sensordata
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// TimeSensor is the name of the input lines setting the time of the following readings
+	TimeSensor = "Time"
+	// TimeFormat is the format of the time in input lines
+	TimeFormat = "2006/01/02 15:04:05"
+
+	separator = ": "
+)
+
+// Reading is a value measured by a sensor
+type Reading struct {
+	Sensor string    `json:"sensor"`
+	Unit   string    `json:"unit,omitempty"`
+	Value  float64   `json:"value"`
+	Time   time.Time `json:"time"`
+}
+
+// String formats the reading like an input line
+func (r *Reading) String() string {
+	s := r.Sensor + separator + strconv.FormatFloat(r.Value, 'f', -1, 64)
+	if r.Unit != "" {
+		s += " " + r.Unit
+	}
+	return s
+}
+
+// Parser parses the line based output of sensor reader applications, see sensorreader.py:
+//
+//	Time: 2017/11/16 21:29:49
+//	Temperature: 22.5 °C
+//	Motion: True
+//
+// Each reading consists of the sensor ID, the value and optionally the unit. Boolean
+// values are read as 1 and 0. The time lines set the time of the following readings, in
+// local time; without them, the readings get the time they were parsed.
+type Parser struct {
+	time time.Time
+}
+
+// ParseLine parses an input line. It returns nil without error for time lines and
+// empty lines.
+func (p *Parser) ParseLine(line string, now time.Time) (*Reading, error) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return nil, nil
+	}
+	index := strings.Index(line, separator)
+	if index <= 0 {
+		return nil, fmt.Errorf("missing separator in %q", line)
+	}
+	sensor, rest := line[:index], strings.TrimSpace(line[index+len(separator):])
+	if sensor == TimeSensor {
+		t, err := time.ParseInLocation(TimeFormat, rest, time.Local)
+		if err != nil {
+			return nil, fmt.Errorf("invalid time in %q", line)
+		}
+		p.time = t
+		return nil, nil
+	}
+
+	fields := strings.Fields(rest)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("missing value in %q", line)
+	}
+	value, err := parseValue(fields[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid value in %q", line)
+	}
+	t := p.time
+	if t.IsZero() {
+		t = now
+	}
+	return &Reading{
+		Sensor: sensor,
+		Unit:   strings.Join(fields[1:], " "),
+		Value:  value,
+		Time:   t,
+	}, nil
+}
+
+func parseValue(s string) (float64, error) {
+	switch strings.ToLower(s) {
+	case "true":
+		return 1, nil
+	case "false":
+		return 0, nil
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err == nil && (math.IsNaN(v) || math.IsInf(v, 0)) {
+		// Not representable in JSON
+		return 0, fmt.Errorf("value not finite: %s", s)
+	}
+	return v, err
+}
@@ -0,0 +1,397 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sensordata
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseLine(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	var p Parser
+
+	r, err := p.ParseLine("CO2: 412", now)
+	if err != nil || r == nil || r.Sensor != "CO2" || r.Value != 412 || r.Unit != "" || !r.Time.Equal(now) {
+		t.Errorf("Unexpected reading without time line: %v, %v", r, err)
+	}
+
+	if r, err = p.ParseLine("Time: 2017/11/16 21:29:49", now); r != nil || err != nil {
+		t.Errorf("Expected no reading for time line, got %v, %v", r, err)
+	}
+	captured := time.Date(2017, 11, 16, 21, 29, 49, 0, time.Local)
+
+	cases := []struct {
+		line  string
+		want  Reading
+		valid bool
+	}{
+		{"Temperature (Humidity sensor): 22.5 °C", Reading{"Temperature (Humidity sensor)", "°C", 22.5, captured}, true},
+		{"Motion: True", Reading{"Motion", "", 1, captured}, true},
+		{"Dust density: -0.25 ug / m3", Reading{"Dust density", "ug / m3", -0.25, captured}, true},
+		{"Humidity: high", Reading{}, false},
+		{"Humidity: NaN", Reading{}, false},
+		{"Humidity:", Reading{}, false},
+		{"no separator", Reading{}, false},
+	}
+	for _, c := range cases {
+		r, err := p.ParseLine(c.line, now)
+		if !c.valid {
+			if err == nil {
+				t.Errorf("Expected error for %q", c.line)
+			}
+			continue
+		}
+		if err != nil || r == nil || !reflect.DeepEqual(*r, c.want) {
+			t.Errorf("%q: expected %v, got %v, %v", c.line, c.want, r, err)
+		}
+	}
+	if r, err := p.ParseLine("  ", now); r != nil || err != nil {
+		t.Errorf("Expected no reading for empty line, got %v, %v", r, err)
+	}
+}
+
+func TestMessages(t *testing.T) {
+	sensors := []string{"CO2", "Temperature (Humidity sensor)"}
+	parsed, err := ParseQuery(mustMarshalQuery(t, sensors))
+	if err != nil || !reflect.DeepEqual(parsed, sensors) {
+		t.Errorf("Expected %v, got %v, %v", sensors, parsed, err)
+	}
+	if parsed, err = ParseQuery(mustMarshalQuery(t, nil)); err != nil || len(parsed) != 0 {
+		t.Errorf("Expected query for all sensors, got %v, %v", parsed, err)
+	}
+
+	var readings []Reading
+	for i := 0; i < 100; i++ {
+		readings = append(readings, Reading{
+			Sensor: fmt.Sprintf("Sensor %d", i),
+			Unit:   "°C",
+			Value:  float64(i) / 4,
+			Time:   time.Unix(1600000000, int64(i)),
+		})
+	}
+	b := MarshalResponse(readings[:3], MaxResponseSize)
+	received, truncated, err := ParseResponse(b)
+	if err != nil || truncated || len(received) != 3 {
+		t.Fatalf("Unexpected response: %v, %v, %v", received, truncated, err)
+	}
+	for i := range received {
+		if received[i].Sensor != readings[i].Sensor || received[i].Unit != readings[i].Unit ||
+			received[i].Value != readings[i].Value || !received[i].Time.Equal(readings[i].Time) {
+			t.Errorf("Expected %v, got %v", readings[i], received[i])
+		}
+	}
+	if _, _, err := ParseResponse(b[:len(b)-1]); err == nil {
+		t.Errorf("Expected error for truncated message")
+	}
+
+	b = MarshalResponse(readings, MaxResponseSize)
+	received, truncated, err = ParseResponse(b)
+	if err != nil || !truncated || len(received) == 0 || len(b) > MaxResponseSize {
+		t.Errorf("Expected truncated response, got %d readings, %v, %v", len(received), truncated, err)
+	}
+}
+
+func mustMarshalQuery(t *testing.T, sensors []string) []byte {
+	b, err := MarshalQuery(sensors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestHistory(t *testing.T) {
+	base := time.Unix(1600000000, 0)
+	h := NewHistory(4)
+	for i := 0; i < 6; i++ {
+		h.Add(Reading{Sensor: "CO2", Unit: "ppm", Value: float64(400 + i), Time: base.Add(time.Duration(i) * time.Second)})
+	}
+	h.Add(Reading{Sensor: "Temperature", Unit: "°C", Value: 22, Time: base})
+	h.Add(Reading{Sensor: "Temperature", Unit: "°C", Value: 23, Time: base})
+
+	latest := h.Latest(nil)
+	if len(latest) != 2 || latest[0].Value != 405 || latest[1].Value != 23 {
+		t.Errorf("Unexpected latest readings: %v", latest)
+	}
+	if latest = h.Latest([]string{"Temperature", "unknown"}); len(latest) != 1 || latest[0].Sensor != "Temperature" {
+		t.Errorf("Unexpected latest readings: %v", latest)
+	}
+
+	readings := h.Range([]string{"CO2"}, base, base.Add(time.Hour))
+	if len(readings) != 4 || readings[0].Value != 402 || readings[3].Value != 405 {
+		t.Errorf("Expected the 4 most recent readings, got %v", readings)
+	}
+	if readings = h.Range(nil, base, base.Add(3*time.Second)); len(readings) != 2 {
+		t.Errorf("Expected 2 readings in window, got %v", readings)
+	}
+
+	samples := Downsample(h.Range([]string{"CO2"}, base, base.Add(time.Hour)), base, 2*time.Second)
+	expected := []Sample{
+		{"CO2", "ppm", base.Add(2 * time.Second), 2, 402, 402.5, 403},
+		{"CO2", "ppm", base.Add(4 * time.Second), 2, 404, 404.5, 405},
+	}
+	if !reflect.DeepEqual(samples, expected) {
+		t.Errorf("Expected %v, got %v", expected, samples)
+	}
+
+	q := &HistoryQuery{From: base, To: base.Add(time.Hour)}
+	if samples = h.Query(q); len(samples) != 5 {
+		t.Fatalf("Expected 5 samples, got %v", samples)
+	}
+	q.AfterSensor, q.AfterTime = samples[1].Sensor, samples[1].Time
+	if rest := h.Query(q); !reflect.DeepEqual(rest, samples[2:]) {
+		t.Errorf("Expected samples after cursor %v, got %v", samples[2:], rest)
+	}
+}
+
+func TestHistoryMessages(t *testing.T) {
+	base := time.Unix(1600000000, 0)
+	q := &HistoryQuery{
+		From:        base,
+		To:          base.Add(time.Hour),
+		Interval:    time.Minute,
+		AfterSensor: "CO2",
+		AfterTime:   base.Add(time.Second),
+		Sensors:     []string{"CO2", "Temperature"},
+	}
+	b, err := MarshalHistoryQuery(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseHistoryQuery(b)
+	if err != nil || !parsed.From.Equal(q.From) || !parsed.To.Equal(q.To) || parsed.Interval != q.Interval ||
+		parsed.AfterSensor != q.AfterSensor || !parsed.AfterTime.Equal(q.AfterTime) ||
+		!reflect.DeepEqual(parsed.Sensors, q.Sensors) {
+		t.Errorf("Expected %v, got %v, %v", q, parsed, err)
+	}
+	if _, err := ParseHistoryQuery(b[:len(b)-1]); err == nil {
+		t.Errorf("Expected error for truncated message")
+	}
+
+	var samples []Sample
+	for i := 0; i < 100; i++ {
+		samples = append(samples, Sample{"CO2", "ppm", base.Add(time.Duration(i) * time.Minute), i, 1, 2, 3})
+	}
+	b = MarshalHistoryResponse(samples, MaxResponseSize)
+	received, more, err := ParseHistoryResponse(b)
+	if err != nil || !more || len(received) == 0 || len(b) > MaxResponseSize {
+		t.Fatalf("Expected partial response, got %d samples, %v, %v", len(received), more, err)
+	}
+	for i := range received {
+		if !received[i].Time.Equal(samples[i].Time) {
+			t.Fatalf("Expected %v, got %v", samples[i], received[i])
+		}
+		received[i].Time = samples[i].Time
+	}
+	if !reflect.DeepEqual(received, samples[:len(received)]) {
+		t.Errorf("Expected %v, got %v", samples[:len(received)], received)
+	}
+	if _, more, err = ParseHistoryResponse(MarshalHistoryResponse(samples[:3], MaxResponseSize)); err != nil || more {
+		t.Errorf("Expected complete response, got %v, %v", more, err)
+	}
+}
+
+func TestSubscriptionMessages(t *testing.T) {
+	threshold, err := ParseThreshold("Temperature (Humidity sensor) > 30.5")
+	if err != nil || threshold != (Threshold{"Temperature (Humidity sensor)", true, 30.5}) {
+		t.Errorf("Unexpected threshold: %v, %v", threshold, err)
+	}
+	for _, s := range []string{"Temperature", ">30", "Temperature<high"} {
+		if _, err := ParseThreshold(s); err == nil {
+			t.Errorf("Expected error for threshold %q", s)
+		}
+	}
+
+	sub := &Subscription{
+		Lease:      time.Minute,
+		Cookie:     [CookieLen]byte{1, 2, 3, 4, 5, 6, 7, 8},
+		Updates:    true,
+		Sensors:    []string{"CO2"},
+		Thresholds: []Threshold{threshold, {"CO2", false, 300}},
+	}
+	b, err := MarshalSubscription(sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseSubscription(b)
+	if err != nil || !reflect.DeepEqual(parsed, sub) {
+		t.Errorf("Expected %v, got %v, %v", sub, parsed, err)
+	}
+	if _, err := ParseSubscription(b[:len(b)-1]); err == nil {
+		t.Errorf("Expected error for truncated message")
+	}
+	lease, cookie, err := ParseSubscriptionAck(MarshalSubscriptionAck(1500*time.Millisecond, sub.Cookie))
+	if err != nil || lease != 2*time.Second || cookie != sub.Cookie {
+		t.Errorf("Unexpected ack: %v, %v, %v", lease, cookie, err)
+	}
+
+	alert := &Alert{threshold, Reading{"Temperature (Humidity sensor)", "°C", 31, time.Unix(1600000000, 0)}, true}
+	parsedAlert, err := ParseAlert(MarshalAlert(alert))
+	if err != nil || parsedAlert.Threshold != alert.Threshold || parsedAlert.Reading.Value != 31 ||
+		!parsedAlert.Reading.Time.Equal(alert.Reading.Time) || !parsedAlert.Cleared {
+		t.Errorf("Expected %v, got %v, %v", alert, parsedAlert, err)
+	}
+	if r, err := ParseUpdate(MarshalUpdate(&alert.Reading)); err != nil || r.Sensor != alert.Reading.Sensor || r.Value != 31 {
+		t.Errorf("Expected %v, got %v, %v", alert.Reading, r, err)
+	}
+}
+
+func TestSubscribers(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	client := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}
+	other := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1235}
+	subs, err := NewSubscribers(1, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := &Subscription{
+		Lease:      time.Hour,
+		Updates:    true,
+		Sensors:    []string{"Temperature"},
+		Thresholds: []Threshold{{"Temperature", true, 30}},
+	}
+	reading := func(sensor string, value float64) *Reading {
+		return &Reading{Sensor: sensor, Value: value, Time: now}
+	}
+
+	// Without the cookie of the address, e.g. from a spoofed address, nothing is pushed
+	if lease, pushes := subs.Subscribe(client, sub, []Reading{*reading("Temperature", 31)}, now); lease != 0 || len(pushes) != 0 || subs.Len() != 0 {
+		t.Fatalf("Expected subscription without cookie to be rejected, got %v, %v", lease, pushes)
+	}
+	if subs.Cookie(client) == subs.Cookie(other) {
+		t.Errorf("Expected different cookies for different addresses")
+	}
+	sub.Cookie = subs.Cookie(client)
+
+	lease, pushes := subs.Subscribe(client, sub, []Reading{*reading("Temperature", 31)}, now)
+	if lease != time.Minute || len(pushes) != 2 || pushes[0].Message[0] != TypeUpdate || pushes[1].Message[0] != TypeAlert {
+		t.Fatalf("Expected capped lease with update and alert, got %v, %v", lease, pushes)
+	}
+	otherSub := *sub
+	otherSub.Cookie = subs.Cookie(other)
+	if lease, _ := subs.Subscribe(other, &otherSub, nil, now); lease != 0 {
+		t.Errorf("Expected subscription beyond maximum to be rejected")
+	}
+
+	if pushes = subs.Update(reading("Temperature", 31), now); len(pushes) != 0 {
+		t.Errorf("Expected no pushes for unchanged reading, got %v", pushes)
+	}
+	if pushes = subs.Update(reading("CO2", 400), now); len(pushes) != 0 {
+		t.Errorf("Expected no pushes for other sensor, got %v", pushes)
+	}
+	pushes = subs.Update(reading("Temperature", 29), now)
+	if len(pushes) != 2 || pushes[0].Addr != client {
+		t.Fatalf("Expected update and cleared alert, got %v", pushes)
+	}
+	if alert, err := ParseAlert(pushes[1].Message); err != nil || !alert.Cleared {
+		t.Errorf("Expected cleared alert, got %v, %v", alert, err)
+	}
+
+	// Renewal keeps the state of the subscription, and repeats the state of the thresholds
+	now = now.Add(50 * time.Second)
+	if lease, pushes = subs.Subscribe(client, sub, []Reading{*reading("Temperature", 29)}, now); lease != time.Minute || len(pushes) != 1 {
+		t.Fatalf("Unexpected renewal: %v, %v", lease, pushes)
+	}
+	if alert, err := ParseAlert(pushes[0].Message); err != nil || !alert.Cleared || alert.Reading.Value != 29 {
+		t.Errorf("Expected repeated cleared alert, got %v, %v", alert, err)
+	}
+	now = now.Add(50 * time.Second)
+	if pushes = subs.Update(reading("Temperature", 28), now); len(pushes) != 1 {
+		t.Errorf("Expected update after renewal, got %v", pushes)
+	}
+
+	now = now.Add(time.Minute + time.Second)
+	if pushes = subs.Update(reading("Temperature", 35), now); len(pushes) != 0 || subs.Len() != 0 {
+		t.Errorf("Expected expired subscription to be dropped, got %v", pushes)
+	}
+	subs.Subscribe(client, sub, nil, now)
+	if lease, _ := subs.Subscribe(client, &Subscription{Cookie: sub.Cookie}, nil, now); lease != 0 || subs.Len() != 0 {
+		t.Errorf("Expected subscription to be cancelled")
+	}
+}
+
+func TestFragments(t *testing.T) {
+	query := mustMarshalQuery(t, nil)
+	packet := MarshalRequest(42, query)
+	id, request, err := ParseRequest(packet)
+	if err != nil || id != 42 || !bytes.Equal(request, query) {
+		t.Errorf("Unexpected request: %v, %v, %v", id, request, err)
+	}
+	if len(packet) != MaxResponseSize || MaxResponseLen(len(packet)) != MaxMessageSize {
+		t.Errorf("Expected request padded to allow a full response, got %d bytes", len(packet))
+	}
+	if MaxResponseLen(len(query)+7) != 0 {
+		t.Errorf("Expected no response to an unpadded request")
+	}
+
+	var readings []Reading
+	for i := 0; i < 100; i++ {
+		readings = append(readings, Reading{Sensor: fmt.Sprintf("Sensor %d", i), Value: float64(i)})
+	}
+	response := MarshalResponse(readings, MaxMessageSize)
+	fragments, err := Fragment(42, response)
+	if err != nil || len(fragments) < 2 {
+		t.Fatalf("Expected several fragments, got %d, %v", len(fragments), err)
+	}
+	r := NewReassembler(42)
+	other, _ := Fragment(43, []byte{TypeResponse})
+	// Out of order, with a duplicate and the fragment of another request
+	received := append([][]byte{other[0], fragments[len(fragments)-1]}, fragments...)
+	var complete []byte
+	for i, f := range received {
+		if len(f) > MaxResponseSize {
+			t.Fatalf("Fragment too large: %d bytes", len(f))
+		}
+		if complete, err = r.Add(f); err != nil {
+			t.Fatal(err)
+		}
+		if complete != nil {
+			if i != len(received)-2 {
+				t.Errorf("Response complete before all fragments were received")
+			}
+			if parsed, truncated, err := ParseResponse(complete); err != nil || truncated || len(parsed) != len(readings) {
+				t.Errorf("Unexpected reassembled response: %d readings, %v, %v", len(parsed), truncated, err)
+			}
+			break
+		}
+	}
+	if complete == nil {
+		t.Errorf("Response not reassembled")
+	}
+	if FragmentsSize(fragments) > MaxAmplification*len(packet) {
+		t.Errorf("Fragments of %d bytes exceed the bound for a request of %d bytes", FragmentsSize(fragments), len(packet))
+	}
+	if _, err := Fragment(42, make([]byte, MaxMessageSize+1)); err == nil {
+		t.Errorf("Expected error for response exceeding MaxMessageSize")
+	}
+
+	now := time.Unix(1600000000, 0)
+	cache := NewResponseCache(1, time.Second)
+	cache.Put("a", fragments, now)
+	if cached := cache.Get("a", now); len(cached) != len(fragments) {
+		t.Errorf("Expected cached response")
+	}
+	if cached := cache.Get("a", now.Add(2*time.Second)); cached != nil {
+		t.Errorf("Expected cached response to expire")
+	}
+	cache.Put("b", fragments, now)
+	if cache.Get("a", now) != nil || cache.Get("b", now) == nil {
+		t.Errorf("Expected oldest response to be dropped from full cache")
+	}
+}
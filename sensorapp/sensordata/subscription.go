@@ -0,0 +1,448 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sensordata
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CookieLen is the length of the cookie with which subscribers prove that they receive
+// the messages sent to their address
+const CookieLen = 8
+
+// Threshold triggers an alert when the value of a sensor is above or below a limit
+type Threshold struct {
+	Sensor string  `json:"sensor"`
+	Above  bool    `json:"above"`
+	Value  float64 `json:"value"`
+}
+
+// ParseThreshold parses a threshold of the form "Temperature>30" or "Humidity<20"
+func ParseThreshold(s string) (Threshold, error) {
+	index := strings.LastIndexAny(s, "<>")
+	if index <= 0 {
+		return Threshold{}, fmt.Errorf("invalid threshold %q, expected <sensor>'>'<value> or <sensor>'<'<value>", s)
+	}
+	value, err := strconv.ParseFloat(strings.TrimSpace(s[index+1:]), 64)
+	if err != nil || math.IsNaN(value) {
+		return Threshold{}, fmt.Errorf("invalid value in threshold %q", s)
+	}
+	return Threshold{
+		Sensor: strings.TrimSpace(s[:index]),
+		Above:  s[index] == '>',
+		Value:  value,
+	}, nil
+}
+
+// String formats the threshold as parsed by ParseThreshold
+func (t *Threshold) String() string {
+	op := "<"
+	if t.Above {
+		op = ">"
+	}
+	return t.Sensor + op + strconv.FormatFloat(t.Value, 'f', -1, 64)
+}
+
+// Exceeded returns whether the value is beyond the threshold
+func (t *Threshold) Exceeded(v float64) bool {
+	if t.Above {
+		return v > t.Value
+	}
+	return v < t.Value
+}
+
+// Subscription requests pushed messages from the server for the duration of the lease.
+// With Updates, the server pushes the readings of Sensors, or all sensors if there are
+// none, whenever their value changes. Independently, the server pushes an alert whenever
+// the value of a sensor exceeds one of the Thresholds, and when it returns within it.
+//
+// The client renews the subscription by sending it again before the lease expires. A
+// subscription with a zero lease cancels the subscription. The server ignores
+// subscriptions without the Cookie of the client's address, which it sends in each
+// acknowledgement; the client first subscribes with a zero cookie to obtain it.
+type Subscription struct {
+	Lease      time.Duration
+	Cookie     [CookieLen]byte
+	Updates    bool
+	Sensors    []string
+	Thresholds []Threshold
+}
+
+// Alert is pushed when a reading exceeds a threshold, and with Cleared set when the
+// readings of the sensor return within the threshold
+type Alert struct {
+	Threshold Threshold `json:"threshold"`
+	Reading   Reading   `json:"reading"`
+	Cleared   bool      `json:"cleared"`
+}
+
+// MarshalSubscription returns the subscription request
+func MarshalSubscription(s *Subscription) ([]byte, error) {
+	if len(s.Sensors) > math.MaxUint8 || len(s.Thresholds) > math.MaxUint8 {
+		return nil, fmt.Errorf("too many sensors or thresholds in subscription")
+	}
+	b := make([]byte, 1+1+4, MaxResponseSize)
+	b[0] = TypeSubscribe
+	if s.Updates {
+		b[1] |= FlagUpdates
+	}
+	binary.BigEndian.PutUint32(b[2:], leaseSeconds(s.Lease))
+	b = append(b, s.Cookie[:]...)
+	b = append(b, byte(len(s.Sensors)))
+	for _, sensor := range s.Sensors {
+		if len(sensor) > MaxIDLength {
+			return nil, fmt.Errorf("sensor ID too long: %q", sensor)
+		}
+		b = append(b, byte(len(sensor)))
+		b = append(b, sensor...)
+	}
+	b = append(b, byte(len(s.Thresholds)))
+	for i := range s.Thresholds {
+		if len(s.Thresholds[i].Sensor) > MaxIDLength {
+			return nil, fmt.Errorf("sensor ID too long: %q", s.Thresholds[i].Sensor)
+		}
+		b = appendThreshold(b, &s.Thresholds[i])
+	}
+	if len(b) > MaxResponseSize {
+		return nil, fmt.Errorf("subscription too large: %d bytes", len(b))
+	}
+	return b, nil
+}
+
+// ParseSubscription parses a subscription request
+func ParseSubscription(b []byte) (*Subscription, error) {
+	if len(b) < 1+1+4+CookieLen+1 || b[0] != TypeSubscribe {
+		return nil, errInvalidMessage
+	}
+	s := &Subscription{
+		Updates: b[1]&FlagUpdates != 0,
+		Lease:   time.Duration(binary.BigEndian.Uint32(b[2:])) * time.Second,
+		Sensors: make([]string, b[6+CookieLen]),
+	}
+	copy(s.Cookie[:], b[6:])
+	var err error
+	rest := b[6+CookieLen+1:]
+	for i := range s.Sensors {
+		if s.Sensors[i], rest, err = parseString(rest); err != nil {
+			return nil, err
+		}
+	}
+	if len(rest) < 1 {
+		return nil, errInvalidMessage
+	}
+	s.Thresholds = make([]Threshold, rest[0])
+	rest = rest[1:]
+	for i := range s.Thresholds {
+		if rest, err = parseThreshold(rest, &s.Thresholds[i]); err != nil {
+			return nil, err
+		}
+	}
+	if len(rest) != 0 {
+		return nil, errInvalidMessage
+	}
+	return s, nil
+}
+
+// MarshalSubscriptionAck returns the acknowledgement of a subscription with the lease
+// granted by the server, zero if the subscription was cancelled or rejected, and the
+// cookie of the client's address
+func MarshalSubscriptionAck(lease time.Duration, cookie [CookieLen]byte) []byte {
+	b := make([]byte, 1+4, 1+4+CookieLen)
+	b[0] = TypeSubscriptionAck
+	binary.BigEndian.PutUint32(b[1:], leaseSeconds(lease))
+	return append(b, cookie[:]...)
+}
+
+// ParseSubscriptionAck returns the lease granted by the server and the cookie
+func ParseSubscriptionAck(b []byte) (time.Duration, [CookieLen]byte, error) {
+	var cookie [CookieLen]byte
+	if len(b) != 1+4+CookieLen || b[0] != TypeSubscriptionAck {
+		return 0, cookie, errInvalidMessage
+	}
+	copy(cookie[:], b[1+4:])
+	return time.Duration(binary.BigEndian.Uint32(b[1:])) * time.Second, cookie, nil
+}
+
+// MarshalUpdate returns the message pushing a changed reading
+func MarshalUpdate(r *Reading) []byte {
+	b := make([]byte, 1, 1+readingFixedSize+len(r.Sensor)+len(r.Unit))
+	b[0] = TypeUpdate
+	return appendReading(b, r)
+}
+
+// ParseUpdate parses an update message
+func ParseUpdate(b []byte) (*Reading, error) {
+	if len(b) < 1 || b[0] != TypeUpdate {
+		return nil, errInvalidMessage
+	}
+	r := &Reading{}
+	rest, err := parseReading(b[1:], r)
+	if err != nil || len(rest) != 0 {
+		return nil, errInvalidMessage
+	}
+	return r, nil
+}
+
+// MarshalAlert returns the message pushing an alert
+func MarshalAlert(a *Alert) []byte {
+	b := []byte{TypeAlert, 0}
+	if a.Cleared {
+		b[1] |= FlagCleared
+	}
+	b = appendThreshold(b, &a.Threshold)
+	return appendReading(b, &a.Reading)
+}
+
+// ParseAlert parses an alert message
+func ParseAlert(b []byte) (*Alert, error) {
+	if len(b) < 2 || b[0] != TypeAlert {
+		return nil, errInvalidMessage
+	}
+	a := &Alert{Cleared: b[1]&FlagCleared != 0}
+	rest, err := parseThreshold(b[2:], &a.Threshold)
+	if err != nil {
+		return nil, err
+	}
+	if rest, err = parseReading(rest, &a.Reading); err != nil || len(rest) != 0 {
+		return nil, errInvalidMessage
+	}
+	return a, nil
+}
+
+func leaseSeconds(lease time.Duration) uint32 {
+	s := (lease + time.Second - 1) / time.Second
+	if s > math.MaxUint32 {
+		return math.MaxUint32
+	}
+	return uint32(s)
+}
+
+func appendThreshold(b []byte, t *Threshold) []byte {
+	b = append(b, byte(len(t.Sensor)))
+	b = append(b, t.Sensor...)
+	op := byte('<')
+	if t.Above {
+		op = '>'
+	}
+	b = append(b, op)
+	b = append(b, make([]byte, 8)...)
+	binary.BigEndian.PutUint64(b[len(b)-8:], math.Float64bits(t.Value))
+	return b
+}
+
+func parseThreshold(b []byte, t *Threshold) ([]byte, error) {
+	var err error
+	if t.Sensor, b, err = parseString(b); err != nil {
+		return nil, err
+	}
+	if len(b) < 1+8 || (b[0] != '<' && b[0] != '>') {
+		return nil, errInvalidMessage
+	}
+	t.Above = b[0] == '>'
+	t.Value = math.Float64frombits(binary.BigEndian.Uint64(b[1:]))
+	return b[1+8:], nil
+}
+
+// Push is a message pushed to a subscriber
+type Push struct {
+	Addr    net.Addr
+	Message []byte
+}
+
+// Subscribers keeps the subscriptions of clients, identified by their address, and
+// determines the messages pushed to them. It is safe for concurrent use.
+type Subscribers struct {
+	maxLease time.Duration
+	max      int
+	secret   []byte
+
+	mutex       sync.Mutex
+	subscribers map[string]*subscriber
+}
+
+type subscriber struct {
+	addr         net.Addr
+	subscription Subscription
+	expires      time.Time
+	// last is the last reading pushed of each sensor
+	last map[string]Reading
+	// alerts holds the state of each threshold whose sensor had a reading, with the
+	// latest reading of the sensor
+	alerts map[int]Alert
+}
+
+// NewSubscribers creates the subscribers, allowing up to max subscribers with a lease of
+// at most maxLease, with a fresh random secret for the cookies
+func NewSubscribers(max int, maxLease time.Duration) (*Subscribers, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return &Subscribers{
+		maxLease:    maxLease,
+		max:         max,
+		secret:      secret,
+		subscribers: make(map[string]*subscriber),
+	}, nil
+}
+
+// Cookie returns the cookie of the client's address, which the server sends in the
+// acknowledgements of subscriptions
+func (s *Subscribers) Cookie(addr net.Addr) [CookieLen]byte {
+	var cookie [CookieLen]byte
+	h := hmac.New(sha256.New, s.secret)
+	_, _ = h.Write([]byte(addr.String()))
+	copy(cookie[:], h.Sum(nil))
+	return cookie
+}
+
+// Subscribe adds, renews or, with a zero lease, cancels the subscription of the client and
+// returns the lease granted, zero if cancelled or rejected. Subscriptions without the
+// cookie of the client's address are rejected without changing any state. For new or changed
+// subscriptions, it returns the pushes for the current readings of the sensors. For
+// renewals, it returns the alerts with the current state of the thresholds, so that
+// the subscriber recovers from lost alerts.
+func (s *Subscribers) Subscribe(addr net.Addr, sub *Subscription, current []Reading,
+	now time.Time) (time.Duration, []Push) {
+
+	cookie := s.Cookie(addr)
+	if !hmac.Equal(sub.Cookie[:], cookie[:]) {
+		return 0, nil
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.expire(now)
+	key := addr.String()
+	sb, ok := s.subscribers[key]
+	if sub.Lease <= 0 {
+		delete(s.subscribers, key)
+		return 0, nil
+	}
+	if !ok && len(s.subscribers) >= s.max {
+		return 0, nil
+	}
+	lease := sub.Lease
+	if lease > s.maxLease {
+		lease = s.maxLease
+	}
+	if ok && sb.subscription.Updates == sub.Updates &&
+		reflect.DeepEqual(sb.subscription.Sensors, sub.Sensors) &&
+		reflect.DeepEqual(sb.subscription.Thresholds, sub.Thresholds) {
+		// Renewal, the path to the client may have changed
+		sb.addr = addr
+		sb.expires = now.Add(lease)
+		return lease, sb.alertStates()
+	}
+	sb = &subscriber{
+		addr:         addr,
+		subscription: *sub,
+		expires:      now.Add(lease),
+		last:         make(map[string]Reading),
+		alerts:       make(map[int]Alert),
+	}
+	s.subscribers[key] = sb
+	var pushes []Push
+	for i := range current {
+		pushes = append(pushes, sb.update(&current[i])...)
+	}
+	return lease, pushes
+}
+
+// Update returns the pushes for a new reading
+func (s *Subscribers) Update(r *Reading, now time.Time) []Push {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.expire(now)
+	var pushes []Push
+	for _, sb := range s.subscribers {
+		pushes = append(pushes, sb.update(r)...)
+	}
+	return pushes
+}
+
+// Len returns the number of subscribers
+func (s *Subscribers) Len() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.subscribers)
+}
+
+// expire drops the subscribers whose lease has expired, must be called with the mutex held
+func (s *Subscribers) expire(now time.Time) {
+	for key, sb := range s.subscribers {
+		if now.After(sb.expires) {
+			delete(s.subscribers, key)
+		}
+	}
+}
+
+// update returns the pushes to the subscriber for a new reading
+func (sb *subscriber) update(r *Reading) []Push {
+	var pushes []Push
+	if sb.subscription.Updates && sb.watches(r.Sensor) {
+		last, ok := sb.last[r.Sensor]
+		if !ok || last.Value != r.Value || last.Unit != r.Unit {
+			sb.last[r.Sensor] = *r
+			pushes = append(pushes, Push{sb.addr, MarshalUpdate(r)})
+		}
+	}
+	for i := range sb.subscription.Thresholds {
+		t := &sb.subscription.Thresholds[i]
+		if t.Sensor != r.Sensor {
+			continue
+		}
+		last, ok := sb.alerts[i]
+		alert := Alert{Threshold: *t, Reading: *r, Cleared: !t.Exceeded(r.Value)}
+		sb.alerts[i] = alert
+		if alert.Cleared != (!ok || last.Cleared) {
+			pushes = append(pushes, Push{sb.addr, MarshalAlert(&alert)})
+		}
+	}
+	return pushes
+}
+
+// alertStates returns the pushes of the current state of the thresholds
+func (sb *subscriber) alertStates() []Push {
+	var pushes []Push
+	for i := range sb.subscription.Thresholds {
+		if alert, ok := sb.alerts[i]; ok {
+			pushes = append(pushes, Push{sb.addr, MarshalAlert(&alert)})
+		}
+	}
+	return pushes
+}
+
+func (sb *subscriber) watches(sensor string) bool {
+	if len(sb.subscription.Sensors) == 0 {
+		return true
+	}
+	for _, s := range sb.subscription.Sensors {
+		if s == sensor {
+			return true
+		}
+	}
+	return false
+}
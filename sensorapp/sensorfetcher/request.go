@@ -0,0 +1,63 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/netsec-ethz/scion-apps/sensorapp/sensordata"
+)
+
+// client sends identified requests to the server, retrying requests that are not
+// answered in time
+type client struct {
+	conn    net.Conn
+	timeout time.Duration
+	retries int
+}
+
+// request sends the request and returns the reassembled response. Retries use the same
+// request ID, so the fragments received in each attempt are combined.
+func (c *client) request(request []byte) ([]byte, error) {
+	id := newRequestID()
+	packet := sensordata.MarshalRequest(id, request)
+	reassembler := sensordata.NewReassembler(id)
+	receivePacketBuffer := make([]byte, 2500)
+	defer func() { _ = c.conn.SetReadDeadline(time.Time{}) }()
+
+	for attempt := 0; attempt <= c.retries; attempt++ {
+		if _, err := c.conn.Write(packet); err != nil {
+			return nil, err
+		}
+		if err := c.conn.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+			return nil, err
+		}
+		for {
+			n, err := c.conn.Read(receivePacketBuffer)
+			if err, ok := err.(net.Error); ok && err.Timeout() {
+				break
+			}
+			if err != nil {
+				// Other errors, e.g. SCMP errors, are ignored; the attempt ends by timeout
+				continue
+			}
+			response, err := reassembler.Add(receivePacketBuffer[:n])
+			if err != nil {
+				// Not a fragment, e.g. a late response to a previous request
+				continue
+			}
+			if response != nil {
+				return response, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("no response from server after %d attempts", c.retries+1)
+}
+
+func newRequestID() uint32 {
+	b := make([]byte, 4)
+	_, _ = rand.Read(b)
+	return binary.BigEndian.Uint32(b)
+}
@@ -1,15 +1,21 @@
 // sensorfetcher application
 // For documentation on how to setup and run the application see:
 // https://github.com/netsec-ethz/scion-apps/blob/master/README.md
+// https://github.com/netsec-ethz/scion-apps/blob/master/sensorapp/README.md
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/netsec-ethz/scion-apps/pkg/appnet"
+	"github.com/netsec-ethz/scion-apps/sensorapp/sensordata"
 )
 
 func check(e error) {
@@ -18,27 +24,171 @@ func check(e error) {
 	}
 }
 
+// parseSensors parses a comma separated list of sensor IDs
+func parseSensors(s string) []string {
+	var sensors []string
+	for _, sensor := range strings.Split(s, ",") {
+		if sensor = strings.TrimSpace(sensor); sensor != "" {
+			sensors = append(sensors, sensor)
+		}
+	}
+	return sensors
+}
+
+// printText prints one line per reading, with the time of the reading
+func printText(readings []sensordata.Reading) {
+	for i := range readings {
+		fmt.Println(readings[i].Time.Local().Format(sensordata.TimeFormat), readings[i].String())
+	}
+}
+
+// parseTime parses a time given as RFC 3339 time or as duration before now
+func parseTime(name, s string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid -%s %q, expected a duration or RFC 3339 time", name, s)
+	}
+	return t, nil
+}
+
+// printSamples prints one line per sample, with the start time of the sample. Samples
+// of several readings are printed with min/avg/max and the number of readings.
+func printSamples(samples []sensordata.Sample) {
+	format := func(v float64) string {
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	for _, s := range samples {
+		line := s.Time.Local().Format(sensordata.TimeFormat) + " " + s.Sensor + ": "
+		if s.Count == 1 {
+			line += format(s.Avg)
+		} else {
+			line += format(s.Min) + "/" + format(s.Avg) + "/" + format(s.Max)
+		}
+		if s.Unit != "" {
+			line += " " + s.Unit
+		}
+		if s.Count != 1 {
+			line += fmt.Sprintf(" (%d readings)", s.Count)
+		}
+		fmt.Println(line)
+	}
+}
+
+// fetchReadings fetches the most recent readings of the sensors
+func fetchReadings(c *client, sensors []string) []sensordata.Reading {
+	query, err := sensordata.MarshalQuery(sensors)
+	check(err)
+
+	response, err := c.request(query)
+	check(err)
+
+	readings, truncated, err := sensordata.ParseResponse(response)
+	check(err)
+	if truncated {
+		log.Println("Response truncated by the server, not all readings were received")
+	}
+	found := make(map[string]bool)
+	for i := range readings {
+		found[readings[i].Sensor] = true
+	}
+	for _, s := range sensors {
+		if !found[s] {
+			log.Printf("No reading for sensor %q", s)
+		}
+	}
+	return readings
+}
+
+// fetchHistory fetches the samples requested by the query, repeating the query with the
+// cursor advanced until the server has sent all samples
+func fetchHistory(c *client, query sensordata.HistoryQuery) []sensordata.Sample {
+	samples := []sensordata.Sample{}
+	for {
+		request, err := sensordata.MarshalHistoryQuery(&query)
+		check(err)
+
+		response, err := c.request(request)
+		check(err)
+		received, more, err := sensordata.ParseHistoryResponse(response)
+		check(err)
+		samples = append(samples, received...)
+		if !more || len(received) == 0 {
+			return samples
+		}
+		last := received[len(received)-1]
+		query.AfterSensor, query.AfterTime = last.Sensor, last.Time
+	}
+}
+
 func main() {
 
 	serverAddrStr := flag.String("s", "", "Server address (<ISD-AS,[IP]:port> or <hostname:port>)")
+	sensorList := flag.String("sensors", "", "Comma separated list of sensor IDs to query, all sensors if empty")
+	jsonOutput := flag.Bool("json", false, "Print the readings as JSON array")
+	from := flag.String("from", "", "Fetch the readings since this time, as duration before now (e.g. 1h) or RFC 3339 time")
+	to := flag.String("to", "", "With -from, fetch the readings until this time, as duration before now or RFC 3339 time (default now)")
+	interval := flag.Duration("interval", 0, "With -from, downsample the readings to min/avg/max per interval")
+	subscribeUpdates := flag.Bool("subscribe", false, "Subscribe to the readings and print them whenever they change")
+	alerts := flag.String("alert", "", "Comma separated list of thresholds to subscribe to alerts for, e.g. \"Temperature>30,CO2>1000\"")
+	lease := flag.Duration("lease", time.Minute, "Lease of the subscription, renewed after a third of the lease")
+	timeout := flag.Duration("timeout", 2*time.Second, "Time to wait for a response before retrying the request")
+	retries := flag.Int("retries", 3, "Number of retries of requests that are not answered in time")
 	flag.Parse()
 
-	if len(*serverAddrStr) == 0 {
+	subscribing := *subscribeUpdates || *alerts != ""
+	if len(*serverAddrStr) == 0 || (*from == "" && (*to != "" || *interval != 0)) || *interval < 0 ||
+		(subscribing && (*from != "" || *lease < time.Second)) || *timeout <= 0 || *retries < 0 {
 		flag.Usage()
 		os.Exit(2)
 	}
+	sensors := parseSensors(*sensorList)
+	thresholds, err := parseThresholds(*alerts)
+	check(err)
 
 	conn, err := appnet.Dial(*serverAddrStr)
 	check(err)
 
-	receivePacketBuffer := make([]byte, 2500)
-	sendPacketBuffer := make([]byte, 0)
-
-	_, err = conn.Write(sendPacketBuffer)
-	check(err)
+	if subscribing {
+		subscribe(conn, sensordata.Subscription{
+			Lease:      *lease,
+			Updates:    *subscribeUpdates,
+			Sensors:    sensors,
+			Thresholds: thresholds,
+		}, *jsonOutput)
+		return
+	}
 
-	n, err := conn.Read(receivePacketBuffer)
-	check(err)
+	c := &client{conn: conn, timeout: *timeout, retries: *retries}
+	if *from != "" {
+		now := time.Now()
+		query := sensordata.HistoryQuery{To: now, Interval: *interval, Sensors: sensors}
+		query.From, err = parseTime("from", *from, now)
+		check(err)
+		if *to != "" {
+			query.To, err = parseTime("to", *to, now)
+			check(err)
+		}
+		samples := fetchHistory(c, query)
+		if *jsonOutput {
+			err = json.NewEncoder(os.Stdout).Encode(samples)
+			check(err)
+		} else {
+			printSamples(samples)
+		}
+		return
+	}
 
-	fmt.Print(string(receivePacketBuffer[:n]))
+	readings := fetchReadings(c, sensors)
+	if *jsonOutput {
+		if readings == nil {
+			readings = []sensordata.Reading{}
+		}
+		err = json.NewEncoder(os.Stdout).Encode(readings)
+		check(err)
+	} else {
+		printText(readings)
+	}
 }
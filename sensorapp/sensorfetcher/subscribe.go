@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/netsec-ethz/scion-apps/sensorapp/sensordata"
+)
+
+// pushedMessage is the JSON output of a pushed update or alert
+type pushedMessage struct {
+	Update *sensordata.Reading `json:"update,omitempty"`
+	Alert  *sensordata.Alert   `json:"alert,omitempty"`
+}
+
+// parseThresholds parses a comma separated list of thresholds
+func parseThresholds(s string) ([]sensordata.Threshold, error) {
+	var thresholds []sensordata.Threshold
+	for _, t := range strings.Split(s, ",") {
+		if strings.TrimSpace(t) == "" {
+			continue
+		}
+		threshold, err := sensordata.ParseThreshold(t)
+		if err != nil {
+			return nil, err
+		}
+		thresholds = append(thresholds, threshold)
+	}
+	return thresholds, nil
+}
+
+// subscribe subscribes to the server and prints the pushed updates and alerts until
+// interrupted. The first subscription request only obtains the cookie from the server's
+// acknowledgement, and is repeated with the cookie right away. The subscription is
+// renewed after a third of the lease, so that the lease doesn't expire if a renewal is
+// lost. The server repeats the state of the thresholds with each renewal; only changes
+// of the state are printed.
+func subscribe(conn net.Conn, sub sensordata.Subscription, jsonOutput bool) {
+	// The cancellation of the current subscription, sent when interrupted
+	var cancel atomic.Value
+	marshal := func() []byte {
+		request, err := sensordata.MarshalSubscription(&sub)
+		check(err)
+		c := sub
+		c.Lease = 0
+		b, err := sensordata.MarshalSubscription(&c)
+		check(err)
+		cancel.Store(b)
+		return request
+	}
+	request := marshal()
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-interrupt
+		_, _ = conn.Write(cancel.Load().([]byte))
+		os.Exit(0)
+	}()
+
+	encoder := json.NewEncoder(os.Stdout)
+	// exceeded holds the thresholds currently exceeded, by their string representation
+	exceeded := make(map[string]bool)
+	receivePacketBuffer := make([]byte, 2500)
+	var sent, renew time.Time
+	for {
+		if now := time.Now(); !now.Before(renew) {
+			_, err := conn.Write(request)
+			check(err)
+			sent, renew = now, now.Add(sub.Lease/3)
+		}
+		err := conn.SetReadDeadline(renew)
+		check(err)
+		n, err := conn.Read(receivePacketBuffer)
+		if err, ok := err.(net.Error); ok && err.Timeout() {
+			continue
+		}
+		if err != nil {
+			// Other errors, e.g. SCMP errors, are logged and ignored; the subscription
+			// is renewed in time regardless
+			log.Printf("Receiving from the server failed: %v", err)
+			continue
+		}
+		if n == 0 {
+			continue
+		}
+
+		// Malformed messages are logged and ignored, as are messages of other types, e.g.
+		// late responses to queries
+		msg := receivePacketBuffer[:n]
+		switch msg[0] {
+		case sensordata.TypeSubscriptionAck:
+			lease, cookie, err := sensordata.ParseSubscriptionAck(msg)
+			if err != nil {
+				log.Printf("Invalid acknowledgement: %v", err)
+				continue
+			}
+			if cookie != sub.Cookie {
+				// First acknowledgement, or the server was restarted: subscribe again with
+				// the new cookie
+				sub.Cookie = cookie
+				request = marshal()
+				renew = time.Now()
+				continue
+			}
+			if lease == 0 {
+				log.Fatal("Subscription rejected by the server")
+			}
+			renew = sent.Add(lease / 3)
+		case sensordata.TypeUpdate:
+			reading, err := sensordata.ParseUpdate(msg)
+			if err != nil {
+				log.Printf("Invalid update: %v", err)
+				continue
+			}
+			if jsonOutput {
+				err = encoder.Encode(pushedMessage{Update: reading})
+				check(err)
+			} else {
+				printText([]sensordata.Reading{*reading})
+			}
+		case sensordata.TypeAlert:
+			alert, err := sensordata.ParseAlert(msg)
+			if err != nil {
+				log.Printf("Invalid alert: %v", err)
+				continue
+			}
+			key := alert.Threshold.String()
+			if exceeded[key] == !alert.Cleared {
+				// Repeated state
+				continue
+			}
+			exceeded[key] = !alert.Cleared
+			if jsonOutput {
+				err = encoder.Encode(pushedMessage{Alert: alert})
+				check(err)
+			} else {
+				state := "ALERT"
+				if alert.Cleared {
+					state = "CLEARED"
+				}
+				fmt.Println(alert.Reading.Time.Local().Format(sensordata.TimeFormat), state,
+					alert.Threshold.String(), "-", alert.Reading.String())
+			}
+		}
+	}
+}
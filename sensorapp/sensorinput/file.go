@@ -0,0 +1,156 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sensorinput
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"github.com/netsec-ethz/scion-apps/sensorapp/sensordata"
+)
+
+// FileTail reads the lines appended to a file, in the input format of sensordata.Parser,
+// like tail -F. Lines already in the file when Run starts are skipped. If the file is
+// replaced, e.g. by log rotation, or truncated, the new content is read from the start.
+type FileTail struct {
+	Path string
+	// Poll is the interval in which the file is checked for new lines
+	Poll time.Duration
+}
+
+// Run reads the file until reading fails
+func (t *FileTail) Run(emit func(sensordata.Reading)) error {
+	var parser sensordata.Parser
+	var file *os.File
+	var reader *bufio.Reader
+	var partial string
+	var offset int64
+	skipExisting := true
+	defer func() {
+		if file != nil {
+			file.Close()
+		}
+	}()
+	for {
+		if file == nil {
+			f, err := os.Open(t.Path)
+			if os.IsNotExist(err) {
+				// Wait for the file to be created, it's new then
+				skipExisting = false
+				time.Sleep(t.Poll)
+				continue
+			} else if err != nil {
+				return err
+			}
+			offset = 0
+			if skipExisting {
+				if offset, err = f.Seek(0, io.SeekEnd); err != nil {
+					f.Close()
+					return err
+				}
+				skipExisting = false
+			}
+			file, reader, partial = f, bufio.NewReader(f), ""
+		}
+
+		line, err := reader.ReadString('\n')
+		offset += int64(len(line))
+		if err == nil {
+			parseLine(&parser, partial+line, emit)
+			partial = ""
+			continue
+		} else if err != io.EOF {
+			return err
+		}
+		// Incomplete line, wait for the rest of it
+		partial += line
+		time.Sleep(t.Poll)
+		if t.replaced(file, offset) {
+			file.Close()
+			file = nil
+		}
+	}
+}
+
+// replaced returns whether the file at the path was replaced or truncated
+func (t *FileTail) replaced(file *os.File, offset int64) bool {
+	current, err := os.Stat(t.Path)
+	if err != nil {
+		// Removed, keep reading the old file until the new one is created
+		return false
+	}
+	opened, err := file.Stat()
+	return err != nil || !os.SameFile(current, opened) || current.Size() < offset
+}
+
+func (t *FileTail) String() string {
+	return "file:" + t.Path
+}
+
+// UnixSocket accepts clients on a UNIX socket, and reads readings as newline-delimited
+// JSON from them, see ParseJSON
+type UnixSocket struct {
+	Path string
+}
+
+// Run accepts clients until accepting fails
+func (u *UnixSocket) Run(emit func(sensordata.Reading)) error {
+	// Remove the socket of a previous run
+	if fi, err := os.Lstat(u.Path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(u.Path); err != nil {
+			return err
+		}
+	}
+	listener, err := net.Listen("unix", u.Path)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go u.serve(conn, emit)
+	}
+}
+
+// serve reads the readings of a client until it disconnects
+func (u *UnixSocket) serve(conn net.Conn, emit func(sensordata.Reading)) {
+	defer conn.Close()
+	input := bufio.NewScanner(conn)
+	for input.Scan() {
+		if len(input.Bytes()) == 0 {
+			continue
+		}
+		reading, err := ParseJSON(input.Bytes(), time.Now())
+		if err != nil {
+			log.Println("Ignoring input:", err)
+			continue
+		}
+		emit(*reading)
+	}
+	if err := input.Err(); err != nil {
+		log.Printf("Reading from %s: %v", u, err)
+	}
+}
+
+func (u *UnixSocket) String() string {
+	return "unix:" + u.Path
+}
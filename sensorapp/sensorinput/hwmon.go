@@ -0,0 +1,133 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sensorinput
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/netsec-ethz/scion-apps/sensorapp/sensordata"
+)
+
+// hwmonTypes maps the types of hwmon sensors to the unit of their values and the
+// divisor converting the sysfs value to it, see the kernel's sysfs-interface
+// documentation
+var hwmonTypes = map[string]struct {
+	unit    string
+	divisor float64
+}{
+	"temp":     {"°C", 1000},
+	"fan":      {"RPM", 1},
+	"in":       {"V", 1000},
+	"curr":     {"A", 1000},
+	"power":    {"W", 1000000},
+	"energy":   {"J", 1000000},
+	"humidity": {"%", 1000},
+}
+
+// Hwmon polls the sensors of the Linux hwmon devices, such as CPU temperatures and fan
+// speeds. The sensor ID is the device name followed by the label of the sensor, or by
+// the sensor's channel if it has no label, e.g. "coretemp Package id 0" or "nct6775 fan2".
+type Hwmon struct {
+	// Root is the directory containing the hwmon devices, usually DefaultHwmonRoot
+	Root     string
+	Interval time.Duration
+}
+
+// Run polls the sensors until reading the devices fails
+func (h *Hwmon) Run(emit func(sensordata.Reading)) error {
+	for {
+		readings, err := h.Read(time.Now())
+		if err != nil {
+			return err
+		}
+		for _, r := range readings {
+			emit(r)
+		}
+		time.Sleep(h.Interval)
+	}
+}
+
+// Read returns the current readings of all sensors. Sensors that can't be read are
+// skipped.
+func (h *Hwmon) Read(now time.Time) ([]sensordata.Reading, error) {
+	if _, err := os.Stat(h.Root); err != nil {
+		return nil, err
+	}
+	devices, err := filepath.Glob(filepath.Join(h.Root, "hwmon*"))
+	if err != nil {
+		return nil, err
+	}
+	var readings []sensordata.Reading
+	seen := make(map[string]bool)
+	for _, device := range devices {
+		dir := device
+		inputs, _ := filepath.Glob(filepath.Join(dir, "*_input"))
+		if len(inputs) == 0 {
+			// Older drivers keep the attributes in the device directory
+			dir = filepath.Join(device, "device")
+			inputs, _ = filepath.Glob(filepath.Join(dir, "*_input"))
+		}
+		name, err := readAttribute(filepath.Join(dir, "name"))
+		if err != nil {
+			name = filepath.Base(device)
+		}
+		for _, input := range inputs {
+			channel := strings.TrimSuffix(filepath.Base(input), "_input")
+			typ, ok := hwmonTypes[strings.TrimRight(channel, "0123456789")]
+			if !ok {
+				continue
+			}
+			raw, err := readAttribute(input)
+			if err != nil {
+				continue
+			}
+			value, err := strconv.ParseFloat(raw, 64)
+			if err != nil {
+				continue
+			}
+			label, err := readAttribute(filepath.Join(dir, channel+"_label"))
+			if err != nil || label == "" {
+				label = channel
+			}
+			id := name + " " + label
+			if seen[id] {
+				// Several devices of the same driver
+				id += " (" + filepath.Base(device) + ")"
+			}
+			seen[id] = true
+			readings = append(readings, sensordata.Reading{
+				Sensor: id,
+				Unit:   typ.unit,
+				Value:  value / typ.divisor,
+				Time:   now,
+			})
+		}
+	}
+	return readings, nil
+}
+
+func (h *Hwmon) String() string {
+	return "hwmon:" + h.Root
+}
+
+func readAttribute(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	return strings.TrimSpace(string(b)), err
+}
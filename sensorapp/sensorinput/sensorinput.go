@@ -0,0 +1,133 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sensorinput implements the sources from which the sensorserver obtains sensor
+// readings.
+package sensorinput
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/netsec-ethz/scion-apps/sensorapp/sensordata"
+)
+
+// DefaultHwmonRoot is the sysfs directory of the hwmon devices
+const DefaultHwmonRoot = "/sys/class/hwmon"
+
+// Source produces sensor readings
+type Source interface {
+	// Run passes the readings of the source to emit until the source is exhausted or
+	// fails. Invalid input is logged and ignored. emit may be called concurrently.
+	Run(emit func(sensordata.Reading)) error
+	// String describes the source, as given to New
+	String() string
+}
+
+// New creates the source described by spec:
+//
+//	stdin               lines in the input format of sensordata.Parser from stdin
+//	file:<path>         lines in the input format appended to the file
+//	unix:<path>         newline-delimited JSON readings from clients of a UNIX socket
+//	hwmon[:<directory>] readings of the Linux hwmon sensors, polled every interval
+func New(spec string, interval time.Duration) (Source, error) {
+	kind, arg := spec, ""
+	if i := strings.Index(spec, ":"); i >= 0 {
+		kind, arg = spec[:i], spec[i+1:]
+	}
+	switch {
+	case kind == "stdin" && arg == "":
+		return &Reader{Name: spec, Reader: os.Stdin}, nil
+	case kind == "file" && arg != "":
+		return &FileTail{Path: arg, Poll: time.Second}, nil
+	case kind == "unix" && arg != "":
+		return &UnixSocket{Path: arg}, nil
+	case kind == "hwmon":
+		if arg == "" {
+			arg = DefaultHwmonRoot
+		}
+		if interval <= 0 {
+			return nil, fmt.Errorf("invalid poll interval for %s: %v", spec, interval)
+		}
+		return &Hwmon{Root: arg, Interval: interval}, nil
+	}
+	return nil, fmt.Errorf("invalid input source %q, expected stdin, file:<path>, unix:<path> or hwmon[:<directory>]", spec)
+}
+
+// Reader reads lines in the input format of sensordata.Parser, e.g. from stdin
+type Reader struct {
+	Name   string
+	Reader io.Reader
+}
+
+// Run reads lines until the end of the input
+func (r *Reader) Run(emit func(sensordata.Reading)) error {
+	var parser sensordata.Parser
+	input := bufio.NewScanner(r.Reader)
+	for input.Scan() {
+		parseLine(&parser, input.Text(), emit)
+	}
+	return input.Err()
+}
+
+func (r *Reader) String() string {
+	return r.Name
+}
+
+// parseLine parses an input line and emits the reading, if any
+func parseLine(parser *sensordata.Parser, line string, emit func(sensordata.Reading)) {
+	reading, err := parser.ParseLine(line, time.Now())
+	if err != nil {
+		log.Println("Ignoring input:", err)
+		return
+	}
+	if reading != nil {
+		emit(*reading)
+	}
+}
+
+// ParseJSON parses a reading encoded as JSON object, e.g.
+//
+//	{"sensor":"CPU temperature","unit":"°C","value":42.5,"time":"2020-06-01T12:00:00Z"}
+//
+// The unit and the time are optional; without time, the reading gets the time now.
+func ParseJSON(b []byte, now time.Time) (*sensordata.Reading, error) {
+	var r struct {
+		Sensor string    `json:"sensor"`
+		Unit   string    `json:"unit"`
+		Value  *float64  `json:"value"`
+		Time   time.Time `json:"time"`
+	}
+	if err := json.Unmarshal(b, &r); err != nil {
+		return nil, fmt.Errorf("invalid JSON reading %q: %v", b, err)
+	}
+	if r.Sensor == "" || r.Value == nil {
+		return nil, fmt.Errorf("missing sensor or value in %q", b)
+	}
+	if r.Time.IsZero() {
+		r.Time = now
+	}
+	return &sensordata.Reading{
+		Sensor: r.Sensor,
+		Unit:   r.Unit,
+		Value:  *r.Value,
+		Time:   r.Time,
+	}, nil
+}
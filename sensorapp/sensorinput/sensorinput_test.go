@@ -0,0 +1,202 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sensorinput
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/netsec-ethz/scion-apps/sensorapp/sensordata"
+)
+
+func TestNew(t *testing.T) {
+	valid := map[string]string{
+		"stdin":          "stdin",
+		"file:/tmp/x":    "file:/tmp/x",
+		"unix:/run/s":    "unix:/run/s",
+		"hwmon":          "hwmon:" + DefaultHwmonRoot,
+		"hwmon:/tmp/hw/": "hwmon:/tmp/hw/",
+	}
+	for spec, expected := range valid {
+		if s, err := New(spec, time.Second); err != nil || s.String() != expected {
+			t.Errorf("%q: expected %s, got %v, %v", spec, expected, s, err)
+		}
+	}
+	for _, spec := range []string{"", "file", "file:", "unix:", "stdin:x", "tcp:localhost:1"} {
+		if _, err := New(spec, time.Second); err == nil {
+			t.Errorf("Expected error for %q", spec)
+		}
+	}
+	if _, err := New("hwmon", 0); err == nil {
+		t.Errorf("Expected error for hwmon without interval")
+	}
+}
+
+func TestParseJSON(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	r, err := ParseJSON([]byte(`{"sensor":"CPU","unit":"°C","value":0}`), now)
+	if err != nil || !reflect.DeepEqual(*r, sensordata.Reading{Sensor: "CPU", Unit: "°C", Value: 0, Time: now}) {
+		t.Errorf("Unexpected reading: %v, %v", r, err)
+	}
+	r, err = ParseJSON([]byte(`{"sensor":"CPU","value":1.5,"time":"2020-06-01T12:00:00Z"}`), now)
+	if err != nil || !r.Time.Equal(time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)) {
+		t.Errorf("Unexpected reading: %v, %v", r, err)
+	}
+	for _, s := range []string{`{"sensor":"CPU"}`, `{"value":1}`, `{"sensor":"CPU","value":"high"}`, `CPU: 1`} {
+		if _, err := ParseJSON([]byte(s), now); err == nil {
+			t.Errorf("Expected error for %s", s)
+		}
+	}
+}
+
+func TestHwmon(t *testing.T) {
+	root, err := ioutil.TempDir("", "hwmon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	files := map[string]string{
+		"hwmon0/name":              "coretemp\n",
+		"hwmon0/temp1_input":       "42500\n",
+		"hwmon0/temp1_label":       "Package id 0\n",
+		"hwmon0/temp2_input":       "41000\n",
+		"hwmon0/temp2_max":         "100000\n",
+		"hwmon1/name":              "coretemp\n",
+		"hwmon1/temp1_input":       "43000\n",
+		"hwmon1/temp1_label":       "Package id 0\n",
+		"hwmon2/device/name":       "nct6775\n",
+		"hwmon2/device/fan2_input": "1200\n",
+		"hwmon2/device/in0_input":  "1224\n",
+		"hwmon2/device/pwm1_input": "255\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now := time.Unix(1600000000, 0)
+	readings, err := (&Hwmon{Root: root}).Read(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []sensordata.Reading{
+		{Sensor: "coretemp Package id 0", Unit: "°C", Value: 42.5, Time: now},
+		{Sensor: "coretemp temp2", Unit: "°C", Value: 41, Time: now},
+		{Sensor: "coretemp Package id 0 (hwmon1)", Unit: "°C", Value: 43, Time: now},
+		{Sensor: "nct6775 fan2", Unit: "RPM", Value: 1200, Time: now},
+		{Sensor: "nct6775 in0", Unit: "V", Value: 1.224, Time: now},
+	}
+	if !reflect.DeepEqual(readings, expected) {
+		t.Errorf("Expected %v, got %v", expected, readings)
+	}
+
+	if _, err := (&Hwmon{Root: filepath.Join(root, "missing")}).Read(now); err == nil {
+		t.Errorf("Expected error for missing directory")
+	}
+}
+
+func TestFileTail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sensorinput")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sensors.log")
+	if err := ioutil.WriteFile(path, []byte("Old: 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	readings := make(chan sensordata.Reading, 10)
+	tail := &FileTail{Path: path, Poll: 10 * time.Millisecond}
+	go func() {
+		_ = tail.Run(func(r sensordata.Reading) { readings <- r })
+	}()
+	expect := func(sensor string) {
+		select {
+		case r := <-readings:
+			if r.Sensor != sensor {
+				t.Errorf("Expected reading of %s, got %v", sensor, r)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timeout waiting for reading of %s", sensor)
+		}
+	}
+
+	// Wait for the file to be opened before appending
+	time.Sleep(100 * time.Millisecond)
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.WriteString("New: 2\nPart")
+	expect("New")
+	_, _ = f.WriteString("ial: 3\n")
+	f.Close()
+	expect("Partial")
+
+	// Rotation
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte("Rotated: 4\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	expect("Rotated")
+}
+
+func TestUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sensorinput")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sensors.sock")
+
+	readings := make(chan sensordata.Reading, 10)
+	source := &UnixSocket{Path: path}
+	go func() {
+		_ = source.Run(func(r sensordata.Reading) { readings <- r })
+	}()
+	var conn net.Conn
+	for i := 0; i < 100; i++ {
+		if conn, err = net.Dial("unix", path); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, _ = conn.Write([]byte("not json\n\n{\"sensor\":\"Fan\",\"unit\":\"RPM\",\"value\":1200}\n"))
+	select {
+	case r := <-readings:
+		if r.Sensor != "Fan" || r.Unit != "RPM" || r.Value != 1200 {
+			t.Errorf("Unexpected reading %v", r)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for reading")
+	}
+}
@@ -49,14 +49,14 @@ if __name__ == "__main__":
         print( "Motion: " + str( motion ))
 
         illuminance = ambientlight.get_illuminance()/10.0
-        print( "Illuminance: " + str(illuminance))
+        print( "Illuminance: " + str(illuminance) + " lx")
 
         uv_light = uvlight.get_uv_light()
-        print( "UV Light: " + str(uv_light))
+        print( "UV Light: " + str(uv_light) + " µW/cm²")
 
         # Get current CO2 concentration (unit is ppm)
         cur_co2_concentration = co2.get_co2_concentration()
-        print( "CO2: " + str(cur_co2_concentration))
+        print( "CO2: " + str(cur_co2_concentration) + " ppm")
 
         # Get current sound intensity level
         cur_si = sound_intensity.get_intensity()
@@ -64,19 +64,19 @@ if __name__ == "__main__":
 
         # Get current dust density
         cur_dd = dust_density.get_dust_density()
-        print( "Dust density: " + str(cur_dd))
+        print( "Dust density: " + str(cur_dd) + " µg/m³")
 
         # Get current humidity level
         cur_humidity = humidity.get_humidity()/100.0
-        print("Humidity: " + str(cur_humidity))
+        print("Humidity: " + str(cur_humidity) + " %RH")
 
         # Get temperature from humidity sensor
         cur_humidity = humidity.get_temperature()/100.0
-        print("Temperature (Humidity sensor): " + str(cur_humidity))
+        print("Temperature (Humidity sensor): " + str(cur_humidity) + " °C")
 
         # Temperature
         cur_temp = temperature.get_temperature()/100.00
-        print( "Temperature: " + str(cur_temp), flush=True )
+        print( "Temperature: " + str(cur_temp) + " °C", flush=True )
 
         # Print out values every 10 seconds
         time.sleep(10)
@@ -1,23 +1,20 @@
 // sensorserver application
 // For documentation on how to setup and run the application see:
 // https://github.com/netsec-ethz/scion-apps/blob/master/README.md
+// https://github.com/netsec-ethz/scion-apps/blob/master/sensorapp/README.md
 package main
 
 import (
-	"bufio"
 	"flag"
+	"fmt"
 	"log"
-	"os"
+	"net"
 	"strings"
-	"sync"
+	"time"
 
 	"github.com/netsec-ethz/scion-apps/pkg/appnet"
-)
-
-const (
-	timeString             string = "Time"
-	separatorString        string = ": "
-	timeAndSeparatorString string = timeString + separatorString
+	"github.com/netsec-ethz/scion-apps/sensorapp/sensordata"
+	"github.com/netsec-ethz/scion-apps/sensorapp/sensorinput"
 )
 
 func check(e error) {
@@ -26,69 +23,186 @@ func check(e error) {
 	}
 }
 
-var sensorData map[string]string
-var sensorDataLock sync.Mutex
+// server holds the readings, the subscriptions of clients and the recent responses to
+// identified requests
+type server struct {
+	conn        net.PacketConn
+	history     *sensordata.History
+	subscribers *sensordata.Subscribers
+	responses   *sensordata.ResponseCache
+}
+
+// runInput obtains the readings of an input source until it is exhausted or fails
+func (s *server) runInput(source sensorinput.Source) {
+	err := source.Run(s.addReading)
+	if err != nil {
+		log.Printf("Input %s failed: %v", source, err)
+	}
+}
+
+// addReading adds a reading to the history and pushes it to the subscribers
+func (s *server) addReading(reading sensordata.Reading) {
+	s.history.Add(reading)
+	s.push(s.subscribers.Update(&reading, time.Now()))
+}
 
-func init() {
-	sensorData = make(map[string]string)
+// push sends the pushes to the subscribers. Errors are logged, a subscriber that can't
+// be reached is dropped when its lease expires.
+func (s *server) push(pushes []sensordata.Push) {
+	for _, p := range pushes {
+		if _, err := s.conn.WriteTo(p.Message, p.Addr); err != nil {
+			log.Printf("Push to %v failed: %v", p.Addr, err)
+		}
+	}
 }
 
-// Obtains input from sensor observation application
-func parseInput() {
-	input := bufio.NewScanner(os.Stdin)
-	for input.Scan() {
-		line := input.Text()
-		index := strings.Index(line, timeAndSeparatorString)
-		if index == 0 {
-			// We found a time string, format in case parsing is desired: 2017/11/16 21:29:49
-			timestr := line[len(timeAndSeparatorString):]
-			sensorDataLock.Lock()
-			sensorData[timeString] = timestr
-			sensorDataLock.Unlock()
-			continue
+// handlePacket returns the packets answering a packet from the client
+func (s *server) handlePacket(packet []byte, client net.Addr) [][]byte {
+	id, request, err := sensordata.ParseRequest(packet)
+	if err != nil {
+		if response := s.handleRequest(packet, client, sensordata.MaxResponseSize); response != nil {
+			return [][]byte{response}
 		}
-		index = strings.Index(line, separatorString)
-		if index > 0 {
-			sensorType := line[:index]
-			sensorDataLock.Lock()
-			sensorData[sensorType] = line
-			sensorDataLock.Unlock()
+		return nil
+	}
+
+	// The response is limited relative to the size of the request, so that it can not be
+	// used to reflect traffic to a spoofed address
+	maxSize := sensordata.MaxResponseLen(len(packet))
+	if maxSize == 0 {
+		return nil
+	}
+	// Retries are answered with the fragments of the first response, so that the client
+	// can combine the fragments received in each attempt
+	key := fmt.Sprintf("%v/%d", client, id)
+	now := time.Now()
+	if fragments := s.responses.Get(key, now); fragments != nil {
+		if sensordata.FragmentsSize(fragments) > sensordata.MaxAmplification*len(packet) {
+			return nil
 		}
+		return fragments
+	}
+	response := s.handleRequest(request, client, maxSize)
+	if response == nil {
+		return nil
+	}
+	fragments, err := sensordata.Fragment(id, response)
+	if err != nil {
+		log.Printf("Response to %v: %v", client, err)
+		return nil
 	}
+	s.responses.Put(key, fragments, now)
+	return fragments
 }
 
-func main() {
-	go parseInput()
+// handleRequest returns the response of at most maxSize to a request from the client,
+// nil if the request is invalid
+func (s *server) handleRequest(request []byte, client net.Addr, maxSize int) []byte {
+	if len(request) == 0 {
+		return []byte(formatText(s.history.Latest(nil), maxSize))
+	}
+	switch request[0] {
+	case sensordata.TypeQuery:
+		sensors, err := sensordata.ParseQuery(request)
+		if err != nil {
+			return nil
+		}
+		return sensordata.MarshalResponse(s.history.Latest(sensors), maxSize)
+	case sensordata.TypeHistoryQuery:
+		query, err := sensordata.ParseHistoryQuery(request)
+		if err != nil {
+			return nil
+		}
+		return sensordata.MarshalHistoryResponse(s.history.Query(query), maxSize)
+	case sensordata.TypeSubscribe:
+		sub, err := sensordata.ParseSubscription(request)
+		if err != nil {
+			return nil
+		}
+		sensors := sub.Sensors
+		if !sub.Updates {
+			sensors = nil
+		}
+		lease, pushes := s.subscribers.Subscribe(client, sub, s.history.Latest(sensors), time.Now())
+		// Acknowledge before pushing the current readings. Without a valid cookie, the
+		// acknowledgement is all that is sent.
+		s.push(append([]sensordata.Push{{
+			Addr:    client,
+			Message: sensordata.MarshalSubscriptionAck(lease, s.subscribers.Cookie(client)),
+		}}, pushes...))
+		return nil
+	}
+	return nil
+}
+
+// formatText formats the readings as text for legacy clients: a time line with the time
+// of the most recent reading, followed by one line per reading. Readings are omitted
+// if the text would exceed maxSize.
+func formatText(readings []sensordata.Reading, maxSize int) string {
+	var latest time.Time
+	for i := range readings {
+		if readings[i].Time.After(latest) {
+			latest = readings[i].Time
+		}
+	}
+	var b strings.Builder
+	if !latest.IsZero() {
+		b.WriteString(latest.Local().Format(sensordata.TimeFormat))
+	}
+	b.WriteString("\n")
+	for i := range readings {
+		line := readings[i].String() + "\n"
+		if b.Len()+len(line) > maxSize {
+			break
+		}
+		b.WriteString(line)
+	}
+	return b.String()
+}
 
+func main() {
 	// Fetch arguments from command line
 	port := flag.Uint("p", 40002, "Server Port")
+	historySize := flag.Int("history", 8640, "Number of readings kept per sensor for history queries")
+	maxSubscribers := flag.Int("maxSubscribers", 100, "Maximum number of subscribers")
+	maxLease := flag.Duration("maxLease", 5*time.Minute, "Maximum lease of subscriptions")
+	inputs := flag.String("input", "stdin", "Comma separated list of input sources: stdin, file:<path>, unix:<path>, hwmon[:<directory>]")
+	pollInterval := flag.Duration("pollInterval", 10*time.Second, "Interval in which hwmon sensors are polled")
 	flag.Parse()
 
+	var sources []sensorinput.Source
+	for _, spec := range strings.Split(*inputs, ",") {
+		source, err := sensorinput.New(strings.TrimSpace(spec), *pollInterval)
+		check(err)
+		sources = append(sources, source)
+	}
+
+	subscribers, err := sensordata.NewSubscribers(*maxSubscribers, *maxLease)
+	check(err)
 	conn, err := appnet.ListenPort(uint16(*port))
 	check(err)
 
+	s := &server{
+		conn:        conn,
+		history:     sensordata.NewHistory(*historySize),
+		subscribers: subscribers,
+		responses:   sensordata.NewResponseCache(256, 10*time.Second),
+	}
+	for _, source := range sources {
+		go s.runInput(source)
+	}
+
 	receivePacketBuffer := make([]byte, 2500)
-	sendPacketBuffer := make([]byte, 2500)
 	for {
-		_, clientAddress, err := conn.ReadFrom(receivePacketBuffer)
+		n, clientAddress, err := conn.ReadFrom(receivePacketBuffer)
 		check(err)
 
 		// Packet received, send back response to same client
-		var sensorValues string
-		var timeStr string
-		sensorDataLock.Lock()
-		for k, v := range sensorData {
-			if strings.Index(k, timeString) == 0 {
-				timeStr = v
-			} else {
-				sensorValues = sensorValues + v + "\n"
+		for _, response := range s.handlePacket(receivePacketBuffer[:n], clientAddress) {
+			if _, err := conn.WriteTo(response, clientAddress); err != nil {
+				log.Printf("Response to %v failed: %v", clientAddress, err)
+				break
 			}
 		}
-		sensorDataLock.Unlock()
-		sensorValues = timeStr + "\n" + sensorValues
-		copy(sendPacketBuffer, sensorValues)
-
-		_, err = conn.WriteTo(sendPacketBuffer[:len(sensorValues)], clientAddress)
-		check(err)
 	}
 }
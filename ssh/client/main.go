@@ -1,9 +1,7 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	golog "log"
 	"net"
 	"os"
@@ -134,23 +132,12 @@ func main() {
 	if remoteUsername == "" {
 		remoteUsername = localUser.Username
 	}
-	var policyMap pathpol.PolicyMap
 	var policy *pathpol.Policy
 	if *policyFile != "" {
-		file, err := ioutil.ReadFile(*policyFile)
+		policy, err = scionutils.LoadPolicy(*policyFile, *policyName)
 		if err != nil {
-			golog.Panicf("Cannot read policy file: %v", err)
+			golog.Panicf("Cannot load policy: %v", err)
 		}
-		err = json.Unmarshal(file, &policyMap)
-		if err != nil {
-			golog.Panicf("Cannot unmarshal policy form file: %v", err)
-		}
-		extPolicy, policyExists := policyMap[*policyName]
-
-		if !policyExists {
-			golog.Panicf("No policy with name %s exists", *policyName)
-		}
-		policy = extPolicy.Policy
 	}
 	appConf, err := scionutils.NewPathAppConf(policy, *pathSelection)
 	if err != nil {
@@ -1,7 +1,11 @@
 package scionutils
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io/ioutil"
+
 	"github.com/scionproto/scion/go/lib/pathpol"
 )
 
@@ -32,6 +36,46 @@ func PathSelectionFromString(s string) (PathSelection, error) {
 	}
 }
 
+// LoadPolicy reads the policy with the given name from a JSON file containing a
+// pathpol.PolicyMap, resolving the policies it extends. If name is empty, the file must
+// contain a single policy.
+func LoadPolicy(file, name string) (*pathpol.Policy, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var policyMap pathpol.PolicyMap
+	if err = json.Unmarshal(b, &policyMap); err != nil {
+		return nil, fmt.Errorf("can't parse policy file %s: %v", file, err)
+	}
+	if name == "" && len(policyMap) == 1 {
+		for n := range policyMap {
+			name = n
+		}
+	}
+	extPolicy, ok := policyMap[name]
+	if !ok || extPolicy == nil {
+		return nil, fmt.Errorf("no policy with name %q in %s", name, file)
+	}
+	// The names are not part of the JSON encoding, but are needed to find extended policies
+	var extended []*pathpol.ExtPolicy
+	for n, p := range policyMap {
+		if p == nil {
+			continue
+		}
+		if p.Policy == nil {
+			p.Policy = &pathpol.Policy{}
+		}
+		p.Policy.Name = n
+		extended = append(extended, p)
+	}
+	policy, err := pathpol.PolicyFromExtPolicy(extPolicy, extended)
+	if err != nil {
+		return nil, fmt.Errorf("invalid policy %q in %s: %v", name, file, err)
+	}
+	return pathpol.NewPolicy(name, policy.ACL, policy.Sequence, policy.Options), nil
+}
+
 // PathAppConf represents application paths configurations specified by the user using command-line arguments
 // policy: SCION path policy
 // pathSelection: path selection mode